@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Take a backup of a running server in the same format as exportAll uses, or
+// load one into it.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/util"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Gather everything up front, so the write lock or the transaction
+	// isn't held open for however long the client takes to download the
+	// backup.
+	exportedData, err := snapshotExportData()
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fileName := fmt.Sprintf("goiardi-backup-%s.json", exportedData.CreatedTime.UTC().Format("20060102T150405Z"))
+	var out io.Writer = w
+	if wantsGzip(r) {
+		fileName = fileName + ".gz"
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Header().Set("Last-Modified", exportedData.CreatedTime.UTC().Format(http.TimeFormat))
+
+	enc := json.NewEncoder(out)
+	if err = enc.Encode(&exportedData); err != nil {
+		// Too late to send an error back to the client at this point,
+		// since the headers have already gone out.
+		logger.Errorf("Error streaming backup: %s", err.Error())
+	}
+}
+
+// wantsGzip checks if the client asked for the backup to be gzipped, either
+// with the Accept-Encoding header or with a "compress=gzip" query parameter
+// for clients that make it awkward to set headers.
+func wantsGzip(r *http.Request) bool {
+	if r.URL.Query().Get("compress") == "gzip" {
+		return true
+	}
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.Index(enc, ";"); i != -1 {
+			if strings.Replace(enc[i:], " ", "", -1) == ";q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := importOptionsFromQuery(r)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exportedData := &ExportData{}
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&exportedData); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := importData(exportedData, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if gerr, ok := err.(util.Gerror); ok {
+			status = gerr.Status()
+		}
+		if report == nil {
+			jsonErrorReport(w, r, err.Error(), status)
+			return
+		}
+		// Let the client know what did (or would) get imported
+		// before things went wrong.
+		logger.Infof(err.Error())
+		w.WriteHeader(status)
+		importErr := map[string]interface{}{"error": []string{err.Error()}, "import": report}
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(&importErr); err != nil {
+			logger.Errorf(err.Error())
+		}
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&report); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// importOptionsFromQuery gets the dry_run, types, and conflict options for an
+// import from the request's query parameters.
+func importOptionsFromQuery(r *http.Request) (*importOptions, error) {
+	q := r.URL.Query()
+	opts := &importOptions{conflict: importConflictSkip}
+	switch q.Get("dry_run") {
+	case "", "false", "0":
+	case "true", "1":
+		opts.dryRun = true
+	default:
+		return nil, fmt.Errorf("Invalid value '%s' for dry_run", q.Get("dry_run"))
+	}
+	if c := q.Get("conflict"); c != "" {
+		switch c {
+		case importConflictSkip, importConflictOverwrite, importConflictFail:
+			opts.conflict = c
+		default:
+			return nil, fmt.Errorf("Invalid conflict policy '%s': must be one of skip, overwrite, or fail", c)
+		}
+	}
+	if t := q.Get("types"); t != "" {
+		opts.types = make(map[string]bool)
+	TypeLoop:
+		for _, objType := range strings.Split(t, ",") {
+			objType = strings.TrimSpace(objType)
+			for _, it := range importTypes {
+				if objType == it {
+					opts.types[objType] = true
+					continue TypeLoop
+				}
+			}
+			return nil, fmt.Errorf("Invalid type '%s' to import", objType)
+		}
+	}
+	return opts, nil
+}
@@ -31,6 +31,7 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/chefcrypto"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
@@ -574,9 +575,20 @@ func (c *Client) GobDecode(b []byte) error {
 
 // AllClients returns a slice of all the clients on this server.
 func AllClients() []*Client {
+	clients, err := AllClientsTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all clients: %s", err.Error())
+	}
+	return clients
+}
+
+// AllClientsTx returns a slice of all the clients on this server like
+// AllClients, but with an SQL backend reads them through the given db handle.
+// Pass in a transaction to read the clients as part of a consistent snapshot.
+func AllClientsTx(tx datastore.Dbhandle) ([]*Client, error) {
 	var clients []*Client
 	if config.UsingDB() {
-		clients = allClientsSQL()
+		return allClientsSQL(tx)
 	} else {
 		clientList := GetList()
 		for _, c := range clientList {
@@ -587,17 +599,26 @@ func AllClients() []*Client {
 			clients = append(clients, cl)
 		}
 	}
-	return clients
+	return clients, nil
 }
 
 // ExportAllClients returns all clients in a fashion suitable for exporting.
-func ExportAllClients() []interface{} {
-	clients := AllClients()
+func ExportAllClients() ([]interface{}, error) {
+	return ExportAllClientsTx(datastore.Dbh)
+}
+
+// ExportAllClientsTx returns all clients in a fashion suitable for exporting,
+// reading them through the given db handle with an SQL backend.
+func ExportAllClientsTx(tx datastore.Dbhandle) ([]interface{}, error) {
+	clients, err := AllClientsTx(tx)
+	if err != nil {
+		return nil, err
+	}
 	export := make([]interface{}, len(clients))
 	for i, c := range clients {
 		export[i] = c.export()
 	}
-	return export
+	return export, nil
 }
 
 func chkInMemUser(name string) error {
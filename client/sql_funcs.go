@@ -133,7 +133,7 @@ func getListSQL() []string {
 	}
 	return clientList
 }
-func allClientsSQL() []*Client {
+func allClientsSQL(dbhandle datastore.Dbhandle) ([]*Client, error) {
 	var clients []*Client
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -142,29 +142,29 @@ func allClientsSQL() []*Client {
 		sqlStatement = "SELECT c.name, nodename, validator, admin, o.name, public_key, certificate FROM goiardi.clients c JOIN goiardi.organizations o ON c.organization_id = o.id"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return clients
+			return clients, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
+	defer rows.Close()
 	for rows.Next() {
 		cl := new(Client)
 		err = cl.fillClientFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		clients = append(clients, cl)
 	}
-	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return clients
+	return clients, nil
 }
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/datastore"
 	"io"
 	"net/http"
 	"strings"
@@ -85,6 +86,39 @@ func splitPath(path string) []string {
 	return sp
 }
 
+// readDbh picks the db handle to read objects with for a request. GET and HEAD
+// requests, and the depsolver POSTs that don't change anything, may read from
+// a replica, but everything else uses the primary database.
+func readDbh(r *http.Request) datastore.Dbhandle {
+	if r.Method != "GET" && r.Method != "HEAD" && !depsolverRequest(r) {
+		return datastore.Dbh
+	}
+	return datastore.ReadDbh(r.Header.Get("X-OPS-USERID"))
+}
+
+// depsolverRequest returns true if the request runs the dependency solver.
+// These are POSTs, but they don't change anything.
+func depsolverRequest(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	if r.URL.Path == "/_depsolver" {
+		return true
+	}
+	pathArray := splitPath(r.URL.Path)
+	return len(pathArray) == 3 && pathArray[0] == "environments" && pathArray[2] == "cookbook_versions"
+}
+
+// tarballUploadRequest returns true if the request uploads a cookbook version
+// as a tarball, which can be as big as a file upload.
+func tarballUploadRequest(r *http.Request) bool {
+	if r.Method != "PUT" {
+		return false
+	}
+	pathArray := splitPath(r.URL.Path)
+	return len(pathArray) == 4 && pathArray[0] == "cookbooks" && pathArray[1] != "" && pathArray[2] != "" && pathArray[3] == "_tarball"
+}
+
 func jsonErrorReport(w http.ResponseWriter, r *http.Request, errorStr string, status int) {
 	logger.Infof(errorStr)
 	jsonError := map[string][]string{"error": []string{errorStr}}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDepsolverRequest(t *testing.T) {
+	reqs := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"POST", "/_depsolver", true},
+		{"POST", "/environments/_default/cookbook_versions", true},
+		{"POST", "/environments/prod/cookbook_versions", true},
+		{"GET", "/environments/prod/cookbook_versions", false},
+		{"POST", "/environments", false},
+		{"PUT", "/environments/prod", false},
+		{"POST", "/environments/prod/cookbooks", false},
+		{"GET", "/_depsolver", false},
+	}
+	for _, q := range reqs {
+		r := httptest.NewRequest(q.method, q.path, nil)
+		if got := depsolverRequest(r); got != q.want {
+			t.Errorf("depsolverRequest for %s %s should have been %t, got %t", q.method, q.path, q.want, got)
+		}
+	}
+}
+
+func TestTarballUploadRequest(t *testing.T) {
+	reqs := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"PUT", "/cookbooks/foo/1.0.0/_tarball", true},
+		{"GET", "/cookbooks/foo/1.0.0/_tarball", false},
+		{"POST", "/cookbooks/foo/1.0.0/_tarball", false},
+		{"PUT", "/nodes/_tarball", false},
+		{"PUT", "/data/foo/_tarball", false},
+		{"PUT", "/cookbooks/foo/_tarball", false},
+		{"PUT", "/cookbooks/foo/1.0.0/bar/_tarball", false},
+		{"PUT", "/cookbooks//1.0.0/_tarball", false},
+	}
+	for _, q := range reqs {
+		r := httptest.NewRequest(q.method, q.path, nil)
+		if got := tarballUploadRequest(r); got != q.want {
+			t.Errorf("tarballUploadRequest for %s %s should have been %t, got %t", q.method, q.path, q.want, got)
+		}
+	}
+}
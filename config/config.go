@@ -21,8 +21,10 @@
 package config
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"github.com/BurntSushi/toml"
@@ -31,6 +33,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
@@ -47,6 +50,8 @@ type Conf struct {
 	ConfFile          string `toml:"conf-file"`
 	IndexFile         string `toml:"index-file"`
 	DataStoreFile     string `toml:"data-file"`
+	DataStoreKeep     int    `toml:"data-file-keep"`
+	LoadSnapshot      string
 	DebugLevel        int    `toml:"debug-level"`
 	LogLevel          string `toml:"log-level"`
 	FreezeInterval    int    `toml:"freeze-interval"`
@@ -67,15 +72,43 @@ type Conf struct {
 	UsePostgreSQL     bool         `toml:"use-postgresql"`
 	PostgreSQL        PostgreSQLdb `toml:"postgresql"`
 	LocalFstoreDir    string       `toml:"local-filestore-dir"`
+	S3                S3Conf       `toml:"s3"`
 	LogEvents         bool         `toml:"log-events"`
 	LogEventKeep      int          `toml:"log-event-keep"`
+	KeepRevisions     int          `toml:"keep-revisions"`
+	TrashRetention    string       `toml:"trash-retention"`
+	TrashRetentionDur time.Duration
+	Supermarket       bool `toml:"supermarket"`
+	FstoreGCInterval  string `toml:"filestore-gc-interval"`
+	FstoreGCIntervalDur time.Duration
+	FstoreScrubInterval string `toml:"filestore-scrub-interval"`
+	FstoreScrubIntervalDur time.Duration
+	FstoreScrubQuarantine bool `toml:"filestore-scrub-quarantine"`
+	SandboxTTL        string `toml:"sandbox-ttl"`
+	SandboxTTLDur     time.Duration
+	FstoreGCGrace     string `toml:"filestore-gc-grace"`
+	FstoreGCGraceDur  time.Duration
+	FileStoreURLKey   string `toml:"file-store-url-key"`
+	FileStoreURLExpiry string `toml:"file-store-url-expiry"`
+	FileStoreURLExpiryDur time.Duration
+	UnsignedFileStore bool `toml:"unsigned-file-store"`
+	CookbookKeepVersions int `toml:"cookbook-keep-versions"`
+	CookbookKeep      map[string]int `toml:"cookbook-keep"`
+	CookbookPruneInterval string `toml:"cookbook-prune-interval"`
+	CookbookPruneIntervalDur time.Duration
 	DoExport          bool
 	DoImport          bool
 	ImpExFile         string
+	DoMigrate         bool
+	NoAutoMigrate     bool   `toml:"no-auto-migrate"`
 	ObjMaxSize        int64  `toml:"obj-max-size"`
 	JSONReqMaxSize    int64  `toml:"json-req-max-size"`
 	UseUnsafeMemStore bool   `toml:"use-unsafe-mem-store"`
 	DbPoolSize        int    `toml:"db-pool-size"`
+	ReadYourWrites    string `toml:"read-your-writes-window"`
+	ReadYourWritesDur time.Duration
+	StandbyOf         string `toml:"standby-of"`
+	ReplicationKey    string `toml:"replication-key"`
 	MaxConn           int    `toml:"max-connections"`
 	UseSerf           bool   `toml:"use-serf"`
 	SerfEventAnnounce bool 	 `toml:"serf-event-announce"`
@@ -106,6 +139,8 @@ type MySQLdb struct {
 	Port        string
 	Dbname      string
 	ExtraParams map[string]string `toml:"extra_params"`
+	// Read replicas. Any options left out are the same as the primary's.
+	Replicas []MySQLdb `toml:"replica"`
 }
 
 // PostgreSQLdb holds Postgres connection options.
@@ -116,6 +151,28 @@ type PostgreSQLdb struct {
 	Port     string
 	Dbname   string
 	SSLMode  string
+	// Read replicas. Any options left out are the same as the primary's.
+	Replicas []PostgreSQLdb `toml:"replica"`
+}
+
+// S3Conf holds options for keeping the filestore's files in a bucket in S3 or
+// an S3-compatible object store, like MinIO.
+type S3Conf struct {
+	Bucket    string
+	Region    string
+	Endpoint  string
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// Prefix is put in front of the files' names in the bucket.
+	Prefix string
+	// PathStyle puts the bucket in the URL's path instead of its
+	// hostname, which most S3-compatible object stores need.
+	PathStyle bool `toml:"path_style"`
+	// RedirectDownloads sends file downloads to pre-signed URLs to fetch
+	// them from the bucket directly.
+	RedirectDownloads bool   `toml:"redirect_downloads"`
+	URLExpiry         string `toml:"url_expiry"`
+	URLExpiryDur      time.Duration
 }
 
 // Options holds options set from the command line, which are then merged with
@@ -130,6 +187,8 @@ type Options struct {
 	Port              int    `short:"P" long:"port" description:"Port to listen on. If port is set to 443, SSL will be activated. (default: 4545)"`
 	IndexFile         string `short:"i" long:"index-file" description:"File to save search index data to."`
 	DataStoreFile     string `short:"D" long:"data-file" description:"File to save data store data to."`
+	DataStoreKeep     int    `long:"data-file-keep" description:"Number of previous data store snapshots to keep when the data store is saved, as <data-file>.1 through <data-file>.N. Default 0 - previous snapshots are overwritten."`
+	LoadSnapshot      string `long:"load-snapshot" description:"Start from an older data store snapshot instead of the data file. Takes either the path to a snapshot file or the number of a previous snapshot kept with --data-file-keep (1 being the most recent). Requires -D/--data-file."`
 	FreezeInterval    int    `short:"F" long:"freeze-interval" description:"Interval in seconds to freeze in-memory data structures to disk (requires -i/--index-file and -D/--data-file options to be set). (Default 300 seconds/5 minutes.)"`
 	LogFile           string `short:"L" long:"log-file" description:"Log to file X"`
 	SysLog            bool   `short:"s" long:"syslog" description:"Log to syslog rather than a log file. Incompatible with -L/--log-file."`
@@ -143,16 +202,34 @@ type Options struct {
 	DisableWebUI      bool   `long:"disable-webui" description:"If enabled, disables connections and logins to goiardi over the webui interface."`
 	UseMySQL          bool   `long:"use-mysql" description:"Use a MySQL database for data storage. Configure database options in the config file."`
 	UsePostgreSQL     bool   `long:"use-postgresql" description:"Use a PostgreSQL database for data storage. Configure database options in the config file."`
-	LocalFstoreDir    string `long:"local-filestore-dir" description:"Directory to save uploaded files in. Optional when running in in-memory mode, *mandatory* for SQL mode."`
+	LocalFstoreDir    string `long:"local-filestore-dir" description:"Directory to save uploaded files in. Optional when running in in-memory mode, *mandatory* for SQL mode unless an S3 bucket is configured."`
 	LogEvents         bool   `long:"log-events" description:"Log changes to chef objects."`
 	LogEventKeep      int    `short:"K" long:"log-event-keep" description:"Number of events to keep in the event log. If set, the event log will be checked periodically and pruned to this number of entries."`
+	KeepRevisions     int    `long:"keep-revisions" description:"Number of previous revisions of roles, environments, nodes, and data bag items to keep. Default is 0 - no revisions are kept."`
+	TrashRetention    string `long:"trash-retention" description:"How long to keep deleted nodes, roles, data bag items, and cookbook versions in the trash before purging them for good. Formatted like 72h, 30m, etc. Set to 0 to delete objects right away without using the trash. Defaults to 168h (one week)."`
+	Supermarket       bool   `long:"supermarket" description:"Serve a read-only Supermarket compatible API for this server's cookbooks under /api/v1, for berks and knife supermarket. Requests to it are not authenticated, but downloads need the signed URLs it hands out."`
+	FstoreGCInterval  string `long:"filestore-gc-interval" description:"How often to remove files from the file store that nothing uses anymore. Formatted like 24h, 90m, etc. Default is 0 - only when asked through /_filestore_gc."`
+	FstoreScrubInterval string `long:"filestore-scrub-interval" description:"How often to check every file in the file store against its checksum. Formatted like 24h, 90m, etc. Default is 0 - only when asked through /_filestore_scrub."`
+	FstoreScrubQuarantine bool `long:"filestore-scrub-quarantine" description:"Quarantine corrupt files found by the scheduled file store scrubs, instead of just reporting them."`
+	SandboxTTL        string `long:"sandbox-ttl" description:"How long a sandbox has to be committed before it expires, and it and the files uploaded for it are purged. Formatted like 24h, 90m, etc. Set to 0 to never expire sandboxes. Defaults to 24h."`
+	FstoreGCGrace     string `long:"filestore-gc-grace" description:"How long a file must go unused before it's removed from the file store, to give newly uploaded files time to be used. Formatted like 24h, 90m, etc. Defaults to 24h."`
+	FileStoreURLKey   string `long:"file-store-url-key" description:"Secret key to sign file store URLs with. Servers that share their files, like behind a load balancer, need the same key. Default is a random key made when goiardi starts."`
+	FileStoreURLExpiry string `long:"file-store-url-expiry" description:"How long signed file store URLs handed out for uploading and downloading cookbook files are good for. Formatted like 8h, 90m, etc. Defaults to 8h."`
+	UnsignedFileStore bool   `long:"unsigned-file-store" description:"Allow file store requests without a signed URL when authentication is on, for older clients."`
+	CookbookKeepVersions int `long:"cookbook-keep-versions" description:"Number of the latest versions of each cookbook to keep when pruning old cookbook versions. Versions an environment or node uses are kept as well. Can be set for individual cookbooks in the config file. Default is 0 - all versions are kept."`
+	CookbookPruneInterval string `long:"cookbook-prune-interval" description:"How often to prune old cookbook versions. Formatted like 24h, 90m, etc. Default is 0 - only when asked through /_cookbook_retention."`
 	Export            string `short:"x" long:"export" description:"Export all server data to the given file, exiting afterwards. Should be used with caution. Cannot be used at the same time as -m/--import."`
 	Import            string `short:"m" long:"import" description:"Import data from the given file, exiting afterwards. Cannot be used at the same time as -x/--export."`
+	Migrate           bool   `long:"migrate" description:"Apply any pending database schema migrations, exiting afterwards. Only useful when using one of the SQL backends."`
+	NoAutoMigrate     bool   `long:"no-auto-migrate" description:"Don't apply pending database schema migrations when goiardi starts; refuse to start instead until they're applied with --migrate."`
 	ObjMaxSize        int64  `short:"Q" long:"obj-max-size" description:"Maximum object size in bytes for the file store. Default 10485760 bytes (10MB)."`
 	JSONReqMaxSize    int64  `short:"j" long:"json-req-max-size" description:"Maximum size for a JSON request from the client. Per chef-pedant, default is 1000000."`
 	UseUnsafeMemStore bool   `long:"use-unsafe-mem-store" description:"Use the faster, but less safe, old method of storing data in the in-memory data store with pointers, rather than encoding the data with gob and giving a new copy of the object to each requestor. If this is enabled goiardi will run faster in in-memory mode, but one goroutine could change an object while it's being used by another. Has no effect when using an SQL backend."`
 	DbPoolSize        int    `long:"db-pool-size" description:"Number of idle db connections to maintain. Only useful when using one of the SQL backends. Default is 0 - no idle connections retained"`
 	MaxConn           int    `long:"max-connections" description:"Maximum number of connections allowed for the database. Only useful when using one of the SQL backends. Default is 0 - unlimited."`
+	ReadYourWrites    string `long:"read-your-writes-window" description:"How long to send an actor's reads to the primary database after it changes something, when read replicas are configured. Formatted like 5s, 1m, etc. Defaults to 5s."`
+	StandbyOf         string `long:"standby-of" description:"Run as a read-only standby of the goiardi server at this URL (like http://primary.example.com:4545), replicating everything from it. Only for in-memory mode. Requires --replication-key."`
+	ReplicationKey    string `long:"replication-key" description:"Shared secret standby servers use to replicate from this server, or that this server uses to replicate from its primary with --standby-of. Replication is turned off if it isn't set."`
 	UseSerf           bool   `long:"use-serf" description:"If set, have goidari use serf to send and receive events and queries from a serf cluster. Required for shovey."`
 	SerfEventAnnounce bool   `long:"serf-event-announce" description:"Announce log events and joining the serf cluster over serf, as serf events. Requires --use-serf."`
 	SerfAddr          string `long:"serf-addr" description:"IP address and port to use for RPC communication with a serf agent. Defaults to 127.0.0.1:7373."`
@@ -243,6 +320,23 @@ func ParseConfigOptions() error {
 		Config.IndexFile = opts.IndexFile
 	}
 
+	if opts.DataStoreKeep != 0 {
+		Config.DataStoreKeep = opts.DataStoreKeep
+	}
+	if Config.DataStoreKeep < 0 {
+		err := fmt.Errorf("data-file-keep cannot be negative.")
+		log.Println(err)
+		os.Exit(1)
+	}
+	if opts.LoadSnapshot != "" {
+		if Config.DataStoreFile == "" {
+			err := fmt.Errorf("--load-snapshot requires -D/--data-file to be set.")
+			log.Println(err)
+			os.Exit(1)
+		}
+		Config.LoadSnapshot = opts.LoadSnapshot
+	}
+
 	// Use MySQL?
 	if opts.UseMySQL {
 		Config.UseMySQL = opts.UseMySQL
@@ -259,6 +353,18 @@ func ParseConfigOptions() error {
 		os.Exit(1)
 	}
 
+	if opts.Migrate {
+		if !(Config.UseMySQL || Config.UsePostgreSQL) {
+			err := fmt.Errorf("--migrate can only be used with a MySQL or Postgres backend.")
+			log.Println(err)
+			os.Exit(1)
+		}
+		Config.DoMigrate = true
+	}
+	if opts.NoAutoMigrate {
+		Config.NoAutoMigrate = opts.NoAutoMigrate
+	}
+
 	if Config.DataStoreFile != "" && (Config.UseMySQL || Config.UsePostgreSQL) {
 		err := fmt.Errorf("The MySQL or Postgres and data store options may not be specified together.")
 		log.Println(err)
@@ -338,13 +444,102 @@ func ParseConfigOptions() error {
 		}
 	}
 
+	// Replicas default to the primary's options, so usually only the
+	// address needs to be given.
+	for i, r := range Config.MySQL.Replicas {
+		p := Config.MySQL
+		if r.Username == "" {
+			r.Username, r.Password = p.Username, p.Password
+		}
+		if r.Protocol == "" {
+			r.Protocol = p.Protocol
+		}
+		if r.Port == "" {
+			r.Port = p.Port
+		}
+		if r.Dbname == "" {
+			r.Dbname = p.Dbname
+		}
+		if r.ExtraParams == nil {
+			r.ExtraParams = p.ExtraParams
+		}
+		Config.MySQL.Replicas[i] = r
+	}
+	for i, r := range Config.PostgreSQL.Replicas {
+		p := Config.PostgreSQL
+		if r.Username == "" {
+			r.Username, r.Password = p.Username, p.Password
+		}
+		if r.Port == "" {
+			r.Port = p.Port
+		}
+		if r.Dbname == "" {
+			r.Dbname = p.Dbname
+		}
+		if r.SSLMode == "" {
+			r.SSLMode = p.SSLMode
+		}
+		Config.PostgreSQL.Replicas[i] = r
+	}
+
+	if opts.ReadYourWrites != "" {
+		Config.ReadYourWrites = opts.ReadYourWrites
+	}
+	if Config.ReadYourWrites != "" {
+		d, derr := time.ParseDuration(Config.ReadYourWrites)
+		if derr != nil {
+			logger.Criticalf("Error parsing read-your-writes-window: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.ReadYourWritesDur = d
+	} else {
+		Config.ReadYourWritesDur = 5 * time.Second
+	}
+
 	if opts.LocalFstoreDir != "" {
 		Config.LocalFstoreDir = opts.LocalFstoreDir
 	}
-	if Config.LocalFstoreDir == "" && (Config.UseMySQL || Config.UsePostgreSQL) {
-		logger.Criticalf("local-filestore-dir must be set when running goiardi in SQL mode")
+	if Config.LocalFstoreDir != "" && Config.S3.Bucket != "" {
+		logger.Criticalf("local-filestore-dir and an S3 bucket may not be used together")
+		os.Exit(1)
+	}
+	if Config.LocalFstoreDir == "" && Config.S3.Bucket == "" && (Config.UseMySQL || Config.UsePostgreSQL) {
+		logger.Criticalf("local-filestore-dir or an S3 bucket must be set when running goiardi in SQL mode")
 		os.Exit(1)
 	}
+	if Config.S3.Bucket != "" {
+		s3 := &Config.S3
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		if s3.Endpoint == "" {
+			s3.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3.Region)
+		}
+		if u, uerr := url.Parse(s3.Endpoint); uerr != nil || u.Host == "" {
+			logger.Criticalf("Invalid S3 endpoint %q", s3.Endpoint)
+			os.Exit(1)
+		}
+		if s3.AccessKey == "" {
+			s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if s3.SecretKey == "" {
+			s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			logger.Criticalf("An access key and secret key must be set for the S3 bucket, in the config file or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+			os.Exit(1)
+		}
+		if s3.URLExpiry != "" {
+			d, derr := time.ParseDuration(s3.URLExpiry)
+			if derr != nil {
+				logger.Criticalf("Error parsing the S3 url_expiry: %s", derr.Error())
+				os.Exit(1)
+			}
+			s3.URLExpiryDur = d
+		} else {
+			s3.URLExpiryDur = 15 * time.Minute
+		}
+	}
 
 	if !Config.FreezeData && (opts.FreezeInterval != 0 || Config.FreezeInterval != 0) {
 		logger.Warningf("FYI, setting the freeze data interval's not especially useful without setting the index and data files.")
@@ -440,6 +635,139 @@ func ParseConfigOptions() error {
 		Config.LogEventKeep = opts.LogEventKeep
 	}
 
+	if opts.KeepRevisions != 0 {
+		Config.KeepRevisions = opts.KeepRevisions
+	}
+	if Config.KeepRevisions < 0 {
+		err := fmt.Errorf("keep-revisions cannot be negative")
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	if opts.TrashRetention != "" {
+		Config.TrashRetention = opts.TrashRetention
+	}
+	if Config.TrashRetention != "" {
+		d, derr := time.ParseDuration(Config.TrashRetention)
+		if derr != nil {
+			logger.Criticalf("Error parsing trash-retention: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.TrashRetentionDur = d
+	} else {
+		Config.TrashRetentionDur = 7 * 24 * time.Hour
+	}
+
+	if opts.Supermarket {
+		Config.Supermarket = opts.Supermarket
+	}
+
+	if opts.FstoreGCInterval != "" {
+		Config.FstoreGCInterval = opts.FstoreGCInterval
+	}
+	if Config.FstoreGCInterval != "" {
+		d, derr := time.ParseDuration(Config.FstoreGCInterval)
+		if derr != nil {
+			logger.Criticalf("Error parsing filestore-gc-interval: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.FstoreGCIntervalDur = d
+	}
+	if opts.FstoreScrubInterval != "" {
+		Config.FstoreScrubInterval = opts.FstoreScrubInterval
+	}
+	if Config.FstoreScrubInterval != "" {
+		d, derr := time.ParseDuration(Config.FstoreScrubInterval)
+		if derr != nil {
+			logger.Criticalf("Error parsing filestore-scrub-interval: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.FstoreScrubIntervalDur = d
+	}
+	if opts.FstoreScrubQuarantine {
+		Config.FstoreScrubQuarantine = opts.FstoreScrubQuarantine
+	}
+	if opts.SandboxTTL != "" {
+		Config.SandboxTTL = opts.SandboxTTL
+	}
+	if Config.SandboxTTL != "" {
+		d, derr := time.ParseDuration(Config.SandboxTTL)
+		if derr != nil {
+			logger.Criticalf("Error parsing sandbox-ttl: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.SandboxTTLDur = d
+	} else {
+		Config.SandboxTTLDur = 24 * time.Hour
+	}
+	if opts.CookbookKeepVersions != 0 {
+		Config.CookbookKeepVersions = opts.CookbookKeepVersions
+	}
+	if Config.CookbookKeepVersions < 0 {
+		err := fmt.Errorf("cookbook-keep-versions cannot be negative")
+		log.Println(err)
+		os.Exit(1)
+	}
+	for cb, keep := range Config.CookbookKeep {
+		if keep < 0 {
+			err := fmt.Errorf("cookbook-keep for %s cannot be negative", cb)
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	if opts.CookbookPruneInterval != "" {
+		Config.CookbookPruneInterval = opts.CookbookPruneInterval
+	}
+	if Config.CookbookPruneInterval != "" {
+		d, derr := time.ParseDuration(Config.CookbookPruneInterval)
+		if derr != nil {
+			logger.Criticalf("Error parsing cookbook-prune-interval: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.CookbookPruneIntervalDur = d
+	}
+	if opts.FstoreGCGrace != "" {
+		Config.FstoreGCGrace = opts.FstoreGCGrace
+	}
+	if Config.FstoreGCGrace != "" {
+		d, derr := time.ParseDuration(Config.FstoreGCGrace)
+		if derr != nil {
+			logger.Criticalf("Error parsing filestore-gc-grace: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.FstoreGCGraceDur = d
+	} else {
+		Config.FstoreGCGraceDur = 24 * time.Hour
+	}
+
+	if opts.FileStoreURLKey != "" {
+		Config.FileStoreURLKey = opts.FileStoreURLKey
+	}
+	if Config.FileStoreURLKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			logger.Criticalf("Error making a key to sign file store URLs: %s", err.Error())
+			os.Exit(1)
+		}
+		Config.FileStoreURLKey = hex.EncodeToString(key)
+	}
+	if opts.FileStoreURLExpiry != "" {
+		Config.FileStoreURLExpiry = opts.FileStoreURLExpiry
+	}
+	if Config.FileStoreURLExpiry != "" {
+		d, derr := time.ParseDuration(Config.FileStoreURLExpiry)
+		if derr != nil {
+			logger.Criticalf("Error parsing file-store-url-expiry: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.FileStoreURLExpiryDur = d
+	} else {
+		Config.FileStoreURLExpiryDur = 8 * time.Hour
+	}
+	if opts.UnsignedFileStore {
+		Config.UnsignedFileStore = opts.UnsignedFileStore
+	}
+
 	// Set max sizes for objects and json requests.
 	if opts.ObjMaxSize != 0 {
 		Config.ObjMaxSize = opts.ObjMaxSize
@@ -472,6 +800,26 @@ func ParseConfigOptions() error {
 			logger.Infof("max-connections is set to %d, which is not particularly useful if you are not using one of the SQL databases.", Config.MaxConn)
 		}
 	}
+	if opts.StandbyOf != "" {
+		Config.StandbyOf = opts.StandbyOf
+	}
+	if opts.ReplicationKey != "" {
+		Config.ReplicationKey = opts.ReplicationKey
+	}
+	if Config.StandbyOf != "" {
+		if UsingDB() {
+			err := fmt.Errorf("standby-of only works in in-memory mode; use database replication with the SQL backends")
+			log.Println(err)
+			os.Exit(1)
+		}
+		if Config.ReplicationKey == "" {
+			err := fmt.Errorf("standby-of requires replication-key to be set")
+			log.Println(err)
+			os.Exit(1)
+		}
+		Config.StandbyOf = strings.TrimRight(Config.StandbyOf, "/")
+	}
+
 	if opts.UseSerf {
 		Config.UseSerf = opts.UseSerf
 	}
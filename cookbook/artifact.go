@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// CookbookArtifact is a cookbook uploaded for Policyfiles. An artifact is
+// identified by a hash of its contents rather than by its version, so
+// different cookbooks with the same name and version can live side by side.
+// Artifacts can't be changed once they're uploaded.
+type CookbookArtifact struct {
+	CookbookVersion
+	Identifier string `json:"identifier"`
+}
+
+// ArtifactSet holds the artifacts of one cookbook in the in-memory data store.
+type ArtifactSet struct {
+	Name      string
+	Artifacts map[string]*CookbookArtifact
+}
+
+// Protects the get, change, and set of artifacts in the in-memory data store.
+var artifactLock sync.Mutex
+
+var validIdentifier = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,255}$`)
+
+// URLType returns the first path element in a cookbook artifact's URL.
+func (a *CookbookArtifact) URLType() string {
+	return "cookbook_artifacts"
+}
+
+// NewArtifact makes a new cookbook artifact from uploaded JSON. The files in
+// it need to have been uploaded already. The artifact isn't saved.
+func NewArtifact(name string, identifier string, data map[string]interface{}) (*CookbookArtifact, util.Gerror) {
+	if !util.ValidateName(name) {
+		return nil, util.Errorf("Invalid cookbook name '%s' using regex: 'Malformed cookbook name. Must only contain A-Z, a-z, 0-9, _, . or -'.", name)
+	}
+	if !validIdentifier.MatchString(identifier) {
+		return nil, util.Errorf("Field 'identifier' invalid")
+	}
+
+	validElements := []string{"cookbook_name", "name", "identifier", "version", "json_class", "chef_type", "definitions", "libraries", "attributes", "recipes", "providers", "resources", "templates", "root_files", "files", "frozen?", "metadata"}
+ValidElem:
+	for k := range data {
+		for _, i := range validElements {
+			if k == i {
+				continue ValidElem
+			}
+		}
+		return nil, util.Errorf("Invalid key %s in request body", k)
+	}
+
+	if n, ok := data["name"].(string); !ok || n != name {
+		return nil, util.Errorf("Field 'name' invalid")
+	}
+	if id, ok := data["identifier"].(string); !ok || id != identifier {
+		return nil, util.Errorf("Field 'identifier' invalid")
+	}
+	if cn, ok := data["cookbook_name"]; ok && cn != name {
+		return nil, util.Errorf("Field 'cookbook_name' invalid")
+	}
+	if ct, ok := data["chef_type"]; ok && ct != "cookbook_version" {
+		return nil, util.Errorf("Field 'chef_type' invalid")
+	}
+	if jc, ok := data["json_class"]; ok && jc != "Chef::CookbookVersion" {
+		return nil, util.Errorf("Field 'json_class' invalid")
+	}
+	version, verr := util.ValidateAsVersion(data["version"])
+	if verr != nil || data["version"] == nil {
+		return nil, util.Errorf("Field 'version' invalid")
+	}
+
+	a := &CookbookArtifact{
+		CookbookVersion: CookbookVersion{
+			CookbookName: name,
+			Name:         name,
+			Version:      version,
+			ChefType:     "cookbook_version",
+			JSONClass:    "Chef::CookbookVersion",
+		},
+		Identifier: identifier,
+	}
+	divs := make(map[string][]map[string]interface{})
+	for _, d := range []string{"definitions", "libraries", "attributes", "recipes", "providers", "resources", "templates", "root_files", "files"} {
+		if divs[d], verr = util.ValidateCookbookDivision(d, data[d]); verr != nil {
+			return nil, verr
+		}
+	}
+	a.Definitions = divs["definitions"]
+	a.Libraries = divs["libraries"]
+	a.Attributes = divs["attributes"]
+	a.Recipes = divs["recipes"]
+	a.Providers = divs["providers"]
+	a.Resources = divs["resources"]
+	a.Templates = divs["templates"]
+	a.RootFiles = divs["root_files"]
+	a.Files = divs["files"]
+	if a.Metadata, verr = util.ValidateCookbookMetadata(data["metadata"]); verr != nil {
+		return nil, verr
+	}
+	if f, ok := data["frozen?"]; ok {
+		if a.IsFrozen, verr = util.ValidateAsBool(f); verr != nil {
+			return nil, verr
+		}
+	}
+	return a, nil
+}
+
+// GetArtifact gets a cookbook artifact.
+func GetArtifact(name string, identifier string) (*CookbookArtifact, util.Gerror) {
+	var a *CookbookArtifact
+	if config.UsingDB() {
+		var err error
+		a, err = getArtifactSQL(name, identifier)
+		if err != nil && err != sql.ErrNoRows {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+	} else if set := getArtifactSet(name); set != nil {
+		a = set.Artifacts[identifier]
+	}
+	if a == nil {
+		err := util.Errorf("Cannot find cookbook artifact %s with identifier %s", name, identifier)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return a, nil
+}
+
+func getArtifactSet(name string) *ArtifactSet {
+	ds := datastore.New()
+	s, found := ds.Get("cookbook_artifact", name)
+	if !found || s == nil {
+		return nil
+	}
+	return s.(*ArtifactSet)
+}
+
+// Save a new cookbook artifact. Saving one that already exists is a conflict.
+func (a *CookbookArtifact) Save() util.Gerror {
+	exists := util.Errorf("Cookbook artifact %s with identifier %s already exists", a.CookbookName, a.Identifier)
+	exists.SetStatus(http.StatusConflict)
+	if config.UsingDB() {
+		if _, err := GetArtifact(a.CookbookName, a.Identifier); err == nil {
+			return exists
+		}
+		if err := a.saveArtifactSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+	set := getArtifactSet(a.CookbookName)
+	if set == nil {
+		set = &ArtifactSet{Name: a.CookbookName, Artifacts: make(map[string]*CookbookArtifact)}
+	}
+	if _, found := set.Artifacts[a.Identifier]; found {
+		return exists
+	}
+	set.Artifacts[a.Identifier] = a
+	ds := datastore.New()
+	ds.Set("cookbook_artifact", a.CookbookName, set)
+	return nil
+}
+
+// Delete a cookbook artifact, along with any of its files that aren't used by
+// anything else.
+func (a *CookbookArtifact) Delete() error {
+	if config.UsingDB() {
+		if err := a.deleteArtifactSQL(); err != nil {
+			return err
+		}
+	} else {
+		artifactLock.Lock()
+		set := getArtifactSet(a.CookbookName)
+		if set != nil {
+			delete(set.Artifacts, a.Identifier)
+			ds := datastore.New()
+			if len(set.Artifacts) == 0 {
+				ds.Delete("cookbook_artifact", a.CookbookName)
+			} else {
+				ds.Set("cookbook_artifact", a.CookbookName, set)
+			}
+		}
+		artifactLock.Unlock()
+	}
+	c, _ := Get(a.CookbookName)
+	if c == nil {
+		c = &Cookbook{Name: a.CookbookName, Versions: make(map[string]*CookbookVersion)}
+	}
+	c.deleteHashes(a.fileHashes())
+	return nil
+}
+
+// ToJSON returns the artifact the way chef expects to get it.
+func (a *CookbookArtifact) ToJSON() map[string]interface{} {
+	j := a.CookbookVersion.ToJSON("GET")
+	j["identifier"] = a.Identifier
+	return j
+}
+
+// ArtifactList returns the identifiers of every cookbook's artifacts, sorted,
+// by cookbook name.
+func ArtifactList() (map[string][]string, error) {
+	var list map[string][]string
+	if config.UsingDB() {
+		var err error
+		if list, err = artifactListSQL(); err != nil {
+			return nil, err
+		}
+	} else {
+		list = make(map[string][]string)
+		ds := datastore.New()
+		for _, name := range ds.GetList("cookbook_artifact") {
+			set := getArtifactSet(name)
+			if set == nil {
+				continue
+			}
+			for id := range set.Artifacts {
+				list[name] = append(list[name], id)
+			}
+		}
+	}
+	for _, ids := range list {
+		sort.Strings(ids)
+	}
+	return list, nil
+}
+
+// AllArtifacts returns every cookbook artifact on the server.
+func AllArtifacts() ([]*CookbookArtifact, error) {
+	return AllArtifactsTx(nil)
+}
+
+// AllArtifactsTx returns every cookbook artifact on the server, reading from
+// the given db handle if using an SQL backend.
+func AllArtifactsTx(tx datastore.Dbhandle) ([]*CookbookArtifact, error) {
+	if config.UsingDB() {
+		return allArtifactsSQL(tx)
+	}
+	var artifacts []*CookbookArtifact
+	ds := datastore.New()
+	for _, name := range ds.GetList("cookbook_artifact") {
+		if set := getArtifactSet(name); set != nil {
+			for _, a := range set.Artifacts {
+				artifacts = append(artifacts, a)
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// artifactHashes returns the checksums of every file used by a cookbook
+// artifact.
+func artifactHashes() (map[string]bool, error) {
+	artifacts, err := AllArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	ah := make(map[string]bool)
+	for _, a := range artifacts {
+		for _, h := range a.fileHashes() {
+			ah[h] = true
+		}
+	}
+	return ah, nil
+}
@@ -22,11 +22,13 @@ package cookbook
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/trash"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
 	"regexp"
@@ -47,6 +49,7 @@ type Cookbook struct {
 	latest      *CookbookVersion
 	numVersions *int
 	id          int32
+	dbhandle    datastore.Dbhandle
 }
 
 /* We... want the JSON tags for this. */
@@ -70,6 +73,8 @@ type CookbookVersion struct {
 	Files        []map[string]interface{} `json:"files"`
 	IsFrozen     bool                     `json:"frozen?"`
 	Metadata     map[string]interface{}   `json:"metadata"`
+	Deprecated   bool                     `json:"deprecated,omitempty"`
+	Yanked       bool                     `json:"yanked,omitempty"`
 	id           int32
 	cookbookID   int32
 }
@@ -138,12 +143,30 @@ func (c *Cookbook) NumVersions() int {
 }
 
 // AllCookbooks returns all the cookbooks that have been uploaded to this server.
-func AllCookbooks() (cookbooks []*Cookbook) {
+func AllCookbooks() []*Cookbook {
+	cookbooks, err := AllCookbooksTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all cookbooks: %s", err.Error())
+	}
+	return cookbooks
+}
+
+// AllCookbooksTx returns all the cookbooks on this server like AllCookbooks,
+// but with an SQL backend reads them and their versions through the given db
+// handle. Pass in a transaction to read the cookbooks as part of a consistent
+// snapshot.
+func AllCookbooksTx(tx datastore.Dbhandle) ([]*Cookbook, error) {
+	var cookbooks []*Cookbook
 	if config.UsingDB() {
-		cookbooks = allCookbooksSQL()
+		var err error
+		if cookbooks, err = allCookbooksSQL(tx); err != nil {
+			return nil, err
+		}
 		for _, c := range cookbooks {
 			// populate the versions hash
-			c.sortedVersions()
+			if _, err = c.sortedCookbookVersionsSQL(tx); err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		cookbookList := GetList()
@@ -156,16 +179,23 @@ func AllCookbooks() (cookbooks []*Cookbook) {
 			cookbooks = append(cookbooks, cb)
 		}
 	}
-	return cookbooks
+	return cookbooks, nil
 }
 
 // Get a cookbook.
 func Get(name string) (*Cookbook, util.Gerror) {
+	return GetFrom(datastore.Dbh, name)
+}
+
+// GetFrom gets a cookbook like Get, but with an SQL backend reads it through
+// the given db handle, like a read replica. Its versions are read through the
+// same handle later on.
+func GetFrom(dbhandle datastore.Dbhandle, name string) (*Cookbook, util.Gerror) {
 	var cookbook *Cookbook
 	var found bool
 	if config.UsingDB() {
 		var err error
-		cookbook, err = getCookbookSQL(name)
+		cookbook, err = getCookbookSQL(dbhandle, name)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				found = false
@@ -244,7 +274,11 @@ func GetList() []string {
 /* Returns a sorted list of all the versions of this cookbook */
 func (c *Cookbook) sortedVersions() []*CookbookVersion {
 	if config.UsingDB() {
-		return c.sortedCookbookVersionsSQL()
+		sorted, err := c.sortedCookbookVersionsSQL(c.readDbh())
+		if err != nil {
+			logger.Errorf("Error getting the versions of cookbook %s: %s", c.Name, err.Error())
+		}
+		return sorted
 	}
 	sorted := make([]*CookbookVersion, len(c.Versions))
 	keys := make(VersionStrings, len(c.Versions))
@@ -268,6 +302,20 @@ func (c *Cookbook) sortedVersions() []*CookbookVersion {
 	return sorted
 }
 
+// SortedVersions returns all of the cookbook's versions, newest first.
+func (c *Cookbook) SortedVersions() []*CookbookVersion {
+	return c.sortedVersions()
+}
+
+// readDbh returns the db handle the cookbook was loaded with, so its versions
+// come from the same place.
+func (c *Cookbook) readDbh() datastore.Dbhandle {
+	if c.dbhandle != nil {
+		return c.dbhandle
+	}
+	return datastore.Dbh
+}
+
 // UpdateLatestVersion updates what the cookbook stores as the latest version
 // available.
 func (c *Cookbook) UpdateLatestVersion() {
@@ -275,13 +323,16 @@ func (c *Cookbook) UpdateLatestVersion() {
 	c.LatestVersion()
 }
 
-// LatestVersion gets the latest version of this cookbook.
+// LatestVersion gets the latest version of this cookbook that hasn't been
+// yanked, or nil if every version has been.
 func (c *Cookbook) LatestVersion() *CookbookVersion {
 	if c.latest == nil {
-		sorted := c.sortedVersions()
-		c.latest = sorted[0]
-		if c.latest != nil {
-			datastore.ChkNilArray(c.latest)
+		for _, cbv := range c.sortedVersions() {
+			if !cbv.Yanked {
+				c.latest = cbv
+				datastore.ChkNilArray(c.latest)
+				break
+			}
 		}
 	}
 	return c.latest
@@ -305,15 +356,22 @@ func CookbookLister(numResults interface{}) map[string]interface{} {
 func CookbookLatest() map[string]interface{} {
 	latest := make(map[string]interface{})
 	if config.UsingDB() {
-		cs := CookbookLister("")
+		// The latest version may have been yanked, so look at all of
+		// them.
+		cs := CookbookLister("all")
 		for name, cbdata := range cs {
-			if len(cbdata.(map[string]interface{})["versions"].([]interface{})) > 0 {
-				latest[name] = cbdata.(map[string]interface{})["versions"].([]interface{})[0].(map[string]string)["url"]
+			for _, v := range cbdata.(map[string]interface{})["versions"].([]interface{}) {
+				if vInfo := v.(map[string]interface{}); vInfo["yanked"] == nil {
+					latest[name] = vInfo["url"]
+					break
+				}
 			}
 		}
 	} else {
 		for _, cb := range AllCookbooks() {
-			latest[cb.Name] = util.CustomObjURL(cb, cb.LatestVersion().Version)
+			if cbv := cb.LatestVersion(); cbv != nil {
+				latest[cb.Name] = util.CustomObjURL(cb, cbv.Version)
+			}
 		}
 	}
 	return latest
@@ -330,7 +388,11 @@ func CookbookRecipes() ([]string, util.Gerror) {
 		/* Damn it, this sends back an array of
 		 * all the recipes. Fill it in, and send
 		 * back the JSON ourselves. */
-		rlistTmp, err := cb.LatestVersion().RecipeList()
+		cbv := cb.LatestVersion()
+		if cbv == nil {
+			continue
+		}
+		rlistTmp, err := cbv.RecipeList()
 		if err != nil {
 			return nil, err
 		}
@@ -354,126 +416,22 @@ func (c *Cookbook) ConstrainedInfoHash(numResults interface{}, constraint string
 }
 
 // DependsCookbooks will, for the given run list and environment constraints,
-// return the cookbook dependencies.
+// return the cookbook dependencies. If they can't be satisfied, the error is a
+// *DependencyError explaining why.
 func DependsCookbooks(runList []string, envConstraints map[string]string) (map[string]interface{}, error) {
-	cdList := make(map[string][]string, len(runList))
-	runListRef := make([]string, len(runList))
-
-	for i, cbV := range runList {
-		var cbName string
-		var constraint string
-		cx := strings.Split(cbV, "@")
-		cbName = strings.Split(cx[0], "::")[0]
-		if len(cx) == 2 {
-			constraint = fmt.Sprintf("= %s", cx[1])
-		}
-		cdList[cbName] = []string{constraint}
-		/* There's a method to our madness. We need to modify the
-		 * cdList as we go along, but want the base list to remain the
-		 * same. Thus, we make an additional array of cookbook names to
-		 * range through. */
-		runListRef[i] = cbName
-	}
-
-	for k, ec := range envConstraints {
-		if _, found := cdList[k]; !found {
-			continue
-		} else {
-			/* Check if there's a constraint in the uploaded run
-			 * list. If not take the env one and move on. */
-			if cdList[k][0] == "" {
-				cdList[k] = []string{ec}
-				continue
-			}
-			/* Override if the environment is more restrictive */
-			_, orgver, _ := splitConstraint(cdList[k][0])
-			newop, newver, nerr := splitConstraint(ec)
-			if nerr != nil {
-				return nil, nerr
-			}
-			/* if the versions are equal, take the env one */
-			if orgver == newver {
-				cdList[k] = []string{ec}
-				continue /* and break out of this step */
-			}
-			switch newop {
-			case ">", ">=":
-				if versionLess(orgver, newver) {
-					cdList[k] = []string{ec}
-				}
-			case "<", "<=":
-				if !versionLess(orgver, newver) {
-					cdList[k] = []string{ec}
-				}
-			case "=":
-				if orgver != newver {
-					err := fmt.Errorf("This run list has a constraint '%s' for %s that conflicts with '%s' in the environment's cookbook versions.", cdList[k][0], k, ec)
-					return nil, err
-				}
-			case "~>":
-				if action := verConstraintCheck(orgver, newver, newop); action == "ok" {
-					cdList[k] = []string{ec}
-				} else {
-					err := fmt.Errorf("This run list has a constraint '%s' for %s that conflicts with '%s' in the environment's cookbook versions.", cdList[k][0], k, ec)
-					return nil, err
-				}
-			default:
-				err := fmt.Errorf("An unlikely occurance, but the constraint '%s' for cookbook %s in this environment is impossible.", ec, k)
-				return nil, err
-			}
-		}
-	}
-
-	/* Build a slice holding all the needed cookbooks. */
-	for _, cbName := range runListRef {
-		c, err := Get(cbName)
-		if err != nil {
-			return nil, err
-		}
-		cbv := c.LatestConstrained(cdList[cbName][0])
-		if cbv == nil {
-			return nil, fmt.Errorf("No cookbook found for %s that satisfies constraint '%s'", c.Name, cdList[cbName][0])
-		}
+	return DependsCookbooksFrom(datastore.Dbh, runList, envConstraints)
+}
 
-		nerr := cbv.resolveDependencies(cdList)
-		if nerr != nil {
-			return nil, nerr
-		}
+// DependsCookbooksFrom works like DependsCookbooks, but with an SQL backend
+// reads the cookbooks through the given db handle, like a read replica.
+func DependsCookbooksFrom(dbhandle datastore.Dbhandle, runList []string, envConstraints map[string]string) (map[string]interface{}, error) {
+	picked, err := SolveDependenciesFrom(dbhandle, runList, envConstraints)
+	if err != nil {
+		return nil, err
 	}
 
-	cookbookDeps := make(map[string]interface{}, len(cdList))
-	for cname, traints := range cdList {
-		cb, err := Get(cname)
-		/* Although we would have already seen this, but being careful
-		 * rarely hurt. */
-		if err != nil {
-			return nil, err
-		}
-		var gcbv *CookbookVersion
-
-		for _, cv := range cb.sortedVersions() {
-		Vers:
-			for _, ct := range traints {
-				if ct != "" { // no constraint
-					op, ver, err := splitConstraint(ct)
-					if err != nil {
-						return nil, err
-					}
-					if action := verConstraintCheck(cv.Version, ver, op); action != "ok" {
-						// BREAK THIS LOOP, BUT CONTINUE THE cv LOOP. HMM
-						continue Vers
-					}
-				}
-			}
-			/* If we pass the constraint tests, set gcbv to cv and
-			 * break. */
-			gcbv = cv
-			break
-		}
-		if gcbv == nil {
-			err := fmt.Errorf("Unfortunately no version of %s could satisfy the requested constraints: %s", cname, strings.Join(traints, ", "))
-			return nil, err
-		}
+	cookbookDeps := make(map[string]interface{}, len(picked))
+	for _, gcbv := range picked {
 		gcbvJSON := gcbv.ToJSON("POST")
 		/* Sigh. For some reason, *some* places want nothing
 		 * sent for cookbook information divisions like
@@ -494,49 +452,6 @@ func DependsCookbooks(runList []string, envConstraints map[string]string) (map[s
 	return cookbookDeps, nil
 }
 
-func (cbv *CookbookVersion) resolveDependencies(cdList map[string][]string) error {
-	depList := cbv.Metadata["dependencies"].(map[string]interface{})
-
-	for r, c2 := range depList {
-		c := c2.(string)
-		depCb, err := Get(r)
-		if err != nil {
-			return err
-		}
-		debCbv := depCb.LatestConstrained(c)
-		if debCbv == nil {
-			err := fmt.Errorf("No cookbook version for %s satisfies constraint '%s'.", r, c)
-			return err
-		}
-
-		/* Do we satisfy the constraints we have? */
-		if constraints, found := cdList[r]; found {
-			for _, dcon := range constraints {
-				if dcon != "" {
-					op, ver, err := splitConstraint(dcon)
-					if err != nil {
-						return err
-					}
-					stat := verConstraintCheck(debCbv.Version, ver, op)
-					if stat != "ok" {
-						err := fmt.Errorf("Oh no! Cookbook %s (ver %s) depends on a version of cookbook %s matching the constraint '%s', but that constraint conflicts with the previous constraint of '%s'. Bailing, sorry.", cbv.CookbookName, cbv.Version, debCbv.CookbookName, c, dcon)
-						return err
-					}
-				}
-			}
-		} else {
-			/* Add our constraint */
-			cdList[r] = []string{c}
-		}
-
-		nerr := debCbv.resolveDependencies(cdList)
-		if nerr != nil {
-			return nerr
-		}
-	}
-	return nil
-}
-
 func splitConstraint(constraint string) (string, string, error) {
 	t1 := strings.Split(constraint, " ")
 	if len(t1) != 2 {
@@ -606,9 +521,7 @@ VerLoop:
 				 * panic over an invalid constraint. */
 			}
 		}
-		cvInfo := make(map[string]string)
-		cvInfo["url"] = util.CustomObjURL(c, cv.Version)
-		cvInfo["version"] = cv.Version
+		cvInfo := versionInfo(util.CustomObjURL(c, cv.Version), cv.Version, cv.Deprecated, cv.Yanked)
 		cbHash["versions"] = append(cbHash["versions"].([]interface{}), cvInfo)
 		nr++
 	}
@@ -617,9 +530,16 @@ VerLoop:
 
 // LatestConstrained returns the latest version of a cookbook that matches the
 // given constraint. If no constraint is given, returns the latest version.
+// Yanked versions are passed over, as are deprecated versions unless the
+// constraint pins that exact version.
 func (c *Cookbook) LatestConstrained(constraint string) *CookbookVersion {
 	if constraint == "" {
-		return c.LatestVersion()
+		for _, cv := range c.sortedVersions() {
+			if cv.resolvable(nil) {
+				return cv
+			}
+		}
+		return nil
 	}
 	var constraintVersion string
 	var constraintOp string
@@ -634,7 +554,7 @@ func (c *Cookbook) LatestConstrained(constraint string) *CookbookVersion {
 	for _, cv := range c.sortedVersions() {
 		action := verConstraintCheck(cv.Version, constraintVersion, constraintOp)
 		/* We only want the latest that works. */
-		if action == "ok" {
+		if action == "ok" && cv.resolvable([]string{constraint}) {
 			return cv
 		}
 	}
@@ -666,6 +586,12 @@ func (c *Cookbook) universeFormat() map[string]interface{} {
 		v["location_path"] = util.CustomObjURL(c, cbv.Version)
 		v["location_type"] = "chef_server"
 		v["dependencies"] = cbv.Metadata["dependencies"]
+		if cbv.Deprecated {
+			v["deprecated"] = true
+		}
+		if cbv.Yanked {
+			v["yanked"] = true
+		}
 		u[cbv.Version] = v
 	}
 	return u
@@ -705,7 +631,12 @@ func (c *Cookbook) NewVersion(cbVersion string, cbvData map[string]interface{})
 // GetVersion gets a particular version of the cookbook.
 func (c *Cookbook) GetVersion(cbVersion string) (*CookbookVersion, util.Gerror) {
 	if cbVersion == "_latest" {
-		return c.LatestVersion(), nil
+		if latest := c.LatestVersion(); latest != nil {
+			return latest, nil
+		}
+		err := util.Errorf("Cannot find a version of cookbook %s that hasn't been yanked", c.Name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
 	}
 	var cbv *CookbookVersion
 	var found bool
@@ -816,8 +747,107 @@ func (c *Cookbook) deleteHashes(fhashes []string) {
 			}
 		}
 	}
+	/* Files used by cookbook versions in the trash have to stay around
+	 * until they're purged, so the versions can still be restored. */
+	trashed, err := trashedHashes()
+	if err != nil {
+		logger.Errorf("Not deleting any files, because the cookbook versions in the trash couldn't be checked: %s", err.Error())
+		return
+	}
+	/* Cookbook artifacts can share files with cookbook versions, too. */
+	artifacts, err := artifactHashes()
+	if err != nil {
+		logger.Errorf("Not deleting any files, because the cookbook artifacts couldn't be checked: %s", err.Error())
+		return
+	}
+	keep := make([]string, 0, len(fhashes))
+	for _, fh := range fhashes {
+		if !trashed[fh] && !artifacts[fh] {
+			keep = append(keep, fh)
+		}
+	}
 	/* And delete whatever file hashes we still have */
-	filestore.DeleteHashes(fhashes)
+	filestore.DeleteHashes(keep)
+}
+
+func trashedHashes() (map[string]bool, error) {
+	th := make(map[string]bool)
+	items, err := trash.List("cookbook_version")
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		cbv := new(CookbookVersion)
+		if err := json.Unmarshal(item.Data, cbv); err != nil {
+			return nil, err
+		}
+		for _, h := range cbv.fileHashes() {
+			th[h] = true
+		}
+	}
+	return th, nil
+}
+
+// ReferencedHashes returns the checksums of every file used by a cookbook
+// version, a cookbook version in the trash, or a cookbook artifact: every
+// file the cookbooks on this server need.
+func ReferencedHashes() (map[string]bool, error) {
+	refs, err := trashedHashes()
+	if err != nil {
+		return nil, err
+	}
+	artifacts, err := artifactHashes()
+	if err != nil {
+		return nil, err
+	}
+	for h := range artifacts {
+		refs[h] = true
+	}
+	for _, c := range AllCookbooks() {
+		for _, cbv := range c.Versions {
+			for _, h := range cbv.fileHashes() {
+				refs[h] = true
+			}
+		}
+	}
+	return refs, nil
+}
+
+// VersionsByHash maps the checksum of each file used by a cookbook version to
+// the versions using it, like "apache2/1.2.0".
+func VersionsByHash() map[string][]string {
+	versions := make(map[string][]string)
+	for _, c := range AllCookbooks() {
+		for v, cbv := range c.Versions {
+			seen := make(map[string]bool)
+			for _, h := range cbv.fileHashes() {
+				if !seen[h] {
+					seen[h] = true
+					versions[h] = append(versions[h], fmt.Sprintf("%s/%s", c.Name, v))
+				}
+			}
+		}
+	}
+	for _, v := range versions {
+		sort.Strings(v)
+	}
+	return versions
+}
+
+// PurgeTrashedVersion deletes the files belonging to a cookbook version that
+// was in the trash, once it's been removed from the trash for good. Files that
+// are still used by other cookbook versions, trashed or not, are kept.
+func PurgeTrashedVersion(item *trash.Item) error {
+	cbv := new(CookbookVersion)
+	if err := json.Unmarshal(item.Data, cbv); err != nil {
+		return err
+	}
+	c, _ := Get(cbv.CookbookName)
+	if c == nil {
+		c = &Cookbook{Name: cbv.CookbookName, Versions: make(map[string]*CookbookVersion)}
+	}
+	c.deleteHashes(cbv.fileHashes())
+	return nil
 }
 
 // DeleteVersion deletes a particular version of a cookbook.
@@ -835,13 +865,26 @@ func (c *Cookbook) DeleteVersion(cbVersion string) util.Gerror {
 	if config.UsingDB() {
 		err := cbv.deleteCookbookVersionSQL()
 		if err != nil {
-			return nil
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
 		}
 	}
 	c.numVersions = nil
 
 	delete(c.Versions, cbVersion)
 	c.Save()
+
+	/* A version in the trash keeps its files until it's purged from the
+	 * trash, which cleans them up then. */
+	name := fmt.Sprintf("%s/%s", c.Name, cbVersion)
+	if trash.Enabled() {
+		err := trash.Add("cookbook_version", name, cbv)
+		if err == nil {
+			return nil
+		}
+		logger.Errorf("Error putting cookbook version %s in the trash: %s", name, err.Error())
+	}
 	c.deleteHashes(fhashes)
 
 	return nil
@@ -869,7 +912,10 @@ func (cbv *CookbookVersion) UpdateVersion(cbvData map[string]interface{}, force
 	}
 
 	/* Validation, validation, all is validation. */
-	validElements := []string{"cookbook_name", "name", "version", "json_class", "chef_type", "definitions", "libraries", "attributes", "recipes", "providers", "resources", "templates", "root_files", "files", "frozen?", "metadata", "force"}
+	/* "deprecated" and "yanked" are allowed so a cookbook version's JSON
+	 * can be sent back as is, but they're only changed with
+	 * SetVersionStatus. */
+	validElements := []string{"cookbook_name", "name", "version", "json_class", "chef_type", "definitions", "libraries", "attributes", "recipes", "providers", "resources", "templates", "root_files", "files", "frozen?", "metadata", "force", "deprecated", "yanked"}
 ValidElem:
 	for k := range cbvData {
 		for _, i := range validElements {
@@ -1035,6 +1081,12 @@ func (cbv *CookbookVersion) ToJSON(method string) map[string]interface{} {
 	toJSON["chef_type"] = cbv.ChefType
 	toJSON["json_class"] = cbv.JSONClass
 	toJSON["frozen?"] = cbv.IsFrozen
+	if cbv.Deprecated {
+		toJSON["deprecated"] = true
+	}
+	if cbv.Yanked {
+		toJSON["yanked"] = true
+	}
 	// hmm.
 	if cbv.Recipes != nil {
 		toJSON["recipes"] = cbv.Recipes
@@ -1076,7 +1128,6 @@ func (cbv *CookbookVersion) ToJSON(method string) map[string]interface{} {
 
 func methodize(method string, cbThing []map[string]interface{}) []map[string]interface{} {
 	retHash := make([]map[string]interface{}, len(cbThing))
-	baseURL := config.ServerBaseURL()
 	r := regexp.MustCompile(`/file_store/`)
 	for i, v := range cbThing {
 		retHash[i] = make(map[string]interface{})
@@ -1086,7 +1137,7 @@ func methodize(method string, cbThing []map[string]interface{}) []map[string]int
 				continue
 			}
 			if k == "url" && r.MatchString(`/file_store/`) {
-				retHash[i][k] = baseURL + "/file_store/" + chkSum
+				retHash[i][k] = util.FileStoreURL(chkSum, "GET")
 			} else {
 				retHash[i][k] = j
 			}
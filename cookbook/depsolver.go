@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Working out which versions of which cookbooks a run list needs.
+
+package cookbook
+
+import (
+	"fmt"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// How many partial solutions the solver will try before giving up. Real
+// dependency graphs are solved in a handful of steps; this keeps a
+// pathological one from tying up the server.
+const maxSolverSteps = 100000
+
+var errSolverGaveUp = unsatisfiablef("Gave up trying to find a set of cookbook versions that satisfies this run list's dependencies after %d attempts.", maxSolverSteps)
+
+// unsatisfiable is a dead end the solver ran into, like a cookbook that
+// doesn't exist or a set of constraints no version meets, as opposed to
+// something going wrong while it was looking, like a database error.
+type unsatisfiable struct {
+	msg string
+}
+
+func (u *unsatisfiable) Error() string {
+	return u.msg
+}
+
+func unsatisfiablef(format string, a ...interface{}) error {
+	return &unsatisfiable{msg: fmt.Sprintf(format, a...)}
+}
+
+func isUnsatisfiable(err error) bool {
+	_, ok := err.(*unsatisfiable)
+	return ok
+}
+
+// depConstraint is a version constraint on a cookbook, along with where it
+// came from: the run list, the environment, or a version of a cookbook that
+// depends on it.
+type depConstraint struct {
+	constraint string
+	from       string
+}
+
+func (dc *depConstraint) String() string {
+	c := dc.constraint
+	if c == "" {
+		c = "any version"
+	}
+	return fmt.Sprintf("'%s' from %s", c, dc.from)
+}
+
+// depSolver searches for a version of every cookbook needed by a run list that
+// satisfies every constraint on it, from the run list, the environment, and
+// the dependencies of the other cookbook versions picked. When a choice leads
+// to a dead end, it goes back and tries the next version down.
+//
+// Along the way it keeps track of the cookbooks it couldn't find, and of how
+// often each cookbook was the one with no version left to pick, so if there's
+// no solution it can say why.
+type depSolver struct {
+	envConstraints map[string]string
+	versions       map[string][]*CookbookVersion
+	getVersions    func(name string) ([]*CookbookVersion, error)
+	steps          int
+	missing        map[string][]*depConstraint
+	conflicts      map[string]int
+	conflictWith   map[string][]*depConstraint
+}
+
+// DependencyError explains why no set of cookbook versions could satisfy a run
+// list, in the same shape as the Chef server's dependency solver errors. The
+// most constrained cookbooks are the ones the solver most often ran out of
+// versions of, and the unsatisfiable constraints are the constraints on those
+// cookbooks that couldn't all be met at once, with where each one came from.
+type DependencyError struct {
+	Message                  string                     `json:"message"`
+	NonExistentCookbooks     []string                   `json:"non_existent_cookbooks"`
+	MostConstrainedCookbooks []string                   `json:"most_constrained_cookbooks"`
+	UnsatisfiableConstraints []*UnsatisfiableConstraint `json:"unsatisfiable_constraints"`
+}
+
+// UnsatisfiableConstraint is a constraint on a cookbook that couldn't be met,
+// and what imposed it: the run list, the environment, or a version of another
+// cookbook.
+type UnsatisfiableConstraint struct {
+	Cookbook   string `json:"cookbook"`
+	Constraint string `json:"constraint"`
+	From       string `json:"from"`
+}
+
+// How many of the most constrained cookbooks to report.
+const mostConstrainedReported = 5
+
+func (e *DependencyError) Error() string {
+	return e.Message
+}
+
+func newDepSolver(envConstraints map[string]string) *depSolver {
+	return &depSolver{envConstraints: envConstraints, versions: make(map[string][]*CookbookVersion), getVersions: sortedCookbookVersions, missing: make(map[string][]*depConstraint), conflicts: make(map[string]int), conflictWith: make(map[string][]*depConstraint)}
+}
+
+// SolveDependencies returns the version of each cookbook to use for the given
+// run list, with the given environment cookbook version constraints. If there
+// isn't one, the error is a *DependencyError explaining why. Any other error,
+// like failing to read a cookbook, is passed back as it is.
+func SolveDependencies(runList []string, envConstraints map[string]string) (map[string]*CookbookVersion, error) {
+	return SolveDependenciesFrom(datastore.Dbh, runList, envConstraints)
+}
+
+// SolveDependenciesFrom works like SolveDependencies, but with an SQL backend
+// reads the cookbooks through the given db handle, like a read replica.
+func SolveDependenciesFrom(dbhandle datastore.Dbhandle, runList []string, envConstraints map[string]string) (map[string]*CookbookVersion, error) {
+	s := newDepSolver(envConstraints)
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		return sortedCookbookVersionsFrom(dbhandle, name)
+	}
+	return s.solve(runList)
+}
+
+func sortedCookbookVersions(name string) ([]*CookbookVersion, error) {
+	return sortedCookbookVersionsFrom(datastore.Dbh, name)
+}
+
+func sortedCookbookVersionsFrom(dbhandle datastore.Dbhandle, name string) ([]*CookbookVersion, error) {
+	c, err := GetFrom(dbhandle, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.sortedVersions(), nil
+}
+
+// runListConstraints turns a run list into constraints on the cookbooks in it.
+// Cookbooks with a version in the run list, like "recipe[foo@1.2.0]", have to
+// be that exact version.
+func runListConstraints(runList []string) map[string][]*depConstraint {
+	constraints := make(map[string][]*depConstraint, len(runList))
+	for _, cbV := range runList {
+		var constraint string
+		cx := strings.Split(cbV, "@")
+		cbName := strings.Split(cx[0], "::")[0]
+		if len(cx) == 2 {
+			constraint = fmt.Sprintf("= %s", cx[1])
+		}
+		constraints[cbName] = append(constraints[cbName], &depConstraint{constraint: constraint, from: "the run list"})
+	}
+	return constraints
+}
+
+// solve returns the versions of each cookbook to use for the run list.
+func (s *depSolver) solve(runList []string) (map[string]*CookbookVersion, error) {
+	picked, err := s.search(make(map[string]*CookbookVersion), runListConstraints(runList))
+	if err != nil {
+		if !isUnsatisfiable(err) {
+			return nil, err
+		}
+		return nil, s.explain(err)
+	}
+	return picked, nil
+}
+
+// explain builds a DependencyError out of what the solver ran into.
+func (s *depSolver) explain(err error) *DependencyError {
+	derr := &DependencyError{NonExistentCookbooks: make([]string, 0, len(s.missing)), MostConstrainedCookbooks: make([]string, 0), UnsatisfiableConstraints: make([]*UnsatisfiableConstraint, 0)}
+	for name := range s.missing {
+		derr.NonExistentCookbooks = append(derr.NonExistentCookbooks, name)
+	}
+	sort.Strings(derr.NonExistentCookbooks)
+
+	for name := range s.conflicts {
+		derr.MostConstrainedCookbooks = append(derr.MostConstrainedCookbooks, name)
+	}
+	sort.Slice(derr.MostConstrainedCookbooks, func(i, j int) bool {
+		a, b := derr.MostConstrainedCookbooks[i], derr.MostConstrainedCookbooks[j]
+		if s.conflicts[a] != s.conflicts[b] {
+			return s.conflicts[a] > s.conflicts[b]
+		}
+		return a < b
+	})
+	if len(derr.MostConstrainedCookbooks) > mostConstrainedReported {
+		derr.MostConstrainedCookbooks = derr.MostConstrainedCookbooks[:mostConstrainedReported]
+	}
+	for _, name := range derr.MostConstrainedCookbooks {
+		for _, dc := range s.conflictWith[name] {
+			derr.UnsatisfiableConstraints = append(derr.UnsatisfiableConstraints, &UnsatisfiableConstraint{Cookbook: name, Constraint: dc.constraint, From: dc.from})
+		}
+	}
+
+	var msgs []string
+	if err == errSolverGaveUp {
+		msgs = append(msgs, err.Error())
+	}
+	if len(derr.NonExistentCookbooks) > 0 {
+		needed := make([]string, len(derr.NonExistentCookbooks))
+		for i, name := range derr.NonExistentCookbooks {
+			needed[i] = fmt.Sprintf("%s (needed by %s)", name, constraintSources(s.missing[name]))
+		}
+		msgs = append(msgs, fmt.Sprintf("These cookbooks do not exist: %s.", strings.Join(needed, ", ")))
+	}
+	if len(derr.MostConstrainedCookbooks) > 0 {
+		name := derr.MostConstrainedCookbooks[0]
+		msgs = append(msgs, fmt.Sprintf("No version of %s satisfies all of the constraints on it: %s.", name, constraintList(s.conflictWith[name])))
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, err.Error())
+	}
+	derr.Message = strings.Join(msgs, " ")
+	return derr
+}
+
+// noteMissing records what needed a cookbook that doesn't exist.
+func (s *depSolver) noteMissing(name string, constraints []*depConstraint) {
+Constraints:
+	for _, dc := range constraints {
+		for _, m := range s.missing[name] {
+			if m.from == dc.from {
+				continue Constraints
+			}
+		}
+		s.missing[name] = append(s.missing[name], dc)
+	}
+}
+
+// noteConflict records that no version of a cookbook could satisfy the given
+// constraints.
+func (s *depSolver) noteConflict(name string, constraints []*depConstraint) {
+	s.conflicts[name]++
+	s.conflictWith[name] = constraints
+}
+
+func (s *depSolver) search(picked map[string]*CookbookVersion, constraints map[string][]*depConstraint) (map[string]*CookbookVersion, error) {
+	s.steps++
+	if s.steps > maxSolverSteps {
+		return nil, errSolverGaveUp
+	}
+
+	// Work on the cookbook with the fewest versions left to choose from,
+	// so dead ends turn up as early as possible.
+	names := make([]string, 0, len(constraints))
+	for name := range constraints {
+		if _, ok := picked[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return picked, nil
+	}
+	sort.Strings(names)
+	var next string
+	var candidates []*CookbookVersion
+	for _, name := range names {
+		cands, err := s.candidates(name, constraints[name])
+		if err != nil {
+			return nil, err
+		}
+		if next == "" || len(cands) < len(candidates) {
+			next = name
+			candidates = cands
+		}
+	}
+
+	var lastErr error
+	for _, cbv := range candidates {
+		newConstraints, err := s.addDependencies(cbv, picked, constraints)
+		if err != nil {
+			if !isUnsatisfiable(err) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		newPicked := make(map[string]*CookbookVersion, len(picked)+1)
+		for k, v := range picked {
+			newPicked[k] = v
+		}
+		newPicked[next] = cbv
+		solution, err := s.search(newPicked, newConstraints)
+		if err == nil {
+			return solution, nil
+		}
+		if err == errSolverGaveUp || !isUnsatisfiable(err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// candidates returns the versions of a cookbook that satisfy all of the given
+// constraints and the environment's constraint, newest first. Yanked versions
+// and deprecated versions that aren't pinned exactly are left out.
+func (s *depSolver) candidates(name string, constraints []*depConstraint) ([]*CookbookVersion, error) {
+	versions, err := s.cookbookVersions(name, constraints)
+	if err != nil {
+		return nil, err
+	}
+	all := constraints
+	if ec, ok := s.envConstraints[name]; ok {
+		all = append(all[:len(all):len(all)], &depConstraint{constraint: ec, from: "the environment"})
+	}
+	cs := make([]string, len(all))
+	for i, dc := range all {
+		cs[i] = dc.constraint
+	}
+	var cands []*CookbookVersion
+	for _, cbv := range versions {
+		if !cbv.resolvable(cs) {
+			continue
+		}
+		ok := true
+		for _, dc := range all {
+			sat, err := satisfiesConstraint(cbv.Version, dc.constraint)
+			if err != nil {
+				return nil, err
+			}
+			if !sat {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			cands = append(cands, cbv)
+		}
+	}
+	if len(cands) == 0 {
+		s.noteConflict(name, all)
+		return nil, unsatisfiablef("Unfortunately no version of %s could satisfy the requested constraints: %s", name, constraintList(all))
+	}
+	return cands, nil
+}
+
+func (s *depSolver) cookbookVersions(name string, constraints []*depConstraint) ([]*CookbookVersion, error) {
+	if versions, ok := s.versions[name]; ok {
+		if versions == nil {
+			s.noteMissing(name, constraints)
+			return nil, unsatisfiablef("Cookbook %s, needed by %s, does not exist.", name, constraintSources(constraints))
+		}
+		return versions, nil
+	}
+	versions, err := s.getVersions(name)
+	if err != nil {
+		if gerr, ok := err.(util.Gerror); ok && gerr.Status() != http.StatusNotFound {
+			return nil, err
+		}
+		s.versions[name] = nil
+		s.noteMissing(name, constraints)
+		return nil, unsatisfiablef("Cookbook %s, needed by %s, does not exist.", name, constraintSources(constraints))
+	}
+	s.versions[name] = versions
+	return versions, nil
+}
+
+// addDependencies adds the constraints from a cookbook version's dependencies
+// to the ones already in place. If any of the cookbooks it depends on has
+// already been picked, the picked version has to satisfy the new constraint.
+// Cookbooks that depend on each other are fine, since a cookbook that's
+// already been picked isn't looked at again.
+func (s *depSolver) addDependencies(cbv *CookbookVersion, picked map[string]*CookbookVersion, constraints map[string][]*depConstraint) (map[string][]*depConstraint, error) {
+	from := fmt.Sprintf("%s %s", cbv.CookbookName, cbv.Version)
+	newConstraints := make(map[string][]*depConstraint, len(constraints))
+	for k, v := range constraints {
+		newConstraints[k] = v
+	}
+	deps, _ := cbv.Metadata["dependencies"].(map[string]interface{})
+	for dep, c := range deps {
+		constraint, _ := c.(string)
+		dc := &depConstraint{constraint: constraint, from: from}
+		if p, ok := picked[dep]; ok {
+			sat, err := satisfiesConstraint(p.Version, constraint)
+			if err != nil {
+				return nil, err
+			}
+			if !sat {
+				cur := constraints[dep]
+				s.noteConflict(dep, append(cur[:len(cur):len(cur)], dc))
+				return nil, unsatisfiablef("Cookbook %s depends on %s %s, but %s %s was already picked to satisfy %s.", from, dep, constraint, dep, p.Version, constraintList(constraints[dep]))
+			}
+		}
+		cur := newConstraints[dep]
+		newConstraints[dep] = append(cur[:len(cur):len(cur)], dc)
+	}
+	return newConstraints, nil
+}
+
+func satisfiesConstraint(version string, constraint string) (bool, error) {
+	if constraint == "" {
+		return true, nil
+	}
+	op, ver, err := splitConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	return verConstraintCheck(version, ver, op) == "ok", nil
+}
+
+func constraintList(constraints []*depConstraint) string {
+	strs := make([]string, len(constraints))
+	for i, dc := range constraints {
+		strs[i] = dc.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+func constraintSources(constraints []*depConstraint) string {
+	strs := make([]string, len(constraints))
+	for i, dc := range constraints {
+		strs[i] = dc.from
+	}
+	return strings.Join(strs, ", ")
+}
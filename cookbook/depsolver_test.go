@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+// fakeCookbooks maps cookbook names to versions, each with its dependencies.
+type fakeCookbooks map[string]map[string]map[string]interface{}
+
+func (f fakeCookbooks) solver(envConstraints map[string]string) *depSolver {
+	s := newDepSolver(envConstraints)
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		vers, ok := f[name]
+		if !ok {
+			err := util.Errorf("Cannot find a cookbook named %s", name)
+			err.SetStatus(http.StatusNotFound)
+			return nil, err
+		}
+		keys := make(VersionStrings, 0, len(vers))
+		for v := range vers {
+			keys = append(keys, v)
+		}
+		sort.Sort(sort.Reverse(keys))
+		sortedVers := make([]*CookbookVersion, len(keys))
+		for i, v := range keys {
+			sortedVers[i] = &CookbookVersion{CookbookName: name, Version: v, Metadata: map[string]interface{}{"dependencies": vers[v]}}
+		}
+		return sortedVers, nil
+	}
+	return s
+}
+
+func TestSolverBacktracks(t *testing.T) {
+	// The latest app needs a newer lib than the latest db allows, so an
+	// older app has to be used.
+	cbs := fakeCookbooks{
+		"app": {
+			"2.0.0": {"lib": ">= 2.0.0"},
+			"1.0.0": {"lib": ">= 1.0.0"},
+		},
+		"db": {
+			"1.0.0": {"lib": "< 2.0.0"},
+		},
+		"lib": {
+			"2.0.0": {},
+			"1.5.0": {},
+			"1.0.0": {},
+		},
+	}
+	picked, err := cbs.solver(nil).solve([]string{"app", "db::server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app": "1.0.0", "db": "1.0.0", "lib": "1.5.0"}
+	for name, ver := range want {
+		if picked[name] == nil || picked[name].Version != ver {
+			t.Errorf("expected %s %s, got %v", name, ver, picked[name])
+		}
+	}
+}
+
+func TestSolverCycles(t *testing.T) {
+	cbs := fakeCookbooks{
+		"a": {"1.0.0": {"b": ">= 0.0.0"}},
+		"b": {"1.0.0": {"a": "= 1.0.0"}},
+	}
+	picked, err := cbs.solver(nil).solve([]string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 2 {
+		t.Errorf("expected 2 cookbooks, got %d", len(picked))
+	}
+}
+
+func TestSolverEnvironment(t *testing.T) {
+	cbs := fakeCookbooks{
+		"app": {
+			"2.0.0": {"lib": ">= 1.0.0"},
+			"1.0.0": {"lib": ">= 1.0.0"},
+		},
+		"lib": {
+			"2.0.0": {},
+			"1.0.0": {},
+		},
+	}
+	// Environment pins apply to dependencies too.
+	picked, err := cbs.solver(map[string]string{"lib": "= 1.0.0"}).solve([]string{"app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if picked["app"].Version != "2.0.0" || picked["lib"].Version != "1.0.0" {
+		t.Errorf("expected app 2.0.0 and lib 1.0.0, got app %s and lib %s", picked["app"].Version, picked["lib"].Version)
+	}
+	if _, err = cbs.solver(map[string]string{"app": "= 1.0.0"}).solve([]string{"app@2.0.0"}); err == nil {
+		t.Errorf("a run list version that conflicts with the environment should have failed")
+	}
+}
+
+func TestSolverFailures(t *testing.T) {
+	cbs := fakeCookbooks{
+		"app": {"1.0.0": {"lib": ">= 3.0.0"}},
+		"lib": {"1.0.0": {}},
+		"web": {
+			"2.0.0": {"missing": ">= 0.0.0"},
+			"1.0.0": {},
+		},
+	}
+	if _, err := cbs.solver(nil).solve([]string{"app"}); err == nil {
+		t.Errorf("an unsatisfiable dependency should have failed")
+	}
+	if _, err := cbs.solver(nil).solve([]string{"nope"}); err == nil {
+		t.Errorf("a cookbook that doesn't exist should have failed")
+	}
+	// A version that depends on a cookbook that doesn't exist is passed
+	// over for one that doesn't.
+	picked, err := cbs.solver(nil).solve([]string{"web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if picked["web"].Version != "1.0.0" {
+		t.Errorf("expected web 1.0.0, got %s", picked["web"].Version)
+	}
+}
+
+func TestSolverExplains(t *testing.T) {
+	cbs := fakeCookbooks{
+		"app": {"1.0.0": {"lib": ">= 2.0.0", "gone": ">= 0.0.0"}},
+		"db":  {"1.0.0": {"lib": "< 2.0.0"}},
+		"lib": {"2.0.0": {}, "1.0.0": {}},
+	}
+	_, err := cbs.solver(nil).solve([]string{"app", "db"})
+	derr, ok := err.(*DependencyError)
+	if !ok {
+		t.Fatalf("expected a *DependencyError, got %v", err)
+	}
+	if len(derr.NonExistentCookbooks) != 1 || derr.NonExistentCookbooks[0] != "gone" {
+		t.Errorf("expected gone to be a non-existent cookbook, got %v", derr.NonExistentCookbooks)
+	}
+
+	cbs["app"]["1.0.0"] = map[string]interface{}{"lib": ">= 2.0.0"}
+	_, err = cbs.solver(nil).solve([]string{"app", "db"})
+	derr, ok = err.(*DependencyError)
+	if !ok {
+		t.Fatalf("expected a *DependencyError, got %v", err)
+	}
+	if len(derr.MostConstrainedCookbooks) == 0 || derr.MostConstrainedCookbooks[0] != "lib" {
+		t.Fatalf("expected lib to be the most constrained cookbook, got %v", derr.MostConstrainedCookbooks)
+	}
+	from := make(map[string]bool)
+	for _, uc := range derr.UnsatisfiableConstraints {
+		if uc.Cookbook == "lib" {
+			from[uc.From] = true
+		}
+	}
+	if !from["app 1.0.0"] || !from["db 1.0.0"] {
+		t.Errorf("expected the constraints on lib from app and db, got %v", from)
+	}
+}
+
+func TestSolverPassesOtherErrorsThrough(t *testing.T) {
+	cbs := fakeCookbooks{
+		"app": {
+			"1.0.0": {"lib": ">= 1.0.0"},
+		},
+	}
+	s := cbs.solver(nil)
+	lookup := s.getVersions
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		if name == "lib" {
+			err := util.Errorf("connection refused")
+			err.SetStatus(http.StatusInternalServerError)
+			return nil, err
+		}
+		return lookup(name)
+	}
+	_, err := s.solve([]string{"app"})
+	if err == nil {
+		t.Fatalf("the solver should have failed when it couldn't read a cookbook")
+	}
+	if _, ok := err.(*DependencyError); ok {
+		t.Errorf("failing to read a cookbook should not have been reported as a dependency error: %s", err.Error())
+	}
+	if gerr, ok := err.(util.Gerror); !ok || gerr.Status() != http.StatusInternalServerError {
+		t.Errorf("expected the error reading the cookbook to be passed through, got %v", err)
+	}
+}
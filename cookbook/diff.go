@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/revision"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Files bigger than this aren't diffed.
+const maxDiffFileSize = 1 << 20
+
+// Comparing two files takes a table this big at most, after leaving out the
+// lines they start and end with in common.
+const maxDiffCells = 1 << 22
+
+// Lines of context around each change in a unified diff.
+const diffContext = 3
+
+// VersionDiff is what changed between two versions of a cookbook.
+type VersionDiff struct {
+	Cookbook     string                   `json:"cookbook"`
+	From         string                   `json:"from"`
+	To           string                   `json:"to"`
+	Files        map[string][]*FileChange `json:"files"`
+	Metadata     []*revision.Change       `json:"metadata"`
+	Dependencies []*revision.Change       `json:"dependencies"`
+}
+
+// FileChange is a file that was added, removed, or changed in one part of a
+// cookbook. Changed text files come with a unified diff, unless the diff was
+// skipped for the reason given in DiffSkipped.
+type FileChange struct {
+	Path        string `json:"path"`
+	Op          string `json:"op"`
+	OldChecksum string `json:"old_checksum,omitempty"`
+	NewChecksum string `json:"new_checksum,omitempty"`
+	Diff        string `json:"diff,omitempty"`
+	DiffSkipped string `json:"diff_skipped,omitempty"`
+}
+
+// DiffVersions compares two versions of a cookbook: the files in each part of
+// the cookbook by checksum, and the metadata and dependencies.
+func DiffVersions(from *CookbookVersion, to *CookbookVersion) *VersionDiff {
+	d := &VersionDiff{Cookbook: to.CookbookName, From: from.Version, To: to.Version}
+	d.Files = make(map[string][]*FileChange)
+	fromSegs := from.segments()
+	for seg, items := range to.segments() {
+		changes := diffSegment(seg, fromSegs[seg], items)
+		if len(changes) > 0 {
+			d.Files[seg] = changes
+		}
+	}
+
+	fromMeta := make(map[string]interface{}, len(from.Metadata))
+	for k, v := range from.Metadata {
+		fromMeta[k] = v
+	}
+	toMeta := make(map[string]interface{}, len(to.Metadata))
+	for k, v := range to.Metadata {
+		toMeta[k] = v
+	}
+	fromDeps, _ := fromMeta["dependencies"].(map[string]interface{})
+	toDeps, _ := toMeta["dependencies"].(map[string]interface{})
+	delete(fromMeta, "dependencies")
+	delete(toMeta, "dependencies")
+	d.Metadata = revision.Diff(fromMeta, toMeta)
+	d.Dependencies = revision.Diff(fromDeps, toDeps)
+	return d
+}
+
+func diffSegment(seg string, from []map[string]interface{}, to []map[string]interface{}) []*FileChange {
+	fromFiles := segmentChecksums(seg, from)
+	toFiles := segmentChecksums(seg, to)
+	changes := make([]*FileChange, 0)
+	for p, chksum := range fromFiles {
+		if _, ok := toFiles[p]; !ok {
+			changes = append(changes, &FileChange{Path: p, Op: revision.DiffRemove, OldChecksum: chksum})
+		}
+	}
+	for p, chksum := range toFiles {
+		oldChksum, ok := fromFiles[p]
+		if !ok {
+			changes = append(changes, &FileChange{Path: p, Op: revision.DiffAdd, NewChecksum: chksum})
+		} else if oldChksum != chksum {
+			fc := &FileChange{Path: p, Op: revision.DiffChange, OldChecksum: oldChksum, NewChecksum: chksum}
+			fc.Diff, fc.DiffSkipped = diffFiles(p, oldChksum, chksum)
+			changes = append(changes, fc)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func segmentChecksums(seg string, items []map[string]interface{}) map[string]string {
+	files := make(map[string]string, len(items))
+	for _, item := range items {
+		chksum, _ := item["checksum"].(string)
+		p, _ := itemPath(seg, item)
+		files[p] = chksum
+	}
+	return files
+}
+
+// diffFiles makes a unified diff of two files from the filestore, or returns
+// why it couldn't.
+func diffFiles(p string, oldChksum string, newChksum string) (string, string) {
+	oldData, reason := diffableData(oldChksum)
+	if reason != "" {
+		return "", reason
+	}
+	newData, reason := diffableData(newChksum)
+	if reason != "" {
+		return "", reason
+	}
+	diff, ok := unifiedDiff("a/"+p, "b/"+p, splitLines(oldData), splitLines(newData))
+	if !ok {
+		return "", "too many changed lines to diff"
+	}
+	return diff, ""
+}
+
+func diffableData(chksum string) ([]byte, string) {
+	f, err := filestore.Get(chksum)
+	if err != nil {
+		return nil, "file not in the file store"
+	}
+	content, err := f.Open()
+	if err != nil {
+		return nil, "file not in the file store"
+	}
+	defer content.Close()
+	if content.Size > maxDiffFileSize {
+		return nil, "file too large to diff"
+	}
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, "file not in the file store"
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		return nil, "binary file"
+	}
+	return data, ""
+}
+
+// splitLines splits text into lines, each keeping its newline. The last line
+// won't have one if the text doesn't end with a newline.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte // ' ', '-', or '+'
+	line string
+}
+
+// unifiedDiff makes a unified diff of two lists of lines, with each change
+// given diffContext lines of context. It gives up if the lines that differ
+// would take too much work to compare.
+func unifiedDiff(fromName string, toName string, a []string, b []string) (string, bool) {
+	ops, ok := diffLines(a, b)
+	if !ok {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", fromName, toName)
+	// The line in each file before each op.
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Gather changes that are close enough together to share a
+		// hunk.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops) && j <= end+2*diffContext+1; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		aCount := aLine[end] - aLine[start]
+		bCount := bLine[end] - bLine[start]
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(aLine[start], aCount), hunkRange(bLine[start], bCount))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return buf.String(), true
+}
+
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line+1)
+	}
+	return fmt.Sprintf("%d,%d", line+1, count)
+}
+
+// diffLines finds the shortest way to get from one list of lines to another
+// using the longest common subsequence of their lines.
+func diffLines(a []string, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	am := a[prefix : len(a)-suffix]
+	bm := b[prefix : len(b)-suffix]
+	n, m := len(am), len(bm)
+	if (n+1)*(m+1) > maxDiffCells {
+		return nil, false
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	// lcs[i*(m+1)+j] is the length of the longest common subsequence of
+	// am[i:] and bm[j:].
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else if lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+			} else {
+				lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && am[i] == bm[j]:
+			ops = append(ops, diffOp{' ', am[i]})
+			i++
+			j++
+		case j == m || (i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+			ops = append(ops, diffOp{'-', am[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', bm[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops, true
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/revision"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := splitLines([]byte("one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"))
+	b := splitLines([]byte("one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven"))
+	diff, ok := unifiedDiff("a/f", "b/f", a, b)
+	if !ok {
+		t.Fatal("unifiedDiff gave up")
+	}
+	expected := `--- a/f
++++ b/f
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -8,3 +8,4 @@
+ eight
+ nine
+ ten
++eleven
+\ No newline at end of file
+`
+	if diff != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", diff, expected)
+	}
+
+	// Changes close together share a hunk.
+	b = splitLines([]byte("one\n2\nthree\nfour\nfive\nsix\nseven\n8\nnine\nten\n"))
+	diff, _ = unifiedDiff("a/f", "b/f", a, b)
+	if n := bytes.Count([]byte(diff), []byte("@@ -")); n != 1 {
+		t.Errorf("expected 1 hunk, got %d:\n%s", n, diff)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+	gob.Register(new(filestore.FileStore))
+	oldRecipe := storeFile(t, "package 'foo'\n")
+	newRecipe := storeFile(t, "package 'foo'\nservice 'foo'\n")
+	attrs := storeFile(t, "default['foo'] = 1\n")
+	from := &CookbookVersion{
+		CookbookName: "difftest",
+		Version:      "1.0.0",
+		Recipes:      []map[string]interface{}{{"name": "default.rb", "path": "recipes/default.rb", "checksum": oldRecipe}},
+		Attributes:   []map[string]interface{}{{"name": "default.rb", "path": "attributes/default.rb", "checksum": attrs}},
+		Metadata:     map[string]interface{}{"version": "1.0.0", "dependencies": map[string]interface{}{"bar": ">= 1.0.0", "baz": ">= 0.0.0"}},
+	}
+	to := &CookbookVersion{
+		CookbookName: "difftest",
+		Version:      "1.1.0",
+		Recipes:      []map[string]interface{}{{"name": "default.rb", "path": "recipes/default.rb", "checksum": newRecipe}},
+		Files:        []map[string]interface{}{{"name": "foo.conf", "path": "files/default/foo.conf", "checksum": attrs}},
+		Metadata:     map[string]interface{}{"version": "1.1.0", "dependencies": map[string]interface{}{"bar": ">= 2.0.0"}},
+	}
+	d := DiffVersions(from, to)
+
+	if c := d.Files["recipes"]; len(c) != 1 || c[0].Op != revision.DiffChange || c[0].Diff == "" {
+		t.Errorf("expected the changed recipe with a diff, got %+v", c)
+	} else if !bytes.Contains([]byte(c[0].Diff), []byte("+service 'foo'\n")) {
+		t.Errorf("the recipe diff is missing the added line:\n%s", c[0].Diff)
+	}
+	if c := d.Files["attributes"]; len(c) != 1 || c[0].Op != revision.DiffRemove || c[0].OldChecksum != attrs {
+		t.Errorf("expected the removed attribute file, got %+v", c)
+	}
+	if c := d.Files["files"]; len(c) != 1 || c[0].Op != revision.DiffAdd || c[0].Path != "files/default/foo.conf" {
+		t.Errorf("expected the added file, got %+v", c)
+	}
+	if len(d.Metadata) != 1 || d.Metadata[0].Path[0] != "version" {
+		t.Errorf("expected only the version to change in the metadata, got %+v", d.Metadata)
+	}
+	if len(d.Dependencies) != 2 {
+		t.Errorf("expected 2 dependency changes, got %d", len(d.Dependencies))
+	}
+}
@@ -72,3 +72,8 @@ func (cbv *CookbookVersion) updateCookbookVersionMySQL(defb, libb, attb, recb, p
 	tx.Commit()
 	return nil
 }
+
+func (a *CookbookArtifact) saveArtifactMySQL(data []byte) error {
+	_, err := datastore.Dbh.Exec("INSERT INTO cookbook_artifacts (name, identifier, version, created_at, data) VALUES (?, ?, ?, NOW(), ?)", a.CookbookName, a.Identifier, a.Version, string(data))
+	return err
+}
@@ -56,3 +56,8 @@ func (cbv *CookbookVersion) updateCookbookVersionPostgreSQL(defb, libb, attb, re
 	tx.Commit()
 	return nil
 }
+
+func (a *CookbookArtifact) saveArtifactPostgreSQL(data []byte) error {
+	_, err := datastore.Dbh.Exec("INSERT INTO goiardi.cookbook_artifacts (name, identifier, version, created_at, data) VALUES ($1, $2, $3, NOW(), $4)", a.CookbookName, a.Identifier, a.Version, string(data))
+	return err
+}
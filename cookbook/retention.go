@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+// PruneCandidates returns the versions of the cookbook, newest first, that
+// fall outside of the latest keep versions and so can be pruned. Versions in
+// protected are never pruned, and don't count against the versions kept.
+// With keep less than 1, every version is kept.
+func (c *Cookbook) PruneCandidates(keep int, protected map[string]bool) []string {
+	prune := make([]string, 0)
+	if keep < 1 {
+		return prune
+	}
+	kept := 0
+	for _, cbv := range c.sortedVersions() {
+		if protected[cbv.Version] {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		prune = append(prune, cbv.Version)
+	}
+	return prune
+}
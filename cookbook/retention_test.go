@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPruneCandidates(t *testing.T) {
+	c := &Cookbook{Name: "pruned", Versions: make(map[string]*CookbookVersion)}
+	for _, v := range []string{"0.9.0", "1.0.0", "1.0.10", "1.0.2", "2.0.0"} {
+		c.Versions[v] = &CookbookVersion{CookbookName: "pruned", Version: v}
+	}
+
+	got := c.PruneCandidates(2, nil)
+	if want := []string{"1.0.2", "1.0.0", "0.9.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keeping 2, expected to prune %v, got %v", want, got)
+	}
+
+	// A protected version is kept on top of the latest ones.
+	got = c.PruneCandidates(2, map[string]bool{"2.0.0": true, "1.0.0": true})
+	if want := []string{"0.9.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with protected versions, expected to prune %v, got %v", want, got)
+	}
+
+	if got = c.PruneCandidates(0, nil); len(got) != 0 {
+		t.Errorf("keeping 0 should keep everything, got %v", got)
+	}
+}
@@ -39,7 +39,7 @@ func (c *Cookbook) numVersionsSQL() *int {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT count(*) AS c FROM goiardi.cookbook_versions cbv WHERE cbv.cookbook_id = $1"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := c.readDbh().Prepare(sqlStatement)
 
 	if err != nil {
 		log.Fatal(err)
@@ -91,7 +91,7 @@ func (cbv *CookbookVersion) fillCookbookVersionFromSQL(row datastore.ResRow) err
 		minor int64
 		patch int64
 	)
-	err := row.Scan(&cbv.id, &cbv.cookbookID, &defb, &libb, &attb, &recb, &prob, &resb, &temb, &roob, &filb, &metb, &major, &minor, &patch, &cbv.IsFrozen, &cbv.CookbookName)
+	err := row.Scan(&cbv.id, &cbv.cookbookID, &defb, &libb, &attb, &recb, &prob, &resb, &temb, &roob, &filb, &metb, &major, &minor, &patch, &cbv.IsFrozen, &cbv.Deprecated, &cbv.Yanked, &cbv.CookbookName)
 	if err != nil {
 		return err
 	}
@@ -224,7 +224,18 @@ func (cbv *CookbookVersion) updateCookbookVersionSQL() util.Gerror {
 	return gerr
 }
 
-func allCookbooksSQL() []*Cookbook {
+func (cbv *CookbookVersion) updateStatusSQL() error {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "UPDATE cookbook_versions SET deprecated = ?, yanked = ?, updated_at = NOW() WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "UPDATE goiardi.cookbook_versions SET deprecated = $1, yanked = $2, updated_at = NOW() WHERE id = $3"
+	}
+	_, err := datastore.Dbh.Exec(sqlStmt, cbv.Deprecated, cbv.Yanked, cbv.id)
+	return err
+}
+
+func allCookbooksSQL(dbhandle datastore.Dbhandle) ([]*Cookbook, error) {
 	var cookbooks []*Cookbook
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -232,35 +243,36 @@ func allCookbooksSQL() []*Cookbook {
 	} else {
 		sqlStatement = "SELECT id, name FROM goiardi.cookbooks"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return cookbooks
+			return cookbooks, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		cb := new(Cookbook)
 		err = cb.fillCookbookFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		cb.Versions = make(map[string]*CookbookVersion)
 		cookbooks = append(cookbooks, cb)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return cookbooks
+	return cookbooks, nil
 }
 
-func getCookbookSQL(name string) (*Cookbook, error) {
+func getCookbookSQL(dbhandle datastore.Dbhandle, name string) (*Cookbook, error) {
 	cookbook := new(Cookbook)
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -268,7 +280,7 @@ func getCookbookSQL(name string) (*Cookbook, error) {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT id, name FROM goiardi.cookbooks WHERE name = $1"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
 		return nil, err
 	}
@@ -280,6 +292,7 @@ func getCookbookSQL(name string) (*Cookbook, error) {
 		return nil, err
 	}
 	cookbook.Versions = make(map[string]*CookbookVersion)
+	cookbook.dbhandle = dbhandle
 
 	return cookbook, nil
 }
@@ -368,34 +381,35 @@ func getCookbookListSQL() []string {
 	return cbList
 }
 
-func (c *Cookbook) sortedCookbookVersionsSQL() []*CookbookVersion {
+func (c *Cookbook) sortedCookbookVersionsSQL(dbhandle datastore.Dbhandle) ([]*CookbookVersion, error) {
 	var sorted []*CookbookVersion
 
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, c.name FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = ? ORDER BY major_ver DESC, minor_ver DESC, patch_ver DESC"
+		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, deprecated, yanked, c.name FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = ? ORDER BY major_ver DESC, minor_ver DESC, patch_ver DESC"
 	} else {
-		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, c.name FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = $1 ORDER BY major_ver DESC, minor_ver DESC, patch_ver DESC"
+		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, deprecated, yanked, c.name FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = $1 ORDER BY major_ver DESC, minor_ver DESC, patch_ver DESC"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 
 	rows, qerr := stmt.Query(c.id)
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return sorted
+			return sorted, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		cbv := new(CookbookVersion)
 		err = cbv.fillCookbookVersionFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		// may as well populate this while we have it
 		c.Versions[cbv.Version] = cbv
@@ -403,9 +417,9 @@ func (c *Cookbook) sortedCookbookVersionsSQL() []*CookbookVersion {
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return sorted
+	return sorted, nil
 }
 
 func (c *Cookbook) getCookbookVersionSQL(cbVersion string) (*CookbookVersion, error) {
@@ -416,11 +430,11 @@ func (c *Cookbook) getCookbookVersionSQL(cbVersion string) (*CookbookVersion, er
 	}
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, c.name FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = ? AND major_ver = ? AND minor_ver = ? AND patch_ver = ?"
+		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, deprecated, yanked, c.name FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = ? AND major_ver = ? AND minor_ver = ? AND patch_ver = ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, c.name FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = $1 AND major_ver = $2 AND minor_ver = $3 AND patch_ver = $4"
+		sqlStatement = "SELECT cv.id, cookbook_id, definitions, libraries, attributes, recipes, providers, resources, templates, root_files, files, metadata, major_ver, minor_ver, patch_ver, frozen, deprecated, yanked, c.name FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id WHERE cookbook_id = $1 AND major_ver = $2 AND minor_ver = $3 AND patch_ver = $4"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := c.readDbh().Prepare(sqlStatement)
 	if err != nil {
 		return nil, err
 	}
@@ -472,9 +486,9 @@ func universeSQL() map[string]map[string]interface{} {
 
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT major_ver, minor_ver, patch_ver, c.name, metadata FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id ORDER BY cv.cookbook_id, major_ver DESC, minor_ver DESC, patch_ver DESC"
+		sqlStatement = "SELECT major_ver, minor_ver, patch_ver, c.name, metadata, deprecated, yanked FROM cookbook_versions cv LEFT JOIN cookbooks c ON cv.cookbook_id = c.id ORDER BY cv.cookbook_id, major_ver DESC, minor_ver DESC, patch_ver DESC"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT major_ver, minor_ver, patch_ver, c.name, metadata->>'dependencies' FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id ORDER BY cv.cookbook_id, major_ver DESC, minor_ver DESC, patch_ver DESC"
+		sqlStatement = "SELECT major_ver, minor_ver, patch_ver, c.name, metadata->>'dependencies', deprecated, yanked FROM goiardi.cookbook_versions cv LEFT JOIN goiardi.cookbooks c ON cv.cookbook_id = c.id ORDER BY cv.cookbook_id, major_ver DESC, minor_ver DESC, patch_ver DESC"
 	}
 	stmt, err := datastore.Dbh.Prepare(sqlStatement)
 
@@ -493,9 +507,10 @@ func universeSQL() map[string]map[string]interface{} {
 
 	for rows.Next() {
 		var metb sql.RawBytes
+		var deprecated, yanked bool
 		metadata := make(map[string]interface{})
 		u := make(map[string]interface{})
-		err := rows.Scan(&major, &minor, &patch, &name, &metb)
+		err := rows.Scan(&major, &minor, &patch, &name, &metb, &deprecated, &yanked)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -513,6 +528,12 @@ func universeSQL() map[string]map[string]interface{} {
 		} else {
 			u["dependencies"] = metadata["dependencies"]
 		}
+		if deprecated {
+			u["deprecated"] = true
+		}
+		if yanked {
+			u["yanked"] = true
+		}
 		if _, ok := universe[name]; !ok {
 			universe[name] = make(map[string]interface{})
 		}
@@ -541,9 +562,9 @@ func cookbookListerSQL(numResults interface{}) map[string]interface{} {
 
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT version, name FROM joined_cookbook_version ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
+		sqlStatement = "SELECT concat(v.major_ver, '.', v.minor_ver, '.', v.patch_ver), c.name, v.deprecated, v.yanked FROM cookbooks c JOIN cookbook_versions v ON c.id = v.cookbook_id ORDER BY c.name, v.major_ver desc, v.minor_ver desc, v.patch_ver desc"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT version, name FROM goiardi.joined_cookbook_version ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
+		sqlStatement = "SELECT v.major_ver || '.' || v.minor_ver || '.' || v.patch_ver, c.name, v.deprecated, v.yanked FROM goiardi.cookbooks c JOIN goiardi.cookbook_versions v ON c.id = v.cookbook_id ORDER BY c.name, v.major_ver desc, v.minor_ver desc, v.patch_ver desc"
 	}
 	stmt, err := datastore.Dbh.Prepare(sqlStatement)
 
@@ -559,14 +580,16 @@ func cookbookListerSQL(numResults interface{}) map[string]interface{} {
 		}
 		log.Fatal(qerr)
 	}
-	scratch := make(map[string][]string)
+	scratch := make(map[string][]map[string]interface{})
 	for rows.Next() {
 		var n, v string
-		err := rows.Scan(&v, &n)
+		var deprecated, yanked bool
+		err := rows.Scan(&v, &n, &deprecated, &yanked)
 		if err != nil {
 			log.Fatal(err)
 		}
-		scratch[n] = append(scratch[n], v)
+		cv := versionInfo(util.CustomURL(fmt.Sprintf("/cookbooks/%s/%s", n, v)), v, deprecated, yanked)
+		scratch[n] = append(scratch[n], cv)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
@@ -578,13 +601,10 @@ func cookbookListerSQL(numResults interface{}) map[string]interface{} {
 		cb := make(map[string]interface{})
 		cb["url"] = util.CustomURL(cburl)
 		cb["versions"] = make([]interface{}, 0)
-		for _, ver := range versions {
+		for _, cv := range versions {
 			if !allVersions && nr >= numVersions {
 				break
 			}
-			cv := make(map[string]string)
-			cv["url"] = util.CustomURL(fmt.Sprintf("/cookbooks/%s/%s", name, ver))
-			cv["version"] = ver
 			cb["versions"] = append(cb["versions"].([]interface{}), cv)
 			nr++
 		}
@@ -596,9 +616,9 @@ func cookbookListerSQL(numResults interface{}) map[string]interface{} {
 func cookbookRecipesSQL() ([]string, util.Gerror) {
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT version, name, recipes FROM joined_cookbook_version ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
+		sqlStatement = "SELECT version, name, recipes FROM joined_cookbook_version WHERE id IN (SELECT id FROM cookbook_versions WHERE yanked = FALSE) ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT version, name, recipes FROM goiardi.joined_cookbook_version ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
+		sqlStatement = "SELECT version, name, recipes FROM goiardi.joined_cookbook_version WHERE id IN (SELECT id FROM goiardi.cookbook_versions WHERE yanked = FALSE) ORDER BY name, major_ver desc, minor_ver desc, patch_ver desc"
 	}
 	stmt, err := datastore.Dbh.Prepare(sqlStatement)
 
@@ -662,3 +682,129 @@ func cookbookRecipesSQL() ([]string, util.Gerror) {
 	sort.Strings(rlist)
 	return rlist, nil
 }
+
+/* Cookbook artifacts */
+
+func getArtifactSQL(name string, identifier string) (*CookbookArtifact, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT data FROM cookbook_artifacts WHERE name = ? AND identifier = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT data FROM goiardi.cookbook_artifacts WHERE name = $1 AND identifier = $2"
+	}
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	a := new(CookbookArtifact)
+	if err = a.fillArtifactFromSQL(stmt.QueryRow(name, identifier)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *CookbookArtifact) fillArtifactFromSQL(row datastore.ResRow) error {
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		return err
+	}
+	return datastore.DecodeBlob(data, a)
+}
+
+func (a *CookbookArtifact) saveArtifactSQL() error {
+	data, err := datastore.EncodeBlob(a)
+	if err != nil {
+		return err
+	}
+	if config.Config.UseMySQL {
+		return a.saveArtifactMySQL(data)
+	} else if config.Config.UsePostgreSQL {
+		return a.saveArtifactPostgreSQL(data)
+	}
+	return util.NoDBConfigured
+}
+
+func (a *CookbookArtifact) deleteArtifactSQL() error {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "DELETE FROM cookbook_artifacts WHERE name = ? AND identifier = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "DELETE FROM goiardi.cookbook_artifacts WHERE name = $1 AND identifier = $2"
+	}
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqlStmt, a.CookbookName, a.Identifier); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func artifactListSQL() (map[string][]string, error) {
+	list := make(map[string][]string)
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, identifier FROM cookbook_artifacts"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, identifier FROM goiardi.cookbook_artifacts"
+	}
+	rows, err := datastore.Dbh.Query(sqlStmt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return list, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, identifier string
+		if err = rows.Scan(&name, &identifier); err != nil {
+			return nil, err
+		}
+		list[name] = append(list[name], identifier)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func allArtifactsSQL(dbhandle datastore.Dbhandle) ([]*CookbookArtifact, error) {
+	if dbhandle == nil {
+		dbhandle = datastore.Dbh
+	}
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT data FROM cookbook_artifacts"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT data FROM goiardi.cookbook_artifacts"
+	}
+	stmt, err := dbhandle.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	var artifacts []*CookbookArtifact
+	for rows.Next() {
+		a := new(CookbookArtifact)
+		if err = a.fillArtifactFromSQL(rows); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+)
+
+// SetVersionStatus marks a version of the cookbook as deprecated or yanked, or
+// clears those marks. A deprecated version is only used when something pins
+// that exact version, and a yanked version is never used, but unlike deleting
+// them both stay available to anything that already has them.
+func (c *Cookbook) SetVersionStatus(cbVersion string, deprecated bool, yanked bool) (*CookbookVersion, util.Gerror) {
+	cbv, err := c.GetVersion(cbVersion)
+	if err != nil {
+		return nil, err
+	}
+	cbv.Deprecated = deprecated
+	cbv.Yanked = yanked
+	// Yanking or unyanking the latest version changes what's latest.
+	c.UpdateLatestVersion()
+	if config.UsingDB() {
+		if serr := cbv.updateStatusSQL(); serr != nil {
+			gerr := util.CastErr(serr)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		return cbv, nil
+	}
+	if serr := c.Save(); serr != nil {
+		gerr := util.CastErr(serr)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	return cbv, nil
+}
+
+// resolvable reports whether this version can be picked to satisfy the given
+// constraints. Yanked versions never can be, and deprecated versions only when
+// one of the constraints pins this exact version.
+func (cbv *CookbookVersion) resolvable(constraints []string) bool {
+	if cbv.Yanked {
+		return false
+	}
+	if !cbv.Deprecated {
+		return true
+	}
+	for _, constraint := range constraints {
+		op, ver, err := splitConstraint(constraint)
+		if err != nil {
+			continue
+		}
+		if op == "=" && verConstraintCheck(cbv.Version, ver, op) == "ok" {
+			return true
+		}
+	}
+	return false
+}
+
+// versionInfo is how a cookbook version appears in lists of cookbooks. The
+// deprecated and yanked flags are only there when they're set.
+func versionInfo(url string, version string, deprecated bool, yanked bool) map[string]interface{} {
+	cvInfo := map[string]interface{}{"url": url, "version": version}
+	if deprecated {
+		cvInfo["deprecated"] = true
+	}
+	if yanked {
+		cvInfo["yanked"] = true
+	}
+	return cvInfo
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"net/http"
+	"testing"
+)
+
+func statusCookbook() *Cookbook {
+	c := &Cookbook{Name: "status", Versions: make(map[string]*CookbookVersion)}
+	for _, v := range []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"} {
+		c.Versions[v] = &CookbookVersion{CookbookName: "status", Version: v}
+	}
+	c.Versions["2.0.0"].Yanked = true
+	c.Versions["1.2.0"].Deprecated = true
+	return c
+}
+
+func TestLatestConstrainedSkipsDeprecatedAndYanked(t *testing.T) {
+	c := statusCookbook()
+	tests := map[string]string{
+		"":         "1.1.0",
+		">= 1.0.0": "1.1.0",
+		"= 1.2.0":  "1.2.0",
+		"= 2.0.0":  "",
+		"~> 1.0":   "1.1.0",
+		"~> 1.2":   "",
+	}
+	for constraint, want := range tests {
+		var got string
+		if cbv := c.LatestConstrained(constraint); cbv != nil {
+			got = cbv.Version
+		}
+		if got != want {
+			t.Errorf("LatestConstrained(%q) gave %q, expected %q", constraint, got, want)
+		}
+	}
+}
+
+func TestSolverSkipsDeprecatedAndYanked(t *testing.T) {
+	c := statusCookbook()
+	s := newDepSolver(nil)
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		return c.sortedVersions(), nil
+	}
+	picked, err := s.solve([]string{"status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := picked["status"].Version; v != "1.1.0" {
+		t.Errorf("expected 1.1.0 to be picked, got %s", v)
+	}
+
+	s = newDepSolver(map[string]string{"status": "= 1.2.0"})
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		return c.sortedVersions(), nil
+	}
+	picked, err = s.solve([]string{"status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := picked["status"].Version; v != "1.2.0" {
+		t.Errorf("expected the pinned deprecated 1.2.0 to be picked, got %s", v)
+	}
+
+	s = newDepSolver(nil)
+	s.getVersions = func(name string) ([]*CookbookVersion, error) {
+		return c.sortedVersions(), nil
+	}
+	if _, err = s.solve([]string{"status@2.0.0"}); err == nil {
+		t.Errorf("a yanked version should never be picked, even when pinned")
+	}
+}
+
+func TestLatestVersionSkipsYanked(t *testing.T) {
+	c := statusCookbook()
+	if l := c.LatestVersion(); l == nil || l.Version != "1.2.0" {
+		t.Errorf("the latest version should have been 1.2.0, since 2.0.0 is yanked, got %v", l)
+	}
+	for _, cbv := range c.Versions {
+		cbv.Yanked = true
+	}
+	c.UpdateLatestVersion()
+	if l := c.LatestVersion(); l != nil {
+		t.Errorf("with every version yanked there should be no latest version, got %s", l.Version)
+	}
+	if _, err := c.GetVersion("_latest"); err == nil || err.Status() != http.StatusNotFound {
+		t.Errorf("_latest should have given %d with every version yanked, got %v", http.StatusNotFound, err)
+	}
+}
@@ -0,0 +1,436 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The parts of a cookbook that live in a directory of their own. Anything
+// else in a cookbook is a root file.
+var segmentDirs = map[string]bool{"definitions": true, "libraries": true, "attributes": true, "recipes": true, "providers": true, "resources": true, "templates": true, "files": true}
+
+// tarballMaxExpansion limits how much bigger than the upload itself the
+// contents of an uploaded tarball may be, so a small but very compressed
+// upload can't fill up memory.
+const tarballMaxExpansion = 10
+
+// cookbookFile is a file in a cookbook version, with where it goes in the
+// cookbook and the checksum of its contents in the filestore.
+type cookbookFile struct {
+	path     string
+	checksum string
+}
+
+// allFiles returns every file in the cookbook version, sorted by path.
+func (cbv *CookbookVersion) allFiles() []*cookbookFile {
+	seen := make(map[string]bool)
+	files := make([]*cookbookFile, 0)
+	for seg, items := range cbv.segments() {
+		for _, item := range items {
+			chksum, _ := item["checksum"].(string)
+			if chksum == "" {
+				continue
+			}
+			p, ok := itemPath(seg, item)
+			if !ok {
+				logger.Warningf("Skipping file with invalid path %s in cookbook %s version %s", p, cbv.CookbookName, cbv.Version)
+				continue
+			}
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			files = append(files, &cookbookFile{path: p, checksum: chksum})
+		}
+	}
+	sort.Sort(cookbookFiles(files))
+	return files
+}
+
+// segments returns the files in each part of the cookbook version.
+func (cbv *CookbookVersion) segments() map[string][]map[string]interface{} {
+	return map[string][]map[string]interface{}{
+		"definitions": cbv.Definitions,
+		"libraries":   cbv.Libraries,
+		"attributes":  cbv.Attributes,
+		"recipes":     cbv.Recipes,
+		"providers":   cbv.Providers,
+		"resources":   cbv.Resources,
+		"templates":   cbv.Templates,
+		"root_files":  cbv.RootFiles,
+		"files":       cbv.Files,
+	}
+}
+
+// itemPath returns the path of a file in a part of a cookbook. Files uploaded
+// by older knifes without a path are put in the directory for their part of
+// the cookbook. It also reports whether the path stays inside the cookbook;
+// versions saved before paths were checked on upload may have ones that
+// don't.
+func itemPath(seg string, item map[string]interface{}) (string, bool) {
+	p, _ := item["path"].(string)
+	if p == "" {
+		name, _ := item["name"].(string)
+		if !util.ValidateCookbookPath(name) {
+			return name, false
+		}
+		if seg == "root_files" {
+			p = name
+		} else {
+			p = path.Join(seg, name)
+		}
+	}
+	return path.Clean(p), util.ValidateCookbookPath(p)
+}
+
+type cookbookFiles []*cookbookFile
+
+func (cf cookbookFiles) Len() int           { return len(cf) }
+func (cf cookbookFiles) Swap(i, j int)      { cf[i], cf[j] = cf[j], cf[i] }
+func (cf cookbookFiles) Less(i, j int) bool { return cf[i].path < cf[j].path }
+
+// WriteTarball writes the cookbook version to w as a gzipped tarball, laid out
+// the way Supermarket and berks expect: everything is in a directory named
+// after the cookbook, with a metadata.json at the top. If the cookbook was
+// uploaded without a metadata.json, one is made from the version's metadata.
+func (cbv *CookbookVersion) WriteTarball(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	dirs := make(map[string]bool)
+
+	var addDirs func(dir string) error
+	addDirs = func(dir string) error {
+		if dir == "." || dir == "/" || dirs[dir] {
+			return nil
+		}
+		if err := addDirs(path.Dir(dir)); err != nil {
+			return err
+		}
+		dirs[dir] = true
+		hdr := &tar.Header{Name: dir + "/", Mode: 0755, ModTime: now, Typeflag: tar.TypeDir}
+		return tw.WriteHeader(hdr)
+	}
+	addFile := func(name string, size int64, data io.Reader) error {
+		name = path.Join(cbv.CookbookName, name)
+		if err := addDirs(path.Dir(name)); err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, data)
+		return err
+	}
+
+	haveMetadata := false
+	for _, f := range cbv.allFiles() {
+		fstore, err := filestore.Get(f.checksum)
+		if err != nil {
+			return fmt.Errorf("Cannot add %s to the tarball for %s %s: %s", f.path, cbv.CookbookName, cbv.Version, err.Error())
+		}
+		content, err := fstore.Open()
+		if err != nil {
+			return fmt.Errorf("Cannot add %s to the tarball for %s %s: %s", f.path, cbv.CookbookName, cbv.Version, err.Error())
+		}
+		if f.path == "metadata.json" {
+			haveMetadata = true
+		}
+		err = addFile(f.path, content.Size, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if !haveMetadata {
+		meta, err := json.MarshalIndent(cbv.Metadata, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = addFile("metadata.json", int64(len(meta)), bytes.NewReader(meta)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Tarball is an uploaded cookbook tarball that has been read and checked, but
+// whose files haven't been saved to the filestore yet. The files are spooled
+// to disk in the meantime; Close removes them.
+type Tarball struct {
+	Name     string
+	Version  string
+	metadata map[string]interface{}
+	prefix   string
+	files    map[string]*tarballFile
+	spool    string
+}
+
+// tarballFile is a file from an uploaded tarball, waiting in the spool
+// directory.
+type tarballFile struct {
+	spooled  string
+	checksum string
+	size     int64
+}
+
+// ReadTarball reads an uploaded gzipped cookbook tarball and gets the
+// cookbook's name and version from its metadata.json. The cookbook may either
+// be at the top of the tarball or in a single directory, like the tarballs
+// WriteTarball and Supermarket make. No file in the tarball may be bigger than
+// maxSize. Nothing is put in the filestore until Save is called, so a tarball
+// that turns out to be invalid, or for the wrong cookbook, leaves nothing
+// behind.
+func ReadTarball(r io.Reader, maxSize int64) (*Tarball, util.Gerror) {
+	spoolBase := ""
+	if blobs := filestore.Blobs(); blobs != nil {
+		spoolBase = blobs.TempDir()
+	}
+	spool, err := ioutil.TempDir(spoolBase, "cookbook-tarball")
+	if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	t := &Tarball{spool: spool, files: make(map[string]*tarballFile)}
+	if gerr := t.readFiles(r, maxSize); gerr != nil {
+		t.Close()
+		return nil, gerr
+	}
+	if gerr := t.readMetadata(); gerr != nil {
+		t.Close()
+		return nil, gerr
+	}
+	return t, nil
+}
+
+// readFiles spools the regular files in a gzipped tarball to disk, by their
+// cleaned up paths.
+func (t *Tarball) readFiles(r io.Reader, maxSize int64) util.Gerror {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return util.Errorf("Invalid cookbook tarball: %s", err.Error())
+	}
+	defer gz.Close()
+	// Allow for the expansion, but keep track of whether the limit was
+	// actually reached.
+	limit := &io.LimitedReader{R: gz, N: maxSize * tarballMaxExpansion}
+	tr := tar.NewReader(limit)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return tarballReadErr(limit, err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		p := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !util.ValidateCookbookPath(p) {
+			return util.Errorf("Invalid path %s in the cookbook tarball", hdr.Name)
+		}
+		// Skip the metadata files some tar programs scatter about.
+		if strings.HasPrefix(path.Base(p), "._") || strings.HasPrefix(p, "PaxHeader") {
+			continue
+		}
+		if hdr.Size > maxSize {
+			gerr := util.Errorf("%s in the cookbook tarball is too big", p)
+			gerr.SetStatus(http.StatusRequestEntityTooLarge)
+			return gerr
+		}
+		f, err := t.spoolFile(i, tr)
+		if err != nil {
+			return tarballReadErr(limit, err)
+		}
+		t.files[p] = f
+	}
+	return nil
+}
+
+func (t *Tarball) spoolFile(i int, r io.Reader) (*tarballFile, error) {
+	spooled := path.Join(t.spool, strconv.Itoa(i))
+	fp, err := os.Create(spooled)
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(fp, h), r)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tarballFile{spooled: spooled, checksum: fmt.Sprintf("%x", h.Sum(nil)), size: n}, nil
+}
+
+// readMetadata finds metadata.json, and with it where the cookbook is in the
+// tarball, and checks the cookbook's name and version.
+func (t *Tarball) readMetadata() util.Gerror {
+	if _, ok := t.files["metadata.json"]; !ok {
+		prefix := ""
+		for p := range t.files {
+			dir := strings.SplitN(p, "/", 2)[0] + "/"
+			if prefix != "" && dir != prefix {
+				prefix = ""
+				break
+			}
+			prefix = dir
+		}
+		if _, ok := t.files[prefix+"metadata.json"]; prefix == "" || !ok {
+			return util.Errorf("No metadata.json found in the cookbook tarball")
+		}
+		t.prefix = prefix
+	}
+
+	data, err := ioutil.ReadFile(t.files[t.prefix+"metadata.json"].spooled)
+	if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return gerr
+	}
+	var metadata map[string]interface{}
+	if jerr := json.Unmarshal(data, &metadata); jerr != nil {
+		return util.Errorf("Invalid metadata.json in the cookbook tarball: %s", jerr.Error())
+	}
+	name, _ := metadata["name"].(string)
+	if !util.ValidateName(name) {
+		return util.Errorf("Field 'metadata.name' invalid")
+	}
+	version, verr := util.ValidateAsVersion(metadata["version"])
+	if verr != nil || metadata["version"] == nil {
+		return util.Errorf("Field 'metadata.version' invalid")
+	}
+	t.Name = name
+	t.Version = version
+	t.metadata = metadata
+	return nil
+}
+
+// Save puts the files in the tarball in the filestore, and returns a cookbook
+// version manifest for them, ready to be saved like one uploaded by knife.
+func (t *Tarball) Save() (map[string]interface{}, util.Gerror) {
+	cbvData := map[string]interface{}{
+		"cookbook_name": t.Name,
+		"name":          fmt.Sprintf("%s-%s", t.Name, t.Version),
+		"version":       t.Version,
+		"json_class":    "Chef::CookbookVersion",
+		"chef_type":     "cookbook_version",
+		"frozen?":       false,
+		"metadata":      t.metadata,
+	}
+	paths := make([]string, 0, len(t.files))
+	for p := range t.files {
+		if strings.HasPrefix(p, t.prefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		f := t.files[p]
+		if err := f.store(); err != nil {
+			return nil, err
+		}
+		cbPath := strings.TrimPrefix(p, t.prefix)
+		seg, item := manifestItem(cbPath, f.checksum)
+		div, _ := cbvData[seg].([]interface{})
+		cbvData[seg] = append(div, item)
+	}
+	return cbvData, nil
+}
+
+// Close removes the tarball's spooled files.
+func (t *Tarball) Close() error {
+	return os.RemoveAll(t.spool)
+}
+
+func tarballReadErr(limit *io.LimitedReader, err error) util.Gerror {
+	if limit.N <= 0 {
+		gerr := util.Errorf("The contents of the cookbook tarball are too big")
+		gerr.SetStatus(http.StatusRequestEntityTooLarge)
+		return gerr
+	}
+	return util.Errorf("Invalid cookbook tarball: %s", err.Error())
+}
+
+func (f *tarballFile) store() util.Gerror {
+	if _, err := filestore.Get(f.checksum); err == nil {
+		return nil
+	}
+	fp, err := os.Open(f.spooled)
+	if err == nil {
+		var fstore *filestore.FileStore
+		fstore, err = filestore.New(f.checksum, fp, f.size)
+		fp.Close()
+		if err == nil {
+			err = fstore.Save()
+		}
+	}
+	if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return gerr
+	}
+	return nil
+}
+
+// manifestItem makes the manifest entry for a file in an uploaded cookbook,
+// returning it with the part of the cookbook it belongs in.
+func manifestItem(cbPath string, chksum string) (string, map[string]interface{}) {
+	parts := strings.Split(cbPath, "/")
+	seg := "root_files"
+	if len(parts) > 1 && segmentDirs[parts[0]] {
+		seg = parts[0]
+	}
+	// Templates and files can be specific to a host or platform, with
+	// the specificity being the directory under templates or files.
+	specificity := "default"
+	if (seg == "templates" || seg == "files") && len(parts) > 2 {
+		specificity = parts[1]
+	}
+	item := map[string]interface{}{
+		"name":        path.Base(cbPath),
+		"path":        cbPath,
+		"checksum":    chksum,
+		"specificity": specificity,
+	}
+	return seg, item
+}
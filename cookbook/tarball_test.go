@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cookbook
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"github.com/ctdk/goiardi/filestore"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func storeFile(t *testing.T, content string) string {
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	f, err := filestore.New(chksum, ioutil.NopCloser(bytes.NewBufferString(content)), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return chksum
+}
+
+func TestWriteTarball(t *testing.T) {
+	gob.Register(new(filestore.FileStore))
+	recipe := "package 'foo'\n"
+	cbv := &CookbookVersion{
+		CookbookName: "tarred",
+		Version:      "1.0.0",
+		Recipes:      []map[string]interface{}{{"name": "default.rb", "path": "recipes/default.rb", "checksum": storeFile(t, recipe)}},
+		Templates:    []map[string]interface{}{{"name": "foo.erb", "checksum": storeFile(t, "<%= @foo %>")}},
+		Metadata:     map[string]interface{}{"name": "tarred", "version": "1.0.0"},
+	}
+	var buf bytes.Buffer
+	if err := cbv.WriteTarball(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		contents[hdr.Name] = string(data)
+	}
+	if contents["tarred/recipes/default.rb"] != recipe {
+		t.Errorf("expected the recipe in the tarball, got %q", contents["tarred/recipes/default.rb"])
+	}
+	if _, ok := contents["tarred/templates/foo.erb"]; !ok {
+		t.Errorf("a file without a path should have gone in its segment's directory")
+	}
+	if _, ok := contents["tarred/metadata.json"]; !ok {
+		t.Errorf("metadata.json should have been made from the metadata")
+	}
+	if _, ok := contents["tarred/recipes/"]; !ok {
+		t.Errorf("expected directory entries in the tarball")
+	}
+}
+
+func TestWriteTarballSkipsEscapingPaths(t *testing.T) {
+	gob.Register(new(filestore.FileStore))
+	chksum := storeFile(t, "* * * * * root true\n")
+	cbv := &CookbookVersion{
+		CookbookName: "slippery",
+		Version:      "1.0.0",
+		Files: []map[string]interface{}{
+			{"name": "x", "path": "../../etc/cron.d/x", "checksum": chksum},
+			{"name": "y", "path": "/etc/cron.d/y", "checksum": chksum},
+			{"name": "../z", "checksum": chksum},
+		},
+		Metadata: map[string]interface{}{"name": "slippery", "version": "1.0.0"},
+	}
+	var buf bytes.Buffer
+	if err := cbv.WriteTarball(&buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "slippery/" && hdr.Name != "slippery/metadata.json" {
+			t.Errorf("%s should not have been written to the tarball", hdr.Name)
+		}
+	}
+}
+
+func TestReadTarball(t *testing.T) {
+	gob.Register(new(filestore.FileStore))
+	cbv := &CookbookVersion{
+		CookbookName: "untarred",
+		Version:      "1.2.0",
+		Recipes:      []map[string]interface{}{{"name": "default.rb", "path": "recipes/default.rb", "checksum": storeFile(t, "package 'bar'\n")}},
+		Templates:    []map[string]interface{}{{"name": "foo.erb", "path": "templates/ubuntu/foo.erb", "checksum": storeFile(t, "<%= @bar %>")}},
+		RootFiles:    []map[string]interface{}{{"name": "README.md", "path": "README.md", "checksum": storeFile(t, "# untarred\n")}},
+		Metadata:     map[string]interface{}{"name": "untarred", "version": "1.2.0"},
+	}
+	var buf bytes.Buffer
+	if err := cbv.WriteTarball(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tarball, err := ReadTarball(&buf, 1048576)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarball.Close()
+	if tarball.Name != "untarred" || tarball.Version != "1.2.0" {
+		t.Errorf("expected untarred 1.2.0, got %s %s", tarball.Name, tarball.Version)
+	}
+	cbvData, err := tarball.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := cbvData["templates"].([]interface{})
+	if len(templates) != 1 || templates[0].(map[string]interface{})["specificity"] != "ubuntu" {
+		t.Errorf("expected one ubuntu template, got %v", templates)
+	}
+	rootFiles, _ := cbvData["root_files"].([]interface{})
+	// metadata.json is a root file too.
+	if len(rootFiles) != 2 {
+		t.Errorf("expected two root files, got %v", rootFiles)
+	}
+	if _, ok := cbvData["recipes"]; !ok {
+		t.Errorf("expected the recipe in the manifest")
+	}
+
+	if _, err := ReadTarball(bytes.NewBufferString("not a tarball"), 1048576); err == nil {
+		t.Errorf("reading something that isn't a tarball should have failed")
+	}
+}
+
+func makeTarball(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadTarballStoresNothingUntilSaved(t *testing.T) {
+	gob.Register(new(filestore.FileStore))
+	recipe := "package 'unsaved'\n"
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(recipe)))
+
+	// A tarball with bad metadata is rejected before anything is stored.
+	bad := makeTarball(t, map[string]string{"unsaved/recipes/default.rb": recipe, "unsaved/metadata.json": `{"name": "unsaved"}`})
+	if _, err := ReadTarball(bad, 1048576); err == nil {
+		t.Errorf("reading a tarball without a version in its metadata should have failed")
+	}
+	if _, err := filestore.Get(chksum); err == nil {
+		t.Errorf("a file from a rejected tarball was put in the filestore")
+	}
+
+	// A good tarball still isn't stored until it's saved.
+	good := makeTarball(t, map[string]string{"unsaved/recipes/default.rb": recipe, "unsaved/metadata.json": `{"name": "unsaved", "version": "0.1.0"}`})
+	tarball, err := ReadTarball(good, 1048576)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarball.Close()
+	if tarball.Name != "unsaved" || tarball.Version != "0.1.0" {
+		t.Errorf("expected unsaved 0.1.0, got %s %s", tarball.Name, tarball.Version)
+	}
+	if _, err := filestore.Get(chksum); err == nil {
+		t.Errorf("a file from a tarball was put in the filestore before it was saved")
+	}
+	if _, err := tarball.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filestore.Get(chksum); err != nil {
+		t.Errorf("a file from a saved tarball was not put in the filestore: %s", err.Error())
+	}
+}
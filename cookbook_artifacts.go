@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cookbook artifacts, the cookbooks Policyfiles use.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+)
+
+func cookbookArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if opUser.IsValidator() || (r.Method != "GET" && !opUser.IsAdmin()) {
+		jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+		return
+	}
+
+	pathArray := splitPath(r.URL.Path)
+	pathArrayLen := len(pathArray)
+	var response interface{}
+
+	switch pathArrayLen {
+	case 1, 2:
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		list, lerr := cookbook.ArtifactList()
+		if lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		artifacts := make(map[string]interface{})
+		if pathArrayLen == 1 {
+			for name, ids := range list {
+				artifacts[name] = artifactListJSON(name, ids)
+			}
+		} else {
+			name := pathArray[1]
+			ids, ok := list[name]
+			if !ok {
+				jsonErrorReport(w, r, fmt.Sprintf("Cannot find a cookbook artifact named %s", name), http.StatusNotFound)
+				return
+			}
+			artifacts[name] = artifactListJSON(name, ids)
+		}
+		response = artifacts
+	case 3:
+		name := pathArray[1]
+		identifier := pathArray[2]
+		defer lockObject("cookbook_artifact", name)()
+		switch r.Method {
+		case "GET", "DELETE":
+			a, err := cookbook.GetArtifact(name, identifier)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if r.Method == "DELETE" {
+				if derr := a.Delete(); derr != nil {
+					jsonErrorReport(w, r, derr.Error(), http.StatusInternalServerError)
+					return
+				}
+				if lerr := loginfo.LogEvent(opUser, a, "delete"); lerr != nil {
+					jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			response = a.ToJSON()
+		case "PUT":
+			aData, jerr := parseObjJSON(r.Body)
+			if jerr != nil {
+				jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
+				return
+			}
+			a, err := cookbook.NewArtifact(name, identifier, aData)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = a.Save(); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, a, "create"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			response = a.ToJSON()
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func artifactListJSON(name string, ids []string) map[string]interface{} {
+	versions := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		versions[i] = map[string]string{
+			"url":        util.CustomURL(fmt.Sprintf("/cookbook_artifacts/%s/%s", name, id)),
+			"identifier": id,
+		}
+	}
+	return map[string]interface{}{
+		"url":      util.CustomURL(fmt.Sprintf("/cookbook_artifacts/%s", name)),
+		"versions": versions,
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Pruning old cookbook versions according to the retention rules.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/environment"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// A run list item with a version, like recipe[foo::bar@1.2.3].
+var versionedRunListItem = regexp.MustCompile(`^recipe\[([^\]:@]+)(?:::[^\]@]+)?@([^\]]+)\]$`)
+
+// Only one pruning runs at a time.
+var cookbookPruneLock sync.Mutex
+
+func cookbookRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+
+	var dryRun bool
+	switch r.Method {
+	case "GET":
+		dryRun = true
+	case "POST":
+		dryRun = false
+	default:
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+	pruned, err := pruneCookbooks(opUser, dryRun)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), err.Status())
+		return
+	}
+	response := map[string]interface{}{"dry_run": dryRun, "pruned": pruned}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// cookbookKeep returns how many of the latest versions of a cookbook to keep,
+// or 0 to keep them all.
+func cookbookKeep(name string) int {
+	if keep, ok := config.Config.CookbookKeep[name]; ok {
+		return keep
+	}
+	return config.Config.CookbookKeepVersions
+}
+
+// pruneCookbooks deletes the versions of each cookbook that its retention rule
+// doesn't keep, returning the versions deleted (or, with a dry run, that
+// would be deleted) by cookbook. Deleted versions go to the trash like any
+// other deleted cookbook version, and each deletion is logged as done by doer.
+func pruneCookbooks(doer actor.Actor, dryRun bool) (map[string][]string, util.Gerror) {
+	cookbookPruneLock.Lock()
+	defer cookbookPruneLock.Unlock()
+
+	pruned := make(map[string][]string)
+	protected := protectedCookbookVersions()
+	for _, cb := range cookbook.AllCookbooks() {
+		prune := cb.PruneCandidates(cookbookKeep(cb.Name), protected[cb.Name])
+		if len(prune) == 0 {
+			continue
+		}
+		pruned[cb.Name] = prune
+		if dryRun {
+			continue
+		}
+		for _, ver := range prune {
+			cbv, err := cb.GetVersion(ver)
+			if err != nil {
+				return nil, err
+			}
+			if err := cb.DeleteVersion(ver); err != nil {
+				return nil, err
+			}
+			if lerr := loginfo.LogEvent(doer, cbv, "delete"); lerr != nil {
+				gerr := util.CastErr(lerr)
+				gerr.SetStatus(http.StatusInternalServerError)
+				return nil, gerr
+			}
+		}
+		logger.Infof("Pruned %d old versions of cookbook %s", len(prune), cb.Name)
+	}
+	return pruned, nil
+}
+
+// protectedCookbookVersions finds the cookbook versions that have to be kept
+// no matter what, because an environment or node is using them: the versions
+// environments' cookbook constraints resolve to, versions given explicitly in
+// node and role run lists, and the versions nodes last ran with.
+func protectedCookbookVersions() map[string]map[string]bool {
+	protected := make(map[string]map[string]bool)
+	protect := func(name, version string) {
+		if protected[name] == nil {
+			protected[name] = make(map[string]bool)
+		}
+		protected[name][version] = true
+	}
+	protectRunList := func(runList []string) {
+		for _, item := range runList {
+			if m := versionedRunListItem.FindStringSubmatch(item); m != nil {
+				protect(m[1], m[2])
+			}
+		}
+	}
+
+	for _, env := range environment.AllEnvironments() {
+		for name, constraint := range env.CookbookVersions {
+			cb, err := cookbook.Get(name)
+			if err != nil {
+				continue
+			}
+			if cbv := cb.LatestConstrained(constraint); cbv != nil {
+				protect(name, cbv.Version)
+			}
+		}
+	}
+	for _, r := range role.AllRoles() {
+		protectRunList(r.RunList)
+		for _, rl := range r.EnvRunLists {
+			protectRunList(rl)
+		}
+	}
+	for _, n := range node.AllNodes() {
+		protectRunList(n.RunList)
+		// chef-client records the cookbook versions it used in the
+		// node's automatic attributes.
+		cbs, _ := n.Automatic["cookbooks"].(map[string]interface{})
+		for name, info := range cbs {
+			if i, ok := info.(map[string]interface{}); ok {
+				if ver, ok := i["version"].(string); ok {
+					protect(name, ver)
+				}
+			}
+		}
+	}
+	return protected
+}
+
+func setCookbookPruneTicker() {
+	if config.Config.CookbookPruneIntervalDur <= 0 {
+		return
+	}
+	// Standbys are read-only, and the versions the primary prunes are
+	// deleted from them when the deletions replicate.
+	runUnlessStandby(config.Config.CookbookPruneIntervalDur, func() {
+		// Scheduled prunings are logged as done by the server's own
+		// admin client.
+		doer, err := client.Get("chef-webui")
+		if err != nil {
+			logger.Errorf("Error pruning old cookbook versions: %s", err.Error())
+			return
+		}
+		if _, err := pruneCookbooks(doer, false); err != nil {
+			logger.Errorf("Error pruning old cookbook versions: %s", err.Error())
+		}
+	})
+}
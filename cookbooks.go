@@ -21,7 +21,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/util"
@@ -103,7 +105,7 @@ func cookbookHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else {
-			cb, err := cookbook.Get(cookbookName)
+			cb, err := cookbook.GetFrom(readDbh(r), cookbookName)
 			if err != nil {
 				jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 				return
@@ -120,6 +122,43 @@ func cookbookHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			cookbookResponse[cookbookName] = cb.InfoHash(numResults)
 		}
+	} else if pathArrayLen == 3 && pathArray[2] == "_diff" {
+		/* what changed between two versions of a cookbook */
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		if opUser.IsValidator() {
+			jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+			return
+		}
+		from := r.FormValue("from")
+		to := r.FormValue("to")
+		if from == "" || to == "" {
+			jsonErrorReport(w, r, "Both 'from' and 'to' versions must be given", http.StatusBadRequest)
+			return
+		}
+		cb, err := cookbook.GetFrom(readDbh(r), pathArray[1])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		fromCbv, err := cb.GetVersion(from)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		toCbv, err := cb.GetVersion(to)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		diff := cookbook.DiffVersions(fromCbv, toCbv)
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(&diff); err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		}
+		return
 	} else if pathArrayLen == 3 {
 		/* get information about or manipulate a specific cookbook
 		 * version */
@@ -147,7 +186,7 @@ func cookbookHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 				return
 			}
-			cb, err := cookbook.Get(cookbookName)
+			cb, err := cookbook.GetFrom(readDbh(r), cookbookName)
 			if err != nil {
 				if err.Status() == http.StatusNotFound {
 					msg := fmt.Sprintf("Cannot find a cookbook named %s with version %s", cookbookName, cookbookVersion)
@@ -221,97 +260,137 @@ func cookbookHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
 				return
 			}
-			/* First, see if the cookbook already exists, &
-			 * if not create it. Second, see if this
-			 * specific version of the cookbook exists. If
-			 * so, update it, otherwise, create it and set
-			 * the latest version as needed. */
-			cb, err := cookbook.Get(cookbookName)
-			if err != nil {
-				cb, err = cookbook.New(cookbookName)
-				if err != nil {
-					jsonErrorReport(w, r, err.Error(), err.Status())
-					return
-				}
-				/* save it so we get the id with mysql
-				 * for creating versions & such */
-				serr := cb.Save()
-				if serr != nil {
-					jsonErrorReport(w, r, serr.Error(), http.StatusInternalServerError)
-					return
-				}
-				if lerr := loginfo.LogEvent(opUser, cb, "create"); lerr != nil {
-					jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
-					return
-				}
+			cbv, ok := saveCookbookVersion(w, r, opUser, cookbookName, cookbookVersion, cbvData, force)
+			if !ok {
+				return
 			}
-			cbv, err := cb.GetVersion(cookbookVersion)
-
-			/* Does the cookbook_name in the URL and what's
-			 * in the body match? */
-			switch t := cbvData["cookbook_name"].(type) {
-			case string:
-				/* Only send this particular
-				 * error if the cookbook version
-				 * hasn't been created yet.
-				 * Instead we want a slightly
-				 * different version later. */
-				if t != cookbookName && cbv == nil {
-					terr := util.Errorf("Field 'name' invalid")
-					jsonErrorReport(w, r, terr.Error(), terr.Status())
-					return
-				}
-			default:
-				// rather unlikely, I think, to
-				// be able to get here past the
-				// cookbook get. Punk out and
-				// don't do anything
-
+			/* API docs are wrong. The docs claim that this
+			 * should have no response body, but in fact it
+			 * wants some (not all) of the cookbook version
+			 * data. */
+			cookbookResponse = cbv.ToJSON(r.Method)
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	} else if pathArrayLen == 4 && pathArray[3] == "_tarball" {
+		/* the whole cookbook version in one tarball */
+		switch r.Method {
+		case "GET", "HEAD":
+			if opUser.IsValidator() {
+				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+				return
 			}
-			if err != nil {
-				var nerr util.Gerror
-				cbv, nerr = cb.NewVersion(cookbookVersion, cbvData)
-				if nerr != nil {
-					// If the new version failed to
-					// take, and there aren't any
-					// other versions of the cookbook
-					// it needs to be deleted.
-					if cb.NumVersions() == 0 {
-						cb.Delete()
-					}
-					jsonErrorReport(w, r, nerr.Error(), nerr.Status())
-					return
-				}
-				if lerr := loginfo.LogEvent(opUser, cbv, "create"); lerr != nil {
-					jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
-					return
-				}
-				w.WriteHeader(http.StatusCreated)
-			} else {
-				err := cbv.UpdateVersion(cbvData, force)
-				if err != nil {
-					jsonErrorReport(w, r, err.Error(), err.Status())
+			cookbookTarball(w, r, pathArray[1], pathArray[2])
+			return
+		case "PUT":
+			if !opUser.IsAdmin() {
+				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+				return
+			}
+			cookbookName := pathArray[1]
+			cookbookVersion, vererr := util.ValidateAsVersion(pathArray[2])
+			if vererr != nil {
+				vererr = util.Errorf("Invalid cookbook version '%s'.", pathArray[2])
+				jsonErrorReport(w, r, vererr.Error(), vererr.Status())
+				return
+			}
+			body := http.MaxBytesReader(w, r.Body, config.Config.ObjMaxSize)
+			tarball, terr := cookbook.ReadTarball(body, config.Config.ObjMaxSize)
+			if terr != nil {
+				jsonErrorReport(w, r, terr.Error(), terr.Status())
+				return
+			}
+			defer tarball.Close()
+			if tarball.Name != cookbookName {
+				jsonErrorReport(w, r, fmt.Sprintf("The cookbook in the tarball is %s, not %s", tarball.Name, cookbookName), http.StatusBadRequest)
+				return
+			}
+			if tarball.Version != cookbookVersion {
+				jsonErrorReport(w, r, fmt.Sprintf("The cookbook in the tarball is version %s, not %s", tarball.Version, cookbookVersion), http.StatusBadRequest)
+				return
+			}
+			cbvData, terr := tarball.Save()
+			if terr != nil {
+				jsonErrorReport(w, r, terr.Error(), terr.Status())
+				return
+			}
+			cbv, ok := saveCookbookVersion(w, r, opUser, cookbookName, cookbookVersion, cbvData, force)
+			if !ok {
+				return
+			}
+			cookbookResponse = cbv.ToJSON(r.Method)
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	} else if pathArrayLen == 4 && pathArray[3] == "_status" {
+		/* whether the cookbook version is deprecated or yanked */
+		if opUser.IsValidator() {
+			jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+			return
+		}
+		cookbookName := pathArray[1]
+		cookbookVersion, vererr := util.ValidateAsVersion(pathArray[2])
+		if vererr != nil {
+			vererr = util.Errorf("Invalid cookbook version '%s'.", pathArray[2])
+			jsonErrorReport(w, r, vererr.Error(), vererr.Status())
+			return
+		}
+		cb, err := cookbook.Get(cookbookName)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		cbv, err := cb.GetVersion(cookbookVersion)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			if !opUser.IsAdmin() {
+				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+				return
+			}
+			statusData, jerr := parseObjJSON(r.Body)
+			if jerr != nil {
+				jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
+				return
+			}
+			deprecated := cbv.Deprecated
+			yanked := cbv.Yanked
+			for k, v := range statusData {
+				if k != "deprecated" && k != "yanked" {
+					jsonErrorReport(w, r, fmt.Sprintf("Invalid key %s in request body", k), http.StatusBadRequest)
 					return
 				}
-				gerr := cb.Save()
-				if gerr != nil {
-					jsonErrorReport(w, r, gerr.Error(), http.StatusInternalServerError)
+				b, ok := v.(bool)
+				if !ok {
+					jsonErrorReport(w, r, fmt.Sprintf("Field '%s' invalid", k), http.StatusBadRequest)
 					return
 				}
-				if lerr := loginfo.LogEvent(opUser, cbv, "modify"); lerr != nil {
-					jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
-					return
+				if k == "deprecated" {
+					deprecated = b
+				} else {
+					yanked = b
 				}
 			}
-			/* API docs are wrong. The docs claim that this
-			 * should have no response body, but in fact it
-			 * wants some (not all) of the cookbook version
-			 * data. */
-			cookbookResponse = cbv.ToJSON(r.Method)
+			if cbv, err = cb.SetVersionStatus(cookbookVersion, deprecated, yanked); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, cbv, "modify"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
 		default:
 			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
 			return
 		}
+		cookbookResponse["deprecated"] = cbv.Deprecated
+		cookbookResponse["yanked"] = cbv.Yanked
 	} else {
 		/* Say what? Bad request. */
 		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
@@ -323,3 +402,152 @@ func cookbookHandler(w http.ResponseWriter, r *http.Request) {
 		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// saveCookbookVersion creates or updates a version of a cookbook from an
+// uploaded manifest, creating the cookbook first if need be. Any error is
+// reported to the client, and false returned.
+func saveCookbookVersion(w http.ResponseWriter, r *http.Request, opUser actor.Actor, cookbookName string, cookbookVersion string, cbvData map[string]interface{}, force string) (*cookbook.CookbookVersion, bool) {
+	/* First, see if the cookbook already exists, & if not create it.
+	 * Second, see if this specific version of the cookbook exists. If so,
+	 * update it, otherwise, create it and set the latest version as
+	 * needed. */
+	cb, err := cookbook.Get(cookbookName)
+	if err != nil {
+		cb, err = cookbook.New(cookbookName)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return nil, false
+		}
+		/* save it so we get the id with mysql for creating versions
+		 * & such */
+		serr := cb.Save()
+		if serr != nil {
+			jsonErrorReport(w, r, serr.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		if lerr := loginfo.LogEvent(opUser, cb, "create"); lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	cbv, err := cb.GetVersion(cookbookVersion)
+
+	/* Does the cookbook_name in the URL and what's in the body match? */
+	switch t := cbvData["cookbook_name"].(type) {
+	case string:
+		/* Only send this particular error if the cookbook version
+		 * hasn't been created yet. Instead we want a slightly
+		 * different version later. */
+		if t != cookbookName && cbv == nil {
+			terr := util.Errorf("Field 'name' invalid")
+			jsonErrorReport(w, r, terr.Error(), terr.Status())
+			return nil, false
+		}
+	default:
+		// rather unlikely, I think, to be able to get here past the
+		// cookbook get. Punk out and don't do anything
+
+	}
+	if err != nil {
+		var nerr util.Gerror
+		cbv, nerr = cb.NewVersion(cookbookVersion, cbvData)
+		if nerr != nil {
+			// If the new version failed to take, and there aren't
+			// any other versions of the cookbook it needs to be
+			// deleted.
+			if cb.NumVersions() == 0 {
+				cb.Delete()
+			}
+			jsonErrorReport(w, r, nerr.Error(), nerr.Status())
+			return nil, false
+		}
+		if lerr := loginfo.LogEvent(opUser, cbv, "create"); lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		err := cbv.UpdateVersion(cbvData, force)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return nil, false
+		}
+		gerr := cb.Save()
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		if lerr := loginfo.LogEvent(opUser, cbv, "modify"); lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	return cbv, true
+}
+
+// cookbookTarball streams a gzipped tarball of a cookbook version, made from
+// the filestore as it goes.
+func cookbookTarball(w http.ResponseWriter, r *http.Request, cookbookName string, cookbookVersion string) {
+	if cookbookVersion != "_latest" {
+		if _, vererr := util.ValidateAsVersion(cookbookVersion); vererr != nil {
+			vererr = util.Errorf("Invalid cookbook version '%s'.", cookbookVersion)
+			jsonErrorReport(w, r, vererr.Error(), vererr.Status())
+			return
+		}
+	}
+	cb, err := cookbook.GetFrom(readDbh(r), cookbookName)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), err.Status())
+		return
+	}
+	cbv, err := cb.GetVersion(cookbookVersion)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	streamTarball(w, r, cbv)
+}
+
+// streamTarball sends a gzipped tarball of a cookbook version, made from the
+// filestore as it's written out.
+func streamTarball(w http.ResponseWriter, r *http.Request, cbv *cookbook.CookbookVersion) {
+	tw := &tarballWriter{w: w, filename: fmt.Sprintf("%s-%s.tar.gz", cbv.CookbookName, cbv.Version)}
+	if r.Method == "HEAD" {
+		tw.writeHeader()
+		return
+	}
+	if terr := cbv.WriteTarball(tw); terr != nil {
+		if !tw.started {
+			jsonErrorReport(w, r, terr.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Part of the tarball's already gone out, so all that can be
+		// done is to cut the connection off so the client doesn't
+		// mistake what it got for the whole thing.
+		logger.Errorf("Error streaming tarball for %s %s: %s", cbv.CookbookName, cbv.Version, terr.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// tarballWriter holds off sending the response headers until the tarball
+// actually starts being written, so a file that can't be found before then
+// can still be reported as an error.
+type tarballWriter struct {
+	w        http.ResponseWriter
+	filename string
+	started  bool
+}
+
+func (t *tarballWriter) writeHeader() {
+	t.w.Header().Set("Content-Type", "application/x-gzip")
+	t.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", t.filename))
+	t.w.WriteHeader(http.StatusOK)
+	t.started = true
+}
+
+func (t *tarballWriter) Write(p []byte) (int, error) {
+	if !t.started {
+		t.writeHeader()
+	}
+	return t.w.Write(p)
+}
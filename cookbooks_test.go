@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func makeTestCookbookVersion(t *testing.T, cb *cookbook.Cookbook, version string, recipeChksum string) {
+	cbvData := map[string]interface{}{
+		"cookbook_name": cb.Name,
+		"name":          cb.Name + "-" + version,
+		"version":       version,
+		"json_class":    "Chef::CookbookVersion",
+		"chef_type":     "cookbook_version",
+		"frozen?":       false,
+		"metadata":      map[string]interface{}{"name": cb.Name, "version": version},
+		"recipes":       []interface{}{map[string]interface{}{"name": "default.rb", "path": "recipes/default.rb", "checksum": recipeChksum, "specificity": "default"}},
+	}
+	if _, err := cb.NewVersion(version, cbvData); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestTarball returns the regular files in a gzipped tarball, by path.
+func readTestTarball(t *testing.T, r io.Reader) map[string]string {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("the download wasn't gzipped: %s", err.Error())
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("the download wasn't a valid tarball: %s", err.Error())
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+	return files
+}
+
+func TestCookbookTarballDownload(t *testing.T) {
+	gobOnce.Do(gobRegister)
+	oldRecipe := "package 'tarball-old'\n"
+	newRecipe := "package 'tarball-new'\n"
+	cb, err := cookbook.New("tardl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	makeTestCookbookVersion(t, cb, "1.0.0", uploadTestFile(t, oldRecipe))
+	makeTestCookbookVersion(t, cb, "1.1.0", uploadTestFile(t, newRecipe))
+
+	w := httptest.NewRecorder()
+	cookbookTarball(w, httptest.NewRequest("GET", "/cookbooks/tardl/1.0.0/_tarball", nil), "tardl", "1.0.0")
+	if w.Code != http.StatusOK {
+		t.Fatalf("downloading the tarball should have given %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-gzip" {
+		t.Errorf("the tarball's content type should have been application/x-gzip, got %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="tardl-1.0.0.tar.gz"` {
+		t.Errorf("unexpected content disposition %s", cd)
+	}
+	files := readTestTarball(t, w.Body)
+	if files["tardl/recipes/default.rb"] != oldRecipe {
+		t.Errorf("the recipe in the tarball should have been %q, got %q", oldRecipe, files["tardl/recipes/default.rb"])
+	}
+	if _, ok := files["tardl/metadata.json"]; !ok {
+		t.Errorf("the tarball should have had a metadata.json")
+	}
+
+	// _latest gets the newest version.
+	w = httptest.NewRecorder()
+	cookbookTarball(w, httptest.NewRequest("GET", "/cookbooks/tardl/_latest/_tarball", nil), "tardl", "_latest")
+	if w.Code != http.StatusOK {
+		t.Fatalf("downloading the latest tarball should have given %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if files = readTestTarball(t, w.Body); files["tardl/recipes/default.rb"] != newRecipe {
+		t.Errorf("the latest tarball should have had the 1.1.0 recipe, got %q", files["tardl/recipes/default.rb"])
+	}
+
+	// HEAD only sends the headers.
+	w = httptest.NewRecorder()
+	cookbookTarball(w, httptest.NewRequest("HEAD", "/cookbooks/tardl/1.0.0/_tarball", nil), "tardl", "1.0.0")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-gzip" {
+		t.Errorf("HEAD should have given %d with the tarball's headers, got %d and %v", http.StatusOK, w.Code, w.Header())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("HEAD should not have sent a body, but sent %d bytes", w.Body.Len())
+	}
+}
+
+func TestCookbookTarballErrors(t *testing.T) {
+	gobOnce.Do(gobRegister)
+	cb, err := cookbook.New("tarerr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// The broken version would trip up anything else reading every
+	// cookbook, like the export tests.
+	defer cb.Delete()
+	makeTestCookbookVersion(t, cb, "1.0.0", uploadTestFile(t, "package 'tarball-errors'\n"))
+	// A version whose file has gone missing from the filestore.
+	lost := uploadTestFile(t, "package 'tarball-lost'\n")
+	makeTestCookbookVersion(t, cb, "2.0.0", lost)
+	f, ferr := filestore.Get(lost)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+	if ferr = f.Delete(); ferr != nil {
+		t.Fatal(ferr)
+	}
+
+	reqs := []struct {
+		name    string
+		version string
+		status  int
+	}{
+		{"tarerr", "3.0.0", http.StatusNotFound},
+		{"nosuchcookbook", "1.0.0", http.StatusNotFound},
+		{"tarerr", "not-a-version", http.StatusBadRequest},
+		{"tarerr", "2.0.0", http.StatusInternalServerError},
+	}
+	for _, q := range reqs {
+		w := httptest.NewRecorder()
+		cookbookTarball(w, httptest.NewRequest("GET", "/cookbooks/"+q.name+"/"+q.version+"/_tarball", nil), q.name, q.version)
+		if w.Code != q.status {
+			t.Errorf("downloading %s %s should have given %d, got %d", q.name, q.version, q.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct == "application/x-gzip" {
+			t.Errorf("a failed download of %s %s should not have been sent as a tarball", q.name, q.version)
+		}
+	}
+}
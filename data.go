@@ -106,6 +106,11 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		dbName := pathArray[1]
 
+		if len(pathArray) > 3 && pathArray[3] == "_revisions" {
+			revisionHandler(w, r, opUser, "data_bag_item", fmt.Sprintf("%s/%s", dbName, pathArray[2]), pathArray[4:])
+			return
+		}
+
 		/* chef-pedant is unhappy about not reporting the HTTP status
 		 * as 404 by fetching the data bag before we see if the method
 		 * is allowed, so do a quick check for that here. */
@@ -224,6 +229,9 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 					jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 					return
 				}
+				if notModified(w, r, dbi.RawData) {
+					return
+				}
 				dbResponse = dbi.RawData
 			case "DELETE":
 				dbi, err := chefDbag.GetDBItem(dbItemName)
@@ -261,9 +269,18 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 						return
 					}
 				}
-				dbitem, err := chefDbag.UpdateDBItem(dbItemName, rawData)
+				defer lockObject("data_bag_item", chefDbag.Name+"/"+dbItemName)()
+				curItem, err := chefDbag.GetDBItem(dbItemName)
 				if err != nil {
-					jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+					jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
+					return
+				}
+				if preconditionFailed(w, r, curItem.RawData) {
+					return
+				}
+				dbitem, err := chefDbag.UpdateDBItemIfMatch(dbItemName, rawData, r.Header.Get("If-Match"))
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), saveErrorStatus(err))
 					return
 				}
 				if lerr := loginfo.LogEvent(opUser, dbitem, "modify"); lerr != nil {
@@ -278,6 +295,7 @@ func dataHandler(w http.ResponseWriter, r *http.Request) {
 				dbResponse["data_bag"] = dbitem.DataBagName
 				dbResponse["chef_type"] = dbitem.ChefType
 				dbResponse["id"] = dbItemName
+				setETag(w, dbitem.RawData)
 			default:
 				w.Header().Set("Allow", "GET, DELETE, PUT")
 				jsonErrorReport(w, r, "GET, DELETE, PUT", http.StatusMethodNotAllowed)
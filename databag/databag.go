@@ -28,6 +28,8 @@ import (
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/revision"
+	"github.com/ctdk/goiardi/trash"
 	"github.com/ctdk/goiardi/util"
 	"io"
 	"net/http"
@@ -143,10 +145,22 @@ func (db *DataBag) Save() error {
 // Delete a data bag.
 func (db *DataBag) Delete() error {
 	if config.UsingDB() {
-		err := db.deleteSQL()
+		// The items go along with the data bag in the database,
+		// rather than being deleted one at a time, so they need to
+		// go in the trash and have their last revisions recorded
+		// here.
+		dbis, err := db.AllDBItems()
 		if err != nil {
 			return err
 		}
+		err = db.deleteSQL()
+		if err != nil {
+			return err
+		}
+		for dbiID, dbi := range dbis {
+			dbi.addToTrash(dbiID)
+			dbi.recordRevision(dbiID, revision.ActionDelete)
+		}
 	} else {
 		ds := datastore.New()
 		/* be thorough, and remove DBItems too */
@@ -256,12 +270,21 @@ func (db *DataBag) NewDBItem(rawDbagItem map[string]interface{}) (*DataBagItem,
 		gerr.SetStatus(http.StatusInternalServerError)
 		return nil, gerr
 	}
+	dbagItem.recordRevision(dbiID, revision.ActionSave)
 	indexer.IndexObj(dbagItem)
 	return dbagItem, nil
 }
 
 // UpdateDBItem updates a data bag item in this data bag.
 func (db *DataBag) UpdateDBItem(dbiID string, rawDbagItem map[string]interface{}) (*DataBagItem, error) {
+	return db.UpdateDBItemIfMatch(dbiID, rawDbagItem, "")
+}
+
+// UpdateDBItemIfMatch updates a data bag item like UpdateDBItem, but with an
+// SQL backend first checks the item's data in the database against an
+// If-Match header while holding a lock on it, and fails with a 412 if it's
+// changed.
+func (db *DataBag) UpdateDBItemIfMatch(dbiID string, rawDbagItem map[string]interface{}, ifMatch string) (*DataBagItem, error) {
 	dbItem, err := db.GetDBItem(dbiID)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -271,7 +294,7 @@ func (db *DataBag) UpdateDBItem(dbiID string, rawDbagItem map[string]interface{}
 	}
 	dbItem.RawData = rawDbagItem
 	if config.UsingDB() {
-		err = dbItem.updateDBItemSQL()
+		err = dbItem.updateDBItemSQL(ifMatch)
 		if err != nil {
 			return nil, err
 		}
@@ -282,17 +305,18 @@ func (db *DataBag) UpdateDBItem(dbiID string, rawDbagItem map[string]interface{}
 	if err != nil {
 		return nil, err
 	}
+	dbItem.recordRevision(dbiID, revision.ActionSave)
 	indexer.IndexObj(dbItem)
 	return dbItem, nil
 }
 
 // DeleteDBItem deletes a data bag item.
 func (db *DataBag) DeleteDBItem(dbItemName string) error {
+	dbi, err := db.GetDBItem(dbItemName)
+	if err != nil {
+		return err
+	}
 	if config.UsingDB() {
-		dbi, err := db.GetDBItem(dbItemName)
-		if err != nil {
-			return err
-		}
 		err = dbi.deleteDBItemSQL()
 		if err != nil {
 			return err
@@ -300,14 +324,34 @@ func (db *DataBag) DeleteDBItem(dbItemName string) error {
 	} else {
 		delete(db.DataBagItems, dbItemName)
 	}
-	err := db.Save()
+	err = db.Save()
 	if err != nil {
 		return err
 	}
+	dbi.addToTrash(dbItemName)
+	dbi.recordRevision(dbItemName, revision.ActionDelete)
 	indexer.DeleteItemFromCollection(db.Name, dbItemName)
 	return nil
 }
 
+// recordRevision records a revision of the data bag item's data. Items are
+// identified by their data bag and id, like "bag/item".
+func (dbi *DataBagItem) recordRevision(dbiID string, action string) {
+	name := fmt.Sprintf("%s/%s", dbi.DataBagName, dbiID)
+	if err := revision.Record("data_bag_item", name, action, dbi.RawData); err != nil {
+		logger.Errorf("Error recording revision of data bag item %s: %s", name, err.Error())
+	}
+}
+
+// addToTrash puts a copy of the data bag item in the trash once it's been
+// deleted.
+func (dbi *DataBagItem) addToTrash(dbiID string) {
+	name := fmt.Sprintf("%s/%s", dbi.DataBagName, dbiID)
+	if err := trash.Add("data_bag_item", name, dbi.RawData); err != nil {
+		logger.Errorf("Error putting data bag item %s in the trash: %s", name, err.Error())
+	}
+}
+
 // GetDBItem gets a data bag item.
 func (db *DataBag) GetDBItem(dbItemName string) (*DataBagItem, error) {
 	if config.UsingDB() {
@@ -328,7 +372,7 @@ func (db *DataBag) GetDBItem(dbItemName string) (*DataBagItem, error) {
 // AllDBItems returns a map of all the items in a data bag.
 func (db *DataBag) AllDBItems() (map[string]*DataBagItem, error) {
 	if config.UsingDB() {
-		return db.allDBItemsSQL()
+		return db.allDBItemsSQL(datastore.Dbh)
 	}
 	return db.DataBagItems, nil
 }
@@ -429,9 +473,21 @@ func (dbi *DataBagItem) Flatten() []string {
 
 // AllDataBags returns all data bags on this server, and all their items.
 func AllDataBags() []*DataBag {
+	dataBags, err := AllDataBagsTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all data bags: %s", err.Error())
+	}
+	return dataBags
+}
+
+// AllDataBagsTx returns all data bags on this server and their items like
+// AllDataBags, but with an SQL backend reads them through the given db handle.
+// Pass in a transaction to read the data bags as part of a consistent
+// snapshot.
+func AllDataBagsTx(tx datastore.Dbhandle) ([]*DataBag, error) {
 	var dataBags []*DataBag
 	if config.UsingDB() {
-		dataBags = allDataBagsSQL()
+		return allDataBagsSQL(tx)
 	} else {
 		dbagList := GetList()
 		for _, d := range dbagList {
@@ -442,5 +498,5 @@ func AllDataBags() []*DataBag {
 			dataBags = append(dataBags, db)
 		}
 	}
-	return dataBags
+	return dataBags, nil
 }
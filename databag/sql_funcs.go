@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
 	"log"
 )
 
@@ -94,7 +95,36 @@ func (db *DataBag) getDBItemSQL(dbItemName string) (*DataBagItem, error) {
 	return dbi, nil
 }
 
-func (dbi *DataBagItem) updateDBItemSQL() error {
+// checkETagSQL locks the data bag item's row until the transaction is over,
+// and makes sure its data still matches the If-Match header.
+func (dbi *DataBagItem) checkETagSQL(tx datastore.Dbhandle, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT raw_data FROM data_bag_items WHERE id = ? FOR UPDATE"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT raw_data FROM goiardi.data_bag_items WHERE id = $1 FOR UPDATE"
+	}
+	var rawb []byte
+	err := tx.QueryRow(sqlStatement, dbi.id).Scan(&rawb)
+	if err == sql.ErrNoRows {
+		return util.ETagMismatch()
+	} else if err != nil {
+		return err
+	}
+	var cur map[string]interface{}
+	if err = datastore.DecodeBlob(rawb, &cur); err != nil {
+		return err
+	}
+	if gerr := util.CheckETag(ifMatch, cur); gerr != nil {
+		return gerr
+	}
+	return nil
+}
+
+func (dbi *DataBagItem) updateDBItemSQL(ifMatch string) error {
 	rawb, rawerr := datastore.EncodeBlob(&dbi.RawData)
 	if rawerr != nil {
 		return rawerr
@@ -103,6 +133,10 @@ func (dbi *DataBagItem) updateDBItemSQL() error {
 	if err != nil {
 		return err
 	}
+	if err = dbi.checkETagSQL(tx, ifMatch); err != nil {
+		tx.Rollback()
+		return err
+	}
 	if config.Config.UseMySQL {
 		_, err = tx.Exec("UPDATE data_bag_items SET raw_data = ?, updated_at = NOW() WHERE id = ?", rawb, dbi.id)
 	} else if config.Config.UsePostgreSQL {
@@ -140,7 +174,7 @@ func (dbi *DataBagItem) deleteDBItemSQL() error {
 	return nil
 }
 
-func (db *DataBag) allDBItemsSQL() (map[string]*DataBagItem, error) {
+func (db *DataBag) allDBItemsSQL(dbhandle datastore.Dbhandle) (map[string]*DataBagItem, error) {
 	dbis := make(map[string]*DataBagItem)
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -148,7 +182,7 @@ func (db *DataBag) allDBItemsSQL() (map[string]*DataBagItem, error) {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT dbi.id, dbi.data_bag_id, dbi.name, dbi.orig_name, db.name, dbi.raw_data FROM goiardi.data_bag_items dbi JOIN goiardi.data_bags db on dbi.data_bag_id = db.id WHERE dbi.data_bag_id = $1"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
 		return nil, err
 	}
@@ -307,7 +341,7 @@ func getListSQL() []string {
 
 	return dbList
 }
-func allDataBagsSQL() []*DataBag {
+func allDataBagsSQL(dbhandle datastore.Dbhandle) ([]*DataBag, error) {
 	var dbags []*DataBag
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -315,33 +349,35 @@ func allDataBagsSQL() []*DataBag {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT id, name FROM goiardi.data_bags"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, err := stmt.Query()
 	if err != nil {
 		if err != sql.ErrNoRows {
-			log.Fatal(err)
+			return nil, err
 		}
-		return dbags
+		return dbags, nil
 	}
 	for rows.Next() {
 		dataBag := new(DataBag)
 		err = rows.Scan(&dataBag.id, &dataBag.Name)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
-		dataBag.DataBagItems, err = dataBag.allDBItemsSQL()
+		dataBag.DataBagItems, err = dataBag.allDBItemsSQL(dbhandle)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		dbags = append(dbags, dataBag)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return dbags
+	return dbags, nil
 }
@@ -26,12 +26,18 @@ argument that specifies what kind of object it is.
 package datastore
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/pmylund/go-cache"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -40,6 +46,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DataStore is the main data store struct, holding the key/value store and list
@@ -48,6 +55,9 @@ type DataStore struct {
 	dsc     *cache.Cache
 	objList map[string]map[string]bool
 	m       sync.RWMutex
+	// wm is held for reading by anything changing the data store, and for
+	// writing while a consistent snapshot of the data store is being read.
+	wm sync.RWMutex
 }
 
 type dsFileStore struct {
@@ -83,16 +93,20 @@ func (ds *DataStore) makeKey(keyType string, key string) string {
 // Set a value of the given type with the provided key.
 func (ds *DataStore) Set(keyType string, key string, val interface{}) {
 	dsKey := ds.makeKey(keyType, key)
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	if config.Config.UseUnsafeMemStore {
 		ds.dsc.Set(dsKey, val, -1)
+		journalSet(keyType, key, val, true, false)
 	} else {
 		valBytes, err := encodeSafeVal(val)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		ds.dsc.Set(dsKey, valBytes, -1)
+		journalSet(keyType, key, valBytes, true, false)
 	}
 	ds.addToList(keyType, key)
 }
@@ -152,10 +166,25 @@ func decodeSafeVal(valEnc interface{}) (interface{}, error) {
 // Delete a value from the data store.
 func (ds *DataStore) Delete(keyType string, key string) {
 	dsKey := ds.makeKey(keyType, key)
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	ds.dsc.Delete(dsKey)
 	ds.removeFromList(keyType, key)
+	Journal(&Change{Kind: ChangeDelete, KeyType: keyType, Key: key})
+}
+
+// HoldWrites blocks any changes to the data store until ReleaseWrites is
+// called, while still allowing reads. This lets everything in the data store be
+// read from a consistent point in time, for backups and the like.
+func (ds *DataStore) HoldWrites() {
+	ds.wm.Lock()
+}
+
+// ReleaseWrites allows changes to the data store again after HoldWrites.
+func (ds *DataStore) ReleaseWrites() {
+	ds.wm.Unlock()
 }
 
 /* For the in-memory data store stuff, we need a convenient list of objects,
@@ -192,6 +221,8 @@ func (ds *DataStore) GetList(keyType string) []string {
 
 // SetNodeStatus updates a node's status using the in-memory data store.
 func (ds *DataStore) SetNodeStatus(nodeName string, obj interface{}, nsID ...int) error {
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	nsKey := ds.makeKey("nodestatus", "nodestatuses")
@@ -225,6 +256,8 @@ func (ds *DataStore) SetNodeStatus(nodeName string, obj interface{}, nsID ...int
 
 	ds.dsc.Set(nsKey, ns, -1)
 	ds.dsc.Set(nsListKey, nslist, -1)
+	journalSet("nodestatus", "nodestatuses", ns, false, true)
+	journalSet("nodestatuslist", "nodestatuslists", nslist, false, true)
 	return nil
 }
 
@@ -237,8 +270,8 @@ func (ds *DataStore) AllNodeStatuses(nodeName string) ([]interface{}, error) {
 	nsListKey := ds.makeKey("nodestatuslist", "nodestatuslists")
 	a, _ := ds.dsc.Get(nsKey)
 	if a == nil {
-		err := fmt.Errorf("No statuses in the datastore")
-		return nil, err
+		// No node has reported a status yet.
+		return []interface{}{}, nil
 	}
 	ns := a.(map[int]interface{})
 	a, _ = ds.dsc.Get(nsListKey)
@@ -305,6 +338,8 @@ func (ds *DataStore) LatestNodeStatus(nodeName string) (interface{}, error) {
 // DeleteNodeStatus deletes all status reports for a node from the in-memory 
 // data store.
 func (ds *DataStore) DeleteNodeStatus(nodeName string) error {
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	nsKey := ds.makeKey("nodestatus", "nodestatuses")
@@ -327,6 +362,8 @@ func (ds *DataStore) DeleteNodeStatus(nodeName string) error {
 	delete(nslist, nodeName)
 	ds.dsc.Set(nsKey, ns, -1)
 	ds.dsc.Set(nsListKey, nslist, -1)
+	journalSet("nodestatus", "nodestatuses", ns, false, true)
+	journalSet("nodestatuslist", "nodestatuslists", nslist, false, true)
 	return nil
 }
 
@@ -356,18 +393,22 @@ func (ds *DataStore) setLogInfoMap(liMap map[int]interface{}) {
 	dsKey := ds.makeKey("loginfo", "loginfos")
 	if config.Config.UseUnsafeMemStore {
 		ds.dsc.Set(dsKey, liMap, -1)
+		journalSet("loginfo", "loginfos", liMap, false, false)
 	} else {
 		valBytes, err := encodeSafeVal(liMap)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		ds.dsc.Set(dsKey, valBytes, -1)
+		journalSet("loginfo", "loginfos", valBytes, false, false)
 	}
 }
 
 // SetLogInfo sets a loginfo in the data store. Unlike most of these objects,
 // log infos are stored and retrieved by id, since they have no useful names.
 func (ds *DataStore) SetLogInfo(obj interface{}, logID ...int) error {
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	arr := ds.getLogInfoMap()
@@ -384,6 +425,8 @@ func (ds *DataStore) SetLogInfo(obj interface{}, logID ...int) error {
 
 // DeleteLogInfo deletes a logged event from the data store.
 func (ds *DataStore) DeleteLogInfo(id int) error {
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	arr := ds.getLogInfoMap()
@@ -395,6 +438,8 @@ func (ds *DataStore) DeleteLogInfo(id int) error {
 // PurgeLogInfoBefore purges all the logged events with an id less than the one
 // given from the data store.
 func (ds *DataStore) PurgeLogInfoBefore(id int) (int64, error) {
+	ds.wm.RLock()
+	defer ds.wm.RUnlock()
 	ds.m.Lock()
 	defer ds.m.Unlock()
 	arr := ds.getLogInfoMap()
@@ -444,17 +489,73 @@ func (ds *DataStore) GetLogInfoList() map[int]interface{} {
 	return arr
 }
 
-// Save freezes and saves the data store to disk.
+// SnapshotFormatVersion is the version of the data store snapshot file format.
+// Bump this whenever the layout of the saved file changes.
+const SnapshotFormatVersion = 1
+
+// snapshotMagic marks the start of the header line of a data store snapshot.
+// Snapshots saved by older versions of goiardi have no header at all, and
+// start straight away with the zlib stream.
+const snapshotMagic = "GOIARDI-DS"
+
+// SnapshotHeader holds the information about a frozen data store snapshot that
+// is written to the beginning of the file: the snapshot format version, the
+// version of goiardi that saved it, when it was created, and a checksum of the
+// rest of the file.
+type SnapshotHeader struct {
+	FormatVersion  int       `json:"format_version"`
+	GoiardiVersion string    `json:"goiardi_version"`
+	CreatedTime    time.Time `json:"created_time"`
+	Checksum       string    `json:"checksum"`
+}
+
+// Save freezes and saves the data store to disk. If the data-file-keep option
+// is set, the previous snapshot is rotated out and kept rather than being
+// overwritten.
 func (ds *DataStore) Save(dsFile string) error {
 	if dsFile == "" {
 		err := fmt.Errorf("Yikes! Cannot save data store to disk because no file was specified.")
 		return err
 	}
+	body, err := ds.freeze()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	header := &SnapshotHeader{FormatVersion: SnapshotFormatVersion, GoiardiVersion: config.Version, CreatedTime: time.Now(), Checksum: hex.EncodeToString(sum[:])}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
 	fp, err := ioutil.TempFile(path.Dir(dsFile), "ds-store")
 	if err != nil {
 		return err
 	}
-	zfp := zlib.NewWriter(fp)
+	if _, err = fmt.Fprintf(fp, "%s %s\n", snapshotMagic, headerJSON); err != nil {
+		fp.Close()
+		return err
+	}
+	if _, err = fp.Write(body); err != nil {
+		fp.Close()
+		return err
+	}
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+	if err = rotateSnapshots(dsFile, config.Config.DataStoreKeep); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return os.Rename(fp.Name(), dsFile)
+}
+
+// freeze encodes the data store into a zlib compressed gob, the body of the
+// snapshot file.
+func (ds *DataStore) freeze() (b []byte, err error) {
+	buf := new(bytes.Buffer)
+	zfp := zlib.NewWriter(buf)
 
 	fstore := new(dsFileStore)
 	dscache := new(bytes.Buffer)
@@ -464,8 +565,7 @@ func (ds *DataStore) Save(dsFile string) error {
 
 	err = ds.dsc.Save(dscache)
 	if err != nil {
-		fp.Close()
-		return err
+		return nil, err
 	}
 	enc := gob.NewEncoder(objList)
 	defer func() {
@@ -475,8 +575,7 @@ func (ds *DataStore) Save(dsFile string) error {
 	}()
 	err = enc.Encode(ds.objList)
 	if err != nil {
-		fp.Close()
-		return err
+		return nil, err
 	}
 	fstore.Cache = dscache.Bytes()
 	fstore.ObjList = objList.Bytes()
@@ -484,17 +583,102 @@ func (ds *DataStore) Save(dsFile string) error {
 	err = enc.Encode(fstore)
 	zfp.Close()
 	if err != nil {
-		fp.Close()
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SnapshotPath returns the name of the nth previous snapshot of the given data
+// store file. The 0th snapshot is the data store file itself.
+func SnapshotPath(dsFile string, n int) string {
+	if n == 0 {
+		return dsFile
+	}
+	return fmt.Sprintf("%s.%d", dsFile, n)
+}
+
+// rotateSnapshots shifts the existing snapshots of the data store file down by
+// one, dropping the oldest, so the current data store file can be kept as the
+// most recent previous snapshot. Does nothing if keep is 0. The current data
+// store file itself is linked (or copied) rather than moved, so it stays in
+// place until the new snapshot is renamed over it; if goiardi dies in between
+// the next startup still finds it.
+func rotateSnapshots(dsFile string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if err := os.Remove(SnapshotPath(dsFile, keep)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	err = fp.Close()
+	for i := keep - 1; i > 0; i-- {
+		err := os.Rename(SnapshotPath(dsFile, i), SnapshotPath(dsFile, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Link(dsFile, SnapshotPath(dsFile, 1))
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	// Hard links aren't available everywhere, so fall back to copying.
+	return copySnapshot(dsFile, SnapshotPath(dsFile, 1))
+}
+
+func copySnapshot(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	return os.Rename(fp.Name(), dsFile)
+	defer in.Close()
+	tmp, err := ioutil.TempFile(path.Dir(dst), "ds-store")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
 }
 
-// Load the frozen data store from disk.
+// ReadSnapshotHeader reads the header from a data store snapshot file, without
+// loading or verifying the rest of the file. Snapshots saved by goiardi
+// versions before the header was added return a nil header and no error.
+func ReadSnapshotHeader(dsFile string) (*SnapshotHeader, error) {
+	fp, err := os.Open(dsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return readSnapshotHeader(bufio.NewReader(fp), dsFile)
+}
+
+func readSnapshotHeader(r *bufio.Reader, dsFile string) (*SnapshotHeader, error) {
+	magic, err := r.Peek(len(snapshotMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, nil
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("data store snapshot %s has a truncated header: %s", dsFile, err.Error())
+	}
+	header := new(SnapshotHeader)
+	if err = json.Unmarshal(line[len(snapshotMagic):], header); err != nil {
+		return nil, fmt.Errorf("data store snapshot %s has a corrupted header: %s", dsFile, err.Error())
+	}
+	return header, nil
+}
+
+// Load the frozen data store from disk. The snapshot's format version and
+// checksum are verified before anything is loaded.
 func (ds *DataStore) Load(dsFile string) error {
 	if dsFile == "" {
 		err := fmt.Errorf("Yikes! Cannot load data store from disk because no file was specified.")
@@ -509,10 +693,46 @@ func (ds *DataStore) Load(dsFile string) error {
 		}
 		return err
 	}
-	zfp, zerr := zlib.NewReader(fp)
-	if zerr != nil {
-		fp.Close()
-		return zerr
+	defer fp.Close()
+	r := bufio.NewReader(fp)
+	header, err := readSnapshotHeader(r, dsFile)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		logger.Warningf("Data store snapshot %s has no header; it was probably saved by an older version of goiardi. Loading it without verifying its checksum.", dsFile)
+	} else {
+		if header.FormatVersion > SnapshotFormatVersion {
+			err := fmt.Errorf("data store snapshot %s has format version %d, created by goiardi %s, but this goiardi (%s) only understands format versions up to %d", dsFile, header.FormatVersion, header.GoiardiVersion, config.Version, SnapshotFormatVersion)
+			return err
+		}
+		sum := sha256.Sum256(body)
+		if chk := hex.EncodeToString(sum[:]); chk != header.Checksum {
+			err := fmt.Errorf("data store snapshot %s failed checksum verification: expected %s, got %s. The file is corrupted or truncated; try starting from an older snapshot", dsFile, header.Checksum, chk)
+			return err
+		}
+		logger.Infof("Loading data store snapshot %s, created %s by goiardi %s", dsFile, header.CreatedTime, header.GoiardiVersion)
+	}
+	if err = ds.thaw(body); err != nil {
+		savedBy := "an older goiardi"
+		if header != nil {
+			savedBy = fmt.Sprintf("goiardi %s", header.GoiardiVersion)
+		}
+		err := fmt.Errorf("could not decode data store snapshot %s, saved by %s, with goiardi %s: %s. If the snapshot was saved by a different version of goiardi, export the data with that version and import it into this one", dsFile, savedBy, config.Version, err.Error())
+		return err
+	}
+	return nil
+}
+
+// thaw decodes the body of a snapshot file back into the data store.
+func (ds *DataStore) thaw(body []byte) error {
+	zfp, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return err
 	}
 	dec := gob.NewDecoder(zfp)
 	ds.m.Lock()
@@ -521,8 +741,6 @@ func (ds *DataStore) Load(dsFile string) error {
 	err = dec.Decode(&fstore)
 	zfp.Close()
 	if err != nil {
-		fp.Close()
-		log.Printf("error at fstore")
 		return err
 	}
 
@@ -531,18 +749,10 @@ func (ds *DataStore) Load(dsFile string) error {
 
 	err = ds.dsc.Load(dscache)
 	if err != nil {
-		log.Println("error at dscache")
-		fp.Close()
 		return err
 	}
 	dec = gob.NewDecoder(objList)
-	err = dec.Decode(&ds.objList)
-	if err != nil {
-		log.Println("error at objList")
-		fp.Close()
-		return err
-	}
-	return fp.Close()
+	return dec.Decode(&ds.objList)
 }
 
 // ChkNilArray examines an object, searching for empty slices.
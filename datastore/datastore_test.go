@@ -19,6 +19,7 @@ package datastore
 import (
 	"encoding/gob"
 	"fmt"
+	"github.com/ctdk/goiardi/config"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -178,6 +179,92 @@ func TestActionAtADistance(t *testing.T) {
 	}
 }
 
+func TestSnapshotHeader(t *testing.T) {
+	ds := New()
+	tmpfile := fmt.Sprintf("%s/ds3.bin", dsTmpDir)
+	if err := ds.Save(tmpfile); err != nil {
+		t.Fatalf("Save() gave an error: %s", err)
+	}
+	header, err := ReadSnapshotHeader(tmpfile)
+	if err != nil {
+		t.Fatalf("ReadSnapshotHeader() gave an error: %s", err)
+	}
+	if header == nil {
+		t.Fatalf("ReadSnapshotHeader() did not find a header")
+	}
+	if header.FormatVersion != SnapshotFormatVersion {
+		t.Errorf("header format version should have been %d, got %d", SnapshotFormatVersion, header.FormatVersion)
+	}
+	if header.Checksum == "" {
+		t.Errorf("header should have had a checksum, but it was empty")
+	}
+}
+
+func TestLoadCorruptSnapshot(t *testing.T) {
+	ds := New()
+	tmpfile := fmt.Sprintf("%s/ds4.bin", dsTmpDir)
+	if err := ds.Save(tmpfile); err != nil {
+		t.Fatalf("Save() gave an error: %s", err)
+	}
+	data, err := ioutil.ReadFile(tmpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err = ioutil.WriteFile(tmpfile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ds.Load(tmpfile); err == nil {
+		t.Errorf("Load() should have failed with a corrupted snapshot, but didn't")
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	ds := New()
+	tmpfile := fmt.Sprintf("%s/ds5.bin", dsTmpDir)
+	config.Config.DataStoreKeep = 2
+	defer func() { config.Config.DataStoreKeep = 0 }()
+	for i := 0; i < 4; i++ {
+		if err := ds.Save(tmpfile); err != nil {
+			t.Fatalf("Save() gave an error: %s", err)
+		}
+	}
+	for i := 0; i <= 2; i++ {
+		if _, err := os.Stat(SnapshotPath(tmpfile, i)); err != nil {
+			t.Errorf("snapshot %d should have been kept, but got %s", i, err)
+		}
+	}
+	if _, err := os.Stat(SnapshotPath(tmpfile, 3)); !os.IsNotExist(err) {
+		t.Errorf("snapshot 3 should have been rotated out, but wasn't")
+	}
+	if err := ds.Load(SnapshotPath(tmpfile, 2)); err != nil {
+		t.Errorf("Load() of an older snapshot gave an error: %s", err)
+	}
+}
+
+func TestSnapshotRotationKeepsCurrent(t *testing.T) {
+	ds := New()
+	tmpfile := fmt.Sprintf("%s/ds6.bin", dsTmpDir)
+	if err := ds.Save(tmpfile); err != nil {
+		t.Fatalf("Save() gave an error: %s", err)
+	}
+	// Rotating without renaming a new snapshot into place afterwards is
+	// what's left behind if goiardi dies in the middle of a save; the
+	// current snapshot must still be there to load.
+	if err := rotateSnapshots(tmpfile, 2); err != nil {
+		t.Fatalf("rotateSnapshots() gave an error: %s", err)
+	}
+	if _, err := os.Stat(tmpfile); err != nil {
+		t.Fatalf("the current snapshot should still exist after rotating, but got %s", err)
+	}
+	if err := ds.Load(tmpfile); err != nil {
+		t.Errorf("Load() of the current snapshot after rotating gave an error: %s", err)
+	}
+	if err := ds.Load(SnapshotPath(tmpfile, 1)); err != nil {
+		t.Errorf("Load() of the rotated snapshot gave an error: %s", err)
+	}
+}
+
 // clean up
 
 func TestCleanup(t *testing.T) {
@@ -87,6 +87,27 @@ func ConnectDB(dbEngine string, params interface{}) (*sql.DB, error) {
 	}
 }
 
+// BeginSnapshotTx starts a read-only transaction with repeatable read isolation,
+// so everything read with it comes from the same consistent point in time. It
+// does not block other clients from writing to the database. The caller must
+// end the transaction with Rollback or Commit.
+func BeginSnapshotTx() (*sql.Tx, error) {
+	tx, err := Dbh.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// MySQL won't change the isolation level of a transaction that's
+	// already been started, but InnoDB uses repeatable read by default.
+	if config.Config.UsePostgreSQL {
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY")
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
 // EncodeToJSON encodes an object to a JSON string.
 func EncodeToJSON(obj interface{}) (string, error) {
 	buf := new(bytes.Buffer)
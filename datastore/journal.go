@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The replication journal, recording changes to the in-memory data store, the
+// search index, and the file store so a standby server can replay them.
+
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"log"
+	"sync"
+)
+
+// Kinds of changes recorded in the replication journal.
+const (
+	ChangeSet            = "set"
+	ChangeDelete         = "delete"
+	ChangeIndex          = "index"
+	ChangeUnindex        = "unindex"
+	ChangeNewCollection  = "new_collection"
+	ChangeDropCollection = "drop_collection"
+	ChangeClearIndex     = "clear_index"
+	ChangeBlob           = "blob"
+	ChangeBlobDelete     = "blob_delete"
+	// Sent down an idle replication stream now and then so the standby
+	// knows the primary is still there.
+	ChangeHeartbeat = "heartbeat"
+)
+
+// How many changes the journal holds on to. A standby that falls further
+// behind than this has to start over from a fresh snapshot.
+const journalSize = 10000
+
+// Change is one change to the data store, search index, or file store. What
+// the fields mean depends on the kind of change: for data store changes,
+// KeyType and Key are what was passed to Set or Delete, and Value is the value
+// encoded with gob. Listed is false for the few things, like node statuses and
+// the event log, that are stored without being put in the object list, and
+// Raw is true if the value is kept in the data store as is, rather than gob
+// encoded, even in the default safe mode. For search index changes, KeyType is
+// the index collection, Key is the document id, and Fields are the flattened
+// object. For file store changes, Key is the file's checksum and Value is its
+// contents.
+type Change struct {
+	Seq     uint64
+	Kind    string
+	KeyType string
+	Key     string
+	Listed  bool
+	Raw     bool
+	Value   []byte
+	Fields  []string
+}
+
+// ErrJournalGone is returned when changes are asked for from a journal that
+// has been restarted since, or from further back than the journal goes.
+var ErrJournalGone = fmt.Errorf("the replication journal no longer has those changes; a new snapshot is needed")
+
+type replJournal struct {
+	sync.Mutex
+	id      string
+	seq     uint64
+	changes []*Change
+	// closed and replaced whenever a change is added, to wake up anything
+	// waiting for new changes.
+	notify chan struct{}
+}
+
+var journal *replJournal
+var journalLock sync.RWMutex
+
+// StartJournal starts recording changes in the replication journal, so
+// standby servers can follow along. Every time the journal is started it gets
+// a new id, so standbys of a previous journal know to start over.
+func StartJournal() error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	journal = &replJournal{id: hex.EncodeToString(b), notify: make(chan struct{})}
+	return nil
+}
+
+// Journaling returns true if changes are being recorded in the replication
+// journal.
+func Journaling() bool {
+	journalLock.RLock()
+	defer journalLock.RUnlock()
+	return journal != nil
+}
+
+// Journal records a change in the replication journal, if the journal is
+// running.
+func Journal(c *Change) {
+	journalLock.RLock()
+	j := journal
+	journalLock.RUnlock()
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.seq++
+	c.Seq = j.seq
+	j.changes = append(j.changes, c)
+	if len(j.changes) > journalSize {
+		j.changes = j.changes[len(j.changes)-journalSize:]
+	}
+	close(j.notify)
+	j.notify = make(chan struct{})
+}
+
+// JournalPosition returns the id of the replication journal and the sequence
+// number of the last change recorded in it.
+func JournalPosition() (string, uint64, error) {
+	journalLock.RLock()
+	j := journal
+	journalLock.RUnlock()
+	if j == nil {
+		return "", 0, fmt.Errorf("the replication journal is not running")
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.id, j.seq, nil
+}
+
+// JournalSince returns the changes recorded in the journal with the given id
+// after the change with the given sequence number, along with a channel that
+// is closed when the next change is recorded. ErrJournalGone is returned if
+// the journal has a different id or has already dropped some of the changes
+// that were asked for.
+func JournalSince(id string, seq uint64) ([]*Change, <-chan struct{}, error) {
+	journalLock.RLock()
+	j := journal
+	journalLock.RUnlock()
+	if j == nil {
+		return nil, nil, fmt.Errorf("the replication journal is not running")
+	}
+	j.Lock()
+	defer j.Unlock()
+	if id != j.id || seq > j.seq {
+		return nil, nil, ErrJournalGone
+	}
+	if seq == j.seq {
+		return nil, j.notify, nil
+	}
+	if len(j.changes) == 0 || j.changes[0].Seq > seq+1 {
+		return nil, nil, ErrJournalGone
+	}
+	start := int(seq + 1 - j.changes[0].Seq)
+	changes := make([]*Change, len(j.changes)-start)
+	copy(changes, j.changes[start:])
+	return changes, j.notify, nil
+}
+
+// journalSet records a data store key being set. The value is encoded even
+// with the unsafe mem store, since it's going to another server.
+func journalSet(keyType string, key string, val interface{}, listed bool, raw bool) {
+	if !Journaling() {
+		return
+	}
+	var valBytes []byte
+	if b, ok := val.([]byte); ok && !raw {
+		valBytes = b
+	} else {
+		var err error
+		valBytes, err = encodeSafeVal(val)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	Journal(&Change{Kind: ChangeSet, KeyType: keyType, Key: key, Listed: listed, Raw: raw, Value: valBytes})
+}
+
+// Snapshot freezes the data store for a standby server, returning it along
+// with the replication journal's position at that moment. Changes to the data
+// store are held while the snapshot is taken, so replaying the journal from
+// that position brings a copy of the snapshot up to date.
+func (ds *DataStore) Snapshot() ([]byte, string, uint64, error) {
+	ds.HoldWrites()
+	defer ds.ReleaseWrites()
+	id, seq, err := JournalPosition()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	body, err := ds.freeze()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return body, id, seq, nil
+}
+
+// Restore replaces everything in the data store with the contents of a
+// snapshot taken with Snapshot.
+func (ds *DataStore) Restore(body []byte) error {
+	ds.HoldWrites()
+	defer ds.ReleaseWrites()
+	ds.m.Lock()
+	ds.dsc.Flush()
+	ds.objList = make(map[string]map[string]bool)
+	ds.m.Unlock()
+	return ds.thaw(body)
+}
+
+// ApplyChange applies a data store change from another server's replication
+// journal. Changes to the search index and file store are left to those
+// packages.
+func (ds *DataStore) ApplyChange(c *Change) error {
+	switch c.Kind {
+	case ChangeSet:
+		var val interface{}
+		if c.Raw || config.Config.UseUnsafeMemStore {
+			v, err := decodeSafeVal(c.Value)
+			if err != nil {
+				return err
+			}
+			val = v
+		} else {
+			val = c.Value
+		}
+		ds.wm.RLock()
+		defer ds.wm.RUnlock()
+		ds.m.Lock()
+		defer ds.m.Unlock()
+		ds.dsc.Set(ds.makeKey(c.KeyType, c.Key), val, -1)
+		if c.Listed {
+			ds.addToList(c.KeyType, c.Key)
+		}
+	case ChangeDelete:
+		ds.wm.RLock()
+		defer ds.wm.RUnlock()
+		ds.m.Lock()
+		defer ds.m.Unlock()
+		ds.dsc.Delete(ds.makeKey(c.KeyType, c.Key))
+		ds.removeFromList(c.KeyType, c.Key)
+	default:
+		return fmt.Errorf("%s is not a data store change", c.Kind)
+	}
+	return nil
+}
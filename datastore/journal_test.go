@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datastore
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	if err := StartJournal(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		journalLock.Lock()
+		journal = nil
+		journalLock.Unlock()
+	}()
+	ds := New()
+	baz := makeDsObj()
+	gob.Register(baz)
+
+	body, id, seq, err := ds.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Set("journal", "kept", baz)
+	ds.Set("journal", "gone", baz)
+	ds.Delete("journal", "gone")
+
+	changes, _, err := JournalSince(id, seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %d", len(changes))
+	}
+	if changes[2].Kind != ChangeDelete || changes[2].Seq != seq+3 {
+		t.Errorf("last change should have been a delete with sequence %d, got %s %d", seq+3, changes[2].Kind, changes[2].Seq)
+	}
+	if _, _, err = JournalSince("nope", seq); err != ErrJournalGone {
+		t.Errorf("asking for changes from another journal should have failed")
+	}
+
+	// Replay the changes on a copy of the snapshot.
+	standby := initDataStore()
+	if err = standby.Restore(body); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := standby.Get("journal", "kept"); found {
+		t.Errorf("the snapshot shouldn't have anything set after it was taken")
+	}
+	for _, c := range changes {
+		if err = standby.ApplyChange(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, found := standby.Get("journal", "kept"); !found || v.(*dsObj).Name != baz.Name {
+		t.Errorf("replayed set was not applied")
+	}
+	if _, found := standby.Get("journal", "gone"); found {
+		t.Errorf("replayed delete was not applied")
+	}
+	if l := standby.GetList("journal"); len(l) != 1 {
+		t.Errorf("expected 1 item in the replayed object list, got %d", len(l))
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Schema migrations for the SQL backends, taken from the same sqitch bundles
+// that are in sql-files.
+
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/config"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SchemaDumpTag is the sqitch tag that the plain schema dumps in sql-files
+// were made from. A database loaded from one of those dumps instead of with
+// sqitch is taken to have every change up through this tag applied.
+const SchemaDumpTag = "v0.8.0"
+
+// Migration is a single change to the database schema, in the order it
+// appears in a sqitch plan.
+type Migration struct {
+	Version int
+	Name    string
+	File    string
+	Tags    []string
+}
+
+// ErrPendingMigrations is returned by Migrate when the schema needs updating
+// but applying migrations was not allowed.
+type ErrPendingMigrations struct {
+	Current int
+	Latest  int
+}
+
+func (e *ErrPendingMigrations) Error() string {
+	return fmt.Sprintf("the database schema is at version %d, but goiardi needs version %d. Run goiardi with --migrate to update it.", e.Current, e.Latest)
+}
+
+var transactionStmt = regexp.MustCompile(`(?im)^\s*(BEGIN|COMMIT);\s*$`)
+
+// LoadMigrations reads the sqitch plan in the given bundle, and works out
+// which deploy script goes with each change. A change that has been reworked
+// uses the script named after the first tag following it, like sqitch does.
+func LoadMigrations(bundle fs.FS) ([]*Migration, string, error) {
+	f, err := bundle.Open("sqitch.plan")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var migrations []*Migration
+	var project string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "%") {
+			if strings.HasPrefix(line, "%project=") {
+				project = strings.TrimPrefix(line, "%project=")
+			}
+			continue
+		}
+		name := strings.Fields(line)[0]
+		if strings.HasPrefix(name, "@") {
+			if len(migrations) == 0 {
+				return nil, "", fmt.Errorf("tag %s in sqitch plan comes before any changes", name)
+			}
+			last := migrations[len(migrations)-1]
+			last.Tags = append(last.Tags, strings.TrimPrefix(name, "@"))
+			continue
+		}
+		name = strings.TrimPrefix(name, "+")
+		migrations = append(migrations, &Migration{Version: len(migrations) + 1, Name: name})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, "", err
+	}
+
+	for i, m := range migrations {
+		m.File = path.Join("deploy", m.Name+".sql")
+		for _, later := range migrations[i+1:] {
+			if later.Name != m.Name {
+				continue
+			}
+			tag := firstTagFrom(migrations[i:])
+			if tag == "" {
+				return nil, "", fmt.Errorf("change %s is reworked in the sqitch plan without a tag in between", m.Name)
+			}
+			m.File = path.Join("deploy", fmt.Sprintf("%s@%s.sql", m.Name, tag))
+			break
+		}
+		if _, err := fs.Stat(bundle, m.File); err != nil {
+			return nil, "", err
+		}
+	}
+	return migrations, project, nil
+}
+
+func firstTagFrom(migrations []*Migration) string {
+	for _, m := range migrations {
+		if len(m.Tags) > 0 {
+			return m.Tags[0]
+		}
+	}
+	return ""
+}
+
+// Migrate brings the database schema up to date with the migrations in the
+// given sqitch bundle, recording each one applied in the
+// goiardi_schema_migrations table. If apply is false, nothing is changed and
+// an *ErrPendingMigrations error is returned if the schema is out of date. It
+// refuses to go any further with a schema newer than the bundle knows about.
+// Returns the number of migrations applied.
+func Migrate(bundle fs.FS, apply bool) (int, error) {
+	migrations, project, err := LoadMigrations(bundle)
+	if err != nil {
+		return 0, err
+	}
+	if err = initMigrationTable(migrations, project); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(applied) > len(migrations) {
+		err = fmt.Errorf("the database schema is at version %d, which is newer than the latest version %d this goiardi knows about. Upgrade goiardi before using this database.", len(applied), len(migrations))
+		return 0, err
+	}
+	for i, name := range applied {
+		if migrations[i].Name != name {
+			err = fmt.Errorf("schema migration %d applied to the database is '%s', but goiardi expected '%s'", i+1, name, migrations[i].Name)
+			return 0, err
+		}
+	}
+	pending := migrations[len(applied):]
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	if !apply {
+		return 0, &ErrPendingMigrations{Current: len(applied), Latest: len(migrations)}
+	}
+	for i, m := range pending {
+		logger.Infof("Applying schema migration %d: %s", m.Version, m.Name)
+		if err = applyMigration(bundle, m); err != nil {
+			return i, fmt.Errorf("schema migration %d (%s) failed: %s", m.Version, m.Name, err.Error())
+		}
+	}
+	return len(pending), nil
+}
+
+func migrationTable() string {
+	if config.Config.UsePostgreSQL {
+		return "public.goiardi_schema_migrations"
+	}
+	return "goiardi_schema_migrations"
+}
+
+// initMigrationTable creates the migrations table if it isn't there yet. If
+// goiardi's tables were already set up by hand, the changes that have already
+// been made are recorded in it.
+func initMigrationTable(migrations []*Migration, project string) error {
+	found, err := tableExists("public", "goiardi_schema_migrations")
+	if err != nil || found {
+		return err
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "CREATE TABLE goiardi_schema_migrations (version int not null, name varchar(255) not null, applied_at timestamp default current_timestamp, primary key(version)) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "CREATE TABLE public.goiardi_schema_migrations (version int primary key, name text not null, applied_at timestamp with time zone default current_timestamp)"
+	}
+	if _, err = Dbh.Exec(sqlStatement); err != nil {
+		return err
+	}
+
+	existing, err := sqitchChanges(project)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		var schema string
+		if config.Config.UsePostgreSQL {
+			schema = "goiardi"
+		}
+		hasTables, err := tableExists(schema, "clients")
+		if err != nil {
+			return err
+		}
+		if hasTables {
+			logger.Infof("Found goiardi tables without a sqitch registry; assuming the schema matches the %s schema dump", SchemaDumpTag)
+			for _, m := range migrations {
+				existing = append(existing, m.Name)
+				if m.hasTag(SchemaDumpTag) {
+					break
+				}
+			}
+		}
+	} else {
+		logger.Infof("Taking over %d schema changes deployed with sqitch", len(existing))
+	}
+	if len(existing) > len(migrations) {
+		return fmt.Errorf("sqitch has deployed %d changes, more than the %d this goiardi knows about. Upgrade goiardi before using this database.", len(existing), len(migrations))
+	}
+
+	tx, err := Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	for i, name := range existing {
+		if migrations[i].Name != name {
+			tx.Rollback()
+			return fmt.Errorf("sqitch change %d deployed to the database is '%s', but goiardi expected '%s'", i+1, name, migrations[i].Name)
+		}
+		if err = recordMigration(tx, migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *Migration) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// sqitchChanges gets the changes deployed by sqitch for the project, in the
+// order they were deployed. If there's no sqitch registry, it returns nil.
+func sqitchChanges(project string) ([]string, error) {
+	found, err := tableExists("sqitch", "changes")
+	if err != nil || !found {
+		return nil, err
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT `change` FROM sqitch.changes WHERE project = ? ORDER BY committed_at"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT change FROM sqitch.changes WHERE project = $1 ORDER BY committed_at"
+	}
+	rows, err := Dbh.Query(sqlStatement, project)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := make([]string, 0)
+	for rows.Next() {
+		var change string
+		if err = rows.Scan(&change); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// tableExists checks if a table is in the database. With MySQL, the schema is
+// the name of the database, and an empty one means the current database.
+func tableExists(schema, table string) (bool, error) {
+	var sqlStatement string
+	var args []interface{}
+	if config.Config.UseMySQL {
+		if schema == "" || schema == "public" {
+			sqlStatement = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+			args = []interface{}{table}
+		} else {
+			sqlStatement = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?"
+			args = []interface{}{schema, table}
+		}
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = $1 AND table_name = $2"
+		args = []interface{}{schema, table}
+	}
+	var c int
+	if err := Dbh.QueryRow(sqlStatement, args...).Scan(&c); err != nil {
+		return false, err
+	}
+	return c > 0, nil
+}
+
+func appliedMigrations() ([]string, error) {
+	rows, err := Dbh.Query(fmt.Sprintf("SELECT version, name FROM %s ORDER BY version", migrationTable()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var version int
+		var name string
+		if err = rows.Scan(&version, &name); err != nil {
+			return nil, err
+		}
+		if version != len(applied)+1 {
+			return nil, fmt.Errorf("schema migration %d is missing from %s", len(applied)+1, migrationTable())
+		}
+		applied = append(applied, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func recordMigration(tx *sql.Tx, m *Migration) error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "INSERT INTO goiardi_schema_migrations (version, name) VALUES (?, ?)"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "INSERT INTO public.goiardi_schema_migrations (version, name) VALUES ($1, $2)"
+	}
+	_, err := tx.Exec(sqlStatement, m.Version, m.Name)
+	return err
+}
+
+// applyMigration runs a deploy script and records it in one transaction. The
+// scripts wrap themselves in BEGIN and COMMIT for sqitch, which is left out
+// here. Postgres can take the whole script at once, but MySQL has to be fed
+// one statement at a time; it also commits implicitly after DDL statements, so
+// a failed migration there may need cleaning up by hand.
+func applyMigration(bundle fs.FS, m *Migration) error {
+	script, err := fs.ReadFile(bundle, m.File)
+	if err != nil {
+		return err
+	}
+	script = transactionStmt.ReplaceAll(script, nil)
+
+	tx, err := Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	if config.Config.UseMySQL {
+		for _, stmt := range splitStatements(script) {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	} else if config.Config.UsePostgreSQL {
+		if _, err = tx.Exec(string(script)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = recordMigration(tx, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements breaks up a MySQL script into separate statements, dropping
+// comment lines. None of the MySQL scripts change the delimiter, so splitting
+// on semicolons is enough.
+func splitStatements(script []byte) []string {
+	var lines [][]byte
+	for _, line := range bytes.Split(script, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("--")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, s := range strings.Split(string(bytes.Join(lines, []byte("\n"))), ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
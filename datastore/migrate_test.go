@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datastore
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	for _, b := range []string{"mysql", "postgres"} {
+		migrations, project, err := LoadMigrations(os.DirFS("../sql-files/" + b + "-bundle"))
+		if err != nil {
+			t.Fatalf("loading %s migrations: %s", b, err.Error())
+		}
+		if project != "goiardi_"+b {
+			t.Errorf("%s project was %q", b, project)
+		}
+		var dumpTag bool
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s migration %s had version %d, expected %d", b, m.Name, m.Version, i+1)
+			}
+			dumpTag = dumpTag || m.hasTag(SchemaDumpTag)
+		}
+		if !dumpTag {
+			t.Errorf("%s plan has no %s tag", b, SchemaDumpTag)
+		}
+	}
+}
+
+func TestReworkedMigration(t *testing.T) {
+	migrations, _, err := LoadMigrations(os.DirFS("../sql-files/mysql-bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, m := range migrations {
+		if m.Name == "log_infos" {
+			files = append(files, m.File)
+		}
+	}
+	if len(files) != 2 || files[0] != "deploy/log_infos@v0.5.0.sql" || files[1] != "deploy/log_infos.sql" {
+		t.Errorf("reworked log_infos change had files %v", files)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := []byte("-- Deploy foo\n\nCREATE TABLE foo (id int);\n-- drop it; really\nALTER TABLE foo\n\tADD bar int;\n")
+	stmts := splitStatements(transactionStmt.ReplaceAll(script, nil))
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(stmts), stmts)
+	}
+	if stmts[1] != "ALTER TABLE foo\n\tADD bar int" {
+		t.Errorf("unexpected second statement %q", stmts[1])
+	}
+	if s := transactionStmt.ReplaceAll([]byte("BEGIN;\nSELECT 1;\nCOMMIT;\n"), nil); strings.TrimSpace(string(s)) != "SELECT 1;" {
+		t.Errorf("BEGIN and COMMIT not removed: %q", s)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Routing reads to database replicas.
+
+package datastore
+
+import (
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many recent writers to remember before clearing out the ones whose
+// read-your-writes window has passed.
+const recentWriterSweep = 1000
+
+var replicas []*sql.DB
+var replicaNext uint32
+
+var recentWriters = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// AddReplica adds a connection to a read replica to the pool that read only
+// requests are sent to.
+func AddReplica(db *sql.DB) {
+	replicas = append(replicas, db)
+}
+
+// ReadDbh returns the db handle to use for read only queries made for the
+// given actor. Reads are spread around the replicas, unless the actor has
+// written something within the read-your-writes window, or there aren't any
+// replicas; then the primary database is used so the actor sees its own
+// changes.
+func ReadDbh(actorName string) Dbhandle {
+	if len(replicas) == 0 || wroteRecently(actorName) {
+		return Dbh
+	}
+	n := atomic.AddUint32(&replicaNext, 1)
+	return replicas[n%uint32(len(replicas))]
+}
+
+// NoteWrite records that the actor has just changed something, so its reads
+// will go to the primary database for a little while.
+func NoteWrite(actorName string) {
+	if len(replicas) == 0 {
+		return
+	}
+	now := time.Now()
+	recentWriters.Lock()
+	defer recentWriters.Unlock()
+	recentWriters.m[actorName] = now
+	if len(recentWriters.m) > recentWriterSweep {
+		for a, t := range recentWriters.m {
+			if now.Sub(t) > config.Config.ReadYourWritesDur {
+				delete(recentWriters.m, a)
+			}
+		}
+	}
+}
+
+func wroteRecently(actorName string) bool {
+	recentWriters.Lock()
+	defer recentWriters.Unlock()
+	t, found := recentWriters.m[actorName]
+	if !found {
+		return false
+	}
+	if time.Since(t) > config.Config.ReadYourWritesDur {
+		delete(recentWriters.m, actorName)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datastore
+
+import (
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"testing"
+	"time"
+)
+
+func TestReadDbh(t *testing.T) {
+	primary := new(sql.DB)
+	replica := new(sql.DB)
+	oldDbh := Dbh
+	Dbh = primary
+	defer func() {
+		Dbh = oldDbh
+		replicas = nil
+	}()
+	config.Config.ReadYourWritesDur = 50 * time.Millisecond
+
+	if ReadDbh("foo") != Dbhandle(primary) {
+		t.Errorf("reads should go to the primary without any replicas")
+	}
+	AddReplica(replica)
+	if ReadDbh("foo") != Dbhandle(replica) {
+		t.Errorf("reads should go to the replica")
+	}
+	NoteWrite("foo")
+	if ReadDbh("foo") != Dbhandle(primary) {
+		t.Errorf("reads right after a write should go to the primary")
+	}
+	if ReadDbh("bar") != Dbhandle(replica) {
+		t.Errorf("reads by another actor should still go to the replica")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ReadDbh("foo") != Dbhandle(replica) {
+		t.Errorf("reads should go back to the replica after the read-your-writes window")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Trying out the cookbook dependency solver on a run list, and reporting why
+// it failed.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/environment"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"regexp"
+)
+
+var runListItemRe = regexp.MustCompile(`^(\w+)\[(.*?)\]$`)
+
+// dependencyErrorReport sends a 412 for a run list whose dependencies can't be
+// satisfied, with the solver's explanation sent like the Chef server's own
+// dependency solver errors. Other errors from the solver, like failing to read
+// a cookbook, are sent on as they are.
+func dependencyErrorReport(w http.ResponseWriter, r *http.Request, err error) {
+	derr, ok := err.(*cookbook.DependencyError)
+	if !ok {
+		// Something went wrong besides the dependencies not being
+		// satisfiable.
+		status := http.StatusInternalServerError
+		if gerr, ok := err.(util.Gerror); ok {
+			status = gerr.Status()
+		}
+		jsonErrorReport(w, r, err.Error(), status)
+		return
+	}
+	logger.Infof(derr.Error())
+	jsonError := map[string][]*cookbook.DependencyError{"error": []*cookbook.DependencyError{derr}}
+	w.WriteHeader(http.StatusPreconditionFailed)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&jsonError); err != nil {
+		logger.Errorf(err.Error())
+	}
+}
+
+// depsolverHandler runs the dependency solver for a run list in an
+// environment, without needing a node. Roles in the run list are expanded
+// first, the same way chef-client would for a node in that environment.
+func depsolverHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if opUser.IsValidator() {
+		jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqData, jerr := parseObjJSON(r.Body)
+	if jerr != nil {
+		jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := reqData["run_list"]; !ok {
+		jsonErrorReport(w, r, "Field 'run_list' missing", http.StatusBadRequest)
+		return
+	}
+	runList, rerr := util.ValidateRunList(reqData["run_list"])
+	if rerr != nil {
+		jsonErrorReport(w, r, rerr.Error(), rerr.Status())
+		return
+	}
+	envName := "_default"
+	if e, ok := reqData["environment"]; ok {
+		if envName, ok = e.(string); !ok {
+			jsonErrorReport(w, r, "Field 'environment' must be a string", http.StatusBadRequest)
+			return
+		}
+	}
+	dbh := readDbh(r)
+	env, gerr := environment.GetFrom(dbh, envName)
+	if gerr != nil {
+		jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+		return
+	}
+
+	recipes, xerr := expandRunList(dbh, runList, envName, make(map[string]bool))
+	if xerr != nil {
+		jsonErrorReport(w, r, xerr.Error(), xerr.Status())
+		return
+	}
+	picked, err := cookbook.SolveDependenciesFrom(dbh, recipes, env.CookbookVersions)
+	if err != nil {
+		dependencyErrorReport(w, r, err)
+		return
+	}
+	versions := make(map[string]string, len(picked))
+	for name, cbv := range picked {
+		versions[name] = cbv.Version
+	}
+	response := map[string]interface{}{
+		"environment":       envName,
+		"expanded_run_list": recipes,
+		"cookbooks":         versions,
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// expandRunList turns a run list into the list of recipes it runs, expanding
+// roles with their run list for the environment. Roles already seen are
+// skipped, so roles that include each other don't loop forever.
+func expandRunList(dbh datastore.Dbhandle, runList []string, envName string, seen map[string]bool) ([]string, util.Gerror) {
+	recipes := make([]string, 0, len(runList))
+	have := make(map[string]bool)
+	add := func(recipe string) {
+		if !have[recipe] {
+			have[recipe] = true
+			recipes = append(recipes, recipe)
+		}
+	}
+	for _, item := range runList {
+		m := runListItemRe.FindStringSubmatch(item)
+		if m == nil {
+			add(item)
+			continue
+		}
+		if m[1] == "recipe" {
+			add(m[2])
+			continue
+		}
+		if seen[m[2]] {
+			continue
+		}
+		seen[m[2]] = true
+		chefRole, err := role.GetFrom(dbh, m[2])
+		if err != nil {
+			gerr := util.Errorf("Role %s in the run list does not exist", m[2])
+			gerr.SetStatus(http.StatusPreconditionFailed)
+			return nil, gerr
+		}
+		roleRunList := chefRole.RunList
+		if erl, ok := chefRole.EnvRunLists[envName]; ok && envName != "_default" {
+			roleRunList = erl
+		}
+		roleRecipes, gerr := expandRunList(dbh, roleRunList, envName, seen)
+		if gerr != nil {
+			return nil, gerr
+		}
+		for _, rc := range roleRecipes {
+			add(rc)
+		}
+	}
+	return recipes, nil
+}
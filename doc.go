@@ -111,6 +111,15 @@ Currently available command line and config file options:
                           structures to disk (requires -i/--index-file and
                           -D/--data-file options to be set). (Default 300
                           seconds/5 minutes.)
+       --data-file-keep=  Number of previous data store snapshots to keep when
+                          the data store is saved, as <data-file>.1 through
+                          <data-file>.N. Default 0 - previous snapshots are
+                          overwritten.
+       --load-snapshot=   Start from an older data store snapshot instead of
+                          the data file. Takes either the path to a snapshot
+                          file or the number of a previous snapshot kept with
+                          --data-file-keep (1 being the most recent).
+                          Requires -D/--data-file.
    -L, --log-file=        Log to file X
    -s, --syslog           Log to syslog rather than a log file. Incompatible
                           with -L/--log-file.
@@ -141,17 +150,72 @@ Currently available command line and config file options:
                           Configure database options in the config file.
        --local-filestore-dir= Directory to save uploaded files in. Optional when
                           running in in-memory mode, *mandatory* for SQL
-                          mode.
+                          mode unless an S3 bucket is configured.
        --log-events       Log changes to chef objects.
    -K, --log-event-keep=  Number of events to keep in the event log. If set,
                           the event log will be checked periodically and
                           pruned to this number of entries.
+       --keep-revisions=  Number of previous revisions of roles,
+                          environments, nodes, and data bag items to keep.
+                          Default is 0 - no revisions are kept.
+       --trash-retention= How long to keep deleted nodes, roles, data bag
+                          items, and cookbook versions in the trash before
+                          purging them for good. Formatted like 72h, 30m,
+                          etc. Set to 0 to delete objects right away without
+                          using the trash. Defaults to 168h (one week).
+       --supermarket      Serve a read-only Supermarket compatible API for
+                          this server's cookbooks under /api/v1, for berks
+                          and knife supermarket. Requests to it are not
+                          authenticated, but downloads need the signed URLs
+                          it hands out.
+       --filestore-gc-interval= How often to remove files from the file store
+                          that nothing uses anymore. Formatted like 24h, 90m,
+                          etc. Default is 0 - only when asked through
+                          /_filestore_gc.
+       --filestore-scrub-interval= How often to check every file in the file
+                          store against its checksum. Formatted like 24h, 90m,
+                          etc. Default is 0 - only when asked through
+                          /_filestore_scrub.
+       --filestore-scrub-quarantine Quarantine corrupt files found by the
+                          scheduled file store scrubs, instead of just
+                          reporting them.
+       --sandbox-ttl=     How long a sandbox has to be committed before it
+                          expires, and it and the files uploaded for it are
+                          purged. Formatted like 24h, 90m, etc. Set to 0 to
+                          never expire sandboxes. Defaults to 24h.
+       --filestore-gc-grace= How long a file must go unused before it's
+                          removed from the file store, to give newly uploaded
+                          files time to be used. Formatted like 24h, 90m, etc.
+                          Defaults to 24h.
+       --file-store-url-key= Secret key to sign file store URLs with. Servers
+                          that share their files, like behind a load balancer,
+                          need the same key. Default is a random key made when
+                          goiardi starts.
+       --file-store-url-expiry= How long signed file store URLs handed out for
+                          uploading and downloading cookbook files are good
+                          for. Formatted like 8h, 90m, etc. Defaults to 8h.
+       --unsigned-file-store Allow file store requests without a signed URL
+                          when authentication is on, for older clients.
+       --cookbook-keep-versions= Number of the latest versions of each
+                          cookbook to keep when pruning old cookbook versions.
+                          Versions an environment or node uses are kept as
+                          well. Can be set for individual cookbooks in the
+                          config file. Default is 0 - all versions are kept.
+       --cookbook-prune-interval= How often to prune old cookbook versions.
+                          Formatted like 24h, 90m, etc. Default is 0 - only
+                          when asked through /_cookbook_retention.
    -x, --export=          Export all server data to the given file, exiting
                           afterwards. Should be used with caution. Cannot be
                           used at the same time as -m/--import.
    -m, --import=          Import data from the given file, exiting
                           afterwards. Cannot be used at the same time as
                           -x/--export.
+       --migrate          Apply any pending database schema migrations,
+                          exiting afterwards. Only useful when using one of
+                          the SQL backends.
+       --no-auto-migrate  Don't apply pending database schema migrations
+                          when goiardi starts; refuse to start instead until
+                          they're applied with --migrate.
    -Q, --obj-max-size=    Maximum object size in bytes for the file store.
                           Default 10485760 bytes (10MB).
    -j, --json-req-max-size= Maximum size for a JSON request from the client.
@@ -170,6 +234,19 @@ Currently available command line and config file options:
        --max-connections= Maximum number of connections allowed for the
                           database. Only useful when using one of the SQL
                           backends. Default is 0 - unlimited.
+       --read-your-writes-window= How long to send an actor's reads to the
+                          primary database after it changes something, when
+                          read replicas are configured. Formatted like 5s,
+                          1m, etc. Defaults to 5s.
+       --standby-of=      Run as a read-only standby of the goiardi server
+                          at this URL (like
+                          http://primary.example.com:4545), replicating
+                          everything from it. Only for in-memory mode.
+                          Requires --replication-key.
+       --replication-key= Shared secret standby servers use to replicate
+                          from this server, or that this server uses to
+                          replicate from its primary with --standby-of.
+                          Replication is turned off if it isn't set.
        --use-serf         If set, have goidari use serf to send and receive
                           events and queries from a serf cluster. Required
                           for shovey.
@@ -287,6 +364,10 @@ If you really really don't want to install sqitch, apply each SQL patch in
 sql-files/mysql-bundle by hand in the same order they're listed in the
 sqitch.plan file.
 
+Goiardi also carries the sqitch bundles inside itself, and will apply any schema
+changes the database is missing when it starts up, so after the database is
+created sqitch is optional. See "Schema Migrations" below.
+
 The above values are for illustration, of course; nothing requires goiardi's
 database to be named "goiardi". Just make sure the right database is specified in
 the config file.
@@ -331,6 +412,24 @@ sufficient. Otherwise, the deploy command will be something like `sqitch deploy
 
 The Postgres sqitch tutorial at https://metacpan.org/pod/sqitchtutorial explains more about how to use sqitch and Postgres.
 
+Schema Migrations
+
+Goiardi has the MySQL and Postgres sqitch bundles built in. When it starts with
+an SQL backend it records the changes that have been applied to the schema in
+the `goiardi_schema_migrations` table (in the `public` schema with Postgres),
+and applies any that are missing before doing anything else. With
+`--no-auto-migrate` it will refuse to start with an out of date schema instead,
+and running goiardi with `--migrate` applies the pending changes and exits.
+Goiardi will refuse to start against a schema newer than it knows about, which
+can happen after rolling back to an older goiardi.
+
+The first time goiardi sees a database that was deployed with sqitch, it takes
+over sqitch's record of the deployed changes. A database loaded from one of the
+plain schema dumps in sql-files is assumed to match the v0.8.0 tag.
+
+With MySQL, a failed migration may be left partly applied, because MySQL
+commits schema changes immediately. Check the database before trying again.
+
 Set `use-postgresql` in the configuration file, or specify `--use-postgresql` on
 the command line. It's also an error to specify both `-D`/`--data-file` flag and
 `--use-postgresql` at the same time like it is in MySQL mode. MySQL and Postgres
@@ -364,6 +463,16 @@ sets the maximum number of connections to open on the database. If they are not
 set, the default behavior is to keep no idle connections alive and to have
 unlimited connections to the database.
 
+Read replicas can take some of the load off of the primary database. List them
+in the config file under `[[mysql.replica]]` or `[[postgresql.replica]]`; any
+connection options a replica leaves out are the same as the primary's, so
+usually only the address or host is needed. GET requests for nodes, roles,
+environments, and cookbooks are spread across the replicas, and everything
+else goes to the primary. After a client or user changes anything, its reads go
+to the primary for a short time so it sees its own changes even if the replicas
+are lagging. That window is set with `--read-your-writes-window` (or
+`read-your-writes-window` in the config file), and defaults to 5 seconds.
+
 It should go without saying that these options don't do much if you aren't using
 one of the SQL backends.
 
@@ -470,6 +579,167 @@ but rather leaves that task to the administrator. This functionality is merely
 theoretical and completely untested. If you try it, you should back your data
 up first.
 
+A running server can also be backed up without stopping it. An admin user can
+GET `/_backup` to receive the same JSON export format that `-x` writes, taken
+from a single consistent point in time. With the in-memory data store, changes
+are held off while the data is gathered; with MySQL or Postgres the data is
+read inside one repeatable read transaction. If the request sends
+`Accept-Encoding: gzip` or has `?compress=gzip` on the URL, the backup will be
+gzipped. For example, with knife:
+
+    knife raw /_backup > goiardi-backup.json
+
+The backup can be loaded into a fresh goiardi with `-m`, the same as any other
+export file.
+
+Export files can also be loaded into a running server by POSTing them to the
+admin only `/_import` endpoint. It takes these query parameters:
+
+* `types`: a comma separated list of the kinds of objects to import, out of
+  client, user, filestore, cookbook, databag, environment, node, role, sandbox,
+  loginfo, report, node_status, shovey, shovey_run, and shovey_run_stream.
+  Everything is imported by default.
+* `conflict`: what to do with objects that already exist on the server. `skip`
+  (the default) leaves them alone, `overwrite` replaces them, and `fail`
+  refuses to import anything if any of them already exist. File store entries,
+  event log entries, reports, node statuses, and shovey records never change
+  once they're created, so existing ones are always skipped with `overwrite`.
+* `dry_run`: if `true`, nothing is changed and goiardi only reports what it
+  would have done.
+
+The response lists what was created, updated, and skipped for each type.
+Objects are indexed for search as they're imported. Importing with `-m` from
+the command line behaves like `conflict=overwrite`.
+
+Conditional Requests
+
+Roles, environments, nodes, and data bag items are sent back with an `ETag`
+header, made from a hash of the object's contents. It's the same whether goiardi
+is running in-memory or with MySQL or Postgres. A GET with an `If-None-Match`
+header that matches the current ETag gets a `304 Not Modified` with no body.
+
+To keep two people editing the same object from silently overwriting each
+other's changes, send the ETag from when you fetched the object in an `If-Match`
+header with the PUT. If the object has been changed in the meantime, the PUT
+fails with `412 Precondition Failed` and the object's current ETag, and nothing
+is saved. PUTs without `If-Match` just overwrite the object like before.
+
+With MySQL or Postgres, the `If-Match` check is made again in the database,
+inside the transaction that saves the object and with its row locked, so it
+still holds when several goiardi servers share one database.
+
+Files in the filestore are streamed to and from the local filestore directory
+instead of being read into memory whole. A download from
+`/file_store/<checksum>` has a `Last-Modified` header and honors
+`If-Modified-Since`, and a `Range` header fetches just part of the file, so an
+interrupted download of a large file can pick up where it left off. Uploads are
+written to a temporary file in the local filestore directory and checked
+against their checksum as they arrive, and only moved into place if they match.
+
+Object Revisions
+
+Goiardi can keep the previous revisions of roles, environments, nodes, and data
+bag items, so a bad `knife role from file` can be undone without restoring a
+whole backup. Set `--keep-revisions` (or `keep-revisions` in the config file) to
+the number of revisions to keep for each object. A revision is recorded whenever
+one of these objects is saved or deleted. For nodes, only the run list and
+normal attributes are kept, and saving a node (or anything else) without
+changing it doesn't record a new revision, so chef-client runs don't push real
+changes out of the history. Revisions are kept for deleted objects too.
+
+The revisions are available under each object's URL, like
+`/roles/NAME/_revisions`, `/environments/NAME/_revisions`,
+`/nodes/NAME/_revisions`, and `/data/BAG/ITEM/_revisions`:
+
+* `GET .../_revisions` lists the revisions kept, oldest first.
+* `GET .../_revisions/N` returns revision N, with the object as it was then.
+* `GET .../_revisions/N/_diff` returns the changes between revision N and the
+  revision before it. Add `?from=M` to compare with revision M instead.
+* `POST .../_revisions/N/_rollback` puts the object back the way it was in
+  revision N, recreating it if it's been deleted. This requires an admin user.
+  The rollback is itself recorded as a new revision.
+
+Trash
+
+Deleted nodes, roles, data bag items, and cookbook versions go into a trash for
+a while before they're gone for good, in case they were deleted by mistake.
+Trashed objects are really removed from the server, so they don't show up in
+searches, lists, or anything else, but a copy of them is kept in the trash. The
+files of deleted cookbook versions are kept until the versions are purged from
+the trash. Items are purged automatically, by a check that runs every minute,
+once they've been in the trash longer than `--trash-retention` (one week by
+default). Setting `--trash-retention` to 0 turns the trash off, and deleted
+objects are removed right away.
+
+The trash is managed by admin users with the `/_trash` endpoint:
+
+* `GET /_trash` lists the items in the trash, with when they were deleted and
+  when they'll be purged. Add `?type=node` (or `role`, `data_bag_item`, or
+  `cookbook_version`) to only list one type of object.
+* `GET /_trash/ID` returns an item, including a copy of the deleted object.
+* `POST /_trash/ID/_restore` puts the object back and takes it out of the
+  trash. If an object with the same name has been created since, it's left
+  alone and the restore fails with a 409.
+* `DELETE /_trash/ID` purges an item from the trash, and `DELETE /_trash`
+  purges everything (or everything of one type, with `?type=`).
+
+In-Memory Replication
+
+An in-memory goiardi can be replicated to one or more standby servers, so
+there's a copy ready to take over if the primary goes down. Set
+`--replication-key` on the primary to a shared secret, and start each standby
+with `--standby-of` pointing at the primary's URL and the same
+`--replication-key`:
+
+    goiardi --replication-key=s3kr1t ...
+    goiardi --standby-of=http://primary.example.com:4545 --replication-key=s3kr1t ...
+
+The standby loads a snapshot of the primary's data store and search index,
+fetching any files in the local file store directory it doesn't have yet from
+the primary, then follows a stream of every change made on the primary afterwards: data store
+changes, search index updates, and files uploaded to the local file store
+directory, which the standby fetches from the primary's file store. If the standby is disconnected it picks up where it left off, or
+loads a new snapshot if it fell too far behind or the primary was restarted.
+Standbys don't create the default clients and users; they get them, along with
+their keys, from the primary.
+
+Standbys only serve read-only requests, which include searches and the
+dependency solver. Anything that would change something is refused with a 503. The standby's replication status is at `GET /_replication`
+(on the primary it shows the current position in the journal of changes), and
+an admin user can promote a standby to a primary with a signed
+`POST /_replication/_promote`; the replication key alone isn't enough. Once promoted it stops following the old primary
+and starts accepting changes, and if it has a replication key set it can have
+standbys of its own. Replication is only for the in-memory mode; the SQL
+backends have their own replication.
+
+Cookbook Dependency Solver
+
+When a node asks for its cookbooks, goiardi searches for a version of every
+cookbook the run list needs that satisfies all of the constraints on it: the
+versions pinned in the run list, the environment's cookbook versions (which
+apply to dependencies as well as to the cookbooks in the run list), and the
+dependencies of every other cookbook version picked. If the newest version of a
+cookbook leads to a conflict further down, older versions are tried. Cookbooks
+that depend on each other are fine.
+
+If no set of versions works, the 412 response explains why in the same format
+as the Chef server's dependency solver errors:
+
+    {"error": [{"message": "No version of lib satisfies all of the constraints on it: '>= 2.0.0' from app 2.0.0, '< 2.0.0' from db 1.0.0.",
+                "non_existent_cookbooks": [],
+                "most_constrained_cookbooks": ["lib"],
+                "unsatisfiable_constraints": [{"cookbook": "lib", "constraint": ">= 2.0.0", "from": "app 2.0.0"},
+                                              {"cookbook": "lib", "constraint": "< 2.0.0", "from": "db 1.0.0"}]}]}
+
+To try the solver out without a node, `POST /_depsolver` with a run list and,
+optionally, an environment (`_default` if left out):
+
+    {"run_list": ["role[web]", "recipe[app]"], "environment": "production"}
+
+Roles in the run list are expanded with their run list for that environment,
+and the response has the expanded run list and the version of each cookbook
+that would be used, or the same 412 explanation if there isn't a solution.
+
 Berks Universe Endpoint
 
 Starting with version 0.6.1, goiardi supports the berks-api `/universe`
@@ -488,6 +758,248 @@ milliseconds, while MySQL took about 1 second and in-mem took about 1.2 seconds.
 Normal functionality is OK, but if you have that many cookbooks and expect to
 use the universe endpoint often you may wish to consider using Postgres.
 
+Private Supermarket
+
+With `--supermarket` (or `supermarket = true` in the config file), goiardi
+serves a read-only Supermarket compatible API for the cookbooks uploaded to it,
+so berks and `knife supermarket` can find and download internal cookbooks
+straight from goiardi. Like Supermarket itself, requests to this API don't need
+to be signed, so only turn it on if that's all right for your cookbooks. The
+download URLs it hands out are signed like the file store URLs below, though,
+and expire the same way, so with authentication on, only clients that got them
+from the API (or that sign their requests as usual) can download cookbooks,
+unless `--unsigned-file-store` is set.
+
+The endpoints are:
+
+* `GET /api/v1/cookbooks`: a list of cookbooks, paged with the `start` and
+  `items` query parameters (up to 100 at a time).
+* `GET /api/v1/search?q=NAME`: the same, for cookbooks with NAME in their name.
+* `GET /api/v1/cookbooks/NAME`: the cookbook, with its maintainer, description,
+  and the URLs of its versions.
+* `GET /api/v1/cookbooks/NAME/versions/VERSION`: a version of the cookbook, with
+  its license, dependencies, and a link to download it. The version can also be
+  written with underscores (`1_2_3`), or be `latest`.
+* `GET /api/v1/cookbooks/NAME/versions/VERSION/download`: the cookbook version as
+  a gzipped tarball, made from its files in the filestore. If the cookbook was
+  uploaded without a `metadata.json`, one is made from its metadata.
+* `GET /api/v1/universe`: the `/universe` above, but pointing berks at the
+  download URLs.
+
+To use it with berks, add goiardi's API as a source in the Berksfile:
+
+    source "https://goiardi.example.com/api/v1"
+
+and with knife, set `knife[:supermarket_site] = "https://goiardi.example.com"`.
+
+Policyfiles
+
+Goiardi supports Policyfiles, with the `/policies`, `/policy_groups`, and
+`/cookbook_artifacts` endpoints, so `chef push`, `chef show-policy`, and the
+other policy commands in the ChefDK work against it. Cookbook artifacts are
+stored separately from regular cookbooks, identified by a hash of their
+contents rather than by version, and can't be changed once uploaded. Policy
+revisions likewise can't be changed, and a revision can't be deleted while a
+policy group still uses it.
+
+Policies, policy groups, and cookbook artifacts work with the in-memory data
+store and both SQL backends, and are included in exports (which are now
+version 1.2 of the export format; older exports still import fine).
+
+At the moment nodes don't keep track of their `policy_name` and
+`policy_group`, so searching for nodes by policy isn't possible yet.
+
+Cookbook Tarballs
+
+A whole cookbook version can be downloaded as a gzipped tarball with a GET to
+`/cookbooks/<name>/<version>/_tarball` (`_latest` works for the version too).
+The tarball is made on the fly from the filestore, with every file at its
+original path under a directory named after the cookbook, which makes
+mirroring or archiving cookbooks one request per version.
+
+Going the other way, a cookbook can be uploaded in one request by PUTting a
+gzipped tarball of it to the same URL, with a `Content-Type` of
+`application/x-gzip`. The tarball needs a `metadata.json` (`metadata.rb` can't
+be read by goiardi), either at the top or in a single directory like the
+tarballs goiardi and Supermarket make, and the name and version in it have to
+match the URL. Goiardi stores the files, builds the cookbook version from them,
+and saves it just like one uploaded with knife; uploading over a frozen version
+needs `?force=true`. The tarball may be as big as `--obj-max-size`.
+
+Filestore Layout
+
+Files in the filestore are named by the MD5 checksums chef uses for them. In
+the local filestore directory they're sharded into subdirectories by the first
+two pairs of characters of the checksum, like `ab/cd/abcd1234...`, so no one
+directory ends up with every file in it. Files in a directory from older
+versions of goiardi, which kept them all at the top, are moved into place the
+first time goiardi starts up with it. Files in an S3 bucket aren't sharded,
+since object stores don't have real directories to fill up.
+
+Alongside the MD5 checksum, goiardi records each file's SHA-256 digest. An
+uploader can send the digest in an `X-Content-SHA256` header, as a hex string,
+to have the file checked against it as well, and downloads from the file store
+come with the same header once the digest is known. Files stored before digests
+were recorded get theirs when they're moved into the sharded layout, or from
+the next filestore scrub that quarantines corrupt files.
+
+The header is optional, since knife and chef-client don't send it. Without it
+the upload is only checked against its MD5 checksum; the SHA-256 digest is
+worked out from what was received and recorded, not verified against anything.
+
+S3 Filestore
+
+Cookbook files can be kept in a bucket in S3, or an S3-compatible object store
+like MinIO, instead of in memory or a local directory. That way several goiardi
+servers behind a load balancer can share the same files, which isn't possible
+with `--local-filestore-dir`. Either one is required with MySQL or Postgres.
+The bucket is set up in the `[s3]` table of the config file:
+
+    [s3]
+        bucket = "goiardi-files"
+        endpoint = "http://minio.example.com:9000"
+        access_key = "goiardi"
+        secret_key = "s3kr1t"
+        path_style = true
+
+The region defaults to `us-east-1`, and the endpoint to the AWS endpoint for
+the region. The keys can be left out of the config file and set in the
+`AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY` environment variables instead.
+Most S3-compatible object stores need `path_style`, so the bucket goes in the
+URL's path instead of its hostname, and `prefix` puts the files under a
+"directory" in the bucket. Uploaded files are still checked against their
+checksums before they're stored in the bucket.
+
+Files are downloaded through goiardi from `/file_store/<checksum>` as usual,
+unless `redirect_downloads` is set. Then downloads are redirected to a
+pre-signed URL to fetch the file from the bucket directly, good for
+`url_expiry` (15 minutes by default).
+
+Signed File Store URLs
+
+The file store at `/file_store/<checksum>` doesn't use the usual request
+signing, so when authentication is on, the URLs goiardi hands out for
+uploading files when a sandbox is created and for downloading the files in a
+cookbook version carry an HMAC signature and an expiry time instead. A URL is
+signed for either uploading or downloading one file, and requests without a
+valid, unexpired signature are turned away with a 403. The URLs are good for
+`--file-store-url-expiry` (8 hours by default).
+
+The URLs are signed with `--file-store-url-key`. Without one, a random key is
+made each time goiardi starts, so URLs handed out before a restart stop
+working; servers sharing files behind a load balancer need to have the same
+key. For older clients that fetch files from the file store without the URLs
+goiardi gave them, `--unsigned-file-store` lets unsigned requests through
+again, although signed URLs are still checked. The same goes for the download
+URLs of the Supermarket API, when it's turned on.
+
+Filestore Garbage Collection
+
+Files can get left behind in the filestore when nothing uses them anymore. To
+clean them up, goiardi can collect the files no cookbook version (including
+ones in the trash), cookbook artifact, or sandbox uses, and remove them. Files
+are only removed once they've gone unused for the grace period set with
+`--filestore-gc-grace` (24 hours by default), so files uploaded for a cookbook
+that hasn't been saved yet are left alone. Files in the local filestore
+directory or S3 bucket that the filestore has lost track of are removed too.
+
+A GET to `/_filestore_gc` as an admin gives a dry run report of what would be
+removed, and which unused files are still within the grace period; a POST
+removes them and reports what was removed. To collect unused files
+periodically, set `--filestore-gc-interval` to how often to run, like `24h`.
+
+Filestore Scrubbing
+
+Goiardi can check that every file in the filestore still matches its checksum,
+so damage to the files on disk or in the S3 bucket shows up before a
+chef-client run trips over it. A scrub reads every file back and reports the
+files that are missing from the local filestore directory or bucket, files
+there that the filestore doesn't know about, and files whose contents don't
+match their checksum or SHA-256 digest anymore, along with the cookbook
+versions that use each of them.
+
+A GET to `/_filestore_scrub` as an admin runs a scrub and reports what it
+found. A POST does the same, but also quarantines the corrupt files: they're
+moved into a `.quarantine` directory in the local filestore directory (or under
+the S3 prefix) and forgotten by the filestore, so uploading the cookbooks that
+use them again puts good copies back. It also records the SHA-256 digests of
+files that don't have one yet. To scrub the filestore periodically, set
+`--filestore-scrub-interval` to how often to run, like `168h`; scheduled scrubs
+only quarantine corrupt files with `--filestore-scrub-quarantine`, and log what
+they find.
+
+Sandbox Expiry
+
+Uploading cookbooks goes through a sandbox: knife asks for one with the
+checksums of the cookbook's files, uploads the files the server doesn't have
+yet, and commits the sandbox when it's done. Uploads that get interrupted leave
+sandboxes behind that are never committed, and the files uploaded for them
+would otherwise stay in the filestore forever. Sandboxes that haven't been
+committed within `--sandbox-ttl` (24h by default) expire and can't be committed
+anymore. Once an hour (or more often, with a TTL shorter than that) goiardi
+purges the expired sandboxes, along with the files uploaded for them that no
+cookbook, cookbook artifact, or other sandbox uses. Set `--sandbox-ttl` to `0`
+to keep sandboxes around until they're committed.
+
+A GET to `/sandboxes` as an admin lists the sandboxes that haven't been
+committed yet, with when each was created, its age in seconds, how many files
+it has and how many of them still need to be uploaded, and whether it's
+expired.
+
+Cookbook Version Retention
+
+Cookbooks that get uploaded often pile up a lot of old versions. Goiardi can
+prune them, keeping the latest few versions of each cookbook and deleting the
+rest. The number of versions to keep is set with `--cookbook-keep-versions`,
+and can be set for individual cookbooks in the `[cookbook-keep]` table in the
+config file, like so:
+
+    [cookbook-keep]
+    apache2 = 10
+    ntp = 2
+
+Setting it to 0, the default, keeps every version. Besides the latest versions,
+the versions in use are always kept: the versions that environments' cookbook
+constraints resolve to, versions given explicitly in node and role run lists
+(like `recipe[apache2@1.2.3]`), and the versions chef-client last ran with on
+each node. The dependencies of kept versions are not protected, though, so a
+version that's only used as an old dependency can be pruned. Pruned versions go
+to the trash like any other deleted cookbook version.
+
+A GET to `/_cookbook_retention` as an admin previews which versions of each
+cookbook would be deleted; a POST deletes them and reports what was deleted.
+To prune old versions periodically, set `--cookbook-prune-interval` to how
+often to run, like `24h`. With `--log-events` on, each pruned version is
+logged as deleted by the admin who asked for the pruning, or by the `chef-webui`
+client for scheduled prunings.
+
+Cookbook Deprecation and Yanking
+
+A broken cookbook version can be taken out of circulation without deleting it,
+which would break nodes pinned to it. A version can be marked deprecated, so it
+isn't used when resolving cookbook versions unless something pins that exact
+version (like `= 1.2.0` in an environment or dependency, or
+`recipe[foo@1.2.0]` in a run list), or yanked, so it's never used at all.
+Either way the version stays on the server and can still be downloaded
+directly.
+
+The marks are set with a PUT to `/cookbooks/<name>/<version>/_status` as an
+admin, with a JSON body like `{"deprecated": true}` or `{"yanked": false}`;
+a GET to the same URL shows them. Deprecated and yanked versions have
+`"deprecated": true` or `"yanked": true` in cookbook lists from `/cookbooks`
+and in `/universe`, and changing the marks is recorded in the event log.
+
+Cookbook Version Diffs
+
+To see what changed between two versions of a cookbook, say before promoting
+the newer one in an environment, GET
+`/cookbooks/<name>/_diff?from=1.2.0&to=1.3.0`. The response lists the files
+added, removed, and changed in each part of the cookbook (recipes, templates,
+and so on), compared by checksum, along with the changes to the metadata and,
+separately, to the dependencies. Changed text files come with a unified diff
+made from the files in the filestore. Binary files, files bigger than 1MB, and
+files with too many changes to compare get a `diff_skipped` reason instead.
+
 Serf
 
 As of version 0.8.0, goiardi has some serf integration. At the moment it's
@@ -628,6 +1140,18 @@ it's still not anywhere near a real database with transaction protection, etc.,
 so while it should work fine in the general case, possibilities for data loss
 and corruption do exist. The appropriate caution is warranted.
 
+Data store snapshots start with a header recording the snapshot format version,
+the version of goiardi that saved it, when it was saved, and a checksum of the
+saved data. Goiardi checks the header when loading the data store, and will
+refuse to start from a snapshot that's corrupted or in a format it doesn't
+understand rather than starting with missing data. Snapshots from before the
+header was added are still loaded, but can't be verified.
+
+If "data-file-keep" is set, goiardi keeps that many previous snapshots around
+as <data-file>.1 (the most recent) through <data-file>.N. To start from one of
+them, give its number or path to --load-snapshot. The search index is rebuilt
+after loading an older snapshot.
+
 Documentation
 
 In addition to the aforementioned Chef documentation at http://docs.opscode.com,
@@ -24,10 +24,12 @@ package environment
 import (
 	"database/sql"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/revision"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
 	"sort"
@@ -209,6 +211,12 @@ ValidElem:
 
 // Get an environment.
 func Get(envName string) (*ChefEnvironment, util.Gerror) {
+	return GetFrom(datastore.Dbh, envName)
+}
+
+// GetFrom gets an environment like Get, but with an SQL backend reads it
+// through the given db handle, like a read replica.
+func GetFrom(dbhandle datastore.Dbhandle, envName string) (*ChefEnvironment, util.Gerror) {
 	if envName == "_default" {
 		return defaultEnvironment(), nil
 	}
@@ -216,7 +224,7 @@ func Get(envName string) (*ChefEnvironment, util.Gerror) {
 	var found bool
 	if config.UsingDB() {
 		var err error
-		env, err = getEnvironmentSQL(envName)
+		env, err = getEnvironmentSQL(dbhandle, envName)
 		if err != nil {
 			var gerr util.Gerror
 			if err != sql.ErrNoRows {
@@ -283,18 +291,25 @@ func defaultEnvironment() *ChefEnvironment {
 // Save the environment. Returns an error if you try to save the "_default"
 // environment.
 func (e *ChefEnvironment) Save() util.Gerror {
+	return e.SaveIfMatch("")
+}
+
+// SaveIfMatch saves the environment like Save, but with an SQL backend first
+// checks the environment in the database against an If-Match header while
+// holding a lock on it, and fails with a 412 if it's changed.
+func (e *ChefEnvironment) SaveIfMatch(ifMatch string) util.Gerror {
 	if e.Name == "_default" {
 		err := util.Errorf("The '_default' environment cannot be modified.")
 		err.SetStatus(http.StatusMethodNotAllowed)
 		return err
 	}
 	if config.Config.UseMySQL {
-		err := e.saveEnvironmentMySQL()
+		err := e.saveEnvironmentMySQL(ifMatch)
 		if err != nil {
 			return err
 		}
 	} else if config.Config.UsePostgreSQL {
-		err := e.saveEnvironmentPostgreSQL()
+		err := e.saveEnvironmentPostgreSQL(ifMatch)
 		if err != nil {
 			return err
 		}
@@ -302,6 +317,9 @@ func (e *ChefEnvironment) Save() util.Gerror {
 		ds := datastore.New()
 		ds.Set("env", e.Name, e)
 	}
+	if err := revision.Record("environment", e.Name, revision.ActionSave, e); err != nil {
+		logger.Errorf("Error recording revision of environment %s: %s", e.Name, err.Error())
+	}
 	indexer.IndexObj(e)
 	return nil
 }
@@ -321,6 +339,9 @@ func (e *ChefEnvironment) Delete() error {
 		ds := datastore.New()
 		ds.Delete("env", e.Name)
 	}
+	if err := revision.Record("environment", e.Name, revision.ActionDelete, e); err != nil {
+		logger.Errorf("Error recording revision of environment %s: %s", e.Name, err.Error())
+	}
 	indexer.DeleteItemFromCollection("environment", e.Name)
 	return nil
 }
@@ -415,9 +436,21 @@ func (e *ChefEnvironment) Flatten() []string {
 
 // AllEnvironments returns a slice of all environments on this server.
 func AllEnvironments() []*ChefEnvironment {
+	environments, err := AllEnvironmentsTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all environments: %s", err.Error())
+	}
+	return environments
+}
+
+// AllEnvironmentsTx returns a slice of all environments on this server like
+// AllEnvironments, but with an SQL backend reads them through the given db
+// handle. Pass in a transaction to read the environments as part of a
+// consistent snapshot.
+func AllEnvironmentsTx(tx datastore.Dbhandle) ([]*ChefEnvironment, error) {
 	var environments []*ChefEnvironment
 	if config.UsingDB() {
-		environments = allEnvironmentsSQL()
+		return allEnvironmentsSQL(tx)
 	} else {
 		envList := GetList()
 		for _, e := range envList {
@@ -428,5 +461,5 @@ func AllEnvironments() []*ChefEnvironment {
 			environments = append(environments, en)
 		}
 	}
-	return environments
+	return environments, nil
 }
@@ -23,7 +23,7 @@ import (
 	"github.com/ctdk/goiardi/util"
 )
 
-func (e *ChefEnvironment) saveEnvironmentMySQL() util.Gerror {
+func (e *ChefEnvironment) saveEnvironmentMySQL(ifMatch string) util.Gerror {
 	dab, daerr := datastore.EncodeBlob(&e.Default)
 	if daerr != nil {
 		return util.CastErr(daerr)
@@ -41,6 +41,10 @@ func (e *ChefEnvironment) saveEnvironmentMySQL() util.Gerror {
 	if err != nil {
 		return util.CastErr(err)
 	}
+	if gerr := e.checkETagSQL(tx, ifMatch); gerr != nil {
+		tx.Rollback()
+		return gerr
+	}
 
 	_, err = tx.Exec("INSERT INTO environments (name, description, default_attr, override_attr, cookbook_vers, created_at, updated_at) VALUES (?, ?, ?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE description = ?, default_attr = ?, override_attr = ?, cookbook_vers = ?, updated_at = NOW()", e.Name, e.Description, dab, oab, cvb, e.Description, dab, oab, cvb)
 	if err != nil {
@@ -23,7 +23,7 @@ import (
 	"github.com/ctdk/goiardi/util"
 )
 
-func (e *ChefEnvironment) saveEnvironmentPostgreSQL() util.Gerror {
+func (e *ChefEnvironment) saveEnvironmentPostgreSQL(ifMatch string) util.Gerror {
 	dab, daerr := datastore.EncodeBlob(&e.Default)
 	if daerr != nil {
 		return util.CastErr(daerr)
@@ -42,6 +42,10 @@ func (e *ChefEnvironment) saveEnvironmentPostgreSQL() util.Gerror {
 		gerr := util.CastErr(err)
 		return gerr
 	}
+	if gerr := e.checkETagSQL(tx, ifMatch); gerr != nil {
+		tx.Rollback()
+		return gerr
+	}
 
 	_, err = tx.Exec("SELECT goiardi.merge_environments($1, $2, $3, $4, $5)", e.Name, e.Description, dab, oab, cvb)
 	if err != nil {
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
 	"log"
+	"net/http"
 )
 
 /* General SQL functions for environments */
@@ -71,7 +73,31 @@ func (e *ChefEnvironment) fillEnvFromSQL(row datastore.ResRow) error {
 	return nil
 }
 
-func getEnvironmentSQL(envName string) (*ChefEnvironment, error) {
+// checkETagSQL locks the environment's row until the transaction is over, and
+// makes sure it still matches the If-Match header.
+func (e *ChefEnvironment) checkETagSQL(tx datastore.Dbhandle, ifMatch string) util.Gerror {
+	if ifMatch == "" {
+		return nil
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name, description, default_attr, override_attr, cookbook_vers FROM environments WHERE name = ? FOR UPDATE"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name, description, default_attr, override_attr, cookbook_vers FROM goiardi.environments WHERE name = $1 FOR UPDATE"
+	}
+	cur := new(ChefEnvironment)
+	err := cur.fillEnvFromSQL(tx.QueryRow(sqlStatement, e.Name))
+	if err == sql.ErrNoRows {
+		return util.ETagMismatch()
+	} else if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return gerr
+	}
+	return util.CheckETag(ifMatch, cur)
+}
+
+func getEnvironmentSQL(dbhandle datastore.Dbhandle, envName string) (*ChefEnvironment, error) {
 	env := new(ChefEnvironment)
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -79,7 +105,7 @@ func getEnvironmentSQL(envName string) (*ChefEnvironment, error) {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT name, description, default_attr, override_attr, cookbook_vers FROM goiardi.environments WHERE name = $1"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +172,7 @@ func getEnvironmentList() []string {
 	return envList
 }
 
-func allEnvironmentsSQL() []*ChefEnvironment {
+func allEnvironmentsSQL(dbhandle datastore.Dbhandle) ([]*ChefEnvironment, error) {
 	var environments []*ChefEnvironment
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -154,29 +180,30 @@ func allEnvironmentsSQL() []*ChefEnvironment {
 	} else if config.Config.UsePostgreSQL {
 		sqlStatement = "SELECT name, description, default_attr, override_attr, cookbook_vers FROM goiardi.environments WHERE name <> '_default'"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return environments
+			return environments, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		env := new(ChefEnvironment)
 		err = env.fillEnvFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		environments = append(environments, env)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return environments
+	return environments, nil
 }
@@ -65,6 +65,11 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 
 	pathArrayLen := len(pathArray)
 
+	if pathArrayLen > 2 && pathArray[2] == "_revisions" {
+		revisionHandler(w, r, opUser, "environment", pathArray[1], pathArray[3:])
+		return
+	}
+
 	if pathArrayLen == 1 {
 		switch r.Method {
 		case "GET":
@@ -121,7 +126,10 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 		 * object, so we do the json encoding in this block and return
 		 * out. */
 		envName := pathArray[1]
-		env, err := environment.Get(envName)
+		if r.Method == "PUT" {
+			defer lockObject("environment", envName)()
+		}
+		env, err := environment.GetFrom(readDbh(r), envName)
 		delEnv := false /* Set this to delete the environment after
 		 * sending the json. */
 		if err != nil {
@@ -146,6 +154,9 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 					jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 					return
 				}
+				if notModified(w, r, env) {
+					return
+				}
 			}
 		case "PUT":
 			if !opUser.IsAdmin() {
@@ -174,6 +185,13 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, "Environment name missing", http.StatusBadRequest)
 				return
 			}
+			if preconditionFailed(w, r, env) {
+				return
+			}
+			// Only an update of the environment itself is checked
+			// against If-Match again when it's saved, not a
+			// renamed copy.
+			var ifMatch string
 			if envName != envData["name"].(string) {
 				env, err = environment.Get(envData["name"].(string))
 				if err == nil {
@@ -186,6 +204,7 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 					jsonErrorReport(w, r, eerr.Error(), eerr.Status())
 					return
 				}
+				setETag(w, env)
 				w.WriteHeader(http.StatusCreated)
 				oldenv, olderr := environment.Get(envName)
 				if olderr == nil {
@@ -199,8 +218,11 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 					jsonErrorReport(w, r, err.Error(), err.Status())
 					return
 				}
+				setETag(w, env)
+				ifMatch = r.Header.Get("If-Match")
 			}
-			if err := env.Save(); err != nil {
+			if err := env.SaveIfMatch(ifMatch); err != nil {
+				w.Header().Del("ETag")
 				jsonErrorReport(w, r, err.Error(), err.Status())
 				return
 			}
@@ -243,7 +265,7 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		env, err := environment.Get(envName)
+		env, err := environment.GetFrom(readDbh(r), envName)
 		if err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 			return
@@ -271,9 +293,9 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, "POSTed JSON badly formed.", http.StatusMethodNotAllowed)
 				return
 			}
-			deps, err := cookbook.DependsCookbooks(cbVer["run_list"].([]string), env.CookbookVersions)
+			deps, err := cookbook.DependsCookbooksFrom(readDbh(r), cbVer["run_list"].([]string), env.CookbookVersions)
 			if err != nil {
-				jsonErrorReport(w, r, err.Error(), http.StatusPreconditionFailed)
+				dependencyErrorReport(w, r, err)
 				return
 			}
 			/* Need our own encoding here too. */
@@ -325,7 +347,7 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 			return
 		}
-		env, err := environment.Get(envName)
+		env, err := environment.GetFrom(readDbh(r), envName)
 		if err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 			return
@@ -336,7 +358,7 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 		 * same, but it makes clients and chef-pedant somewhat unhappy
 		 * to not have this way available. */
 		if op == "roles" {
-			role, err := role.Get(opName)
+			role, err := role.GetFrom(readDbh(r), opName)
 			if err != nil {
 				jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 				return
@@ -349,7 +371,7 @@ func environmentHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			envResponse["run_list"] = runList
 		} else if op == "cookbooks" {
-			cb, err := cookbook.Get(opName)
+			cb, err := cookbook.GetFrom(readDbh(r), opName)
 			if err != nil {
 				jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 				return
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Conditional requests with ETags, so clients can avoid stomping on each
+// other's changes.
+
+package main
+
+import (
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/util"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Conditional updates lock the object they're changing for the length of the
+// request, so the If-Match check and the save can't be interleaved with
+// another update. Rather than keeping a lock around for every object, the
+// locks are striped. These locks only exist within this process, so with an
+// SQL backend the If-Match header is also checked again in the database when
+// the object's saved, against the object's row locked in the save's
+// transaction, in case another goiardi sharing the database has changed it.
+var objLocks [64]sync.Mutex
+
+func lockObject(objType string, name string) func() {
+	m := &objLocks[objLockStripe(objType, name)]
+	m.Lock()
+	return m.Unlock
+}
+
+// lockObjects locks several objects at once, each given as its type and name.
+// The locks aren't reentrant, so the stripes are locked in order and a stripe
+// shared by more than one of the objects is only locked once.
+func lockObjects(objs ...[2]string) func() {
+	stripes := make([]int, 0, len(objs))
+	for _, o := range objs {
+		stripes = append(stripes, objLockStripe(o[0], o[1]))
+	}
+	sort.Ints(stripes)
+	var locked []*sync.Mutex
+	for i, st := range stripes {
+		if i > 0 && st == stripes[i-1] {
+			continue
+		}
+		m := &objLocks[st]
+		m.Lock()
+		locked = append(locked, m)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].Unlock()
+		}
+	}
+}
+
+func objLockStripe(objType string, name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(objType))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(objLocks)))
+}
+
+// setETag sets the ETag header for an object that's being sent back to the
+// client, and returns the etag.
+func setETag(w http.ResponseWriter, obj interface{}) string {
+	etag, err := util.ETag(obj)
+	if err != nil {
+		logger.Errorf("Error making etag: %s", err.Error())
+		return ""
+	}
+	w.Header().Set("ETag", etag)
+	return etag
+}
+
+// notModified sets the ETag header for an object being fetched, and if the
+// client's If-None-Match header matches it sends back a 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	etag := setETag(w, obj)
+	inm := r.Header.Get("If-None-Match")
+	if etag == "" || inm == "" || !util.ETagMatches(inm, etag) {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// saveErrorStatus gives the status to send back when saving an object with an
+// If-Match header fails. It's a 412 if the object was changed in the database
+// after it was checked here, and a 500 otherwise.
+func saveErrorStatus(err error) int {
+	if gerr, ok := err.(util.Gerror); ok && gerr.Status() == http.StatusPreconditionFailed {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// preconditionFailed checks the client's If-Match header against the current
+// state of an object about to be updated. If it doesn't match, somebody else
+// has changed the object since the client last fetched it, so a 412 is sent
+// back and it returns true.
+func preconditionFailed(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return false
+	}
+	etag, err := util.ETag(obj)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if util.ETagMatches(im, etag) {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	jsonErrorReport(w, r, "The object has been modified since it was last fetched", http.StatusPreconditionFailed)
+	return true
+}
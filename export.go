@@ -20,12 +20,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/environment"
 	"github.com/ctdk/goiardi/filestore"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/policy"
 	"github.com/ctdk/goiardi/report"
 	"github.com/ctdk/goiardi/role"
 	"github.com/ctdk/goiardi/sandbox"
@@ -51,31 +54,17 @@ type ExportData struct {
 const ExportMajorVersion = 1
 
 // Minor version number of the export file format.
-const ExportMinorVersion = 1
+const ExportMinorVersion = 2
 
 // Export all data to a json file. This can help with upgrading goiardi if save
 // file compatibitity is broken between releases, or with transferring goiardi
 // data between different backends.
 
 func exportAll(fileName string) error {
-	exportedData := &ExportData{MajorVersion: ExportMajorVersion, MinorVersion: ExportMinorVersion, CreatedTime: time.Now()}
-	exportedData.Data = make(map[string][]interface{})
-	// ... and march through everything.
-	exportedData.Data["client"] = client.ExportAllClients()
-	exportedData.Data["cookbook"] = exportTransformSlice(cookbook.AllCookbooks())
-	exportedData.Data["databag"] = exportTransformSlice(databag.AllDataBags())
-	exportedData.Data["environment"] = exportTransformSlice(environment.AllEnvironments())
-	exportedData.Data["filestore"] = exportTransformSlice(filestore.AllFilestores())
-	exportedData.Data["loginfo"] = exportTransformSlice(loginfo.AllLogInfos())
-	exportedData.Data["node"] = exportTransformSlice(node.AllNodes())
-	exportedData.Data["node_status"] = exportTransformSlice(node.AllNodeStatuses())
-	exportedData.Data["report"] = exportTransformSlice(report.AllReports())
-	exportedData.Data["role"] = exportTransformSlice(role.AllRoles())
-	exportedData.Data["sandbox"] = exportTransformSlice(sandbox.AllSandboxes())
-	exportedData.Data["shovey"] = exportTransformSlice(shovey.AllShoveys())
-	exportedData.Data["shovey_run"] = exportTransformSlice(shovey.AllShoveyRuns())
-	exportedData.Data["shovey_run_stream"] = exportTransformSlice(shovey.AllShoveyRunStreams())
-	exportedData.Data["user"] = user.ExportAllUsers()
+	exportedData, err := snapshotExportData()
+	if err != nil {
+		return err
+	}
 
 	fp, err := os.Create(fileName)
 	if err != nil {
@@ -83,9 +72,126 @@ func exportAll(fileName string) error {
 	}
 	enc := json.NewEncoder(fp)
 	if err = enc.Encode(&exportedData); err != nil {
+		fp.Close()
 		return err
 	}
-	return nil
+	return fp.Close()
+}
+
+// snapshotExportData gathers all of the server's data for exporting from one
+// consistent point in time. With the in-memory data store, changes are held
+// off until everything has been read; with an SQL backend everything is read
+// inside one repeatable read transaction.
+func snapshotExportData() (*ExportData, error) {
+	if config.UsingDB() {
+		tx, err := datastore.BeginSnapshotTx()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		return gatherExportData(tx)
+	}
+	ds := datastore.New()
+	ds.HoldWrites()
+	defer ds.ReleaseWrites()
+	return gatherExportData(nil)
+}
+
+func gatherExportData(tx datastore.Dbhandle) (*ExportData, error) {
+	exportedData := &ExportData{MajorVersion: ExportMajorVersion, MinorVersion: ExportMinorVersion, CreatedTime: time.Now()}
+	exportedData.Data = make(map[string][]interface{})
+	// ... and march through everything.
+	clients, err := client.ExportAllClientsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["client"] = clients
+	cookbooks, err := cookbook.AllCookbooksTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["cookbook"] = exportTransformSlice(cookbooks)
+	artifacts, err := cookbook.AllArtifactsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["cookbook_artifact"] = exportTransformSlice(artifacts)
+	dataBags, err := databag.AllDataBagsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["databag"] = exportTransformSlice(dataBags)
+	environments, err := environment.AllEnvironmentsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["environment"] = exportTransformSlice(environments)
+	filestores, err := filestore.AllFilestoresTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["filestore"] = exportTransformSlice(filestores)
+	logInfos, err := loginfo.AllLogInfosTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["loginfo"] = exportTransformSlice(logInfos)
+	nodes, err := node.AllNodesTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["node"] = exportTransformSlice(nodes)
+	statuses, err := node.AllNodeStatusesTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["node_status"] = exportTransformSlice(statuses)
+	groups, err := policy.AllGroupsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["policy_group"] = exportTransformSlice(groups)
+	revisions, err := policy.AllRevisionsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["policy_revision"] = exportTransformSlice(revisions)
+	reports, err := report.AllReportsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["report"] = exportTransformSlice(reports)
+	roles, err := role.AllRolesTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["role"] = exportTransformSlice(roles)
+	sandboxes, err := sandbox.AllSandboxesTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["sandbox"] = exportTransformSlice(sandboxes)
+	shoveys, err := shovey.AllShoveysTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["shovey"] = exportTransformSlice(shoveys)
+	runs, err := shovey.AllShoveyRunsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["shovey_run"] = exportTransformSlice(runs)
+	streams, err := shovey.AllShoveyRunStreamsTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["shovey_run_stream"] = exportTransformSlice(streams)
+	users, err := user.ExportAllUsersTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	exportedData.Data["user"] = users
+	return exportedData, nil
 }
 
 func exportTransformSlice(data interface{}) []interface{} {
@@ -106,6 +212,11 @@ func exportTransformSlice(data interface{}) []interface{} {
 		for i, v := range data {
 			exp[i] = v
 		}
+	case []*cookbook.CookbookArtifact:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
 	case []*databag.DataBag:
 		exp = make([]interface{}, len(data))
 		for i, v := range data {
@@ -131,6 +242,16 @@ func exportTransformSlice(data interface{}) []interface{} {
 		for i, v := range data {
 			exp[i] = v
 		}
+	case []*policy.Revision:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
+	case []*policy.Group:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
 	case []*report.Report:
 		exp = make([]interface{}, len(data))
 		for i, v := range data {
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/environment"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/role"
+	"sync"
+	"testing"
+)
+
+var gobOnce sync.Once
+
+// exportRoundTrip exports everything and decodes it again, so the data looks
+// the same as it would coming out of a dump file.
+func exportRoundTrip(t *testing.T) *ExportData {
+	exported, err := snapshotExportData()
+	if err != nil {
+		t.Fatalf("exporting data failed: %s", err.Error())
+	}
+	j, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatalf("encoding the export failed: %s", err.Error())
+	}
+	data := &ExportData{}
+	if err = json.Unmarshal(j, data); err != nil {
+		t.Fatalf("decoding the export failed: %s", err.Error())
+	}
+	return data
+}
+
+func setupExportObjects(t *testing.T, prefix string) {
+	gobOnce.Do(gobRegister)
+	e, _ := environment.New(prefix + "_env")
+	e.Description = "round trip"
+	if err := e.Save(); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := role.New(prefix + "_role")
+	r.RunList = []string{"recipe[foo]"}
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := node.New(prefix + "_node")
+	n.ChefEnvironment = prefix + "_env"
+	n.Normal["foo"] = "bar"
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := databag.New(prefix + "_bag")
+	if err := d.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.NewDBItem(map[string]interface{}{"id": "item1", "foo": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deleteExportObjects(t *testing.T, prefix string) {
+	if e, err := environment.Get(prefix + "_env"); err == nil {
+		e.Delete()
+	}
+	if r, err := role.Get(prefix + "_role"); err == nil {
+		r.Delete()
+	}
+	if n, err := node.Get(prefix + "_node"); err == nil {
+		n.Delete()
+	}
+	if d, err := databag.Get(prefix + "_bag"); err == nil {
+		d.Delete()
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	setupExportObjects(t, "rt")
+	data := exportRoundTrip(t)
+	if data.MajorVersion != ExportMajorVersion || data.MinorVersion != ExportMinorVersion {
+		t.Errorf("export version should have been %d.%d, got %d.%d", ExportMajorVersion, ExportMinorVersion, data.MajorVersion, data.MinorVersion)
+	}
+	deleteExportObjects(t, "rt")
+	if _, err := node.Get("rt_node"); err == nil {
+		t.Fatalf("node rt_node still existed after being deleted")
+	}
+
+	if _, err := importData(data, &importOptions{conflict: importConflictOverwrite}); err != nil {
+		t.Fatalf("importing the export failed: %s", err.Error())
+	}
+
+	e, err := environment.Get("rt_env")
+	if err != nil {
+		t.Errorf("environment rt_env was not imported: %s", err.Error())
+	} else if e.Description != "round trip" {
+		t.Errorf("environment rt_env description should have been 'round trip', got '%s'", e.Description)
+	}
+	r, rerr := role.Get("rt_role")
+	if rerr != nil {
+		t.Errorf("role rt_role was not imported: %s", rerr.Error())
+	} else if len(r.RunList) != 1 || r.RunList[0] != "recipe[foo]" {
+		t.Errorf("role rt_role run list should have been [recipe[foo]], got %v", r.RunList)
+	}
+	n, err := node.Get("rt_node")
+	if err != nil {
+		t.Errorf("node rt_node was not imported: %s", err.Error())
+	} else {
+		if n.ChefEnvironment != "rt_env" {
+			t.Errorf("node rt_node environment should have been rt_env, got %s", n.ChefEnvironment)
+		}
+		if n.Normal["foo"] != "bar" {
+			t.Errorf("node rt_node normal attribute foo should have been 'bar', got %v", n.Normal["foo"])
+		}
+	}
+	d, derr := databag.Get("rt_bag")
+	if derr != nil {
+		t.Errorf("data bag rt_bag was not imported: %s", derr.Error())
+	} else if dbi, err := d.GetDBItem("item1"); err != nil {
+		t.Errorf("data bag item rt_bag/item1 was not imported: %s", err.Error())
+	} else if dbi.RawData["foo"] != "bar" {
+		t.Errorf("data bag item rt_bag/item1 foo should have been 'bar', got %v", dbi.RawData["foo"])
+	}
+
+	// Exporting again after the import should give the same objects back.
+	again := exportRoundTrip(t)
+	for _, k := range []string{"environment", "role", "node", "databag"} {
+		if len(again.Data[k]) != len(data.Data[k]) {
+			t.Errorf("expected %d %s objects after the import, got %d", len(data.Data[k]), k, len(again.Data[k]))
+		}
+	}
+}
@@ -21,8 +21,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/util"
 	"net/http"
 )
 
@@ -31,18 +34,47 @@ func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
 	 * for obvious reasons. Still do for the PUT/POST though. */
 	chksum := r.URL.Path[12:]
 
-	/* Eventually, both local storage (in-memory or on disk, depending) or
-	 * uploading to s3 or a similar cloud storage provider needs to be
-	 * supported. */
+	/* The file store skips the usual authentication, so the URLs given
+	 * out for files are signed instead. */
+	if err := checkFileStoreURL(r); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		jsonErrorReport(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		w.Header().Set("Content-Type", "application/x-binary")
 		fileStore, err := filestore.Get(chksum)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		w.Write(*fileStore.Data)
+		/* Let clients fetch files straight from an S3 bucket, if
+		 * that's been turned on. */
+		if config.Config.S3.RedirectDownloads {
+			signedURL, err := fileStore.SignedURL(config.Config.S3.URLExpiryDur)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if signedURL != "" {
+				http.Redirect(w, r, signedURL, http.StatusFound)
+				return
+			}
+		}
+		content, err := fileStore.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer content.Close()
+		if fileStore.SHA256 != "" {
+			w.Header().Set("X-Content-SHA256", fileStore.SHA256)
+		}
+		/* ServeContent takes care of Range and conditional
+		 * requests. */
+		http.ServeContent(w, r, chksum, content.ModTime, content)
 	case "PUT", "POST": /* Seems like for file uploads we ought to
 		 * support POST too. */
 		w.Header().Set("Content-Type", "application/json")
@@ -56,11 +88,29 @@ func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, fileErr.Error(), http.StatusOK)
 			return
 		}
-		fileStore, err := filestore.New(chksum, r.Body, r.ContentLength)
+		/* Uploads too big for the file store with a length are
+		 * turned away before getting here, but chunked uploads don't
+		 * say how big they are, so they're cut off at the limit. */
+		body := http.MaxBytesReader(w, r.Body, config.Config.ObjMaxSize)
+		fileStore, err := filestore.New(chksum, body, r.ContentLength)
 		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				jsonErrorReport(w, r, "Content-length too long!", http.StatusRequestEntityTooLarge)
+				return
+			}
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		/* Uploaders can send the file's SHA-256 digest too, to have
+		 * it checked. Without it the digest is only recorded, not
+		 * verified. */
+		if digest := r.Header.Get("X-Content-SHA256"); digest != "" {
+			if err = fileStore.VerifySHA256(digest); err != nil {
+				jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		err = fileStore.Save()
 		if err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -77,3 +127,21 @@ func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
 		jsonErrorReport(w, r, "Unrecognized method!", http.StatusMethodNotAllowed)
 	}
 }
+
+// checkFileStoreURL makes sure a request to the file store has a valid,
+// unexpired signature when authentication is turned on. Standbys fetching
+// files with the replication key, and unsigned requests from older clients
+// when --unsigned-file-store is set, are let through as well.
+func checkFileStoreURL(r *http.Request) error {
+	if !config.Config.UseAuth || replicationKeyOK(r) {
+		return nil
+	}
+	query := r.URL.Query()
+	if config.Config.UnsignedFileStore && query.Get("signature") == "" {
+		return nil
+	}
+	if err := util.CheckFileStoreURL(r.Method, r.URL.Path, query); err != nil {
+		return err
+	}
+	return nil
+}
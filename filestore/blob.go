@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+// BlobStore is where the contents of the files in the filestore are kept,
+// when they aren't kept in memory. Files in a blob store are named by their
+// checksums.
+type BlobStore interface {
+	// TempDir is the directory new files are written to while they're
+	// uploaded and checked against their checksums.
+	TempDir() string
+	// Store moves a new file from the given temporary file, once it's
+	// been checked, into the blob store.
+	Store(chksum string, tmpPath string) error
+	// Open opens a file for reading.
+	Open(chksum string) (*Content, error)
+	// Stat returns when a file was stored, or an error satisfying
+	// os.IsNotExist if there is no such file.
+	Stat(chksum string) (time.Time, error)
+	// Remove removes a file. Removing a file that isn't there is not an
+	// error.
+	Remove(chksum string) error
+	// List lists all the files in the blob store.
+	List() ([]BlobInfo, error)
+	// Quarantine moves a damaged file out of the way, where it won't be
+	// served or listed but can still be looked at.
+	Quarantine(chksum string) error
+	// SignedURL returns a URL the file can be downloaded from directly
+	// for the given length of time, or "" if the blob store can't make
+	// one.
+	SignedURL(chksum string, expires time.Duration) (string, error)
+}
+
+// Damaged files are moved here, under the local filestore directory or the
+// S3 prefix.
+const quarantineDir = ".quarantine"
+
+// BlobInfo describes a file in a blob store.
+type BlobInfo struct {
+	Name    string
+	ModTime time.Time
+}
+
+// Blobs returns the blob store set up in the config: the local filestore
+// directory, or a bucket in S3 or an S3-compatible object store. It returns
+// nil if the filestore's files are kept in memory.
+func Blobs() BlobStore {
+	if config.Config.LocalFstoreDir != "" {
+		return LocalBlobs(config.Config.LocalFstoreDir)
+	}
+	if config.Config.S3.Bucket != "" {
+		return newS3Blobs(&config.Config.S3)
+	}
+	return nil
+}
+
+// LocalBlobs keeps files in a directory on the local disk. So no one directory
+// gets too big, files are sharded into subdirectories by the first two pairs
+// of characters of their checksums, like ab/cd/abcd1234...
+type LocalBlobs string
+
+// shard returns the subdirectory a file is kept in, or "" for things in the
+// directory that aren't named by a checksum, like temporary upload files.
+func shard(chksum string) string {
+	if !validChksum.MatchString(chksum) {
+		return ""
+	}
+	return path.Join(chksum[0:2], chksum[2:4])
+}
+
+// The names of shard subdirectories.
+var shardDir = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+func (l LocalBlobs) path(chksum string) string {
+	return path.Join(string(l), shard(chksum), chksum)
+}
+
+// writeFile writes a file's data straight to its place in the directory.
+func (l LocalBlobs) writeFile(chksum string, data []byte) error {
+	if err := os.MkdirAll(path.Join(string(l), shard(chksum)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path(chksum), data, 0644)
+}
+
+// TempDir returns the directory itself, so new files can be moved into place
+// without copying them.
+func (l LocalBlobs) TempDir() string {
+	return string(l)
+}
+
+// Store moves the new file into place.
+func (l LocalBlobs) Store(chksum string, tmpPath string) error {
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(string(l), shard(chksum)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path(chksum))
+}
+
+// Open opens the file on disk.
+func (l LocalBlobs) Open(chksum string) (*Content, error) {
+	fp, err := os.Open(l.path(chksum))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &Content{ReadSeeker: fp, Size: stat.Size(), ModTime: stat.ModTime(), closer: fp}, nil
+}
+
+// Stat returns when the file on disk was last written.
+func (l LocalBlobs) Stat(chksum string) (time.Time, error) {
+	fi, err := os.Stat(l.path(chksum))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Remove removes the file from the disk.
+func (l LocalBlobs) Remove(chksum string) error {
+	err := os.Remove(l.path(chksum))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List lists the files in the directory and its shard subdirectories. Files
+// that aren't in the right shard for their checksum, like ones left from
+// before the directory was sharded, aren't included.
+func (l LocalBlobs) List() ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		files, err := ioutil.ReadDir(path.Join(string(l), dir))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if fi.IsDir() {
+				if depth < 2 && shardDir.MatchString(fi.Name()) {
+					if err := walk(path.Join(dir, fi.Name()), depth+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if shard(fi.Name()) == dir {
+				blobs = append(blobs, BlobInfo{Name: fi.Name(), ModTime: fi.ModTime()})
+			}
+		}
+		return nil
+	}
+	if err := walk("", 0); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// Quarantine moves the file into the quarantine directory inside the
+// directory.
+func (l LocalBlobs) Quarantine(chksum string) error {
+	qdir := path.Join(string(l), quarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(l.path(chksum), path.Join(qdir, chksum))
+}
+
+// SignedURL returns "", since files on the local disk can only be downloaded
+// through goiardi.
+func (l LocalBlobs) SignedURL(chksum string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// Content is the open contents of a file in the filestore.
+type Content struct {
+	io.ReadSeeker
+	Size    int64
+	ModTime time.Time
+	closer  io.Closer
+}
+
+// Close closes the file's contents.
+func (c *Content) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// notFound is returned when a blob store doesn't have a file, so it can be
+// told apart with os.IsNotExist.
+func notFound(chksum string) error {
+	return &os.PathError{Op: "open", Path: chksum, Err: os.ErrNotExist}
+}
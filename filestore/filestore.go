@@ -23,73 +23,125 @@
 // rather than the file name.
 //
 // If config.Config.LocalFstoreDir is != "", the content of the files will be
-// stored in that directory.
+// stored in that directory, sharded into subdirectories by checksum. If an S3 bucket is configured instead, they're
+// stored in the bucket.
 package filestore
 
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"io"
+	"io/ioutil"
 	"os"
-	"path"
+	"strings"
+	"time"
 )
 
 /* Local filestorage struct. Add fields as needed. */
 
 // FileStore is an individual file in the filestore. Note that there is no
 // actual name for the file used, but it is identified by the file's checksum.
-// The file's data is stored as a pointer to an array of bytes.
+// The file's data is stored as a pointer to an array of bytes. Alongside the
+// MD5 checksum chef uses, the file's SHA-256 digest is recorded so the file
+// can be checked with something harder to forge; it's empty for files stored
+// before digests were recorded until they're next checked.
 type FileStore struct {
-	Chksum string
-	Data   *[]byte
+	Chksum  string
+	SHA256  string
+	Data    *[]byte
+	tmpPath string
 }
 
+// New files are streamed to temporary files with this prefix in the local
+// filestore directory before being moved into place.
+const uploadPrefix = ".upload-"
+
 /* New, for this, includes giving it the file data */
 
 // New creates a new filestore item with the given checksum, io.ReadCloser
-// holding the file's data, and the length of the file. If the file data's
-// checksum does not match the provided checksum an error will be trhown.
+// holding the file's data, and the length of the file, or -1 if the length
+// isn't known. If the file data's checksum does not match the provided
+// checksum an error will be trhown. The file's SHA-256 digest is worked out
+// along the way. When files are kept in a blob store, the data is streamed to
+// a temporary file as it's read, and only moved into the blob store when the
+// item is saved.
 func New(chksum string, data io.ReadCloser, dataLength int64) (*FileStore, error) {
-	f, err := Get(chksum)
-	if err == nil {
-		// if err is nil, wait until checking the uploaded content to
-		// see if it's the same as what we have already
-		err = fmt.Errorf("File with checksum %s already exists.", chksum)
-	}
-	/* Read the data in */
-	fileData := make([]byte, dataLength)
-	if n, err := io.ReadFull(data, fileData); err != nil {
-		/* Something went wrong reading the data! */
-		readErr := fmt.Errorf("Only read %d bytes (out of %d, supposedly) from io.ReadCloser: %s", n, dataLength, err.Error())
-		return nil, readErr
+	var src io.Reader = data
+	if dataLength >= 0 {
+		src = io.LimitReader(data, dataLength)
 	}
-	if f != nil {
-		if !bytes.Equal(fileData, *f.Data) {
+	verChk := md5.New()
+	digest := sha256.New()
+	filestore := &FileStore{Chksum: chksum}
+
+	var n int64
+	var err error
+	if blobs := Blobs(); blobs != nil {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(blobs.TempDir(), uploadPrefix)
+		if err != nil {
 			return nil, err
 		}
+		n, err = io.Copy(io.MultiWriter(tmp, verChk, digest), src)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		filestore.tmpPath = tmp.Name()
+	} else {
+		var buf bytes.Buffer
+		n, err = io.Copy(io.MultiWriter(&buf, verChk, digest), src)
+		fileData := buf.Bytes()
+		filestore.Data = &fileData
 	}
-	/* Verify checksum. May move to a different function later. */
-	verChk := md5.New()
-	/* try writestring first */
-	verChk.Write(fileData)
+	if err == nil && dataLength >= 0 && n != dataLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		/* Something went wrong reading the data! */
+		filestore.discard()
+		readErr := fmt.Errorf("Only read %d bytes (out of %d, supposedly) from io.ReadCloser: %w", n, dataLength, err)
+		return nil, readErr
+	}
+	/* Verify checksum. */
 	verChksum := fmt.Sprintf("%x", verChk.Sum(nil))
 	if verChksum != chksum {
+		filestore.discard()
 		chkErr := fmt.Errorf("Checksum %s did not match original %s!", verChksum, chksum)
 		return nil, chkErr
 	}
-	filestore := &FileStore{
-		Chksum: chksum,
-		Data:   &fileData,
-	}
+	filestore.SHA256 = fmt.Sprintf("%x", digest.Sum(nil))
 	return filestore, nil
 }
 
-// Get the file with this checksum.
+// VerifySHA256 checks a new filestore item's data against the SHA-256 digest
+// the uploader gave for it, as a hex string. If they don't match, the item's
+// data is thrown away and it can't be saved.
+func (f *FileStore) VerifySHA256(digest string) error {
+	if !strings.EqualFold(digest, f.SHA256) {
+		f.discard()
+		f.Data = nil
+		return fmt.Errorf("SHA-256 digest %s did not match original %s!", f.SHA256, digest)
+	}
+	return nil
+}
+
+// discard removes the temporary file holding a new item's data, if there is
+// one.
+func (f *FileStore) discard() {
+	if f.tmpPath != "" {
+		os.Remove(f.tmpPath)
+		f.tmpPath = ""
+	}
+}
+
+// Get the file with this checksum. Only the file's checksum is filled in when
+// the file's contents are in a blob store; use Open to read them.
 func Get(chksum string) (*FileStore, error) {
 	var filestore *FileStore
 	var found bool
@@ -117,41 +169,65 @@ func Get(chksum string) (*FileStore, error) {
 		err := fmt.Errorf("File with checksum %s not found", chksum)
 		return nil, err
 	}
+	// Checking with an object store for every file would be too slow, so
+	// only files on the local disk are looked for.
 	if config.Config.LocalFstoreDir != "" {
-		if err := filestore.loadData(); err != nil {
+		if _, err := LocalBlobs(config.Config.LocalFstoreDir).Stat(chksum); err != nil {
 			return nil, err
 		}
 	}
 	return filestore, nil
 }
 
+// loadData reads the whole file from the blob store into memory, for
+// exporting.
 func (f *FileStore) loadData() error {
-	/* If this is called, file data is stored on disk */
-	chkPath := path.Join(config.Config.LocalFstoreDir, f.Chksum)
-
-	fp, err := os.Open(chkPath)
+	content, err := f.Open()
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	stat, sterr := fp.Stat()
-	if sterr != nil {
-		return sterr
-	}
-	fdata := make([]byte, stat.Size())
-	n, fperr := fp.Read(fdata)
-	if fperr != nil {
-		return fperr
-	} else if int64(n) != stat.Size() {
-		err = fmt.Errorf("only %d bytes were read from the expected %d", n, stat.Size())
+	defer content.Close()
+	fdata, err := ioutil.ReadAll(content)
+	if err != nil {
 		return err
 	}
 	f.Data = &fdata
 	return nil
 }
 
-// Save a file store item.
+// Open opens the file's contents for reading, from the blob store if there is
+// one. The caller must close it.
+func (f *FileStore) Open() (*Content, error) {
+	blobs := Blobs()
+	if blobs == nil {
+		if f.Data == nil {
+			return nil, fmt.Errorf("File with checksum %s has no data", f.Chksum)
+		}
+		return &Content{ReadSeeker: bytes.NewReader(*f.Data), Size: int64(len(*f.Data))}, nil
+	}
+	return blobs.Open(f.Chksum)
+}
+
+// SignedURL returns a URL the file can be downloaded from directly for the
+// given length of time, if the blob store can make one, or "" otherwise.
+func (f *FileStore) SignedURL(expires time.Duration) (string, error) {
+	blobs := Blobs()
+	if blobs == nil {
+		return "", nil
+	}
+	return blobs.SignedURL(f.Chksum, expires)
+}
+
+// Save a file store item. With a blob store, a new item's data is moved from
+// its temporary file into the blob store.
 func (f *FileStore) Save() error {
+	if blobs := Blobs(); blobs != nil && f.tmpPath != "" {
+		if err := blobs.Store(f.Chksum, f.tmpPath); err != nil {
+			f.discard()
+			return err
+		}
+		f.tmpPath = ""
+	}
 	if config.Config.UseMySQL {
 		err := f.saveMySQL()
 		if err != nil {
@@ -166,18 +242,23 @@ func (f *FileStore) Save() error {
 		ds := datastore.New()
 		ds.Set("filestore", f.Chksum, f)
 	}
+	// Files in an object store are shared with any standbys already.
+	// Standbys fetch new files in the local filestore directory from the
+	// file store themselves, so only the checksum goes in the journal.
 	if config.Config.LocalFstoreDir != "" {
-		fp, err := os.Create(path.Join(config.Config.LocalFstoreDir, f.Chksum))
-		if err != nil {
-			return err
-		}
-		defer fp.Close()
-		_, err = fp.Write(*f.Data)
-		if err != nil {
-			return err
-		}
-		return fp.Close()
+		datastore.Journal(&datastore.Change{Kind: datastore.ChangeBlob, Key: f.Chksum})
+	}
+	return nil
+}
+
+// recordSHA256 saves the SHA-256 digest of a file that's already in the
+// filestore, for files stored before digests were recorded.
+func (f *FileStore) recordSHA256() error {
+	if config.UsingDB() {
+		return f.updateSHA256SQL()
 	}
+	ds := datastore.New()
+	ds.Set("filestore", f.Chksum, f)
 	return nil
 }
 
@@ -193,11 +274,14 @@ func (f *FileStore) Delete() error {
 		ds.Delete("filestore", f.Chksum)
 	}
 
-	if config.Config.LocalFstoreDir != "" {
-		err := os.Remove(path.Join(config.Config.LocalFstoreDir, f.Chksum))
-		if err != nil {
+	if blobs := Blobs(); blobs != nil {
+		// If the file's already gone, there's nothing more to do.
+		if err := blobs.Remove(f.Chksum); err != nil {
 			return err
 		}
+		if config.Config.LocalFstoreDir != "" {
+			datastore.Journal(&datastore.Change{Kind: datastore.ChangeBlobDelete, Key: f.Chksum})
+		}
 	}
 	return nil
 }
@@ -236,11 +320,15 @@ func DeleteHashes(fileHashes []string) {
 			}
 		}
 	}
-	if config.Config.LocalFstoreDir != "" {
+	if blobs := Blobs(); blobs != nil {
 		for _, fh := range fileHashes {
-			err := os.Remove(path.Join(config.Config.LocalFstoreDir, fh))
+			err := blobs.Remove(fh)
 			if err != nil {
 				logger.Errorf(err.Error())
+				continue
+			}
+			if config.Config.LocalFstoreDir != "" {
+				datastore.Journal(&datastore.Change{Kind: datastore.ChangeBlobDelete, Key: fh})
 			}
 		}
 	}
@@ -248,9 +336,21 @@ func DeleteHashes(fileHashes []string) {
 
 // AllFilestores returns all file checksums and their contents, for exporting.
 func AllFilestores() []*FileStore {
+	filestores, err := AllFilestoresTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all file checksums: %s", err.Error())
+	}
+	return filestores
+}
+
+// AllFilestoresTx returns all file checksums and their contents like
+// AllFilestores, but with an SQL backend reads the checksums through the given
+// db handle. Pass in a transaction to read them as part of a consistent
+// snapshot.
+func AllFilestoresTx(tx datastore.Dbhandle) ([]*FileStore, error) {
 	var filestores []*FileStore
 	if config.UsingDB() {
-		filestores = allFilestoresSQL()
+		return allFilestoresSQL(tx)
 	} else {
 		fileList := GetList()
 		for _, f := range fileList {
@@ -259,8 +359,94 @@ func AllFilestores() []*FileStore {
 				logger.Debugf("File checksum %s was in the list of files, but wasn't found when fetched. Continuing.", f)
 				continue
 			}
+			if Blobs() != nil {
+				fl = &FileStore{Chksum: fl.Chksum}
+				if err = fl.loadData(); err != nil {
+					logger.Debugf("File checksum %s couldn't be read: %s. Continuing.", f, err.Error())
+					continue
+				}
+			}
 			filestores = append(filestores, fl)
 		}
 	}
-	return filestores
+	return filestores, nil
+}
+
+// ApplyChange applies a file store change from another server's replication
+// journal, fetching a new file into the local file store directory with fetch
+// or removing one from it.
+func ApplyChange(c *datastore.Change, fetch func(chksum string) (io.ReadCloser, error)) error {
+	if config.Config.LocalFstoreDir == "" {
+		return nil
+	}
+	blobs := LocalBlobs(config.Config.LocalFstoreDir)
+	switch c.Kind {
+	case datastore.ChangeBlob:
+		err := fetchBlob(blobs, c.Key, fetch)
+		// A file that's already been removed again will have its
+		// deletion come along later.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case datastore.ChangeBlobDelete:
+		return blobs.Remove(c.Key)
+	default:
+		return fmt.Errorf("%s is not a file store change", c.Kind)
+	}
+}
+
+// RestoreLocalFiles writes out any files in the in-memory data store that are
+// missing from the local file store directory, like after loading a snapshot
+// from another server. Files whose data isn't in the data store are read from
+// fetch, if it's given.
+func RestoreLocalFiles(fetch func(chksum string) (io.ReadCloser, error)) error {
+	if config.Config.LocalFstoreDir == "" || config.UsingDB() {
+		return nil
+	}
+	blobs := LocalBlobs(config.Config.LocalFstoreDir)
+	ds := datastore.New()
+	for _, chksum := range ds.GetList("filestore") {
+		if _, err := blobs.Stat(chksum); err == nil {
+			continue
+		}
+		f, _ := ds.Get("filestore", chksum)
+		if f != nil && f.(*FileStore).Data != nil {
+			if err := blobs.writeFile(chksum, *f.(*FileStore).Data); err != nil {
+				return err
+			}
+			continue
+		}
+		if fetch == nil {
+			logger.Warningf("File %s has no data to restore", chksum)
+			continue
+		}
+		if err := fetchBlob(blobs, chksum, fetch); err != nil {
+			if os.IsNotExist(err) {
+				logger.Warningf("File %s has no data to restore", chksum)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchBlob reads a file's data from fetch and stores it in the local file
+// store directory, once it's been checked against its checksum.
+func fetchBlob(blobs LocalBlobs, chksum string, fetch func(chksum string) (io.ReadCloser, error)) error {
+	data, err := fetch(chksum)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	f, err := New(chksum, data, -1)
+	if err != nil {
+		return err
+	}
+	if err = blobs.Store(chksum, f.tmpPath); err != nil {
+		f.discard()
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func readContent(t *testing.T, chksum string) string {
+	f, err := Get(chksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != content.Size {
+		t.Errorf("read %d bytes from %s, but its size is %d", len(data), chksum, content.Size)
+	}
+	return string(data)
+}
+
+func TestNewChecksumMismatch(t *testing.T) {
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte("right")))
+	if _, err := New(chksum, ioutil.NopCloser(bytes.NewBufferString("wrong")), 5); err == nil {
+		t.Errorf("New accepted data with the wrong checksum")
+	}
+	if _, err := New(chksum, ioutil.NopCloser(bytes.NewBufferString("righ")), 5); err == nil {
+		t.Errorf("New accepted data shorter than its length")
+	}
+}
+
+func TestLocalFstoreStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	chksum := storeFile(t, "streamed to disk")
+	stored := []string{chksum}
+	defer func() { DeleteHashes(stored) }()
+	if got := readContent(t, chksum); got != "streamed to disk" {
+		t.Errorf("expected 'streamed to disk', got %q", got)
+	}
+	f, _ := Get(chksum)
+	if f.Data != nil {
+		t.Errorf("files in the local filestore directory shouldn't be kept in memory")
+	}
+
+	// A length of -1 reads until the end of the data.
+	content := "unknown length"
+	chksum = fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	f, err = New(chksum, ioutil.NopCloser(bytes.NewBufferString(content)), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	stored = append(stored, chksum)
+	if got := readContent(t, chksum); got != content {
+		t.Errorf("expected %q, got %q", content, got)
+	}
+
+	// Failed uploads don't leave their temporary files behind.
+	if _, err = New(chksum, ioutil.NopCloser(bytes.NewBufferString("wrong")), -1); err == nil {
+		t.Errorf("New accepted data with the wrong checksum")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if !fi.IsDir() {
+			t.Errorf("unexpected file %s left in the filestore directory", fi.Name())
+		}
+	}
+}
+
+func TestApplyBlobChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	content := "replicated"
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	gone := fmt.Sprintf("%x", md5.Sum([]byte("gone")))
+	fetch := func(c string) (io.ReadCloser, error) {
+		if c != chksum {
+			return nil, &os.PathError{Op: "fetch", Path: c, Err: os.ErrNotExist}
+		}
+		return ioutil.NopCloser(bytes.NewBufferString(content)), nil
+	}
+	blobs := LocalBlobs(dir)
+	if err = ApplyChange(&datastore.Change{Kind: datastore.ChangeBlob, Key: chksum}, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(blobs.path(chksum)); err != nil || string(data) != content {
+		t.Errorf("the fetched file wasn't stored: %q, %v", data, err)
+	}
+	// A file removed from the primary before it was fetched is skipped.
+	if err = ApplyChange(&datastore.Change{Kind: datastore.ChangeBlob, Key: gone}, fetch); err != nil {
+		t.Errorf("a missing file wasn't skipped: %s", err.Error())
+	}
+	if err = ApplyChange(&datastore.Change{Kind: datastore.ChangeBlobDelete, Key: chksum}, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = blobs.Stat(chksum); !os.IsNotExist(err) {
+		t.Errorf("the file wasn't removed: %v", err)
+	}
+}
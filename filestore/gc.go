@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SweepReport describes what a sweep of the filestore found, and what it
+// removed (or, with a dry run, would have removed).
+type SweepReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Grace      string   `json:"grace_period"`
+	Referenced int      `json:"referenced"`
+	Total      int      `json:"total"`
+	Removed    []string `json:"removed"`
+	Orphaned   []string `json:"orphaned_files"`
+	Pending    []string `json:"pending"`
+}
+
+var validChksum = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// When unreferenced files with no file on disk to go by were first seen by a
+// sweep, to tell how long they've been unreferenced.
+var unrefSeen = make(map[string]time.Time)
+var unrefLock sync.Mutex
+
+// Sweep removes every file from the filestore that isn't in referenced, once
+// it's been around for longer than the grace period. This includes files in
+// the blob store that the filestore has lost track of. The grace period gives
+// files uploaded for a cookbook that hasn't been saved yet time to be used.
+// With dryRun set, nothing is removed.
+func Sweep(referenced map[string]bool, grace time.Duration, dryRun bool) (*SweepReport, error) {
+	report := &SweepReport{DryRun: dryRun, Grace: grace.String(), Referenced: len(referenced)}
+	report.Removed = make([]string, 0)
+	report.Orphaned = make([]string, 0)
+	report.Pending = make([]string, 0)
+	now := time.Now()
+
+	unrefLock.Lock()
+	defer unrefLock.Unlock()
+	seen := make(map[string]time.Time)
+
+	// When each file in the blob store was stored, to tell how old it is.
+	blobs := Blobs()
+	var stored []BlobInfo
+	storedAt := make(map[string]time.Time)
+	if blobs != nil {
+		var err error
+		if stored, err = blobs.List(); err != nil {
+			return nil, err
+		}
+		for _, b := range stored {
+			storedAt[b.Name] = b.ModTime
+		}
+	}
+
+	fileList := GetList()
+	report.Total = len(fileList)
+	listed := make(map[string]bool, len(fileList))
+	for _, chksum := range fileList {
+		listed[chksum] = true
+		if referenced[chksum] {
+			continue
+		}
+		var age time.Duration
+		if t, ok := storedAt[chksum]; ok {
+			age = now.Sub(t)
+		} else {
+			// Nothing in the blob store to go by, so count from
+			// when it was first found to be unreferenced.
+			first, found := unrefSeen[chksum]
+			if !found {
+				first = now
+			}
+			seen[chksum] = first
+			age = now.Sub(first)
+		}
+		if age < grace {
+			report.Pending = append(report.Pending, chksum)
+			continue
+		}
+		report.Removed = append(report.Removed, chksum)
+		if !dryRun {
+			f := &FileStore{Chksum: chksum}
+			if err := f.Delete(); err != nil {
+				return nil, err
+			}
+			delete(seen, chksum)
+		}
+	}
+	unrefSeen = seen
+
+	// Files in the blob store that aren't in the filestore at all.
+	for _, b := range stored {
+		chksum := b.Name
+		// Uploads that were never finished leave their temporary
+		// files behind.
+		if strings.HasPrefix(chksum, uploadPrefix) && now.Sub(b.ModTime) >= grace {
+			if !dryRun {
+				blobs.Remove(chksum)
+			}
+			continue
+		}
+		if !validChksum.MatchString(chksum) || listed[chksum] || referenced[chksum] {
+			continue
+		}
+		if now.Sub(b.ModTime) < grace {
+			report.Pending = append(report.Pending, chksum)
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, chksum)
+		if !dryRun {
+			if err := blobs.Remove(chksum); err != nil {
+				return nil, err
+			}
+			if config.Config.LocalFstoreDir != "" {
+				datastore.Journal(&datastore.Change{Kind: datastore.ChangeBlobDelete, Key: chksum})
+			}
+		}
+	}
+
+	sort.Strings(report.Removed)
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Pending)
+	return report, nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func init() {
+	gob.Register(new(FileStore))
+}
+
+func storeFile(t *testing.T, content string) string {
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	f, err := New(chksum, ioutil.NopCloser(bytes.NewBufferString(content)), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return chksum
+}
+
+func TestSweep(t *testing.T) {
+	used := storeFile(t, "used")
+	unused := storeFile(t, "unused")
+	referenced := map[string]bool{used: true}
+
+	// The first time an unused file is seen it's within the grace period.
+	report, err := Sweep(referenced, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 0 || len(report.Pending) != 1 || report.Pending[0] != unused {
+		t.Errorf("expected %s to be pending, got %+v", unused, report)
+	}
+
+	// With no grace period, a dry run says it would go but leaves it.
+	report, err = Sweep(referenced, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != unused {
+		t.Errorf("expected %s to be removed, got %+v", unused, report)
+	}
+	if _, err := Get(unused); err != nil {
+		t.Errorf("a dry run removed %s", unused)
+	}
+
+	if _, err = Sweep(referenced, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(unused); err == nil {
+		t.Errorf("%s should have been removed", unused)
+	}
+	if _, err := Get(used); err != nil {
+		t.Errorf("%s is in use and should not have been removed", used)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// MigrateLayout moves the files left directly in the local filestore directory
+// from before it was sharded into their shard subdirectories, recording their
+// SHA-256 digests along the way. It only has anything to do the first time
+// goiardi runs with a directory in the old flat layout. It returns how many
+// files were moved.
+func MigrateLayout() (int, error) {
+	if config.Config.LocalFstoreDir == "" {
+		return 0, nil
+	}
+	blobs := LocalBlobs(config.Config.LocalFstoreDir)
+	files, err := ioutil.ReadDir(string(blobs))
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, fi := range files {
+		chksum := fi.Name()
+		if fi.IsDir() || !validChksum.MatchString(chksum) {
+			continue
+		}
+		flatPath := path.Join(string(blobs), chksum)
+		md5sum, digest, err := digestFile(flatPath)
+		if err != nil {
+			return moved, err
+		}
+		if err = os.MkdirAll(path.Join(string(blobs), shard(chksum)), 0755); err != nil {
+			return moved, err
+		}
+		if err = os.Rename(flatPath, blobs.path(chksum)); err != nil {
+			return moved, err
+		}
+		moved++
+
+		// A damaged file's digest would be wrong too; that's left for
+		// a scrub to find.
+		if md5sum != chksum {
+			logger.Warningf("File %s in the file store doesn't match its checksum", chksum)
+			continue
+		}
+		// Files the filestore doesn't know about are left for
+		// garbage collection.
+		f, err := Get(chksum)
+		if err != nil || f.SHA256 != "" {
+			continue
+		}
+		f.SHA256 = digest
+		if err = f.recordSHA256(); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// digestFile returns the MD5 checksum and SHA-256 digest of a file on disk.
+func digestFile(p string) (string, string, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return "", "", err
+	}
+	defer fp.Close()
+	md5sum := md5.New()
+	digest := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(md5sum, digest), fp); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", md5sum.Sum(nil)), fmt.Sprintf("%x", digest.Sum(nil)), nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestShardedLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	chksum := storeFile(t, "sharded")
+	defer DeleteHashes([]string{chksum})
+	if _, err = os.Stat(path.Join(dir, chksum[0:2], chksum[2:4], chksum)); err != nil {
+		t.Errorf("the file wasn't stored in its shard: %s", err.Error())
+	}
+	f, _ := Get(chksum)
+	if expected := fmt.Sprintf("%x", sha256.Sum256([]byte("sharded"))); f.SHA256 != expected {
+		t.Errorf("expected SHA-256 digest %s, got %q", expected, f.SHA256)
+	}
+	list, err := LocalBlobs(dir).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != chksum {
+		t.Errorf("expected only %s to be listed, got %+v", chksum, list)
+	}
+}
+
+func TestVerifySHA256(t *testing.T) {
+	content := "checked twice"
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	f, err := New(chksum, ioutil.NopCloser(bytes.NewBufferString(content)), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.VerifySHA256(strings.ToUpper(digest)); err != nil {
+		t.Errorf("the right digest was rejected: %s", err.Error())
+	}
+	if err = f.VerifySHA256(strings.Repeat("0", 64)); err == nil {
+		t.Errorf("the wrong digest was accepted")
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	// A file stored in the old flat layout, from before digests were
+	// recorded.
+	content := "flat"
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	if err = ioutil.WriteFile(path.Join(dir, chksum), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ds := datastore.New()
+	ds.Set("filestore", chksum, &FileStore{Chksum: chksum})
+	defer DeleteHashes([]string{chksum})
+
+	moved, err := MigrateLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Errorf("expected 1 file to be moved, got %d", moved)
+	}
+	if got := readContent(t, chksum); got != content {
+		t.Errorf("expected %q, got %q", content, got)
+	}
+	f, _ := Get(chksum)
+	if expected := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); f.SHA256 != expected {
+		t.Errorf("expected the migration to record SHA-256 digest %s, got %q", expected, f.SHA256)
+	}
+	if moved, _ = MigrateLayout(); moved != 0 {
+		t.Errorf("a second migration moved %d files", moved)
+	}
+}
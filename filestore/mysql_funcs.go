@@ -32,7 +32,7 @@ func (f *FileStore) saveMySQL() error {
 		return err
 	}
 
-	_, err = tx.Exec("INSERT IGNORE INTO file_checksums (checksum) VALUES (?)", f.Chksum)
+	_, err = tx.Exec("INSERT IGNORE INTO file_checksums (checksum, sha256) VALUES (?, ?)", f.Chksum, f.sha256Value())
 	if err != nil {
 		tx.Rollback()
 		return err
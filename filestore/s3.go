@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The SHA-256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 won't accept pre-signed URLs that last longer than a week.
+const maxSignedURLExpiry = 7 * 24 * time.Hour
+
+// S3Blobs keeps files in a bucket in S3 or an S3-compatible object store, like
+// MinIO, so that several goiardi servers can share them. Requests are signed
+// with AWS signature version 4.
+type S3Blobs struct {
+	conf     *config.S3Conf
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3Blobs(conf *config.S3Conf) *S3Blobs {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		// The endpoint was checked when the config was loaded.
+		panic(err)
+	}
+	return &S3Blobs{conf: conf, endpoint: endpoint, client: http.DefaultClient}
+}
+
+func (s *S3Blobs) key(chksum string) string {
+	if s.conf.Prefix == "" {
+		return chksum
+	}
+	return path.Join(s.conf.Prefix, chksum)
+}
+
+// objectURL is the URL of an object in the bucket, or of the bucket itself if
+// key is empty.
+func (s *S3Blobs) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	p := "/" + key
+	if s.conf.PathStyle {
+		p = "/" + s.conf.Bucket + p
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + p
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+// TempDir is the system's temporary directory, since new files are uploaded
+// to the bucket once they've been checked.
+func (s *S3Blobs) TempDir() string {
+	return os.TempDir()
+}
+
+// Store uploads the new file to the bucket, and removes the temporary file.
+func (s *S3Blobs) Store(chksum string, tmpPath string) error {
+	fp, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, fp)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "application/x-binary")
+	resp, err := s.request("PUT", s.key(chksum), nil, ioutil.NopCloser(fp), size, hex.EncodeToString(hash.Sum(nil)), hdr)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return os.Remove(tmpPath)
+}
+
+// Open opens the file in the bucket. Its contents are only fetched once
+// they're read, starting from wherever they've been seeked to.
+func (s *S3Blobs) Open(chksum string) (*Content, error) {
+	key := s.key(chksum)
+	resp, err := s.request("HEAD", key, nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	r := &s3Reader{s: s, key: key, size: resp.ContentLength}
+	return &Content{ReadSeeker: r, Size: resp.ContentLength, ModTime: modTime, closer: r}, nil
+}
+
+// Stat returns when the file was uploaded to the bucket.
+func (s *S3Blobs) Stat(chksum string) (time.Time, error) {
+	resp, err := s.request("HEAD", s.key(chksum), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+// Remove removes the file from the bucket.
+func (s *S3Blobs) Remove(chksum string) error {
+	resp, err := s.request("DELETE", s.key(chksum), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List lists the files in the bucket under the prefix.
+func (s *S3Blobs) List() ([]BlobInfo, error) {
+	prefix := ""
+	if s.conf.Prefix != "" {
+		prefix = strings.TrimSuffix(s.conf.Prefix, "/") + "/"
+	}
+	var blobs []BlobInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.request("GET", "", query, nil, 0, emptyPayloadHash, nil)
+		if err != nil {
+			return nil, err
+		}
+		list := new(s3ListResult)
+		err = xml.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			blobs = append(blobs, BlobInfo{Name: name, ModTime: c.LastModified})
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+	return blobs, nil
+}
+
+// Quarantine copies the file into the quarantine "directory" under the
+// prefix, and removes the original.
+func (s *S3Blobs) Quarantine(chksum string) error {
+	hdr := http.Header{}
+	hdr.Set("X-Amz-Copy-Source", s3Escape("/"+s.conf.Bucket+"/"+s.key(chksum), false))
+	resp, err := s.request("PUT", s.key(path.Join(quarantineDir, chksum)), nil, nil, 0, emptyPayloadHash, hdr)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.Remove(chksum)
+}
+
+// SignedURL returns a pre-signed URL to download the file from the bucket
+// directly.
+func (s *S3Blobs) SignedURL(chksum string, expires time.Duration) (string, error) {
+	return s.presign(s.key(chksum), expires, time.Now()), nil
+}
+
+func (s *S3Blobs) presign(key string, expires time.Duration, now time.Time) string {
+	if expires > maxSignedURLExpiry {
+		expires = maxSignedURLExpiry
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	u := s.objectURL(key)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.conf.AccessKey+"/"+s.scope(amzDate))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(query)
+	canonical := strings.Join([]string{"GET", u.RawPath, u.RawQuery, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(amzDate, canonical)
+	return u.String()
+}
+
+// request makes a signed request to the object store, returning an error if
+// it doesn't succeed. A missing object gives an error satisfying
+// os.IsNotExist.
+func (s *S3Blobs) request(method string, key string, query url.Values, body io.ReadCloser, size int64, payloadHash string, hdr http.Header) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+	if size == 0 {
+		// Otherwise an empty body is sent chunked, which S3 won't
+		// take.
+		body = nil
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	req.ContentLength = size
+	s.sign(req, u, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFound(key)
+	}
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(b, &s3Err) != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("S3 %s of %s failed: %s", method, u.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("S3 %s of %s failed: %s: %s", method, u.Path, s3Err.Code, s3Err.Message)
+}
+
+// sign adds an AWS signature version 4 Authorization header to the request,
+// signing the host and any x-amz-* headers.
+func (s *S3Blobs) sign(req *http.Request, u *url.URL, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	names := []string{"host"}
+	values := map[string]string{"host": u.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers string
+	for _, n := range names {
+		headers += n + ":" + values[n] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, u.RawPath, u.RawQuery, headers, signedHeaders, payloadHash}, "\n")
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.conf.AccessKey, s.scope(amzDate), signedHeaders, s.signature(amzDate, canonical))
+	req.Header.Set("Authorization", auth)
+}
+
+func (s *S3Blobs) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.conf.Region + "/s3/aws4_request"
+}
+
+func (s *S3Blobs) signature(amzDate string, canonicalRequest string) string {
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + s.scope(amzDate) + "\n" + hex.EncodeToString(crHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.conf.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way AWS signatures expect: sorted
+// by key, with everything but unreserved characters escaped.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes
+// unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Reader reads an object from the bucket, fetching it from wherever it was
+// last seeked to.
+type s3Reader struct {
+	s      *S3Blobs
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		var hdr http.Header
+		if r.offset > 0 {
+			hdr = http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		}
+		resp, err := r.s.request("GET", r.key, nil, nil, 0, emptyPayloadHash, hdr)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seeking to negative position %d", offset)
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
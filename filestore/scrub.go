@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ScrubReport describes what a scrub of the filestore found: files the
+// filestore has that are missing from the blob store, files in the blob store
+// the filestore doesn't know about, and files whose contents don't match their
+// checksums anymore.
+type ScrubReport struct {
+	Quarantine bool            `json:"quarantine"`
+	Checked    int             `json:"checked"`
+	Missing    []*ScrubbedFile `json:"missing"`
+	Extra      []*ScrubbedFile `json:"extra"`
+	Corrupt    []*ScrubbedFile `json:"corrupt"`
+}
+
+// ScrubbedFile is a file a scrub found something wrong with.
+type ScrubbedFile struct {
+	Checksum string `json:"checksum"`
+	// The cookbook versions that use the file, filled in by the caller.
+	CookbookVersions []string `json:"cookbook_versions,omitempty"`
+	Quarantined      bool     `json:"quarantined,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// Only one scrub runs at a time.
+var scrubLock sync.Mutex
+
+// Scrub reads every file in the filestore back and checks it against its
+// checksum and SHA-256 digest. With quarantine set, corrupt files are moved out
+// of the way in the blob store and forgotten by the filestore, so they'll be
+// asked for again the next time a cookbook using them is uploaded, and files
+// stored before digests were recorded get theirs.
+func Scrub(quarantine bool) (*ScrubReport, error) {
+	scrubLock.Lock()
+	defer scrubLock.Unlock()
+
+	report := &ScrubReport{Quarantine: quarantine}
+	report.Missing = make([]*ScrubbedFile, 0)
+	report.Extra = make([]*ScrubbedFile, 0)
+	report.Corrupt = make([]*ScrubbedFile, 0)
+
+	blobs := Blobs()
+	stored := make(map[string]bool)
+	if blobs != nil {
+		list, err := blobs.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range list {
+			if validChksum.MatchString(b.Name) {
+				stored[b.Name] = true
+			}
+		}
+	}
+
+	fileList := GetList()
+	sort.Strings(fileList)
+	for _, chksum := range fileList {
+		if blobs != nil {
+			if !stored[chksum] {
+				report.Missing = append(report.Missing, &ScrubbedFile{Checksum: chksum})
+				continue
+			}
+			delete(stored, chksum)
+		}
+		f, err := Get(chksum)
+		if err != nil {
+			// Removed since the list was made.
+			continue
+		}
+		if blobs == nil && f.Data == nil {
+			report.Missing = append(report.Missing, &ScrubbedFile{Checksum: chksum})
+			continue
+		}
+		report.Checked++
+		ok, err := f.verify(quarantine)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, &ScrubbedFile{Checksum: chksum, Error: err.Error()})
+			continue
+		}
+		if ok {
+			continue
+		}
+		bad := &ScrubbedFile{Checksum: chksum}
+		if quarantine && blobs != nil {
+			if err := f.quarantine(blobs); err != nil {
+				bad.Error = err.Error()
+			} else {
+				bad.Quarantined = true
+				logger.Warningf("Quarantined corrupt file %s from the file store", chksum)
+			}
+		}
+		report.Corrupt = append(report.Corrupt, bad)
+	}
+
+	extra := make([]string, 0, len(stored))
+	for chksum := range stored {
+		extra = append(extra, chksum)
+	}
+	sort.Strings(extra)
+	for _, chksum := range extra {
+		report.Extra = append(report.Extra, &ScrubbedFile{Checksum: chksum})
+	}
+	return report, nil
+}
+
+// verify reads the file's contents and checks them against its checksum, and
+// its SHA-256 digest if it has one. With record set, a file without a digest
+// that matches its checksum has its digest recorded.
+func (f *FileStore) verify(record bool) (bool, error) {
+	content, err := f.Open()
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	h := md5.New()
+	digest := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(h, digest), content); err != nil {
+		return false, err
+	}
+	if !strings.EqualFold(fmt.Sprintf("%x", h.Sum(nil)), f.Chksum) {
+		return false, nil
+	}
+	sha := fmt.Sprintf("%x", digest.Sum(nil))
+	if f.SHA256 == "" {
+		if record {
+			f.SHA256 = sha
+			if err = f.recordSHA256(); err != nil {
+				logger.Errorf("Error recording the SHA-256 digest of file %s: %s", f.Chksum, err.Error())
+			}
+		}
+		return true, nil
+	}
+	return strings.EqualFold(sha, f.SHA256), nil
+}
+
+// quarantine moves a corrupt file out of the way and forgets about it.
+func (f *FileStore) quarantine(blobs BlobStore) error {
+	if err := blobs.Quarantine(f.Chksum); err != nil {
+		return err
+	}
+	if config.UsingDB() {
+		if err := f.deleteSQL(); err != nil {
+			return err
+		}
+	} else {
+		ds := datastore.New()
+		ds.Delete("filestore", f.Chksum)
+	}
+	if config.Config.LocalFstoreDir != "" {
+		datastore.Journal(&datastore.Change{Kind: datastore.ChangeBlobDelete, Key: f.Chksum})
+	}
+	return nil
+}
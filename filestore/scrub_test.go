@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func scrubbed(files []*ScrubbedFile, chksum string) *ScrubbedFile {
+	for _, f := range files {
+		if f.Checksum == chksum {
+			return f
+		}
+	}
+	return nil
+}
+
+func TestScrub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrub-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	good := storeFile(t, "good")
+	corrupt := storeFile(t, "corrupt")
+	missing := storeFile(t, "missing")
+	defer DeleteHashes([]string{good, corrupt, missing})
+	blobs := LocalBlobs(dir)
+	if err = blobs.writeFile(corrupt, []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(blobs.path(missing))
+	extra := fmt.Sprintf("%x", md5.Sum([]byte("extra")))
+	if err = blobs.writeFile(extra, []byte("extra")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Scrub(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := scrubbed(report.Missing, missing); f == nil {
+		t.Errorf("expected %s to be missing", missing)
+	}
+	if f := scrubbed(report.Extra, extra); f == nil {
+		t.Errorf("expected %s to be extra", extra)
+	}
+	if f := scrubbed(report.Corrupt, corrupt); f == nil || f.Quarantined {
+		t.Errorf("expected %s to be corrupt and left alone, got %+v", corrupt, f)
+	}
+	if len(report.Corrupt) != 1 || scrubbed(report.Missing, good) != nil {
+		t.Errorf("%s shouldn't have been reported", good)
+	}
+
+	report, err = Scrub(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := scrubbed(report.Corrupt, corrupt); f == nil || !f.Quarantined {
+		t.Errorf("expected %s to be quarantined, got %+v", corrupt, f)
+	}
+	if _, err = os.Stat(path.Join(dir, quarantineDir, corrupt)); err != nil {
+		t.Errorf("the corrupt file isn't in quarantine: %s", err.Error())
+	}
+	if f, _ := Get(corrupt); f != nil {
+		t.Errorf("the filestore should have forgotten the quarantined file")
+	}
+	if _, err = Get(good); err != nil {
+		t.Errorf("the good file should still be there: %s", err.Error())
+	}
+}
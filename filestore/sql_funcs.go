@@ -30,22 +30,28 @@ func getSQL(chksum string) (*FileStore, error) {
 	filestore := new(FileStore)
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT checksum FROM file_checksums WHERE checksum = ?"
+		sqlStatement = "SELECT checksum, COALESCE(sha256, '') FROM file_checksums WHERE checksum = ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT checksum FROM goiardi.file_checksums WHERE checksum = $1"
+		sqlStatement = "SELECT checksum, COALESCE(sha256, '') FROM goiardi.file_checksums WHERE checksum = $1"
 	}
 	stmt, err := datastore.Dbh.Prepare(sqlStatement)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(chksum).Scan(&filestore.Chksum)
+	err = stmt.QueryRow(chksum).Scan(&filestore.Chksum, &filestore.SHA256)
 	if err != nil {
 		return nil, err
 	}
 	return filestore, nil
 }
 
+// sha256Value is the file's SHA-256 digest to save in the database, or NULL if
+// it isn't known.
+func (f *FileStore) sha256Value() sql.NullString {
+	return sql.NullString{String: f.SHA256, Valid: f.SHA256 != ""}
+}
+
 func (f *FileStore) deleteSQL() error {
 	tx, err := datastore.Dbh.Begin()
 	if err != nil {
@@ -70,6 +76,27 @@ func (f *FileStore) deleteSQL() error {
 	return nil
 }
 
+func (f *FileStore) updateSHA256SQL() error {
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "UPDATE file_checksums SET sha256 = ? WHERE checksum = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "UPDATE goiardi.file_checksums SET sha256 = $1 WHERE checksum = $2"
+	}
+
+	_, err = tx.Exec(sqlStatement, f.SHA256, f.Chksum)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
 func getListSQL() []string {
 	var fileList []string
 	var sqlStatement string
@@ -103,41 +130,43 @@ func getListSQL() []string {
 	return fileList
 }
 
-func allFilestoresSQL() []*FileStore {
+func allFilestoresSQL(dbhandle datastore.Dbhandle) ([]*FileStore, error) {
 	var filestores []*FileStore
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT checksum FROM file_checksums"
+		sqlStatement = "SELECT checksum, COALESCE(sha256, '') FROM file_checksums"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT checksum FROM goiardi.file_checksums"
+		sqlStatement = "SELECT checksum, COALESCE(sha256, '') FROM goiardi.file_checksums"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return filestores
+			return filestores, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		fl := new(FileStore)
-		err = rows.Scan(&fl.Chksum)
+		err = rows.Scan(&fl.Chksum, &fl.SHA256)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		if err = fl.loadData(); err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		filestores = append(filestores, fl)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return filestores
+	return filestores, nil
 }
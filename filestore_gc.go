@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Garbage collection for the filestore, removing files nothing uses anymore.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/sandbox"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Only one collection runs at a time.
+var filestoreGCLock sync.Mutex
+
+func filestoreGCHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+
+	var dryRun bool
+	switch r.Method {
+	case "GET":
+		dryRun = true
+	case "POST":
+		dryRun = false
+	default:
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := collectFilestore(dryRun)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&report); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// collectFilestore finds every file that's still needed by a cookbook,
+// cookbook artifact, or sandbox, and sweeps away the rest.
+func collectFilestore(dryRun bool) (*filestore.SweepReport, error) {
+	filestoreGCLock.Lock()
+	defer filestoreGCLock.Unlock()
+
+	grace := config.Config.FstoreGCGraceDur
+	referenced, err := cookbook.ReferencedHashes()
+	if err != nil {
+		return nil, err
+	}
+	// Files in sandboxes that are still open, or were committed recently
+	// enough that the cookbook they're for may not be saved yet, are in
+	// use too.
+	for _, s := range sandbox.AllSandboxes() {
+		if s.Completed && time.Since(s.CreationTime) >= grace {
+			continue
+		}
+		for _, chksum := range s.Checksums {
+			referenced[chksum] = true
+		}
+	}
+	return filestore.Sweep(referenced, grace, dryRun)
+}
+
+func setFilestoreGCTicker() {
+	if config.Config.FstoreGCIntervalDur <= 0 {
+		return
+	}
+	// Files the primary collects are removed from a standby's file store
+	// when the change replicates, so standbys don't collect their own.
+	runUnlessStandby(config.Config.FstoreGCIntervalDur, func() {
+		report, err := collectFilestore(false)
+		if err != nil {
+			logger.Errorf("Error collecting unused files from the file store: %s", err.Error())
+			return
+		}
+		if n := len(report.Removed) + len(report.Orphaned); n > 0 {
+			logger.Infof("Removed %d unused files from the file store", n)
+		}
+	})
+}
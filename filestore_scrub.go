@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Scrubbing the filestore, checking that its files still match their
+// checksums.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"net/http"
+	"time"
+)
+
+func filestoreScrubHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+
+	var quarantine bool
+	switch r.Method {
+	case "GET":
+		quarantine = false
+	case "POST":
+		quarantine = true
+	default:
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := scrubFilestore(quarantine)
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&report); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// scrubFilestore checks every file in the filestore, and notes which cookbook
+// versions use each of the files with something wrong with them.
+func scrubFilestore(quarantine bool) (*filestore.ScrubReport, error) {
+	report, err := filestore.Scrub(quarantine)
+	if err != nil {
+		return nil, err
+	}
+	versions := cookbook.VersionsByHash()
+	for _, files := range [][]*filestore.ScrubbedFile{report.Missing, report.Extra, report.Corrupt} {
+		for _, f := range files {
+			f.CookbookVersions = versions[f.Checksum]
+		}
+	}
+	return report, nil
+}
+
+func setFilestoreScrubTicker() {
+	if config.Config.FstoreScrubIntervalDur <= 0 {
+		return
+	}
+	ticker := time.NewTicker(config.Config.FstoreScrubIntervalDur)
+	go func() {
+		for _ = range ticker.C {
+			// Standbys check their own files, but leave quarantining
+			// them to the primary.
+			report, err := scrubFilestore(config.Config.FstoreScrubQuarantine && !isStandby())
+			if err != nil {
+				logger.Errorf("Error scrubbing the file store: %s", err.Error())
+				continue
+			}
+			if len(report.Missing)+len(report.Extra)+len(report.Corrupt) > 0 {
+				logger.Warningf("File store scrub found %d missing, %d extra, and %d corrupt files out of %d checked", len(report.Missing), len(report.Extra), len(report.Corrupt), report.Checked)
+			}
+		}
+	}()
+}
@@ -37,17 +37,21 @@ import (
 	"github.com/ctdk/goiardi/indexer"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/policy"
 	"github.com/ctdk/goiardi/report"
+	"github.com/ctdk/goiardi/revision"
 	"github.com/ctdk/goiardi/role"
 	"github.com/ctdk/goiardi/sandbox"
 	"github.com/ctdk/goiardi/serfin"
 	"github.com/ctdk/goiardi/shovey"
+	"github.com/ctdk/goiardi/trash"
 	"github.com/ctdk/goiardi/user"
 	serfclient "github.com/hashicorp/serf/client"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -70,13 +74,34 @@ func main() {
 			logger.Criticalf(derr.Error())
 			os.Exit(1)
 		}
+		if rerr := connectReplicas(); rerr != nil {
+			logger.Criticalf(rerr.Error())
+			os.Exit(1)
+		}
+		// Bring the schema up to date before anything else touches
+		// the database.
+		if merr := migrateSchema(config.Config.DoMigrate || !config.Config.NoAutoMigrate); merr != nil {
+			logger.Criticalf(merr.Error())
+			os.Exit(1)
+		}
+		if config.Config.DoMigrate {
+			os.Exit(0)
+		}
 	}
 
 	gobRegister()
 	ds := datastore.New()
 	if config.Config.FreezeData {
 		if config.Config.DataStoreFile != "" {
-			uerr := ds.Load(config.Config.DataStoreFile)
+			// Unlike the data file, a snapshot that was asked
+			// for specifically needs to be there.
+			if config.Config.LoadSnapshot != "" {
+				if _, serr := os.Stat(snapshotFile()); serr != nil {
+					logger.Criticalf(serr.Error())
+					os.Exit(1)
+				}
+			}
+			uerr := ds.Load(snapshotFile())
 			if uerr != nil {
 				logger.Criticalf(uerr.Error())
 				os.Exit(1)
@@ -87,9 +112,28 @@ func main() {
 			logger.Criticalf(ierr.Error())
 			os.Exit(1)
 		}
+		// The saved index goes with the current data file, not
+		// with an older snapshot, so it needs to be rebuilt.
+		if config.Config.LoadSnapshot != "" {
+			logger.Infof("Rebuilding the search index after loading snapshot %s", snapshotFile())
+			reindexAll()
+		}
+	}
+	// Files from before the local filestore directory was sharded are
+	// moved into place the first time through.
+	if moved, merr := filestore.MigrateLayout(); merr != nil {
+		logger.Criticalf(merr.Error())
+		os.Exit(1)
+	} else if moved > 0 {
+		logger.Infof("Moved %d files in the file store into shard subdirectories", moved)
 	}
 	setSaveTicker()
 	setLogEventPurgeTicker()
+	setTrashPurgeTicker()
+	setFilestoreGCTicker()
+	setFilestoreScrubTicker()
+	setSandboxPurgeTicker()
+	setCookbookPruneTicker()
 
 	/* handle import/export */
 	if config.Config.DoExport {
@@ -143,9 +187,16 @@ func main() {
 		startNodeMonitor()
 	}
 
+	if rerr := startReplication(); rerr != nil {
+		logger.Criticalf(rerr.Error())
+		os.Exit(1)
+	}
+
 	/* Create default clients and users. Currently chef-validator,
-	 * chef-webui, and admin. */
-	createDefaultActors()
+	 * chef-webui, and admin. A standby gets these from its primary. */
+	if !isStandby() {
+		createDefaultActors()
+	}
 	handleSignals()
 
 	/* Register the various handlers, found in their own source files. */
@@ -154,12 +205,18 @@ func main() {
 	http.HandleFunc("/clients/", clientHandler)
 	http.HandleFunc("/cookbooks", cookbookHandler)
 	http.HandleFunc("/cookbooks/", cookbookHandler)
+	http.HandleFunc("/cookbook_artifacts", cookbookArtifactHandler)
+	http.HandleFunc("/cookbook_artifacts/", cookbookArtifactHandler)
 	http.HandleFunc("/data", dataHandler)
 	http.HandleFunc("/data/", dataHandler)
 	http.HandleFunc("/environments", environmentHandler)
 	http.HandleFunc("/environments/", environmentHandler)
 	http.HandleFunc("/nodes", listHandler)
 	http.HandleFunc("/nodes/", nodeHandler)
+	http.HandleFunc("/policies", policyHandler)
+	http.HandleFunc("/policies/", policyHandler)
+	http.HandleFunc("/policy_groups", policyGroupHandler)
+	http.HandleFunc("/policy_groups/", policyGroupHandler)
 	http.HandleFunc("/principals/", principalHandler)
 	http.HandleFunc("/roles", listHandler)
 	http.HandleFunc("/roles/", roleHandler)
@@ -175,8 +232,19 @@ func main() {
 	http.HandleFunc("/events/", eventHandler)
 	http.HandleFunc("/reports/", reportHandler)
 	http.HandleFunc("/universe", universeHandler)
+	http.HandleFunc("/api/v1/", supermarketHandler)
 	http.HandleFunc("/shovey/", shoveyHandler)
 	http.HandleFunc("/status/", statusHandler)
+	http.HandleFunc("/_backup", backupHandler)
+	http.HandleFunc("/_import", importHandler)
+	http.HandleFunc("/_trash", trashHandler)
+	http.HandleFunc("/_trash/", trashHandler)
+	http.HandleFunc("/_depsolver", depsolverHandler)
+	http.HandleFunc("/_filestore_gc", filestoreGCHandler)
+	http.HandleFunc("/_filestore_scrub", filestoreScrubHandler)
+	http.HandleFunc("/_cookbook_retention", cookbookRetentionHandler)
+	http.HandleFunc("/_replication", replicationHandler)
+	http.HandleFunc("/_replication/", replicationHandler)
 
 	/* TODO: figure out how to handle the root & not found pages */
 	http.HandleFunc("/", rootHandler)
@@ -215,7 +283,9 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	/* Make configurable, I guess, but Chef wants it to be 1000000 */
-	if !strings.HasPrefix(r.URL.Path, "/file_store") && r.ContentLength > config.Config.JSONReqMaxSize {
+	/* Imports and cookbook tarballs can carry whole cookbook files, so
+	 * let them be as big as file uploads. */
+	if !strings.HasPrefix(r.URL.Path, "/file_store") && r.URL.Path != "/_import" && !tarballUploadRequest(r) && r.ContentLength > config.Config.JSONReqMaxSize {
 		http.Error(w, "Content-length too long!", http.StatusRequestEntityTooLarge)
 		return
 	} else if r.ContentLength > config.Config.ObjMaxSize {
@@ -253,7 +323,10 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	/* Only perform the authorization check if that's configured. Bomb with
 	 * an error if the check of the headers, timestamps, etc. fails. */
 	/* No clue why /principals doesn't require authorization. Hrmph. */
-	if config.Config.UseAuth && !strings.HasPrefix(r.URL.Path, "/file_store") && !(strings.HasPrefix(r.URL.Path, "/principals") && r.Method == "GET") {
+	/* Standbys replicating from this server use the replication key
+	 * instead. The Supermarket API is read-only and unauthenticated,
+	 * like Supermarket itself. */
+	if config.Config.UseAuth && !strings.HasPrefix(r.URL.Path, "/file_store") && !(strings.HasPrefix(r.URL.Path, "/principals") && r.Method == "GET") && !replicationKeyOK(r) && !supermarketRequest(r) {
 		herr := authentication.CheckHeader(userID, r)
 		if herr != nil {
 			w.Header().Set("Content-Type", "application/json")
@@ -265,6 +338,12 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if isStandby() && !standbyAllowed(r) {
+		w.Header().Set("Content-Type", "application/json")
+		jsonErrorReport(w, r, "This server is a read-only standby", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Experimental: decompress gzipped requests
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		reader, err := gzip.NewReader(r.Body)
@@ -277,6 +356,12 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Body = reader
 	}
 
+	// Send this actor's reads to the primary database for a bit after it
+	// changes anything, in case the replicas haven't caught up yet.
+	if r.Method != "GET" && r.Method != "HEAD" && !depsolverRequest(r) {
+		defer datastore.NoteWrite(r.Header.Get("X-OPS-USERID"))
+	}
+
 	http.DefaultServeMux.ServeHTTP(w, r)
 }
 
@@ -459,6 +544,10 @@ func gobRegister() {
 	gob.Register(uu)
 	li := new(loginfo.LogInfo)
 	gob.Register(li)
+	rh := new(revision.History)
+	gob.Register(rh)
+	tb := new(trash.Bin)
+	gob.Register(tb)
 	mis := map[int]interface{}{}
 	gob.Register(mis)
 	cbv := new(cookbook.CookbookVersion)
@@ -477,6 +566,53 @@ func gobRegister() {
 	gob.Register(ns)
 	msi := make(map[string][]int)
 	gob.Register(msi)
+	ca := new(cookbook.CookbookArtifact)
+	gob.Register(ca)
+	cas := new(cookbook.ArtifactSet)
+	gob.Register(cas)
+	pol := new(policy.Policy)
+	gob.Register(pol)
+	prev := new(policy.Revision)
+	gob.Register(prev)
+	pg := new(policy.Group)
+	gob.Register(pg)
+}
+
+// snapshotFile returns the data store snapshot to load at startup: normally
+// the data file, but an older snapshot if one was asked for with
+// --load-snapshot.
+func snapshotFile() string {
+	snap := config.Config.LoadSnapshot
+	if snap == "" {
+		return config.Config.DataStoreFile
+	}
+	if n, err := strconv.Atoi(snap); err == nil {
+		return datastore.SnapshotPath(config.Config.DataStoreFile, n)
+	}
+	return snap
+}
+
+// connectReplicas connects to any read replicas configured for the SQL
+// backend.
+func connectReplicas() error {
+	if config.Config.UseMySQL {
+		for _, r := range config.Config.MySQL.Replicas {
+			db, err := datastore.ConnectDB("mysql", r)
+			if err != nil {
+				return fmt.Errorf("connecting to MySQL replica %s: %s", r.Address, err.Error())
+			}
+			datastore.AddReplica(db)
+		}
+	} else if config.Config.UsePostgreSQL {
+		for _, r := range config.Config.PostgreSQL.Replicas {
+			db, err := datastore.ConnectDB("postgres", r)
+			if err != nil {
+				return fmt.Errorf("connecting to Postgres replica %s: %s", r.Host, err.Error())
+			}
+			datastore.AddReplica(db)
+		}
+	}
+	return nil
 }
 
 func setSaveTicker() {
@@ -507,6 +643,10 @@ func setLogEventPurgeTicker() {
 		ticker := time.NewTicker(time.Second * time.Duration(60))
 		go func() {
 			for _ = range ticker.C {
+				// Standbys get their purges from the primary.
+				if isStandby() {
+					continue
+				}
 				les, _ := loginfo.GetLogInfos(nil, 0, 1)
 				if len(les) != 0 {
 					p, err := loginfo.PurgeLogInfos(les[0].ID - config.Config.LogEventKeep)
@@ -580,6 +720,9 @@ func startNodeMonitor() {
 		time.Sleep(1 * time.Minute)
 		ticker := time.NewTicker(time.Minute)
 		for _ = range ticker.C {
+			if isStandby() {
+				continue
+			}
 			unseen, err := node.UnseenNodes()
 			if err != nil {
 				logger.Errorf(err.Error())
@@ -29,13 +29,17 @@ import (
 	"github.com/ctdk/goiardi/filestore"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/policy"
 	"github.com/ctdk/goiardi/report"
 	"github.com/ctdk/goiardi/role"
 	"github.com/ctdk/goiardi/sandbox"
 	"github.com/ctdk/goiardi/shovey"
 	"github.com/ctdk/goiardi/user"
+	"github.com/ctdk/goiardi/util"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -44,272 +48,814 @@ func importAll(fileName string) error {
 	if err != nil {
 		return err
 	}
+	defer fp.Close()
 	exportedData := &ExportData{}
 	dec := json.NewDecoder(fp)
 	if err := dec.Decode(&exportedData); err != nil {
 		return err
 	}
 
+	// Importing from the command line has always overwritten whatever was
+	// already there.
+	_, err = importData(exportedData, &importOptions{conflict: importConflictOverwrite})
+	return err
+}
+
+// Policies for dealing with objects in an import that already exist on the
+// server.
+const (
+	importConflictSkip      = "skip"
+	importConflictOverwrite = "overwrite"
+	importConflictFail      = "fail"
+)
+
+// importTypes are the kinds of objects found in an export dump, in the order
+// they need to be imported in.
+var importTypes = []string{"client", "user", "filestore", "cookbook", "databag", "environment", "node", "role", "sandbox", "loginfo", "report", "node_status", "shovey", "shovey_run", "shovey_run_stream", "cookbook_artifact", "policy_revision", "policy_group"}
+
+// Objects of these types are never modified once they've been created, so
+// existing ones are always left alone rather than overwritten.
+var importImmutableTypes = map[string]bool{"filestore": true, "loginfo": true, "report": true, "node_status": true, "shovey": true, "shovey_run": true, "shovey_run_stream": true, "cookbook_artifact": true, "policy_revision": true}
+
+// These types were added to the export format in version 1.1.
+var importMinor1Types = map[string]bool{"node_status": true, "shovey": true, "shovey_run": true, "shovey_run_stream": true}
+
+// These types were added to the export format in version 1.2.
+var importMinor2Types = map[string]bool{"cookbook_artifact": true, "policy_revision": true, "policy_group": true}
+
+type importOptions struct {
+	types    map[string]bool // nil means everything
+	dryRun   bool
+	conflict string
+}
+
+// importReport lists what was (or, with a dry run, would be) done with each
+// object in an import, by type.
+type importReport struct {
+	DryRun    bool                `json:"dry_run"`
+	Conflict  string              `json:"conflict"`
+	Created   map[string][]string `json:"created"`
+	Updated   map[string][]string `json:"updated"`
+	Skipped   map[string][]string `json:"skipped"`
+	Conflicts map[string][]string `json:"conflicts,omitempty"`
+}
+
+type importer struct {
+	data    *ExportData
+	opts    *importOptions
+	report  *importReport
+	curType string
+}
+
+// importData loads the objects in an export dump into goiardi, following the
+// given options.
+func importData(exportedData *ExportData, opts *importOptions) (*importReport, error) {
 	// What versions of the exported data are supported?
-	// At the moment it's only 1.0.
+	// At the moment it's 1.0 through 1.2.
+	if exportedData.MajorVersion != 1 || exportedData.MinorVersion < 0 || exportedData.MinorVersion > ExportMinorVersion {
+		err := util.Errorf("goiardi export data version %d.%d is not supported by this version of goiardi", exportedData.MajorVersion, exportedData.MinorVersion)
+		return nil, err
+	}
+	if opts.conflict == "" {
+		opts.conflict = importConflictSkip
+	}
 
-	if exportedData.MajorVersion == 1 && (exportedData.MinorVersion == 0 || exportedData.MinorVersion == 1) {
-		logger.Infof("Importing data, version %d.%d created on %s", exportedData.MajorVersion, exportedData.MinorVersion, exportedData.CreatedTime)
+	// If any conflict is supposed to stop the import, find that out
+	// before changing anything.
+	if opts.conflict == importConflictFail && !opts.dryRun {
+		checkOpts := *opts
+		checkOpts.dryRun = true
+		check := newImporter(exportedData, &checkOpts)
+		if err := check.run(); err != nil {
+			return nil, err
+		}
+		if len(check.report.Conflicts) != 0 {
+			err := util.Errorf("Some objects in the import already exist")
+			err.SetStatus(http.StatusConflict)
+			return check.report, err
+		}
+	}
 
-		// load clients
-		logger.Infof("Loading clients")
-		for _, v := range exportedData.Data["client"] {
-			c, err := client.NewFromJSON(v.(map[string]interface{}))
-			if err != nil {
-				return err
+	logger.Infof("Importing data, version %d.%d created on %s", exportedData.MajorVersion, exportedData.MinorVersion, exportedData.CreatedTime)
+	im := newImporter(exportedData, opts)
+	err := im.run()
+	return im.report, err
+}
+
+func newImporter(exportedData *ExportData, opts *importOptions) *importer {
+	report := &importReport{DryRun: opts.dryRun, Conflict: opts.conflict}
+	report.Created = make(map[string][]string)
+	report.Updated = make(map[string][]string)
+	report.Skipped = make(map[string][]string)
+	if opts.conflict == importConflictFail {
+		report.Conflicts = make(map[string][]string)
+	}
+	return &importer{data: exportedData, opts: opts, report: report}
+}
+
+func (im *importer) run() (err error) {
+	// Bad data in the dump will generally show up as a failed type
+	// assertion somewhere, so turn that into an error here rather than
+	// crash.
+	defer func() {
+		if r := recover(); r != nil {
+			err = util.Errorf("Malformed %s data in import: %v", im.curType, r)
+		}
+	}()
+	for _, t := range importTypes {
+		if im.opts.types != nil && !im.opts.types[t] {
+			continue
+		}
+		if importMinor1Types[t] && im.data.MinorVersion < 1 {
+			continue
+		}
+		if importMinor2Types[t] && im.data.MinorVersion < 2 {
+			continue
+		}
+		im.curType = t
+		items := im.data.Data[t]
+		if t == "databag" {
+			// older versions of the import expected this key
+			items = append(items, im.data.Data["data_bag"]...)
+		}
+		logger.Infof("Loading %s", t)
+		if err = im.importType(t, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proceed records what's going to happen with an object, and reports whether
+// it should actually be written out.
+func (im *importer) proceed(objType, name string, exists bool) (bool, error) {
+	if !exists {
+		im.report.Created[objType] = append(im.report.Created[objType], name)
+		return !im.opts.dryRun, nil
+	}
+	switch im.opts.conflict {
+	case importConflictOverwrite:
+		if importImmutableTypes[objType] {
+			break
+		}
+		im.report.Updated[objType] = append(im.report.Updated[objType], name)
+		return !im.opts.dryRun, nil
+	case importConflictFail:
+		if im.opts.dryRun {
+			im.report.Conflicts[objType] = append(im.report.Conflicts[objType], name)
+			return false, nil
+		}
+		err := util.Errorf("%s %s already exists", objType, name)
+		err.SetStatus(http.StatusConflict)
+		return false, err
+	}
+	im.report.Skipped[objType] = append(im.report.Skipped[objType], name)
+	return false, nil
+}
+
+func (im *importer) importType(objType string, items []interface{}) error {
+	switch objType {
+	case "client":
+		return im.importClients(items)
+	case "user":
+		return im.importUsers(items)
+	case "filestore":
+		return im.importFilestores(items)
+	case "cookbook":
+		return im.importCookbooks(items)
+	case "databag":
+		return im.importDataBags(items)
+	case "environment":
+		return im.importEnvironments(items)
+	case "node":
+		return im.importNodes(items)
+	case "role":
+		return im.importRoles(items)
+	case "sandbox":
+		return im.importSandboxes(items)
+	case "loginfo":
+		return im.importLogInfos(items)
+	case "report":
+		return im.importReports(items)
+	case "node_status":
+		return im.importNodeStatuses(items)
+	case "shovey":
+		return im.importShoveys(items)
+	case "shovey_run":
+		return im.importShoveyRuns(items)
+	case "shovey_run_stream":
+		return im.importShoveyRunStreams(items)
+	case "cookbook_artifact":
+		return im.importCookbookArtifacts(items)
+	case "policy_revision":
+		return im.importPolicyRevisions(items)
+	case "policy_group":
+		return im.importPolicyGroups(items)
+	}
+	return fmt.Errorf("unknown import type %s", objType)
+}
+
+func (im *importer) importClients(items []interface{}) error {
+	for _, v := range items {
+		cData := v.(map[string]interface{})
+		name, _ := cData["name"].(string)
+		c, cerr := client.Get(name)
+		ok, err := im.proceed("client", name, cerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if cerr == nil {
+			if gerr := c.UpdateFromJSON(cData); gerr != nil {
+				return gerr
 			}
-			c.SetPublicKey(v.(map[string]interface{})["public_key"])
-			gerr := c.Save()
-			if gerr != nil {
+		} else {
+			var gerr util.Gerror
+			if c, gerr = client.NewFromJSON(cData); gerr != nil {
 				return gerr
 			}
 		}
+		c.SetPublicKey(cData["public_key"])
+		if err := c.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// load users
-		logger.Infof("Loading users")
-		for _, v := range exportedData.Data["user"] {
-			pwhash, _ := v.(map[string]interface{})["password"].(string)
-			v.(map[string]interface{})["password"] = ""
-			u, err := user.NewFromJSON(v.(map[string]interface{}))
-			if err != nil {
-				return err
+func (im *importer) importUsers(items []interface{}) error {
+	for _, v := range items {
+		uData := v.(map[string]interface{})
+		name, _ := uData["name"].(string)
+		u, uerr := user.Get(name)
+		ok, err := im.proceed("user", name, uerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		pwhash, _ := uData["password"].(string)
+		uData["password"] = ""
+		if uerr == nil {
+			if gerr := u.UpdateFromJSON(uData); gerr != nil {
+				return gerr
 			}
-			u.SetPasswdHash(pwhash)
-			u.SetPublicKey(v.(map[string]interface{})["public_key"])
-			gerr := u.Save()
-			if gerr != nil {
+		} else {
+			var gerr util.Gerror
+			if u, gerr = user.NewFromJSON(uData); gerr != nil {
 				return gerr
 			}
 		}
+		u.SetPasswdHash(pwhash)
+		u.SetPublicKey(uData["public_key"])
+		if gerr := u.Save(); gerr != nil {
+			return gerr
+		}
+	}
+	return nil
+}
 
-		// load filestore
-		logger.Infof("Loading filestore")
-		for _, v := range exportedData.Data["filestore"] {
-			fileData, err := base64.StdEncoding.DecodeString(v.(map[string]interface{})["Data"].(string))
-			if err != nil {
-				return err
+func (im *importer) importFilestores(items []interface{}) error {
+	for _, v := range items {
+		fData := v.(map[string]interface{})
+		chksum := fData["Chksum"].(string)
+		_, ferr := filestore.Get(chksum)
+		ok, err := im.proceed("filestore", chksum, ferr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		fileData, err := base64.StdEncoding.DecodeString(fData["Data"].(string))
+		if err != nil {
+			return err
+		}
+		fdBuf := bytes.NewBuffer(fileData)
+		fdRc := ioutil.NopCloser(fdBuf)
+		fs, err := filestore.New(chksum, fdRc, int64(fdBuf.Len()))
+		if err != nil {
+			return err
+		}
+		if err = fs.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importCookbooks(items []interface{}) error {
+	for _, v := range items {
+		cbData := v.(map[string]interface{})
+		name := cbData["Name"].(string)
+		cb, cberr := cookbook.Get(name)
+		if cberr != nil {
+			cb = nil
+		}
+		for ver, cbvData := range cbData["Versions"].(map[string]interface{}) {
+			var cbv *cookbook.CookbookVersion
+			if cb != nil {
+				cbv, _ = cb.GetVersion(ver)
 			}
-			fdBuf := bytes.NewBuffer(fileData)
-			fdRc := ioutil.NopCloser(fdBuf)
-			fs, err := filestore.New(v.(map[string]interface{})["Chksum"].(string), fdRc, int64(fdBuf.Len()))
+			ok, err := im.proceed("cookbook", fmt.Sprintf("%s-%s", name, ver), cbv != nil)
 			if err != nil {
 				return err
 			}
-			if err = fs.Save(); err != nil {
-				return err
+			if !ok {
+				continue
+			}
+			if cb == nil {
+				var gerr util.Gerror
+				if cb, gerr = cookbook.New(name); gerr != nil {
+					return gerr
+				}
+				if err := cb.Save(); err != nil {
+					return err
+				}
+			}
+			cbvData, cerr := checkAttrs(cbvData.(map[string]interface{}))
+			if cerr != nil {
+				return cerr
+			}
+			if cbv != nil {
+				if gerr := cbv.UpdateVersion(cbvData, "true"); gerr != nil {
+					return gerr
+				}
+				cb.Versions[ver] = cbv
+				cb.UpdateLatestVersion()
+				if err := cb.Save(); err != nil {
+					return err
+				}
+			} else if _, gerr := cb.NewVersion(ver, cbvData); gerr != nil {
+				return gerr
+			}
+			deprecated, _ := cbvData["deprecated"].(bool)
+			yanked, _ := cbvData["yanked"].(bool)
+			if deprecated || yanked || cbv != nil {
+				if _, gerr := cb.SetVersionStatus(ver, deprecated, yanked); gerr != nil {
+					return gerr
+				}
 			}
 		}
+	}
+	return nil
+}
 
-		// load cookbooks
-		logger.Infof("Loading cookbooks")
-		for _, v := range exportedData.Data["cookbook"] {
-			cb, err := cookbook.New(v.(map[string]interface{})["Name"].(string))
+func (im *importer) importDataBags(items []interface{}) error {
+	for _, v := range items {
+		dbData := v.(map[string]interface{})
+		name := dbData["Name"].(string)
+		dbag, dberr := databag.Get(name)
+		if dberr != nil {
+			// Existing data bags themselves have nothing to update,
+			// only their items.
+			ok, err := im.proceed("databag", name, false)
 			if err != nil {
 				return err
 			}
-			gerr := cb.Save()
-			if gerr != nil {
-				return gerr
-			}
-			for ver, cbvData := range v.(map[string]interface{})["Versions"].(map[string]interface{}) {
-				cbvData, cerr := checkAttrs(cbvData.(map[string]interface{}))
-				if cerr != nil {
-					return cerr
+			dbag = nil
+			if ok {
+				var gerr util.Gerror
+				if dbag, gerr = databag.New(name); gerr != nil {
+					return gerr
 				}
-				_, cbverr := cb.NewVersion(ver, cbvData)
-				if cbverr != nil {
-					return cbverr
+				if err := dbag.Save(); err != nil {
+					return err
 				}
 			}
 		}
-
-		// load data bags
-		logger.Infof("Loading data bags")
-		for _, v := range exportedData.Data["data_bag"] {
-			dbag, err := databag.New(v.(map[string]interface{})["Name"].(string))
+		dbItems, _ := dbData["DataBagItems"].(map[string]interface{})
+		for _, dbiData := range dbItems {
+			rawData := dbiData.(map[string]interface{})["raw_data"].(map[string]interface{})
+			itemID, _ := rawData["id"].(string)
+			var exists bool
+			if dbag != nil {
+				_, ierr := dbag.GetDBItem(itemID)
+				exists = ierr == nil
+			}
+			ok, err := im.proceed("databag_item", fmt.Sprintf("%s/%s", name, itemID), exists)
 			if err != nil {
 				return err
 			}
-			gerr := dbag.Save()
-			if gerr != nil {
-				return gerr
+			if !ok {
+				continue
 			}
-			for _, dbagData := range v.(map[string]interface{})["DataBagItems"].(map[string]interface{}) {
-				_, dbierr := dbag.NewDBItem(dbagData.(map[string]interface{})["raw_data"].(map[string]interface{}))
-				if dbierr != nil {
-					return dbierr
+			if exists {
+				if _, err := dbag.UpdateDBItem(itemID, rawData); err != nil {
+					return err
 				}
-			}
-			gerr = dbag.Save()
-			if gerr != nil {
+			} else if _, gerr := dbag.NewDBItem(rawData); gerr != nil {
 				return gerr
 			}
 		}
-		// load environments
-		logger.Infof("Loading environments")
-		for _, v := range exportedData.Data["environment"] {
-			envData, cerr := checkAttrs(v.(map[string]interface{}))
-			if cerr != nil {
-				return nil
-			}
-			if envData["name"].(string) != "_default" {
-				e, err := environment.NewFromJSON(envData)
-				if err != nil {
-					return err
-				}
-				gerr := e.Save()
-				if gerr != nil {
-					return gerr
-				}
+		if dbag != nil && !im.opts.dryRun {
+			if err := dbag.Save(); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		// load nodes
-		logger.Infof("Loading nodes")
-		for _, v := range exportedData.Data["node"] {
-			nodeData, cerr := checkAttrs(v.(map[string]interface{}))
-			if cerr != nil {
-				return nil
-			}
-			n, err := node.NewFromJSON(nodeData)
-			if err != nil {
-				return err
+func (im *importer) importEnvironments(items []interface{}) error {
+	for _, v := range items {
+		envData := v.(map[string]interface{})
+		name, _ := envData["name"].(string)
+		if name == "_default" {
+			// The default environment can't be changed.
+			im.report.Skipped["environment"] = append(im.report.Skipped["environment"], name)
+			continue
+		}
+		e, eerr := environment.Get(name)
+		ok, err := im.proceed("environment", name, eerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		envData, cerr := checkAttrs(envData)
+		if cerr != nil {
+			return cerr
+		}
+		if eerr == nil {
+			if gerr := e.UpdateFromJSON(envData); gerr != nil {
+				return gerr
 			}
-			gerr := n.Save()
-			if gerr != nil {
+		} else {
+			var gerr util.Gerror
+			if e, gerr = environment.NewFromJSON(envData); gerr != nil {
 				return gerr
 			}
 		}
+		if gerr := e.Save(); gerr != nil {
+			return gerr
+		}
+	}
+	return nil
+}
 
-		// load roles
-		logger.Infof("Loading roles")
-		for _, v := range exportedData.Data["role"] {
-			roleData, cerr := checkAttrs(v.(map[string]interface{}))
-			if cerr != nil {
-				return nil
-			}
-			r, err := role.NewFromJSON(roleData)
-			if err != nil {
-				return err
+func (im *importer) importNodes(items []interface{}) error {
+	for _, v := range items {
+		nodeData := v.(map[string]interface{})
+		name, _ := nodeData["name"].(string)
+		n, nerr := node.Get(name)
+		ok, err := im.proceed("node", name, nerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		nodeData, cerr := checkAttrs(nodeData)
+		if cerr != nil {
+			return cerr
+		}
+		if nerr == nil {
+			if gerr := n.UpdateFromJSON(nodeData); gerr != nil {
+				return gerr
 			}
-			gerr := r.Save()
-			if gerr != nil {
+		} else {
+			var gerr util.Gerror
+			if n, gerr = node.NewFromJSON(nodeData); gerr != nil {
 				return gerr
 			}
 		}
+		if err := n.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// load sandboxes
-		logger.Infof("Loading sandboxes")
-		for _, v := range exportedData.Data["sandbox"] {
-			sbid, _ := v.(map[string]interface{})["Id"].(string)
-			sbts, _ := v.(map[string]interface{})["CreationTime"].(string)
-			sbcomplete, _ := v.(map[string]interface{})["Completed"].(bool)
-			sbck, _ := v.(map[string]interface{})["Checksums"].([]interface{})
-			sbTime, err := time.Parse(time.RFC3339, sbts)
-			if err != nil {
-				return err
-			}
-			sbChecksums := make([]string, len(sbck))
-			for i, c := range sbck {
-				sbChecksums[i] = c.(string)
+func (im *importer) importRoles(items []interface{}) error {
+	for _, v := range items {
+		roleData := v.(map[string]interface{})
+		name, _ := roleData["name"].(string)
+		r, rerr := role.Get(name)
+		ok, err := im.proceed("role", name, rerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		roleData, cerr := checkAttrs(roleData)
+		if cerr != nil {
+			return cerr
+		}
+		if rerr == nil {
+			if gerr := r.UpdateFromJSON(roleData); gerr != nil {
+				return gerr
 			}
-			sbox := &sandbox.Sandbox{ID: sbid, CreationTime: sbTime, Completed: sbcomplete, Checksums: sbChecksums}
-			if err = sbox.Save(); err != nil {
-				return err
+		} else {
+			var gerr util.Gerror
+			if r, gerr = role.NewFromJSON(roleData); gerr != nil {
+				return gerr
 			}
 		}
+		if err := r.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// load loginfos
-		logger.Infof("Loading loginfo")
-		for _, v := range exportedData.Data["loginfo"] {
-			if err := loginfo.Import(v.(map[string]interface{})); err != nil {
-				return err
-			}
+func (im *importer) importSandboxes(items []interface{}) error {
+	for _, v := range items {
+		sbData := v.(map[string]interface{})
+		sbid, _ := sbData["Id"].(string)
+		_, sberr := sandbox.Get(sbid)
+		ok, err := im.proceed("sandbox", sbid, sberr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		sbts, _ := sbData["CreationTime"].(string)
+		sbcomplete, _ := sbData["Completed"].(bool)
+		sbck, _ := sbData["Checksums"].([]interface{})
+		sbTime, err := time.Parse(time.RFC3339, sbts)
+		if err != nil {
+			return err
 		}
+		sbChecksums := make([]string, len(sbck))
+		for i, c := range sbck {
+			sbChecksums[i] = c.(string)
+		}
+		sbox := &sandbox.Sandbox{ID: sbid, CreationTime: sbTime, Completed: sbcomplete, Checksums: sbChecksums}
+		if err = sbox.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// load reports
-		logger.Infof("Loading reports")
-		for _, v := range exportedData.Data["report"] {
-			nodeName := v.(map[string]interface{})["node_name"].(string)
-			v.(map[string]interface{})["action"] = "start"
-			if st, ok := v.(map[string]interface{})["start_time"].(string); ok {
-				t, err := time.Parse(time.RFC3339, st)
-				if err != nil {
-					return err
-				}
-				v.(map[string]interface{})["start_time"] = t.Format(report.ReportTimeFormat)
-			}
-			if et, ok := v.(map[string]interface{})["end_time"].(string); ok {
-				t, err := time.Parse(time.RFC3339, et)
-				if err != nil {
-					return err
-				}
-				v.(map[string]interface{})["end_time"] = t.Format(report.ReportTimeFormat)
-			}
-			r, err := report.NewFromJSON(nodeName, v.(map[string]interface{}))
+func (im *importer) importLogInfos(items []interface{}) error {
+	for _, v := range items {
+		leData := v.(map[string]interface{})
+		id := int(leData["id"].(float64))
+		le, lerr := loginfo.Get(id)
+		ok, err := im.proceed("loginfo", strconv.Itoa(id), lerr == nil && le != nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := loginfo.Import(leData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importReports(items []interface{}) error {
+	for _, v := range items {
+		rData := v.(map[string]interface{})
+		runID, _ := rData["run_id"].(string)
+		_, rerr := report.Get(runID)
+		ok, err := im.proceed("report", runID, rerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		nodeName, found := rData["node_name"].(string)
+		if !found {
+			// reports are exported with this key
+			nodeName = rData["nodeName"].(string)
+		}
+		rData["action"] = "start"
+		if st, ok := rData["start_time"].(string); ok {
+			t, err := time.Parse(time.RFC3339, st)
 			if err != nil {
 				return err
 			}
-			gerr := r.Save()
-			if gerr != nil {
-				return gerr
-			}
-			v.(map[string]interface{})["action"] = "end"
-			if err := r.UpdateFromJSON(v.(map[string]interface{})); err != nil {
+			rData["start_time"] = t.Format(report.ReportTimeFormat)
+		}
+		if et, ok := rData["end_time"].(string); ok {
+			t, err := time.Parse(time.RFC3339, et)
+			if err != nil {
 				return err
 			}
-			gerr = r.Save()
-			if gerr != nil {
-				return gerr
-			}
+			rData["end_time"] = t.Format(report.ReportTimeFormat)
+		}
+		r, err := report.NewFromJSON(nodeName, rData)
+		if err != nil {
+			return err
 		}
+		gerr := r.Save()
+		if gerr != nil {
+			return gerr
+		}
+		rData["action"] = "end"
+		if err := r.UpdateFromJSON(rData); err != nil {
+			return err
+		}
+		gerr = r.Save()
+		if gerr != nil {
+			return gerr
+		}
+	}
+	return nil
+}
 
-		if exportedData.MinorVersion == 1 {
-			// import shovey jobs, run, and streams, and node
-			// statuses
-			logger.Infof("Loading node statuses...")
-			for _, v := range exportedData.Data["node_status"] {
-				ns := v.(map[string]interface{})
-				err := node.ImportStatus(ns)
-				if err != nil {
-					return err
+func (im *importer) importNodeStatuses(items []interface{}) error {
+	for _, v := range items {
+		ns := v.(map[string]interface{})
+		nodeName := ns["Node"].(map[string]interface{})["name"].(string)
+		ut := ns["UpdatedAt"].(string)
+		updatedAt, err := time.Parse(time.RFC3339, ut)
+		if err != nil {
+			return err
+		}
+		var exists bool
+		if n, nerr := node.Get(nodeName); nerr == nil {
+			statuses, _ := n.AllStatuses()
+			for _, s := range statuses {
+				if s.UpdatedAt.Equal(updatedAt) {
+					exists = true
+					break
 				}
 			}
-			logger.Infof("Loading shoveys...")
-			for _, v := range exportedData.Data["shovey"] {
-				s := v.(map[string]interface{})
-				err := shovey.ImportShovey(s)
-				if err != nil {
-					return err
+		}
+		ok, err := im.proceed("node_status", fmt.Sprintf("%s@%s", nodeName, ut), exists)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := node.ImportStatus(ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importShoveys(items []interface{}) error {
+	for _, v := range items {
+		s := v.(map[string]interface{})
+		runID := s["id"].(string)
+		_, serr := shovey.Get(runID)
+		ok, err := im.proceed("shovey", runID, serr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := shovey.ImportShovey(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importShoveyRuns(items []interface{}) error {
+	for _, v := range items {
+		s := v.(map[string]interface{})
+		runID := s["run_id"].(string)
+		nodeName := s["node_name"].(string)
+		var exists bool
+		if sj, serr := shovey.Get(runID); serr == nil {
+			_, rerr := sj.GetRun(nodeName)
+			exists = rerr == nil
+		}
+		ok, err := im.proceed("shovey_run", fmt.Sprintf("%s/%s", runID, nodeName), exists)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := shovey.ImportShoveyRun(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importShoveyRunStreams(items []interface{}) error {
+	for _, v := range items {
+		s := v.(map[string]interface{})
+		runID := s["ShoveyUUID"].(string)
+		nodeName := s["NodeName"].(string)
+		outputType := s["OutputType"].(string)
+		seq := int(s["Seq"].(float64))
+		var exists bool
+		if sj, serr := shovey.Get(runID); serr == nil {
+			if sr, rerr := sj.GetRun(nodeName); rerr == nil {
+				streams, _ := sr.GetStreamOutput(outputType, seq)
+				for _, st := range streams {
+					if st.Seq == seq {
+						exists = true
+						break
+					}
 				}
 			}
-			logger.Infof("Loading shovey runs...")
-			for _, v := range exportedData.Data["shovey_run"] {
-				s := v.(map[string]interface{})
-				err := shovey.ImportShoveyRun(s)
-				if err != nil {
-					return err
-				}
+		}
+		ok, err := im.proceed("shovey_run_stream", fmt.Sprintf("%s/%s/%s/%d", runID, nodeName, outputType, seq), exists)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := shovey.ImportShoveyRunStream(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func (im *importer) importCookbookArtifacts(items []interface{}) error {
+	for _, v := range items {
+		aData := v.(map[string]interface{})
+		name := aData["name"].(string)
+		identifier := aData["identifier"].(string)
+		_, aerr := cookbook.GetArtifact(name, identifier)
+		ok, err := im.proceed("cookbook_artifact", fmt.Sprintf("%s/%s", name, identifier), aerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		aData, cerr := checkAttrs(aData)
+		if cerr != nil {
+			return cerr
+		}
+		a, gerr := cookbook.NewArtifact(name, identifier, aData)
+		if gerr != nil {
+			return gerr
+		}
+		if gerr = a.Save(); gerr != nil {
+			return gerr
+		}
+	}
+	return nil
+}
+
+func (im *importer) importPolicyRevisions(items []interface{}) error {
+	for _, v := range items {
+		rData := v.(map[string]interface{})
+		name := rData["name"].(string)
+		revID := rData["revision_id"].(string)
+		_, rerr := policy.GetRevision(name, revID)
+		ok, err := im.proceed("policy_revision", fmt.Sprintf("%s/%s", name, revID), rerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		rev, gerr := policy.NewRevision(name, rData["policy"].(map[string]interface{}))
+		if gerr != nil {
+			return gerr
+		}
+		if ct, ok := rData["created_at"].(string); ok {
+			if rev.CreatedAt, err = time.Parse(time.RFC3339, ct); err != nil {
+				return err
 			}
-			logger.Infof("Loading shovey run streams...")
-			for _, v := range exportedData.Data["shovey_run_stream"] {
-				s := v.(map[string]interface{})
-				err := shovey.ImportShoveyRunStream(s)
-				if err != nil {
-					return err
-				}
-			}
 		}
+		if gerr = rev.Save(); gerr != nil {
+			return gerr
+		}
+	}
+	return nil
+}
 
-	} else {
-		err := fmt.Errorf("goiardi export data version %d.%d is not supported by this version of goiardi", exportedData.MajorVersion, exportedData.MinorVersion)
-		return err
+func (im *importer) importPolicyGroups(items []interface{}) error {
+	for _, v := range items {
+		gData := v.(map[string]interface{})
+		name := gData["name"].(string)
+		g, gerr := policy.GetGroup(name)
+		ok, err := im.proceed("policy_group", name, gerr == nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if gerr != nil {
+			if g, gerr = policy.NewGroup(name); gerr != nil {
+				return gerr
+			}
+		}
+		policies, _ := gData["policies"].(map[string]interface{})
+		for pName, revID := range policies {
+			g.Policies[pName] = revID.(string)
+		}
+		if err := g.Save(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
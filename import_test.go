@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/ctdk/goiardi/environment"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func inReport(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func changeEnvDescription(t *testing.T, name string, desc string) {
+	e, err := environment.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Description = desc
+	if err := e.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func envDescription(t *testing.T, name string) string {
+	e, err := environment.Get(name)
+	if err != nil {
+		t.Fatalf("environment %s should have existed: %s", name, err.Error())
+	}
+	return e.Description
+}
+
+func TestImportDryRun(t *testing.T) {
+	setupExportObjects(t, "dry")
+	data := exportRoundTrip(t)
+	deleteExportObjects(t, "dry")
+
+	report, err := importData(data, &importOptions{dryRun: true, conflict: importConflictOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun {
+		t.Errorf("the report should have said it was a dry run")
+	}
+	if !inReport(report.Created["node"], "dry_node") {
+		t.Errorf("the dry run should have reported that node dry_node would be created, got %v", report.Created["node"])
+	}
+	if !inReport(report.Created["role"], "dry_role") {
+		t.Errorf("the dry run should have reported that role dry_role would be created, got %v", report.Created["role"])
+	}
+	if _, err := node.Get("dry_node"); err == nil {
+		t.Errorf("node dry_node was created by a dry run")
+	}
+	if _, err := role.Get("dry_role"); err == nil {
+		t.Errorf("role dry_role was created by a dry run")
+	}
+}
+
+func TestImportTypeSelection(t *testing.T) {
+	setupExportObjects(t, "sel")
+	data := exportRoundTrip(t)
+	deleteExportObjects(t, "sel")
+
+	report, err := importData(data, &importOptions{types: map[string]bool{"role": true}, conflict: importConflictOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := role.Get("sel_role"); err != nil {
+		t.Errorf("role sel_role should have been imported: %s", err.Error())
+	}
+	if _, err := node.Get("sel_node"); err == nil {
+		t.Errorf("node sel_node was imported, but only roles were selected")
+	}
+	if _, err := environment.Get("sel_env"); err == nil {
+		t.Errorf("environment sel_env was imported, but only roles were selected")
+	}
+	for _, k := range []string{"node", "environment", "databag"} {
+		if len(report.Created[k]) != 0 || len(report.Updated[k]) != 0 || len(report.Skipped[k]) != 0 {
+			t.Errorf("the report should have nothing for %s, since only roles were selected", k)
+		}
+	}
+}
+
+func TestImportConflictSkip(t *testing.T) {
+	setupExportObjects(t, "skip")
+	data := exportRoundTrip(t)
+	changeEnvDescription(t, "skip_env", "changed")
+
+	// Skipping is the default.
+	report, err := importData(data, &importOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Conflict != importConflictSkip {
+		t.Errorf("the default conflict policy should have been %s, got %s", importConflictSkip, report.Conflict)
+	}
+	if !inReport(report.Skipped["environment"], "skip_env") {
+		t.Errorf("environment skip_env should have been skipped, got %v", report.Skipped["environment"])
+	}
+	if d := envDescription(t, "skip_env"); d != "changed" {
+		t.Errorf("environment skip_env should not have been overwritten, but its description is now '%s'", d)
+	}
+}
+
+func TestImportConflictOverwrite(t *testing.T) {
+	setupExportObjects(t, "over")
+	data := exportRoundTrip(t)
+	changeEnvDescription(t, "over_env", "changed")
+
+	report, err := importData(data, &importOptions{conflict: importConflictOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inReport(report.Updated["environment"], "over_env") {
+		t.Errorf("environment over_env should have been updated, got %v", report.Updated["environment"])
+	}
+	if d := envDescription(t, "over_env"); d != "round trip" {
+		t.Errorf("environment over_env should have been overwritten, but its description is '%s'", d)
+	}
+}
+
+func TestImportConflictFail(t *testing.T) {
+	setupExportObjects(t, "fail")
+	data := exportRoundTrip(t)
+	changeEnvDescription(t, "fail_env", "changed")
+	r, _ := role.Get("fail_role")
+	r.Delete()
+
+	report, err := importData(data, &importOptions{conflict: importConflictFail})
+	if err == nil {
+		t.Fatalf("an import with conflicts should have failed with the fail policy")
+	}
+	if gerr, ok := err.(util.Gerror); !ok || gerr.Status() != http.StatusConflict {
+		t.Errorf("a failed import should have had status %d, got %v", http.StatusConflict, err)
+	}
+	if report == nil || !inReport(report.Conflicts["environment"], "fail_env") {
+		t.Errorf("environment fail_env should have been reported as a conflict")
+	}
+	// Nothing at all should have been changed.
+	if d := envDescription(t, "fail_env"); d != "changed" {
+		t.Errorf("environment fail_env should not have been overwritten, but its description is now '%s'", d)
+	}
+	if _, err := role.Get("fail_role"); err == nil {
+		t.Errorf("role fail_role was created even though the import failed")
+	}
+
+	// A dry run reports the conflicts without failing.
+	report, err = importData(data, &importOptions{dryRun: true, conflict: importConflictFail})
+	if err != nil {
+		t.Fatalf("a dry run with the fail policy should not have failed: %s", err.Error())
+	}
+	if !inReport(report.Conflicts["environment"], "fail_env") {
+		t.Errorf("the dry run should have reported environment fail_env as a conflict")
+	}
+}
+
+func TestImportOptionsFromQuery(t *testing.T) {
+	r := httptest.NewRequest("POST", "/_import?dry_run=true&conflict=fail&types=role,%20node", nil)
+	opts, err := importOptionsFromQuery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.dryRun || opts.conflict != importConflictFail {
+		t.Errorf("expected a dry run with the fail policy, got dry run %t and policy %s", opts.dryRun, opts.conflict)
+	}
+	if len(opts.types) != 2 || !opts.types["role"] || !opts.types["node"] {
+		t.Errorf("expected the role and node types to be selected, got %v", opts.types)
+	}
+
+	opts, err = importOptionsFromQuery(httptest.NewRequest("POST", "/_import", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.dryRun || opts.conflict != importConflictSkip || opts.types != nil {
+		t.Errorf("expected the defaults with no query, got %+v", opts)
+	}
+
+	for _, q := range []string{"dry_run=maybe", "conflict=merge", "types=role,widget"} {
+		if _, err := importOptionsFromQuery(httptest.NewRequest("POST", "/_import?"+q, nil)); err == nil {
+			t.Errorf("import options with %s should have been rejected", q)
+		}
+	}
+}
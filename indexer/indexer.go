@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"github.com/ctdk/go-trie/gtrie"
 	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/datastore"
 	"io/ioutil"
 	"os"
 	"path"
@@ -72,6 +73,7 @@ func CreateNewCollection(idxName string) {
 	indexMap.m.Lock()
 	defer indexMap.m.Unlock()
 	indexMap.createCollection(idxName)
+	datastore.Journal(&datastore.Change{Kind: datastore.ChangeNewCollection, KeyType: idxName})
 }
 
 // DeleteCollection deletes a collection from the index. Useful only for data
@@ -83,12 +85,16 @@ func DeleteCollection(idxName string) error {
 		return err
 	}
 	indexMap.deleteCollection(idxName)
+	datastore.Journal(&datastore.Change{Kind: datastore.ChangeDropCollection, KeyType: idxName})
 	return nil
 }
 
 // DeleteItemFromCollection deletes an item from a collection
 func DeleteItemFromCollection(idxName string, doc string) error {
 	err := indexMap.deleteItem(idxName, doc)
+	if err == nil {
+		datastore.Journal(&datastore.Change{Kind: datastore.ChangeUnindex, KeyType: idxName, Key: doc})
+	}
 	return err
 }
 
@@ -106,13 +112,19 @@ func (i *Index) deleteCollection(idxName string) {
 }
 
 func (i *Index) saveIndex(object Indexable) {
+	flattened := object.Flatten()
+	datastore.Journal(&datastore.Change{Kind: datastore.ChangeIndex, KeyType: object.Index(), Key: object.DocID(), Fields: flattened})
+	i.indexDoc(object.Index(), object.DocID(), flattened)
+}
+
+func (i *Index) indexDoc(idxName string, docID string, flattened []string) {
 	/* Have to check to see if data bag indexes exist */
 	i.m.Lock()
 	defer i.m.Unlock()
-	if _, found := i.idxmap[object.Index()]; !found {
-		i.createCollection(object.Index())
+	if _, found := i.idxmap[idxName]; !found {
+		i.createCollection(idxName)
 	}
-	i.idxmap[object.Index()].addDoc(object)
+	i.idxmap[idxName].addDoc(docID, flattened)
 }
 
 func (i *Index) deleteItem(idxName string, doc string) error {
@@ -183,15 +195,15 @@ func (i *Index) endpoints() []string {
 
 /* IdxCollection methods */
 
-func (ic *IdxCollection) addDoc(object Indexable) {
+func (ic *IdxCollection) addDoc(docID string, flattened []string) {
 	ic.m.Lock()
-	if _, found := ic.docs[object.DocID()]; !found {
-		ic.docs[object.DocID()] = new(IdxDoc)
+	if _, found := ic.docs[docID]; !found {
+		ic.docs[docID] = new(IdxDoc)
 	}
 	ic.m.Unlock()
 	ic.m.RLock()
 	defer ic.m.RUnlock()
-	ic.docs[object.DocID()].update(object)
+	ic.docs[docID].update(flattened)
 }
 
 func (ic *IdxCollection) delDoc(doc string) {
@@ -264,10 +276,9 @@ func safeSearchResults(results map[string]*IdxDoc) map[string]*IdxDoc {
 }
 
 /* IdxDoc methods */
-func (idoc *IdxDoc) update(object Indexable) {
+func (idoc *IdxDoc) update(flattened []string) {
 	idoc.m.Lock()
 	defer idoc.m.Unlock()
-	flattened := object.Flatten()
 	flatText := strings.Join(flattened, "\n")
 	/* recover from horrific trie errors that seem to happen with really
 	 * big values. :-/ */
@@ -586,6 +597,7 @@ func (i *Index) load(idxFile string) error {
 // ClearIndex of all collections and documents
 func ClearIndex() {
 	indexMap.makeDefaultCollections()
+	datastore.Journal(&datastore.Change{Kind: datastore.ChangeClearIndex})
 	return
 }
 
@@ -598,3 +610,52 @@ func ReIndex(objects []Indexable) error {
 	// there aren't any ways it does so in the index save bits.
 	return nil
 }
+
+// Snapshot encodes the whole index for a standby server.
+func Snapshot() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	indexMap.m.RLock()
+	defer indexMap.m.RUnlock()
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(indexMap); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the index with one encoded by Snapshot.
+func Restore(b []byte) error {
+	im := new(Index)
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	if err := dec.Decode(&im); err != nil {
+		return err
+	}
+	indexMap.m.Lock()
+	defer indexMap.m.Unlock()
+	indexMap.idxmap = im.idxmap
+	return nil
+}
+
+// ApplyChange applies a search index change from another server's replication
+// journal.
+func ApplyChange(c *datastore.Change) error {
+	switch c.Kind {
+	case datastore.ChangeIndex:
+		indexMap.indexDoc(c.KeyType, c.Key, c.Fields)
+	case datastore.ChangeUnindex:
+		// The item may have been deleted from the index before the
+		// snapshot was taken.
+		indexMap.deleteItem(c.KeyType, c.Key)
+	case datastore.ChangeNewCollection:
+		indexMap.m.Lock()
+		defer indexMap.m.Unlock()
+		indexMap.createCollection(c.KeyType)
+	case datastore.ChangeDropCollection:
+		indexMap.deleteCollection(c.KeyType)
+	case datastore.ChangeClearIndex:
+		indexMap.makeDefaultCollections()
+	default:
+		return fmt.Errorf("%s is not a search index change", c.Kind)
+	}
+	return nil
+}
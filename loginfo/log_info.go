@@ -210,7 +210,7 @@ func GetLogInfos(searchParams map[string]string, limits ...int) ([]*LogInfo, err
 		}
 	}
 	if config.UsingDB() {
-		return getLogInfoListSQL(searchParams, from, until, limits...)
+		return getLogInfoListSQL(datastore.Dbh, searchParams, from, until, limits...)
 	}
 	var offset, limit int
 	if len(limits) > 0 {
@@ -270,3 +270,13 @@ func AllLogInfos() []*LogInfo {
 	l, _ := GetLogInfos(nil)
 	return l
 }
+
+// AllLogInfosTx returns a list of all logged events like AllLogInfos, but with
+// an SQL backend reads them through the given db handle. Pass in a transaction
+// to read the events as part of a consistent snapshot.
+func AllLogInfosTx(tx datastore.Dbhandle) ([]*LogInfo, error) {
+	if config.UsingDB() {
+		return getLogInfoListSQL(tx, nil, time.Unix(0, 0), time.Now())
+	}
+	return AllLogInfos(), nil
+}
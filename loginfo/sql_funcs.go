@@ -167,7 +167,7 @@ func purgeSQL(id int) (int64, error) {
 	return rowsAffected, nil
 }
 
-func getLogInfoListSQL(searchParams map[string]string, from, until time.Time, limits ...int) ([]*LogInfo, error) {
+func getLogInfoListSQL(dbhandle datastore.Dbhandle, searchParams map[string]string, from, until time.Time, limits ...int) ([]*LogInfo, error) {
 	var offset int
 	var limit int64 = (1 << 63) - 1
 	if len(limits) > 0 {
@@ -238,7 +238,7 @@ func getLogInfoListSQL(searchParams map[string]string, from, until time.Time, li
 	sqlArgs = append(sqlArgs, offset)
 	sqlArgs = append(sqlArgs, limit)
 
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"embed"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"io/fs"
+)
+
+// The sqitch bundles are built into goiardi so it can keep the database schema
+// up to date on its own.
+
+//go:embed sql-files/mysql-bundle/sqitch.plan sql-files/mysql-bundle/deploy
+//go:embed sql-files/postgres-bundle/sqitch.plan sql-files/postgres-bundle/deploy
+var sqlBundles embed.FS
+
+// migrateSchema applies any pending schema migrations for the SQL backend in
+// use, or with apply set to false just checks that there aren't any.
+func migrateSchema(apply bool) error {
+	bundleDir := "sql-files/mysql-bundle"
+	if config.Config.UsePostgreSQL {
+		bundleDir = "sql-files/postgres-bundle"
+	}
+	bundle, err := fs.Sub(sqlBundles, bundleDir)
+	if err != nil {
+		return err
+	}
+	n, err := datastore.Migrate(bundle, apply)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logger.Infof("Applied %d schema migrations", n)
+	}
+	return nil
+}
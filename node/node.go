@@ -21,9 +21,12 @@ package node
 
 import (
 	"database/sql"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/revision"
+	"github.com/ctdk/goiardi/trash"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
 )
@@ -104,11 +107,17 @@ func NewFromJSON(jsonNode map[string]interface{}) (*Node, util.Gerror) {
 
 // Get a node.
 func Get(nodeName string) (*Node, util.Gerror) {
+	return GetFrom(datastore.Dbh, nodeName)
+}
+
+// GetFrom gets a node like Get, but with an SQL backend reads it through the
+// given db handle, like a read replica.
+func GetFrom(dbhandle datastore.Dbhandle, nodeName string) (*Node, util.Gerror) {
 	var node *Node
 	var found bool
 	if config.UsingDB() {
 		var err error
-		node, err = getSQL(nodeName)
+		node, err = getSQL(dbhandle, nodeName)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				found = false
@@ -234,14 +243,26 @@ ValidElem:
 
 // Save the node.
 func (n *Node) Save() error {
+	return n.SaveIfMatch("")
+}
+
+// SaveIfMatch saves the node like Save, but with an SQL backend first checks
+// the node in the database against an If-Match header while holding a lock on
+// it, and fails with a 412 if it's changed. The in-memory data store is only
+// used by one goiardi, so the check made before the node was updated is
+// enough there.
+func (n *Node) SaveIfMatch(ifMatch string) error {
 	if config.UsingDB() {
-		if err := n.saveSQL(); err != nil {
+		if err := n.saveSQL(ifMatch); err != nil {
 			return err
 		}
 	} else {
 		ds := datastore.New()
 		ds.Set("node", n.Name, n)
 	}
+	if err := revision.Record("node", n.Name, revision.ActionSave, n.revisionData()); err != nil {
+		logger.Errorf("Error recording revision of node %s: %s", n.Name, err.Error())
+	}
 	/* TODO Later: excellent candidate for a goroutine */
 	indexer.IndexObj(n)
 	return nil
@@ -261,10 +282,28 @@ func (n *Node) Delete() error {
 			n.deleteStatuses()
 		}
 	}
+	if err := trash.Add("node", n.Name, n); err != nil {
+		logger.Errorf("Error putting node %s in the trash: %s", n.Name, err.Error())
+	}
+	if err := revision.Record("node", n.Name, revision.ActionDelete, n.revisionData()); err != nil {
+		logger.Errorf("Error recording revision of node %s: %s", n.Name, err.Error())
+	}
 	indexer.DeleteItemFromCollection("node", n.Name)
 	return nil
 }
 
+// revisionData returns the parts of the node that are kept in its revisions.
+// The automatic attributes change with every chef-client run, and the default
+// and override attributes come from cookbooks, roles, and environments, so
+// only the run list and normal attributes are kept.
+func (n *Node) revisionData() map[string]interface{} {
+	return map[string]interface{}{
+		"name":     n.Name,
+		"run_list": n.RunList,
+		"normal":   n.Normal,
+	}
+}
+
 // GetList gets a list of the nodes on this server.
 func GetList() []string {
 	var nodeList []string
@@ -327,9 +366,20 @@ func (n *Node) Flatten() []string {
 
 // AllNodes returns all the nodes on the server
 func AllNodes() []*Node {
+	nodes, err := AllNodesTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all nodes: %s", err.Error())
+	}
+	return nodes
+}
+
+// AllNodesTx returns all the nodes on the server like AllNodes, but with an SQL
+// backend reads them through the given db handle. Pass in a transaction to read
+// the nodes as part of a consistent snapshot.
+func AllNodesTx(tx datastore.Dbhandle) ([]*Node, error) {
 	var nodes []*Node
 	if config.UsingDB() {
-		nodes = allNodesSQL()
+		return allNodesSQL(tx)
 	} else {
 		nodeList := GetList()
 		for _, n := range nodeList {
@@ -340,5 +390,5 @@ func AllNodes() []*Node {
 			nodes = append(nodes, no)
 		}
 	}
-	return nodes
+	return nodes, nil
 }
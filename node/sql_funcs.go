@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
 	"log"
 )
 
@@ -81,7 +82,7 @@ func (n *Node) fillNodeFromSQL(row datastore.ResRow) error {
 	return nil
 }
 
-func getSQL(nodeName string) (*Node, error) {
+func getSQL(dbhandle datastore.Dbhandle, nodeName string) (*Node, error) {
 	node := new(Node)
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -90,7 +91,7 @@ func getSQL(nodeName string) (*Node, error) {
 		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from goiardi.nodes n where n.name = $1"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +105,32 @@ func getSQL(nodeName string) (*Node, error) {
 	return node, nil
 }
 
-func (n *Node) saveSQL() error {
+// checkETagSQL locks the node's row until the transaction is over, and makes
+// sure it still matches the If-Match header.
+func (n *Node) checkETagSQL(tx datastore.Dbhandle, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from nodes n where n.name = ? FOR UPDATE"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from goiardi.nodes n where n.name = $1 FOR UPDATE"
+	}
+	cur := new(Node)
+	err := cur.fillNodeFromSQL(tx.QueryRow(sqlStmt, n.Name))
+	if err == sql.ErrNoRows {
+		return util.ETagMismatch()
+	} else if err != nil {
+		return err
+	}
+	if gerr := util.CheckETag(ifMatch, cur); gerr != nil {
+		return gerr
+	}
+	return nil
+}
+
+func (n *Node) saveSQL(ifMatch string) error {
 	// prepare the complex structures for saving
 	rlb, rlerr := datastore.EncodeBlob(&n.RunList)
 	if rlerr != nil {
@@ -131,6 +157,10 @@ func (n *Node) saveSQL() error {
 	if err != nil {
 		return err
 	}
+	if err = n.checkETagSQL(tx, ifMatch); err != nil {
+		tx.Rollback()
+		return err
+	}
 	if config.Config.UseMySQL {
 		err = n.saveMySQL(tx, rlb, aab, nab, dab, oab)
 	} else if config.Config.UsePostgreSQL {
@@ -265,7 +295,7 @@ func getNodesInEnvSQL(envName string) ([]*Node, error) {
 	return nodes, nil
 }
 
-func allNodesSQL() []*Node {
+func allNodesSQL(dbhandle datastore.Dbhandle) ([]*Node, error) {
 	var nodes []*Node
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -274,31 +304,32 @@ func allNodesSQL() []*Node {
 		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from goiardi.nodes n"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return nodes
+			return nodes, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		no := new(Node)
 		err = no.fillNodeFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		nodes = append(nodes, no)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return nodes
+	return nodes, nil
 }
 
 func (n *Node) latestStatusSQL() (*NodeStatus, error) {
@@ -326,7 +357,7 @@ func (n *Node) latestStatusSQL() (*NodeStatus, error) {
 	return ns, nil
 }
 
-func (n *Node) allStatusesSQL() ([]*NodeStatus, error) {
+func (n *Node) allStatusesSQL(dbhandle datastore.Dbhandle) ([]*NodeStatus, error) {
 	var nodeStatuses []*NodeStatus
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -334,7 +365,7 @@ func (n *Node) allStatusesSQL() ([]*NodeStatus, error) {
 	} else if config.Config.UsePostgreSQL {
 		sqlStmt = "SELECT status, ns.updated_at FROM goiardi.node_statuses ns JOIN goiardi.nodes n ON ns.node_id = n.id WHERE n.name = $1 ORDER BY ns.id"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
 		return nil, err
 	}
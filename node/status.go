@@ -24,7 +24,6 @@ import (
 	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
-	"os"
 	"time"
 )
 
@@ -97,8 +96,12 @@ func (n *Node) LatestStatus() (*NodeStatus, error) {
 
 // AllStatuses returns all of the node's status reports to date.
 func (n *Node) AllStatuses() ([]*NodeStatus, error) {
+	return n.allStatuses(datastore.Dbh)
+}
+
+func (n *Node) allStatuses(tx datastore.Dbhandle) ([]*NodeStatus, error) {
 	if config.UsingDB() {
-		return n.allStatusesSQL()
+		return n.allStatusesSQL(tx)
 	}
 	ds := datastore.New()
 	arr, err := ds.AllNodeStatuses(n.Name)
@@ -114,19 +117,29 @@ func (n *Node) AllStatuses() ([]*NodeStatus, error) {
 
 // AllNodeStatuses returns all node status reports on the server, from all
 // nodes.
-func AllNodeStatuses() ([]*NodeStatus) {
+func AllNodeStatuses() ([]*NodeStatus, error) {
+	return AllNodeStatusesTx(datastore.Dbh)
+}
+
+// AllNodeStatusesTx returns all node status reports on the server like
+// AllNodeStatuses, but with an SQL backend reads them through the given db
+// handle. Pass in a transaction to read the statuses as part of a consistent
+// snapshot.
+func AllNodeStatusesTx(tx datastore.Dbhandle) ([]*NodeStatus, error) {
 	var allStatus []*NodeStatus
-	nodes := AllNodes()
+	nodes, err := AllNodesTx(tx)
+	if err != nil {
+		return nil, err
+	}
 	for _, n := range nodes {
-		ns, err := n.AllStatuses()
+		ns, err := n.allStatuses(tx)
 		if err != nil {
-			logger.Criticalf(err.Error())
-			os.Exit(1)
+			return nil, err
 		}
 		allStatus = append(allStatus, ns...)
 	}
 	
-	return allStatus
+	return allStatus, nil
 }
 
 func (n *Node) deleteStatuses() error {
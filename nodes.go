@@ -39,6 +39,11 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if pathArray := splitPath(r.URL.Path); len(pathArray) > 2 && pathArray[2] == "_revisions" {
+		revisionHandler(w, r, opUser, "node", pathArray[1], pathArray[3:])
+		return
+	}
+
 	/* So, what are we doing? Depends on the HTTP method, of course */
 	switch r.Method {
 	case "GET", "DELETE":
@@ -46,11 +51,14 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 			return
 		}
-		chefNode, nerr := node.Get(nodeName)
+		chefNode, nerr := node.GetFrom(readDbh(r), nodeName)
 		if nerr != nil {
 			jsonErrorReport(w, r, nerr.Error(), http.StatusNotFound)
 			return
 		}
+		if r.Method == "GET" && notModified(w, r, chefNode) {
+			return
+		}
 		enc := json.NewEncoder(w)
 		if err := enc.Encode(&chefNode); err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -77,6 +85,7 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
 			return
 		}
+		defer lockObject("node", nodeName)()
 		chefNode, kerr := node.Get(nodeName)
 		if kerr != nil {
 			jsonErrorReport(w, r, kerr.Error(), http.StatusNotFound)
@@ -100,20 +109,24 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 		if jsonName == "" {
 			nodeData["name"] = nodeName
 		}
+		if preconditionFailed(w, r, chefNode) {
+			return
+		}
 		nerr := chefNode.UpdateFromJSON(nodeData)
 		if nerr != nil {
 			jsonErrorReport(w, r, nerr.Error(), nerr.Status())
 			return
 		}
-		err := chefNode.Save()
+		err := chefNode.SaveIfMatch(r.Header.Get("If-Match"))
 		if err != nil {
-			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			jsonErrorReport(w, r, err.Error(), saveErrorStatus(err))
 			return
 		}
 		if lerr := loginfo.LogEvent(opUser, chefNode, "modify"); lerr != nil {
 			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
 			return
 		}
+		setETag(w, chefNode)
 		enc := json.NewEncoder(w)
 		if err = enc.Encode(&chefNode); err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Policyfile policies and policy groups.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/policy"
+	"github.com/ctdk/goiardi/util"
+	"io"
+	"net/http"
+)
+
+func policyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if opUser.IsValidator() || (r.Method != "GET" && !opUser.IsAdmin()) {
+		jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+		return
+	}
+
+	pathArray := splitPath(r.URL.Path)
+	pathArrayLen := len(pathArray)
+	var response interface{}
+
+	switch pathArrayLen {
+	case 1:
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		names, lerr := policy.GetList()
+		if lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		policies := make(map[string]interface{})
+		for _, name := range names {
+			revs, err := policy.RevisionIDs(name)
+			if err != nil {
+				continue
+			}
+			policies[name] = map[string]interface{}{
+				"uri":       util.CustomURL(fmt.Sprintf("/policies/%s", name)),
+				"revisions": revisionMap(revs),
+			}
+		}
+		response = policies
+	case 2:
+		name := pathArray[1]
+		defer lockObject("policy", name)()
+		revs, err := policy.RevisionIDs(name)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			// Make sure every revision can be deleted before
+			// deleting any of them.
+			for _, id := range revs {
+				groups, gerr := policy.GroupsUsing(name, id)
+				if gerr != nil {
+					jsonErrorReport(w, r, gerr.Error(), http.StatusInternalServerError)
+					return
+				}
+				if len(groups) > 0 {
+					jsonErrorReport(w, r, fmt.Sprintf("Policy %s is in use by the policy group %s", name, groups[0]), http.StatusConflict)
+					return
+				}
+			}
+			for _, id := range revs {
+				rev, gerr := policy.GetRevision(name, id)
+				if gerr != nil {
+					jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+					return
+				}
+				if gerr = rev.Delete(); gerr != nil {
+					jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+					return
+				}
+				if lerr := loginfo.LogEvent(opUser, rev, "delete"); lerr != nil {
+					jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		response = map[string]interface{}{"revisions": revisionMap(revs)}
+	case 3:
+		if pathArray[2] != "revisions" {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Method != "POST" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		name := pathArray[1]
+		defer lockObject("policy", name)()
+		policyData, jerr := parsePolicyJSON(r.Body)
+		if jerr != nil {
+			jsonErrorReport(w, r, jerr.Error(), http.StatusBadRequest)
+			return
+		}
+		rev, err := policy.NewRevision(name, policyData)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = rev.Save(); err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		if lerr := loginfo.LogEvent(opUser, rev, "create"); lerr != nil {
+			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		response = rev.Policy
+	case 4:
+		if pathArray[2] != "revisions" {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		name := pathArray[1]
+		defer lockObject("policy", name)()
+		rev, err := policy.GetRevision(name, pathArray[3])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			if err = rev.Delete(); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, rev, "delete"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		response = rev.Policy
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func policyGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if opUser.IsValidator() || (r.Method != "GET" && !opUser.IsAdmin()) {
+		jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+		return
+	}
+
+	pathArray := splitPath(r.URL.Path)
+	pathArrayLen := len(pathArray)
+	var response interface{}
+
+	switch pathArrayLen {
+	case 1:
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		all, gerr := policy.AllGroups()
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		groups := make(map[string]interface{})
+		for _, g := range all {
+			groups[g.Name] = policyGroupJSON(g)
+		}
+		response = groups
+	case 2:
+		defer lockObject("policy_group", pathArray[1])()
+		g, err := policy.GetGroup(pathArray[1])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			if derr := g.Delete(); derr != nil {
+				jsonErrorReport(w, r, derr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, g, "delete"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		response = policyGroupJSON(g)
+	case 4:
+		if pathArray[2] != "policies" {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		groupName := pathArray[1]
+		name := pathArray[3]
+		/* Setting the group's policy saves the policy revision too,
+		 * so both are locked. */
+		defer lockObjects([2]string{"policy_group", groupName}, [2]string{"policy", name})()
+		g, gerr := policy.GetGroup(groupName)
+		if gerr != nil && gerr.Status() != http.StatusNotFound {
+			jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+			return
+		}
+
+		if r.Method == "PUT" {
+			rev, status, err := setGroupPolicy(g, groupName, name, r.Body)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, rev, "modify"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(status)
+			response = rev.Policy
+			break
+		}
+
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+			return
+		}
+		revID, ok := g.Policies[name]
+		if !ok {
+			jsonErrorReport(w, r, fmt.Sprintf("Policy group %s does not have the policy %s", groupName, name), http.StatusNotFound)
+			return
+		}
+		rev, err := policy.GetRevision(name, revID)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			delete(g.Policies, name)
+			if serr := g.Save(); serr != nil {
+				jsonErrorReport(w, r, serr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if lerr := loginfo.LogEvent(opUser, g, "modify"); lerr != nil {
+				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		response = rev.Policy
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setGroupPolicy puts a policy in a policy group, creating the group and the
+// policy revision if they don't exist yet. It returns the revision the group
+// now uses, and whether the policy is new to the group (201) or not (200). The
+// caller must hold the locks for both the group and the policy.
+func setGroupPolicy(g *policy.Group, groupName string, name string, body io.ReadCloser) (*policy.Revision, int, util.Gerror) {
+	policyData, jerr := parsePolicyJSON(body)
+	if jerr != nil {
+		gerr := util.CastErr(jerr)
+		gerr.SetStatus(http.StatusBadRequest)
+		return nil, 0, gerr
+	}
+	rev, err := policy.NewRevision(name, policyData)
+	if err != nil {
+		err.SetStatus(http.StatusBadRequest)
+		return nil, 0, err
+	}
+	if g == nil {
+		if g, err = policy.NewGroup(groupName); err != nil {
+			err.SetStatus(http.StatusBadRequest)
+			return nil, 0, err
+		}
+	}
+
+	// A revision that's already been uploaded is used as it is.
+	if existing, _ := policy.GetRevision(name, rev.RevisionID); existing != nil {
+		rev = existing
+	} else if err = rev.Save(); err != nil {
+		return nil, 0, err
+	}
+
+	status := http.StatusOK
+	if _, ok := g.Policies[name]; !ok {
+		status = http.StatusCreated
+	}
+	g.Policies[name] = rev.RevisionID
+	if serr := g.Save(); serr != nil {
+		gerr := util.CastErr(serr)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, 0, gerr
+	}
+	return rev, status, nil
+}
+
+func policyGroupJSON(g *policy.Group) map[string]interface{} {
+	policies := make(map[string]interface{}, len(g.Policies))
+	for name, revID := range g.Policies {
+		policies[name] = map[string]string{"revision_id": revID}
+	}
+	return map[string]interface{}{
+		"uri":      util.ObjURL(g),
+		"policies": policies,
+	}
+}
+
+func revisionMap(revs []string) map[string]interface{} {
+	m := make(map[string]interface{}, len(revs))
+	for _, id := range revs {
+		m[id] = map[string]interface{}{}
+	}
+	return m
+}
+
+// parsePolicyJSON reads a policy document. Unlike parseObjJSON, the run lists
+// in it are left alone to be checked as policy run lists.
+func parsePolicyJSON(data io.ReadCloser) (map[string]interface{}, error) {
+	policyData := make(map[string]interface{})
+	dec := json.NewDecoder(data)
+	if err := dec.Decode(&policyData); err != nil {
+		return nil, err
+	}
+	return policyData, nil
+}
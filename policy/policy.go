@@ -0,0 +1,428 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package policy holds Policyfile policies and policy groups. A policy is pushed to the server as a series of revisions, each one a complete, locked down description of a node's run list and the exact cookbook artifacts it uses; a policy group says which revision of each policy the nodes in that group should use.
+*/
+package policy
+
+import (
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revision is one revision of a policy, as pushed with `chef push`. Revisions
+// are never changed once they've been created.
+type Revision struct {
+	Name       string                 `json:"name"`
+	RevisionID string                 `json:"revision_id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	Policy     map[string]interface{} `json:"policy"`
+}
+
+// Policy holds the revisions of a policy in the in-memory data store.
+type Policy struct {
+	Name      string
+	Revisions map[string]*Revision
+}
+
+// Group is a policy group, which says which revision of each policy the nodes
+// in the group use.
+type Group struct {
+	Name     string            `json:"name"`
+	Policies map[string]string `json:"policies"`
+}
+
+// Protects the get, change, and set of policies and policy groups in the
+// in-memory data store.
+var memLock sync.Mutex
+
+var validPolicyName = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,255}$`)
+var validLockedRecipe = regexp.MustCompile(`^recipe\[[A-Za-z0-9_.-]+::[A-Za-z0-9_.-]+\]$`)
+
+// GetName returns the name of the policy the revision belongs to.
+func (r *Revision) GetName() string {
+	return r.Name
+}
+
+// URLType returns the first path element in a policy's URL.
+func (r *Revision) URLType() string {
+	return "policies"
+}
+
+// GetName returns the policy group's name.
+func (g *Group) GetName() string {
+	return g.Name
+}
+
+// URLType returns the first path element in a policy group's URL.
+func (g *Group) URLType() string {
+	return "policy_groups"
+}
+
+// NewRevision makes a new revision of the named policy from an uploaded policy
+// document, checking that the document is a valid policy for that name. The
+// revision isn't saved.
+func NewRevision(name string, data map[string]interface{}) (*Revision, util.Gerror) {
+	if err := validatePolicy(name, data); err != nil {
+		return nil, err
+	}
+	rev := &Revision{Name: name, RevisionID: data["revision_id"].(string), CreatedAt: time.Now(), Policy: data}
+	return rev, nil
+}
+
+func validatePolicy(name string, data map[string]interface{}) util.Gerror {
+	if n, ok := data["name"].(string); !ok || !validPolicyName.MatchString(n) {
+		return util.Errorf("Field 'name' invalid")
+	} else if n != name {
+		return util.Errorf("Field 'name' invalid : %s does not match %s", n, name)
+	}
+	if r, ok := data["revision_id"].(string); !ok || !validPolicyName.MatchString(r) {
+		return util.Errorf("Field 'revision_id' invalid")
+	}
+	if err := validateLockedRunList("run_list", data["run_list"]); err != nil {
+		return err
+	}
+	if nrl, ok := data["named_run_lists"]; ok {
+		named, ok := nrl.(map[string]interface{})
+		if !ok {
+			return util.Errorf("Field 'named_run_lists' invalid")
+		}
+		for _, rl := range named {
+			if err := validateLockedRunList("named_run_lists", rl); err != nil {
+				return err
+			}
+		}
+	}
+	locks, ok := data["cookbook_locks"].(map[string]interface{})
+	if !ok {
+		return util.Errorf("Field 'cookbook_locks' missing or invalid")
+	}
+	for cb, l := range locks {
+		lock, ok := l.(map[string]interface{})
+		if !ok {
+			return util.Errorf("Field 'cookbook_locks' invalid: the lock for %s is not an object", cb)
+		}
+		if id, ok := lock["identifier"].(string); !ok || !validPolicyName.MatchString(id) {
+			return util.Errorf("Field 'cookbook_locks' invalid: the lock for %s has an invalid identifier", cb)
+		}
+		if _, verr := util.ValidateAsVersion(lock["version"]); verr != nil || lock["version"] == nil {
+			return util.Errorf("Field 'cookbook_locks' invalid: the lock for %s has an invalid version", cb)
+		}
+	}
+	return nil
+}
+
+// validateLockedRunList checks a policy's run list. Unlike node and role run
+// lists, these can only have fully qualified recipes, since roles are expanded
+// when the policy is locked.
+func validateLockedRunList(field string, rl interface{}) util.Gerror {
+	items, ok := rl.([]interface{})
+	if !ok {
+		return util.Errorf("Field '%s' missing or invalid", field)
+	}
+	for _, i := range items {
+		s, ok := i.(string)
+		if !ok || !validLockedRecipe.MatchString(s) {
+			return util.Errorf("Field '%s' is not a valid run list", field)
+		}
+	}
+	return nil
+}
+
+// Save a new revision of a policy. Revisions can't be changed, so saving one
+// that already exists is a conflict.
+func (r *Revision) Save() util.Gerror {
+	if config.UsingDB() {
+		if _, err := GetRevision(r.Name, r.RevisionID); err == nil {
+			return revisionExists(r)
+		}
+		if err := r.saveSQL(); err != nil {
+			return internalErr(err)
+		}
+		return nil
+	}
+	memLock.Lock()
+	defer memLock.Unlock()
+	p := getPolicy(r.Name)
+	if p == nil {
+		p = &Policy{Name: r.Name, Revisions: make(map[string]*Revision)}
+	}
+	if _, found := p.Revisions[r.RevisionID]; found {
+		return revisionExists(r)
+	}
+	p.Revisions[r.RevisionID] = r
+	ds := datastore.New()
+	ds.Set("policy", r.Name, p)
+	return nil
+}
+
+func revisionExists(r *Revision) util.Gerror {
+	err := util.Errorf("Revision %s of policy %s already exists", r.RevisionID, r.Name)
+	err.SetStatus(http.StatusConflict)
+	return err
+}
+
+// Delete a revision of a policy. A revision that a policy group is using can't
+// be deleted, since the nodes in that group would be left without a policy.
+func (r *Revision) Delete() util.Gerror {
+	groups, err := GroupsUsing(r.Name, r.RevisionID)
+	if err != nil {
+		return internalErr(err)
+	}
+	if len(groups) > 0 {
+		gerr := util.Errorf("Revision %s of policy %s is in use by the policy groups %s", r.RevisionID, r.Name, strings.Join(groups, ", "))
+		gerr.SetStatus(http.StatusConflict)
+		return gerr
+	}
+	if config.UsingDB() {
+		if err := r.deleteSQL(); err != nil {
+			return internalErr(err)
+		}
+		return nil
+	}
+	memLock.Lock()
+	defer memLock.Unlock()
+	p := getPolicy(r.Name)
+	if p == nil {
+		return nil
+	}
+	delete(p.Revisions, r.RevisionID)
+	ds := datastore.New()
+	if len(p.Revisions) == 0 {
+		ds.Delete("policy", r.Name)
+	} else {
+		ds.Set("policy", r.Name, p)
+	}
+	return nil
+}
+
+func getPolicy(name string) *Policy {
+	ds := datastore.New()
+	p, found := ds.Get("policy", name)
+	if !found || p == nil {
+		return nil
+	}
+	return p.(*Policy)
+}
+
+// GetRevision gets a revision of a policy.
+func GetRevision(name string, revisionID string) (*Revision, util.Gerror) {
+	var rev *Revision
+	if config.UsingDB() {
+		var err error
+		rev, err = getRevisionSQL(name, revisionID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, internalErr(err)
+		}
+	} else if p := getPolicy(name); p != nil {
+		rev = p.Revisions[revisionID]
+	}
+	if rev == nil {
+		err := util.Errorf("Cannot load revision %s of policy %s", revisionID, name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return rev, nil
+}
+
+// RevisionIDs returns the ids of the revisions of a policy, sorted. A policy
+// exists for as long as it has any revisions.
+func RevisionIDs(name string) ([]string, util.Gerror) {
+	var ids []string
+	if config.UsingDB() {
+		var err error
+		if ids, err = revisionIDsSQL(name); err != nil {
+			return nil, internalErr(err)
+		}
+	} else if p := getPolicy(name); p != nil {
+		for id := range p.Revisions {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		err := util.Errorf("Cannot load policy %s", name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// GetList returns the names of all the policies on the server.
+func GetList() ([]string, error) {
+	var names []string
+	if config.UsingDB() {
+		var err error
+		if names, err = getListSQL(); err != nil {
+			return nil, err
+		}
+	} else {
+		ds := datastore.New()
+		names = ds.GetList("policy")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AllRevisions returns every revision of every policy, for exporting.
+func AllRevisions() ([]*Revision, error) {
+	return AllRevisionsTx(nil)
+}
+
+// AllRevisionsTx returns every revision of every policy, reading from the
+// given db handle if using an SQL backend.
+func AllRevisionsTx(tx datastore.Dbhandle) ([]*Revision, error) {
+	if config.UsingDB() {
+		return allRevisionsSQL(tx)
+	}
+	names, _ := GetList()
+	var revs []*Revision
+	for _, name := range names {
+		p := getPolicy(name)
+		if p == nil {
+			continue
+		}
+		for _, r := range p.Revisions {
+			revs = append(revs, r)
+		}
+	}
+	return revs, nil
+}
+
+/* Policy groups */
+
+// NewGroup makes a new, empty policy group. It isn't saved.
+func NewGroup(name string) (*Group, util.Gerror) {
+	if !validPolicyName.MatchString(name) {
+		return nil, util.Errorf("Field 'name' invalid")
+	}
+	return &Group{Name: name, Policies: make(map[string]string)}, nil
+}
+
+// GetGroup gets a policy group.
+func GetGroup(name string) (*Group, util.Gerror) {
+	var g *Group
+	if config.UsingDB() {
+		var err error
+		g, err = getGroupSQL(name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, internalErr(err)
+		}
+	} else {
+		ds := datastore.New()
+		gr, found := ds.Get("policy_group", name)
+		if found && gr != nil {
+			g = gr.(*Group)
+		}
+	}
+	if g == nil {
+		err := util.Errorf("Cannot load policy group %s", name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	if g.Policies == nil {
+		g.Policies = make(map[string]string)
+	}
+	return g, nil
+}
+
+// Save a policy group.
+func (g *Group) Save() error {
+	if config.UsingDB() {
+		return g.saveSQL()
+	}
+	ds := datastore.New()
+	ds.Set("policy_group", g.Name, g)
+	return nil
+}
+
+// Delete a policy group. The policy revisions it was using are left alone.
+func (g *Group) Delete() error {
+	if config.UsingDB() {
+		return g.deleteSQL()
+	}
+	ds := datastore.New()
+	ds.Delete("policy_group", g.Name)
+	return nil
+}
+
+// GroupList returns the names of all the policy groups on the server.
+func GroupList() ([]string, error) {
+	var names []string
+	if config.UsingDB() {
+		var err error
+		if names, err = groupListSQL(); err != nil {
+			return nil, err
+		}
+	} else {
+		ds := datastore.New()
+		names = ds.GetList("policy_group")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AllGroups returns all of the policy groups, for exporting.
+func AllGroups() ([]*Group, error) {
+	return AllGroupsTx(nil)
+}
+
+// AllGroupsTx returns all of the policy groups, reading from the given db
+// handle if using an SQL backend.
+func AllGroupsTx(tx datastore.Dbhandle) ([]*Group, error) {
+	if config.UsingDB() {
+		return allGroupsSQL(tx)
+	}
+	names, _ := GroupList()
+	var groups []*Group
+	for _, name := range names {
+		if g, err := GetGroup(name); err == nil {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// GroupsUsing returns the names of the policy groups using a revision of a
+// policy.
+func GroupsUsing(name string, revisionID string) ([]string, error) {
+	all, err := AllGroups()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, g := range all {
+		if g.Policies[name] == revisionID {
+			groups = append(groups, g.Name)
+		}
+	}
+	return groups, nil
+}
+
+func internalErr(err error) util.Gerror {
+	gerr := util.CastErr(err)
+	gerr.SetStatus(http.StatusInternalServerError)
+	return gerr
+}
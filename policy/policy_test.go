@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+import (
+	"encoding/gob"
+	"net/http"
+	"testing"
+)
+
+func init() {
+	gob.Register(new(Policy))
+	gob.Register(new(Revision))
+	gob.Register(new(Group))
+	gob.Register(make(map[string]interface{}))
+	gob.Register(make([]interface{}, 0))
+}
+
+func testPolicy(name, revID string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"revision_id": revID,
+		"run_list":    []interface{}{"recipe[web::default]"},
+		"cookbook_locks": map[string]interface{}{
+			"web": map[string]interface{}{"identifier": "abc123", "version": "1.0.0"},
+		},
+	}
+}
+
+func TestNewRevisionValidation(t *testing.T) {
+	if _, err := NewRevision("app", testPolicy("app", "1111")); err != nil {
+		t.Errorf("a valid policy was rejected: %s", err)
+	}
+	if _, err := NewRevision("other", testPolicy("app", "1111")); err == nil {
+		t.Errorf("a policy whose name doesn't match should have been rejected")
+	}
+	bad := testPolicy("app", "1111")
+	bad["run_list"] = []interface{}{"role[web]"}
+	if _, err := NewRevision("app", bad); err == nil {
+		t.Errorf("a policy with a role in its run list should have been rejected")
+	}
+	bad = testPolicy("app", "1111")
+	delete(bad, "cookbook_locks")
+	if _, err := NewRevision("app", bad); err == nil {
+		t.Errorf("a policy without cookbook locks should have been rejected")
+	}
+}
+
+func TestRevisionsAndGroups(t *testing.T) {
+	rev, _ := NewRevision("svc", testPolicy("svc", "2222"))
+	if err := rev.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rev.Save(); err == nil || err.Status() != http.StatusConflict {
+		t.Errorf("saving a revision twice should have been a conflict, got %v", err)
+	}
+	if _, err := GetRevision("svc", "2222"); err != nil {
+		t.Errorf("couldn't get the saved revision: %s", err)
+	}
+
+	g, _ := NewGroup("prod")
+	g.Policies["svc"] = "2222"
+	if err := g.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rev.Delete(); err == nil || err.Status() != http.StatusConflict {
+		t.Errorf("deleting a revision in use by a group should have been a conflict, got %v", err)
+	}
+	if err := g.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rev.Delete(); err != nil {
+		t.Errorf("deleting an unused revision failed: %s", err)
+	}
+	if _, err := RevisionIDs("svc"); err == nil || err.Status() != http.StatusNotFound {
+		t.Errorf("a policy with no revisions left should be gone, got %v", err)
+	}
+}
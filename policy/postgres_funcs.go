@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package policy
+
+/* Postgres specific functions for policies and policy groups */
+
+import (
+	"github.com/ctdk/goiardi/datastore"
+)
+
+func (r *Revision) savePostgreSQL() error {
+	data, err := datastore.EncodeBlob(&r.Policy)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Dbh.Exec("INSERT INTO goiardi.policy_revisions (name, revision_id, created_at, data) VALUES ($1, $2, $3, $4)", r.Name, r.RevisionID, r.CreatedAt, string(data))
+	return err
+}
+
+func (r *Revision) fillRevisionFromPostgreSQL(row datastore.ResRow) error {
+	var data []byte
+	err := row.Scan(&r.Name, &r.RevisionID, &r.CreatedAt, &data)
+	if err != nil {
+		return err
+	}
+	return datastore.DecodeBlob(data, &r.Policy)
+}
+
+func (g *Group) savePostgreSQL() error {
+	policies, err := datastore.EncodeBlob(&g.Policies)
+	if err != nil {
+		return err
+	}
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("SELECT goiardi.merge_policy_groups($1, $2)", g.Name, string(policies))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
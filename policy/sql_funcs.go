@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package policy
+
+/* Generic SQL functions for policies and policy groups */
+
+import (
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+)
+
+func (r *Revision) saveSQL() error {
+	if config.Config.UseMySQL {
+		return r.saveMySQL()
+	} else if config.Config.UsePostgreSQL {
+		return r.savePostgreSQL()
+	}
+	return util.NoDBConfigured
+}
+
+func getRevisionSQL(name string, revisionID string) (*Revision, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, revision_id, created_at, data FROM policy_revisions WHERE name = ? AND revision_id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, revision_id, created_at, data FROM goiardi.policy_revisions WHERE name = $1 AND revision_id = $2"
+	}
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rev := new(Revision)
+	if err = rev.fillRevisionSQL(stmt.QueryRow(name, revisionID)); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func revisionIDsSQL(name string) ([]string, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT revision_id FROM policy_revisions WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT revision_id FROM goiardi.policy_revisions WHERE name = $1"
+	}
+	return stringListSQL(sqlStmt, name)
+}
+
+func getListSQL() ([]string, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT DISTINCT name FROM policy_revisions"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT DISTINCT name FROM goiardi.policy_revisions"
+	}
+	return stringListSQL(sqlStmt)
+}
+
+func groupListSQL() ([]string, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name FROM policy_groups"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name FROM goiardi.policy_groups"
+	}
+	return stringListSQL(sqlStmt)
+}
+
+func stringListSQL(sqlStmt string, args ...interface{}) ([]string, error) {
+	rows, err := datastore.Dbh.Query(sqlStmt, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (r *Revision) deleteSQL() error {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "DELETE FROM policy_revisions WHERE name = ? AND revision_id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "DELETE FROM goiardi.policy_revisions WHERE name = $1 AND revision_id = $2"
+	}
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqlStmt, r.Name, r.RevisionID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func allRevisionsSQL(dbhandle datastore.Dbhandle) ([]*Revision, error) {
+	if dbhandle == nil {
+		dbhandle = datastore.Dbh
+	}
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, revision_id, created_at, data FROM policy_revisions"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, revision_id, created_at, data FROM goiardi.policy_revisions"
+	}
+	stmt, err := dbhandle.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var revs []*Revision
+	for rows.Next() {
+		rev := new(Revision)
+		if err = rev.fillRevisionSQL(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+func (r *Revision) fillRevisionSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return r.fillRevisionFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return r.fillRevisionFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
+
+func (g *Group) saveSQL() error {
+	if config.Config.UseMySQL {
+		return g.saveMySQL()
+	} else if config.Config.UsePostgreSQL {
+		return g.savePostgreSQL()
+	}
+	return util.NoDBConfigured
+}
+
+func getGroupSQL(name string) (*Group, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, policies FROM policy_groups WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, policies FROM goiardi.policy_groups WHERE name = $1"
+	}
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	g := new(Group)
+	if err = g.fillGroupSQL(stmt.QueryRow(name)); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Group) deleteSQL() error {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "DELETE FROM policy_groups WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "DELETE FROM goiardi.policy_groups WHERE name = $1"
+	}
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqlStmt, g.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func allGroupsSQL(dbhandle datastore.Dbhandle) ([]*Group, error) {
+	if dbhandle == nil {
+		dbhandle = datastore.Dbh
+	}
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, policies FROM policy_groups"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, policies FROM goiardi.policy_groups"
+	}
+	stmt, err := dbhandle.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var groups []*Group
+	for rows.Next() {
+		g := new(Group)
+		if err = g.fillGroupSQL(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (g *Group) fillGroupSQL(row datastore.ResRow) error {
+	var policies []byte
+	if err := row.Scan(&g.Name, &policies); err != nil {
+		return err
+	}
+	return datastore.DecodeBlob(policies, &g.Policies)
+}
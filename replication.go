@@ -0,0 +1,485 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Replicating an in-memory goiardi server to read-only standby servers.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/indexer"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the primary sends a heartbeat down an idle replication stream. A
+// standby that hasn't heard anything for three heartbeats reconnects.
+const replicationHeartbeat = 15 * time.Second
+
+// How long a standby waits before trying to reconnect to its primary.
+const replicationRetry = 5 * time.Second
+
+const replicationKeyHeader = "X-Goiardi-Replication-Key"
+
+type replicationSnapshot struct {
+	Journal string
+	Seq     uint64
+	Data    []byte
+	Index   []byte
+}
+
+// standbyState tracks how far a standby has gotten replaying its primary's
+// journal. The lock is held while each change is applied, so promoting the
+// standby waits for the change in progress to finish.
+type standbyState struct {
+	sync.Mutex
+	active      bool
+	journal     string
+	seq         uint64
+	primarySeq  uint64
+	connected   bool
+	lastContact time.Time
+	lastErr     string
+	// closes the current replication stream
+	stop func()
+}
+
+var standby = &standbyState{}
+
+func isStandby() bool {
+	standby.Lock()
+	defer standby.Unlock()
+	return standby.active
+}
+
+// runUnlessStandby runs fn every interval in the background, skipping it
+// whenever this server is a standby, for jobs that only the primary should do.
+func runUnlessStandby(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for _ = range ticker.C {
+			if isStandby() {
+				continue
+			}
+			fn()
+		}
+	}()
+}
+
+// startReplication starts either following the primary, if this server is a
+// standby, or recording changes for standbys to follow, if a replication key
+// is set.
+func startReplication() error {
+	if config.Config.StandbyOf != "" {
+		standby.active = true
+		logger.Infof("Running as a read-only standby of %s", config.Config.StandbyOf)
+		go followPrimary()
+		return nil
+	}
+	if config.Config.ReplicationKey != "" && !config.UsingDB() {
+		return datastore.StartJournal()
+	}
+	return nil
+}
+
+// standbyAllowed returns true if a request can be served by a standby. Only
+// reads are allowed, plus the few POSTs that don't change anything and
+// promoting the standby.
+func standbyAllowed(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	if r.Method == "POST" {
+		return strings.HasPrefix(r.URL.Path, "/search/") || r.URL.Path == "/authenticate_user" || r.URL.Path == "/_replication/_promote" || depsolverRequest(r)
+	}
+	return false
+}
+
+// replicationKeyOK checks the replication key sent by a standby. Standbys use
+// the key instead of signing their requests, so these requests skip the usual
+// authentication. The key is only good for what standbys need: the snapshot,
+// the journal stream, and files from the primary's file store. Anything else,
+// like promoting a standby, has to be signed by an admin.
+func replicationKeyOK(r *http.Request) bool {
+	standbyReq := r.URL.Path == "/_replication/_snapshot" || r.URL.Path == "/_replication/_stream" || strings.HasPrefix(r.URL.Path, "/file_store/")
+	if config.Config.ReplicationKey == "" || r.Method != "GET" || !standbyReq {
+		return false
+	}
+	key := r.Header.Get(replicationKeyHeader)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(config.Config.ReplicationKey)) == 1
+}
+
+func replicationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	pathArray := splitPath(r.URL.Path)
+
+	if len(pathArray) == 2 && (pathArray[1] == "_snapshot" || pathArray[1] == "_stream") {
+		if !replicationKeyOK(r) {
+			jsonErrorReport(w, r, "Invalid replication key", http.StatusForbidden)
+			return
+		}
+		if !datastore.Journaling() {
+			jsonErrorReport(w, r, "Replication is not enabled on this server", http.StatusNotFound)
+			return
+		}
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		if pathArray[1] == "_snapshot" {
+			sendReplicationSnapshot(w, r)
+		} else {
+			sendReplicationStream(w, r)
+		}
+		return
+	}
+
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(pathArray) == 1:
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	case len(pathArray) == 2 && pathArray[1] == "_promote":
+		if r.Method != "POST" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := promoteStandby(); err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	response := replicationStatus()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func replicationStatus() map[string]interface{} {
+	standby.Lock()
+	defer standby.Unlock()
+	if standby.active {
+		return map[string]interface{}{
+			"role":         "standby",
+			"primary":      config.Config.StandbyOf,
+			"journal":      standby.journal,
+			"seq":          standby.seq,
+			"lag":          standby.primarySeq - standby.seq,
+			"connected":    standby.connected,
+			"last_contact": standby.lastContact,
+			"last_error":   standby.lastErr,
+		}
+	}
+	status := map[string]interface{}{"role": "primary", "journaling": datastore.Journaling()}
+	if id, seq, err := datastore.JournalPosition(); err == nil {
+		status["journal"] = id
+		status["seq"] = seq
+	}
+	return status
+}
+
+func sendReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	ds := datastore.New()
+	data, id, seq, err := ds.Snapshot()
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idx, err := indexer.Snapshot()
+	if err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	snap := &replicationSnapshot{Journal: id, Seq: seq, Data: data, Index: idx}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snap); err != nil {
+		logger.Errorf("Error sending replication snapshot: %s", err.Error())
+	}
+}
+
+// sendReplicationStream sends the changes recorded in the journal after the
+// sequence number the standby asks for, and then keeps sending new changes as
+// they happen until the standby goes away.
+func sendReplicationStream(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("journal")
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		jsonErrorReport(w, r, "Invalid sequence number", http.StatusBadRequest)
+		return
+	}
+	changes, notify, err := datastore.JournalSince(id, since)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == datastore.ErrJournalGone {
+			status = http.StatusGone
+		}
+		jsonErrorReport(w, r, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	flusher, _ := w.(http.Flusher)
+	enc := gob.NewEncoder(w)
+	ticker := time.NewTicker(replicationHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+			since = c.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-notify:
+		case <-ticker.C:
+			if err := enc.Encode(&datastore.Change{Kind: datastore.ChangeHeartbeat, Seq: since}); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		changes, notify, err = datastore.JournalSince(id, since)
+		if err != nil {
+			// The standby will find out why when it reconnects.
+			return
+		}
+	}
+}
+
+// followPrimary keeps a standby following its primary's journal, reconnecting
+// whenever the stream is interrupted, until the standby is promoted.
+func followPrimary() {
+	for isStandby() {
+		err := followStream()
+		standby.Lock()
+		standby.connected = false
+		standby.stop = nil
+		if err != nil && standby.active {
+			standby.lastErr = err.Error()
+			logger.Errorf("Replication from %s interrupted: %s", config.Config.StandbyOf, err.Error())
+		}
+		standby.Unlock()
+		if isStandby() {
+			time.Sleep(replicationRetry)
+		}
+	}
+}
+
+func replicationRequest(reqPath string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", config.Config.StandbyOf+reqPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(replicationKeyHeader, config.Config.ReplicationKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return resp, fmt.Errorf("%s from primary: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// fetchPrimaryFile fetches a file from the primary's file store. A file the
+// primary doesn't have gives an error satisfying os.IsNotExist.
+func fetchPrimaryFile(chksum string) (io.ReadCloser, error) {
+	resp, err := replicationRequest("/file_store/" + chksum)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: "fetch", Path: chksum, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// loadReplicationSnapshot replaces everything on the standby with a fresh
+// snapshot from the primary.
+func loadReplicationSnapshot() error {
+	resp, err := replicationRequest("/_replication/_snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	snap := new(replicationSnapshot)
+	dec := gob.NewDecoder(resp.Body)
+	if err := dec.Decode(snap); err != nil {
+		return err
+	}
+
+	standby.Lock()
+	defer standby.Unlock()
+	if !standby.active {
+		return nil
+	}
+	ds := datastore.New()
+	if err := ds.Restore(snap.Data); err != nil {
+		return err
+	}
+	if err := indexer.Restore(snap.Index); err != nil {
+		return err
+	}
+	// Files kept in the local filestore directory aren't in the
+	// snapshot, so they're fetched from the primary.
+	if err := filestore.RestoreLocalFiles(fetchPrimaryFile); err != nil {
+		return err
+	}
+	standby.journal = snap.Journal
+	standby.seq = snap.Seq
+	standby.primarySeq = snap.Seq
+	standby.lastContact = time.Now()
+	logger.Infof("Loaded snapshot from %s at journal %s position %d", config.Config.StandbyOf, snap.Journal, snap.Seq)
+	return nil
+}
+
+func followStream() error {
+	standby.Lock()
+	journal, seq := standby.journal, standby.seq
+	standby.Unlock()
+	if journal == "" {
+		if err := loadReplicationSnapshot(); err != nil {
+			return err
+		}
+		standby.Lock()
+		journal, seq = standby.journal, standby.seq
+		standby.Unlock()
+	}
+
+	resp, err := replicationRequest(fmt.Sprintf("/_replication/_stream?journal=%s&since=%d", journal, seq))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusGone {
+			// Start over with a new snapshot next time.
+			standby.Lock()
+			standby.journal = ""
+			standby.Unlock()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var closeOnce sync.Once
+	stop := func() { closeOnce.Do(func() { resp.Body.Close() }) }
+	watchdog := time.AfterFunc(3*replicationHeartbeat, stop)
+	defer watchdog.Stop()
+	standby.Lock()
+	if !standby.active {
+		standby.Unlock()
+		return nil
+	}
+	standby.connected = true
+	standby.lastErr = ""
+	standby.stop = stop
+	standby.Unlock()
+
+	dec := gob.NewDecoder(resp.Body)
+	for {
+		c := new(datastore.Change)
+		if err := dec.Decode(c); err != nil {
+			return err
+		}
+		watchdog.Reset(3 * replicationHeartbeat)
+		if err := applyReplicatedChange(c); err != nil {
+			standby.Lock()
+			standby.journal = ""
+			standby.Unlock()
+			return fmt.Errorf("applying change %d: %s", c.Seq, err.Error())
+		}
+	}
+}
+
+func applyReplicatedChange(c *datastore.Change) error {
+	standby.Lock()
+	defer standby.Unlock()
+	if !standby.active {
+		return nil
+	}
+	standby.lastContact = time.Now()
+	if c.Seq > standby.primarySeq {
+		standby.primarySeq = c.Seq
+	}
+	var err error
+	switch c.Kind {
+	case datastore.ChangeHeartbeat:
+		return nil
+	case datastore.ChangeSet, datastore.ChangeDelete:
+		err = datastore.New().ApplyChange(c)
+	case datastore.ChangeBlob, datastore.ChangeBlobDelete:
+		err = filestore.ApplyChange(c, fetchPrimaryFile)
+	default:
+		err = indexer.ApplyChange(c)
+	}
+	if err != nil {
+		return err
+	}
+	standby.seq = c.Seq
+	return nil
+}
+
+// promoteStandby turns a standby into a primary that accepts changes. If a
+// replication key is set, it starts a new journal for standbys of its own.
+func promoteStandby() error {
+	standby.Lock()
+	defer standby.Unlock()
+	if !standby.active {
+		return fmt.Errorf("This server is not a standby")
+	}
+	standby.active = false
+	if standby.stop != nil {
+		standby.stop()
+	}
+	logger.Infof("Promoted from standby of %s to primary at journal %s position %d", config.Config.StandbyOf, standby.journal, standby.seq)
+	if config.Config.ReplicationKey != "" {
+		return datastore.StartJournal()
+	}
+	return nil
+}
@@ -15,7 +15,8 @@
  */
 
 /*
-Package report implements reporting on client runs and node changes. See http://docs.opscode.com/reporting.html for details. CURRENTLY EXPERIMENTAL. */
+Package report implements reporting on client runs and node changes. See http://docs.opscode.com/reporting.html for details. CURRENTLY EXPERIMENTAL.
+*/
 package report
 
 import (
@@ -23,6 +24,7 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"github.com/codeskyblue/go-uuid"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/util"
@@ -353,8 +355,19 @@ func (r *Report) GobDecode(b []byte) error {
 
 // AllReports returns all run reports currently on the server for export.
 func AllReports() []*Report {
+	reports, err := AllReportsTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all reports: %s", err.Error())
+	}
+	return reports
+}
+
+// AllReportsTx returns all run reports currently on the server for export like
+// AllReports, but with an SQL backend reads them through the given db handle.
+// Pass in a transaction to read the reports as part of a consistent snapshot.
+func AllReportsTx(tx datastore.Dbhandle) ([]*Report, error) {
 	if config.UsingDB() {
-		return getReportsSQL()
+		return getReportsSQL(tx)
 	}
 	var reports []*Report
 	reportList := GetList()
@@ -364,5 +377,5 @@ func AllReports() []*Report {
 			reports = append(reports, rp)
 		}
 	}
-	return reports
+	return reports, nil
 }
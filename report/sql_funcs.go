@@ -249,7 +249,7 @@ func getNodeListSQL(nodeName string, from, until time.Time, retrows int, status
 	return reports, nil
 }
 
-func getReportsSQL() []*Report {
+func getReportsSQL(dbhandle datastore.Dbhandle) ([]*Report, error) {
 	var reports []*Report
 
 	var sqlStmt string
@@ -259,30 +259,30 @@ func getReportsSQL() []*Report {
 		sqlStmt = "SELECT run_id, start_time, end_time, total_res_count, status, run_list, resources, data, node_name FROM goiardi.reports"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, rerr := stmt.Query()
 	if rerr != nil {
 		if rerr == sql.ErrNoRows {
-			return reports
+			return reports, nil
 		}
-		log.Fatal(rerr)
+		return nil, rerr
 	}
 	for rows.Next() {
 		r := new(Report)
 		err = r.fillReportFromSQL(rows)
 		if err != nil {
 			rows.Close()
-			log.Fatal(err)
+			return nil, err
 		}
 		reports = append(reports, r)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return reports
+	return reports, nil
 }
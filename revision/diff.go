@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package revision
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Kinds of changes in a diff.
+const (
+	DiffAdd    = "add"
+	DiffRemove = "remove"
+	DiffChange = "change"
+)
+
+// Change is one difference between two versions of an object. Path is the list
+// of keys leading down to the value that changed. Maps are compared key by key,
+// while anything else (including arrays, like run lists) is compared as a
+// whole.
+type Change struct {
+	Path []string    `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Diff returns the changes needed to get from one version of an object to
+// another, sorted by path.
+func Diff(from map[string]interface{}, to map[string]interface{}) []*Change {
+	changes := make([]*Change, 0)
+	return diffMaps(changes, nil, from, to)
+}
+
+func diffMaps(changes []*Change, path []string, from map[string]interface{}, to map[string]interface{}) []*Change {
+	keys := make([]string, 0, len(from)+len(to))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	for k := range to {
+		if _, ok := from[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := make([]string, len(path)+1)
+		copy(p, path)
+		p[len(path)] = k
+		oldVal, inFrom := from[k]
+		newVal, inTo := to[k]
+		switch {
+		case !inTo:
+			changes = append(changes, &Change{Path: p, Op: DiffRemove, Old: oldVal})
+		case !inFrom:
+			changes = append(changes, &Change{Path: p, Op: DiffAdd, New: newVal})
+		default:
+			oldMap, oldOk := oldVal.(map[string]interface{})
+			newMap, newOk := newVal.(map[string]interface{})
+			if oldOk && newOk {
+				changes = diffMaps(changes, p, oldMap, newMap)
+			} else if !reflect.DeepEqual(oldVal, newVal) {
+				changes = append(changes, &Change{Path: p, Op: DiffChange, Old: oldVal, New: newVal})
+			}
+		}
+	}
+	return changes
+}
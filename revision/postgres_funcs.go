@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package revision
+
+/* Postgres specific functions for object revisions */
+
+import (
+	"github.com/ctdk/goiardi/datastore"
+)
+
+func (rev *Revision) fillRevisionFromPostgreSQL(row datastore.ResRow) error {
+	var data []byte
+	err := row.Scan(&rev.ObjectType, &rev.ObjectName, &rev.Revision, &rev.Action, &rev.Time, &data)
+	if err != nil {
+		return err
+	}
+	rev.Data = data
+	return nil
+}
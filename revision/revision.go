@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package revision keeps the previous states of roles, environments, nodes, and data bag items as they're saved and deleted, so they can be looked at, compared, and rolled back to later. Where the event log only records that an object changed, a revision records what the object looked like.
+*/
+package revision
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Actions a revision can record.
+const (
+	ActionSave   = "save"
+	ActionDelete = "delete"
+)
+
+// Revision is the state of an object when it was saved, or right before it
+// was deleted. Revision numbers count up from 1 for each object, and are not
+// reused even after old revisions are pruned.
+type Revision struct {
+	ObjectType string          `json:"object_type"`
+	ObjectName string          `json:"object_name"`
+	Revision   int             `json:"revision"`
+	Action     string          `json:"action"`
+	Time       time.Time       `json:"time"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// History holds the revisions kept for an object in the in-memory data store.
+type History struct {
+	Revisions []*Revision
+}
+
+// Protects the get, append, and set of an object's revisions in the in-memory
+// data store.
+var memLock sync.Mutex
+
+// Record a new revision of the object with the given type and name, if keeping
+// revisions is turned on. A save that doesn't change anything from the latest
+// revision isn't recorded, so nodes that are saved on every chef-client run
+// don't push their real changes out of the history.
+func Record(objType string, name string, action string, obj interface{}) error {
+	keep := config.Config.KeepRevisions
+	if keep == 0 {
+		return nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	rev := &Revision{ObjectType: objType, ObjectName: name, Action: action, Time: time.Now(), Data: data}
+	if config.UsingDB() {
+		return rev.recordSQL(keep)
+	}
+	return rev.recordInMem(keep)
+}
+
+func (rev *Revision) recordInMem(keep int) error {
+	memLock.Lock()
+	defer memLock.Unlock()
+	revs := getInMem(rev.ObjectType, rev.ObjectName)
+	if len(revs) > 0 {
+		latest := revs[len(revs)-1]
+		if rev.Action == ActionSave && latest.Action == ActionSave && bytes.Equal(rev.Data, latest.Data) {
+			return nil
+		}
+		rev.Revision = latest.Revision + 1
+	} else {
+		rev.Revision = 1
+	}
+	revs = append(revs, rev)
+	if len(revs) > keep {
+		revs = revs[len(revs)-keep:]
+	}
+	ds := datastore.New()
+	ds.Set("revision", memKey(rev.ObjectType, rev.ObjectName), &History{Revisions: revs})
+	return nil
+}
+
+func getInMem(objType string, name string) []*Revision {
+	ds := datastore.New()
+	r, found := ds.Get("revision", memKey(objType, name))
+	if !found || r == nil {
+		return nil
+	}
+	return r.(*History).Revisions
+}
+
+func memKey(objType string, name string) string {
+	return fmt.Sprintf("%s/%s", objType, name)
+}
+
+// List returns the revisions kept for an object, oldest first.
+func List(objType string, name string) ([]*Revision, error) {
+	if config.UsingDB() {
+		return listSQL(objType, name)
+	}
+	return getInMem(objType, name), nil
+}
+
+// Get a particular revision of an object.
+func Get(objType string, name string, revNum int) (*Revision, util.Gerror) {
+	var rev *Revision
+	if config.UsingDB() {
+		var err error
+		rev, err = getSQL(objType, name, revNum)
+		if err != nil && err != sql.ErrNoRows {
+			gerr := util.Errorf(err.Error())
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+	} else {
+		for _, r := range getInMem(objType, name) {
+			if r.Revision == revNum {
+				rev = r
+				break
+			}
+		}
+	}
+	if rev == nil {
+		gerr := util.Errorf("Cannot load revision %d of %s %s", revNum, objType, name)
+		gerr.SetStatus(http.StatusNotFound)
+		return nil, gerr
+	}
+	return rev, nil
+}
+
+// Object returns the revision's copy of the object as a map, like it would
+// have been sent to the server in a request.
+func (rev *Revision) Object() (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(rev.Data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package revision
+
+import (
+	"encoding/gob"
+	"github.com/ctdk/goiardi/config"
+	"testing"
+)
+
+func init() {
+	h := new(History)
+	gob.Register(h)
+	m := make(map[string]interface{})
+	gob.Register(m)
+}
+
+func TestRecordRevisions(t *testing.T) {
+	config.Config.KeepRevisions = 3
+	defer func() { config.Config.KeepRevisions = 0 }()
+
+	obj := map[string]interface{}{"name": "foo", "description": "one"}
+	for _, d := range []string{"one", "one", "two", "three", "four"} {
+		obj["description"] = d
+		if err := Record("role", "foo", ActionSave, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Record("role", "foo", ActionDelete, obj); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := List("role", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The repeated save of "one" isn't recorded, so there were five
+	// revisions, and only the last three are kept.
+	if len(revs) != 3 {
+		t.Fatalf("expected 3 revisions, got %d", len(revs))
+	}
+	if revs[0].Revision != 3 || revs[2].Revision != 5 {
+		t.Errorf("expected revisions 3 through 5, got %d through %d", revs[0].Revision, revs[2].Revision)
+	}
+	if revs[2].Action != ActionDelete {
+		t.Errorf("expected the last revision to be a delete, got %s", revs[2].Action)
+	}
+	rev, gerr := Get("role", "foo", 3)
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	o, err := rev.Object()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o["description"] != "three" {
+		t.Errorf("expected revision 3 to have description 'three', got %v", o["description"])
+	}
+	if _, gerr = Get("role", "foo", 1); gerr == nil {
+		t.Errorf("pruned revision 1 was still found")
+	}
+}
+
+func TestNoRevisions(t *testing.T) {
+	if err := Record("role", "bar", ActionSave, map[string]interface{}{"name": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	revs, _ := List("role", "bar")
+	if len(revs) != 0 {
+		t.Errorf("revisions were kept with keep-revisions unset")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := map[string]interface{}{
+		"name":     "foo",
+		"run_list": []interface{}{"recipe[a]"},
+		"normal":   map[string]interface{}{"a": "b", "c": map[string]interface{}{"d": float64(1)}},
+	}
+	to := map[string]interface{}{
+		"name":     "foo",
+		"run_list": []interface{}{"recipe[a]", "recipe[b]"},
+		"normal":   map[string]interface{}{"c": map[string]interface{}{"d": float64(2)}, "e": true},
+	}
+	changes := Diff(from, to)
+	expected := []struct {
+		path string
+		op   string
+	}{
+		{"normal/a", DiffRemove},
+		{"normal/c/d", DiffChange},
+		{"normal/e", DiffAdd},
+		{"run_list", DiffChange},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+	}
+	for i, e := range expected {
+		p := ""
+		for j, k := range changes[i].Path {
+			if j > 0 {
+				p += "/"
+			}
+			p += k
+		}
+		if p != e.path || changes[i].Op != e.op {
+			t.Errorf("change %d: expected %s %s, got %s %s", i, e.op, e.path, changes[i].Op, p)
+		}
+	}
+	if len(Diff(from, from)) != 0 {
+		t.Errorf("diffing an object with itself found changes")
+	}
+}
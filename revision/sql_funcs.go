@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package revision
+
+/* Generic SQL functions for object revisions */
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+)
+
+func (rev *Revision) recordSQL(keep int) error {
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+
+	var latestStmt, insertStmt, pruneStmt string
+	if config.Config.UseMySQL {
+		latestStmt = "SELECT revision, action, data FROM object_revisions WHERE object_type = ? AND object_name = ? ORDER BY revision DESC LIMIT 1 FOR UPDATE"
+		insertStmt = "INSERT INTO object_revisions (object_type, object_name, revision, action, created_at, data) VALUES (?, ?, ?, ?, ?, ?)"
+		pruneStmt = "DELETE FROM object_revisions WHERE object_type = ? AND object_name = ? AND revision <= ?"
+	} else if config.Config.UsePostgreSQL {
+		latestStmt = "SELECT revision, action, data FROM goiardi.object_revisions WHERE object_type = $1 AND object_name = $2 ORDER BY revision DESC LIMIT 1 FOR UPDATE"
+		insertStmt = "INSERT INTO goiardi.object_revisions (object_type, object_name, revision, action, created_at, data) VALUES ($1, $2, $3, $4, $5, $6)"
+		pruneStmt = "DELETE FROM goiardi.object_revisions WHERE object_type = $1 AND object_name = $2 AND revision <= $3"
+	}
+
+	var latestRev int
+	var latestAction string
+	var latestData []byte
+	err = tx.QueryRow(latestStmt, rev.ObjectType, rev.ObjectName).Scan(&latestRev, &latestAction, &latestData)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if err == nil && rev.Action == ActionSave && latestAction == ActionSave && bytes.Equal(rev.Data, latestData) {
+		tx.Rollback()
+		return nil
+	}
+	rev.Revision = latestRev + 1
+
+	_, err = tx.Exec(insertStmt, rev.ObjectType, rev.ObjectName, rev.Revision, rev.Action, rev.Time, string(rev.Data))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(pruneStmt, rev.ObjectType, rev.ObjectName, rev.Revision-keep)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+func getSQL(objType string, name string, revNum int) (*Revision, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT object_type, object_name, revision, action, created_at, data FROM object_revisions WHERE object_type = ? AND object_name = ? AND revision = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT object_type, object_name, revision, action, created_at, data FROM goiardi.object_revisions WHERE object_type = $1 AND object_name = $2 AND revision = $3"
+	}
+
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rev := new(Revision)
+	row := stmt.QueryRow(objType, name, revNum)
+	if err = rev.fillRevisionSQL(row); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func listSQL(objType string, name string) ([]*Revision, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT object_type, object_name, revision, action, created_at, data FROM object_revisions WHERE object_type = ? AND object_name = ? ORDER BY revision"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT object_type, object_name, revision, action, created_at, data FROM goiardi.object_revisions WHERE object_type = $1 AND object_name = $2 ORDER BY revision"
+	}
+
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(objType, name)
+	if err != nil {
+		return nil, err
+	}
+	var revs []*Revision
+	for rows.Next() {
+		rev := new(Revision)
+		if err = rev.fillRevisionSQL(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+func (rev *Revision) fillRevisionSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return rev.fillRevisionFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return rev.fillRevisionFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Looking at, comparing, and rolling back to previous revisions of roles,
+// environments, nodes, and data bag items.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/environment"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/revision"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// revisionHandler handles the _revisions part of an object's URL, like
+// /roles/NAME/_revisions. The object doesn't need to exist anymore, so deleted
+// objects can be brought back. revPath is whatever comes after _revisions in
+// the URL.
+func revisionHandler(w http.ResponseWriter, r *http.Request, opUser actor.Actor, objType string, name string, revPath []string) {
+	if opUser.IsValidator() {
+		jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+		return
+	}
+
+	var response interface{}
+	switch len(revPath) {
+	case 0:
+		// GET /_revisions
+		if r.Method != "GET" {
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		revs, err := revision.List(objType, name)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(revs) == 0 {
+			jsonErrorReport(w, r, fmt.Sprintf("No revisions found for %s %s", objType, name), http.StatusNotFound)
+			return
+		}
+		revList := make([]map[string]interface{}, len(revs))
+		for i, rev := range revs {
+			revList[i] = map[string]interface{}{
+				"revision": rev.Revision,
+				"action":   rev.Action,
+				"time":     rev.Time,
+				"uri":      revisionURL(objType, name, rev.Revision),
+			}
+		}
+		response = revList
+	case 1, 2:
+		revNum, err := strconv.Atoi(revPath[0])
+		if err != nil {
+			jsonErrorReport(w, r, fmt.Sprintf("Invalid revision '%s'", revPath[0]), http.StatusBadRequest)
+			return
+		}
+		rev, gerr := revision.Get(objType, name, revNum)
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+			return
+		}
+		op := ""
+		if len(revPath) == 2 {
+			op = revPath[1]
+		}
+		switch op {
+		case "":
+			// GET /_revisions/N
+			if r.Method != "GET" {
+				jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+				return
+			}
+			response = rev
+		case "_diff":
+			// GET /_revisions/N/_diff?from=M
+			if r.Method != "GET" {
+				jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+				return
+			}
+			diff, derr := diffRevision(r, rev)
+			if derr != nil {
+				jsonErrorReport(w, r, derr.Error(), derr.Status())
+				return
+			}
+			response = diff
+		case "_rollback":
+			// POST /_revisions/N/_rollback
+			if r.Method != "POST" {
+				jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+				return
+			}
+			if !opUser.IsAdmin() {
+				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
+				return
+			}
+			obj, rerr := rollbackRevision(opUser, rev)
+			if rerr != nil {
+				jsonErrorReport(w, r, rerr.Error(), rerr.Status())
+				return
+			}
+			setETag(w, obj)
+			response = obj
+		default:
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func revisionURL(objType string, name string, revNum int) string {
+	var base string
+	switch objType {
+	case "role":
+		base = "roles"
+	case "environment":
+		base = "environments"
+	case "node":
+		base = "nodes"
+	case "data_bag_item":
+		base = "data"
+	}
+	return util.CustomURL(fmt.Sprintf("/%s/%s/_revisions/%d", base, name, revNum))
+}
+
+// diffRevision compares a revision with an earlier one, given with the "from"
+// query parameter. Without "from", the revision is compared with the one right
+// before it, or with nothing at all if it's the oldest revision kept. Comparing
+// with a deleted revision is like comparing with nothing, since the object
+// wasn't there.
+func diffRevision(r *http.Request, rev *revision.Revision) (map[string]interface{}, util.Gerror) {
+	var from *revision.Revision
+	if f := r.URL.Query().Get("from"); f != "" {
+		fromNum, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, util.Errorf("Invalid revision '%s'", f)
+		}
+		var gerr util.Gerror
+		from, gerr = revision.Get(rev.ObjectType, rev.ObjectName, fromNum)
+		if gerr != nil {
+			return nil, gerr
+		}
+	} else {
+		revs, err := revision.List(rev.ObjectType, rev.ObjectName)
+		if err != nil {
+			return nil, internalGerror(err)
+		}
+		for _, rv := range revs {
+			if rv.Revision < rev.Revision {
+				from = rv
+			}
+		}
+	}
+
+	revObj, err := revisionObject(rev)
+	if err != nil {
+		return nil, err
+	}
+	fromObj := make(map[string]interface{})
+	fromNum := 0
+	if from != nil {
+		fromNum = from.Revision
+		if fromObj, err = revisionObject(from); err != nil {
+			return nil, err
+		}
+	}
+	diff := map[string]interface{}{
+		"from":    fromNum,
+		"to":      rev.Revision,
+		"changes": revision.Diff(fromObj, revObj),
+	}
+	return diff, nil
+}
+
+func revisionObject(rev *revision.Revision) (map[string]interface{}, util.Gerror) {
+	if rev.Action == revision.ActionDelete {
+		return make(map[string]interface{}), nil
+	}
+	obj, err := rev.Object()
+	if err != nil {
+		return nil, internalGerror(err)
+	}
+	return obj, nil
+}
+
+// rollbackRevision puts an object back the way it was in the given revision,
+// recreating it if it's been deleted since. Saving the object records a new
+// revision, so a rollback can itself be rolled back.
+func rollbackRevision(opUser actor.Actor, rev *revision.Revision) (interface{}, util.Gerror) {
+	objData, err := rev.Object()
+	if err != nil {
+		return nil, internalGerror(err)
+	}
+	// Data bag items can have anything in them, including things that
+	// look like run lists, so they're left alone.
+	if rev.ObjectType != "data_bag_item" {
+		if objData, err = checkAttrs(objData); err != nil {
+			return nil, util.CastErr(err)
+		}
+	}
+	defer lockObject(rev.ObjectType, rev.ObjectName)()
+
+	var obj util.GoiardiObj
+	var response interface{}
+	action := "modify"
+	switch rev.ObjectType {
+	case "role":
+		chefRole, _ := role.Get(rev.ObjectName)
+		if chefRole == nil {
+			action = "create"
+			var gerr util.Gerror
+			if chefRole, gerr = role.NewFromJSON(objData); gerr != nil {
+				return nil, gerr
+			}
+		} else if gerr := chefRole.UpdateFromJSON(objData); gerr != nil {
+			return nil, gerr
+		}
+		if err := chefRole.Save(); err != nil {
+			return nil, internalGerror(err)
+		}
+		obj, response = chefRole, chefRole
+	case "environment":
+		env, _ := environment.Get(rev.ObjectName)
+		if env == nil {
+			action = "create"
+			var gerr util.Gerror
+			if env, gerr = environment.NewFromJSON(objData); gerr != nil {
+				return nil, gerr
+			}
+		} else if gerr := env.UpdateFromJSON(objData); gerr != nil {
+			return nil, gerr
+		}
+		if gerr := env.Save(); gerr != nil {
+			return nil, gerr
+		}
+		obj, response = env, env
+	case "node":
+		// Node revisions only have the run list and normal
+		// attributes, so only those get rolled back on an existing
+		// node.
+		chefNode, _ := node.Get(rev.ObjectName)
+		if chefNode == nil {
+			action = "create"
+			var gerr util.Gerror
+			if chefNode, gerr = node.NewFromJSON(objData); gerr != nil {
+				return nil, gerr
+			}
+		} else {
+			rl, verr := util.ValidateRunList(objData["run_list"])
+			if verr != nil {
+				return nil, verr
+			}
+			normal, verr := util.ValidateAttributes("normal", objData["normal"])
+			if verr != nil {
+				return nil, verr
+			}
+			chefNode.RunList = rl
+			chefNode.Normal = normal
+		}
+		if err := chefNode.Save(); err != nil {
+			return nil, internalGerror(err)
+		}
+		obj, response = chefNode, chefNode
+	case "data_bag_item":
+		bagItem := strings.SplitN(rev.ObjectName, "/", 2)
+		if len(bagItem) != 2 {
+			return nil, util.Errorf("Invalid data bag item name %s", rev.ObjectName)
+		}
+		chefDbag, _ := databag.Get(bagItem[0])
+		if chefDbag == nil {
+			var gerr util.Gerror
+			if chefDbag, gerr = databag.New(bagItem[0]); gerr != nil {
+				return nil, gerr
+			}
+			if err := chefDbag.Save(); err != nil {
+				return nil, internalGerror(err)
+			}
+			if lerr := loginfo.LogEvent(opUser, chefDbag, "create"); lerr != nil {
+				return nil, internalGerror(lerr)
+			}
+		}
+		var dbi *databag.DataBagItem
+		if cur, _ := chefDbag.GetDBItem(bagItem[1]); cur == nil {
+			action = "create"
+			var gerr util.Gerror
+			if dbi, gerr = chefDbag.NewDBItem(objData); gerr != nil {
+				return nil, gerr
+			}
+		} else {
+			var err error
+			if dbi, err = chefDbag.UpdateDBItem(bagItem[1], objData); err != nil {
+				return nil, internalGerror(err)
+			}
+		}
+		obj, response = dbi, dbi.RawData
+	default:
+		return nil, util.Errorf("Cannot roll back objects of type %s", rev.ObjectType)
+	}
+
+	if lerr := loginfo.LogEvent(opUser, obj, action); lerr != nil {
+		return nil, internalGerror(lerr)
+	}
+	return response, nil
+}
+
+func internalGerror(err error) util.Gerror {
+	gerr := util.CastErr(err)
+	gerr.SetStatus(http.StatusInternalServerError)
+	return gerr
+}
@@ -22,7 +22,7 @@ import (
 	"github.com/ctdk/goiardi/datastore"
 )
 
-func (r *Role) saveMySQL() error {
+func (r *Role) saveMySQL(ifMatch string) error {
 	rlb, rlerr := datastore.EncodeBlob(&r.RunList)
 	if rlerr != nil {
 		return rlerr
@@ -43,6 +43,10 @@ func (r *Role) saveMySQL() error {
 	if err != nil {
 		return err
 	}
+	if err = r.checkETagSQL(tx, ifMatch); err != nil {
+		tx.Rollback()
+		return err
+	}
 	_, err = tx.Exec("INSERT INTO roles (name, description, run_list, env_run_lists, default_attr, override_attr, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE description = ?, run_list = ?, env_run_lists = ?, default_attr = ?, override_attr = ?, updated_at = NOW()", r.Name, r.Description, rlb, erb, dab, oab, r.Description, rlb, erb, dab, oab)
 	if err != nil {
 		tx.Rollback()
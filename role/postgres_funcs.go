@@ -22,7 +22,7 @@ import (
 	"github.com/ctdk/goiardi/datastore"
 )
 
-func (r *Role) savePostgreSQL() error {
+func (r *Role) savePostgreSQL(ifMatch string) error {
 	rlb, rlerr := datastore.EncodeBlob(&r.RunList)
 	if rlerr != nil {
 		return rlerr
@@ -43,6 +43,10 @@ func (r *Role) savePostgreSQL() error {
 	if err != nil {
 		return err
 	}
+	if err = r.checkETagSQL(tx, ifMatch); err != nil {
+		tx.Rollback()
+		return err
+	}
 	_, err = tx.Exec("SELECT goiardi.merge_roles($1, $2, $3, $4, $5, $6)", r.Name, r.Description, rlb, erb, dab, oab)
 	if err != nil {
 		tx.Rollback()
@@ -23,9 +23,12 @@ package role
 import (
 	"database/sql"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/revision"
+	"github.com/ctdk/goiardi/trash"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
 )
@@ -186,11 +189,17 @@ ValidElem:
 
 // Get a role.
 func Get(roleName string) (*Role, error) {
+	return GetFrom(datastore.Dbh, roleName)
+}
+
+// GetFrom gets a role like Get, but with an SQL backend reads it through the
+// given db handle, like a read replica.
+func GetFrom(dbhandle datastore.Dbhandle, roleName string) (*Role, error) {
 	var role *Role
 	var found bool
 	if config.UsingDB() {
 		var err error
-		role, err = getSQL(roleName)
+		role, err = getSQL(dbhandle, roleName)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				found = false
@@ -217,18 +226,28 @@ func Get(roleName string) (*Role, error) {
 
 // Save the role.
 func (r *Role) Save() error {
+	return r.SaveIfMatch("")
+}
+
+// SaveIfMatch saves the role like Save, but with an SQL backend first checks
+// the role in the database against an If-Match header while holding a lock on
+// it, and fails with a 412 if it's changed.
+func (r *Role) SaveIfMatch(ifMatch string) error {
 	if config.Config.UseMySQL {
-		if err := r.saveMySQL(); err != nil {
-			return nil
+		if err := r.saveMySQL(ifMatch); err != nil {
+			return err
 		}
 	} else if config.Config.UsePostgreSQL {
-		if err := r.savePostgreSQL(); err != nil {
-			return nil
+		if err := r.savePostgreSQL(ifMatch); err != nil {
+			return err
 		}
 	} else {
 		ds := datastore.New()
 		ds.Set("role", r.Name, r)
 	}
+	if err := revision.Record("role", r.Name, revision.ActionSave, r); err != nil {
+		logger.Errorf("Error recording revision of role %s: %s", r.Name, err.Error())
+	}
 	indexer.IndexObj(r)
 	return nil
 }
@@ -243,6 +262,12 @@ func (r *Role) Delete() error {
 		ds := datastore.New()
 		ds.Delete("role", r.Name)
 	}
+	if err := trash.Add("role", r.Name, r); err != nil {
+		logger.Errorf("Error putting role %s in the trash: %s", r.Name, err.Error())
+	}
+	if err := revision.Record("role", r.Name, revision.ActionDelete, r); err != nil {
+		logger.Errorf("Error recording revision of role %s: %s", r.Name, err.Error())
+	}
 	indexer.DeleteItemFromCollection("role", r.Name)
 	return nil
 }
@@ -288,9 +313,20 @@ func (r *Role) Flatten() []string {
 
 // AllRoles returns all the roles on the server
 func AllRoles() []*Role {
+	roles, err := AllRolesTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all roles: %s", err.Error())
+	}
+	return roles
+}
+
+// AllRolesTx returns all the roles on this server like AllRoles, but with an
+// SQL backend reads them through the given db handle. Pass in a transaction to
+// read the roles as part of a consistent snapshot.
+func AllRolesTx(tx datastore.Dbhandle) ([]*Role, error) {
 	var roles []*Role
 	if config.UsingDB() {
-		roles = allRolesSQL()
+		return allRolesSQL(tx)
 	} else {
 		roleList := GetList()
 		for _, r := range roleList {
@@ -301,5 +337,5 @@ func AllRoles() []*Role {
 			roles = append(roles, ro)
 		}
 	}
-	return roles
+	return roles, nil
 }
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
 	"log"
 )
 
@@ -71,7 +72,32 @@ func (r *Role) fillRoleFromSQL(row datastore.ResRow) error {
 	return nil
 }
 
-func getSQL(roleName string) (*Role, error) {
+// checkETagSQL locks the role's row until the transaction is over, and makes
+// sure it still matches the If-Match header.
+func (r *Role) checkETagSQL(tx datastore.Dbhandle, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT name, description, run_list, env_run_lists, default_attr, override_attr FROM roles WHERE name = ? FOR UPDATE"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT name, description, run_list, env_run_lists, default_attr, override_attr FROM goiardi.roles WHERE name = $1 FOR UPDATE"
+	}
+	cur := new(Role)
+	err := cur.fillRoleFromSQL(tx.QueryRow(sqlStmt, r.Name))
+	if err == sql.ErrNoRows {
+		return util.ETagMismatch()
+	} else if err != nil {
+		return err
+	}
+	if gerr := util.CheckETag(ifMatch, cur); gerr != nil {
+		return gerr
+	}
+	return nil
+}
+
+func getSQL(dbhandle datastore.Dbhandle, roleName string) (*Role, error) {
 	role := new(Role)
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -79,7 +105,7 @@ func getSQL(roleName string) (*Role, error) {
 	} else if config.Config.UsePostgreSQL {
 		sqlStmt = "SELECT name, description, run_list, env_run_lists, default_attr, override_attr FROM goiardi.roles WHERE name = $1"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +172,7 @@ func getListSQL() []string {
 	return roleList
 }
 
-func allRolesSQL() []*Role {
+func allRolesSQL(dbhandle datastore.Dbhandle) ([]*Role, error) {
 	var roles []*Role
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -154,29 +180,30 @@ func allRolesSQL() []*Role {
 	} else if config.Config.UsePostgreSQL {
 		sqlStmt = "SELECT name, description, run_list, env_run_lists, default_attr, override_attr FROM goiardi.roles"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return roles
+			return roles, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		ro := new(Role)
 		err = ro.fillRoleFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		roles = append(roles, ro)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return roles
+	return roles, nil
 }
@@ -44,7 +44,16 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 	pathArray := splitPath(r.URL.Path)
 	roleName := pathArray[1]
 
-	chefRole, err := role.Get(roleName)
+	if len(pathArray) > 2 && pathArray[2] == "_revisions" {
+		revisionHandler(w, r, opUser, "role", roleName, pathArray[3:])
+		return
+	}
+
+	if r.Method == "PUT" && len(pathArray) == 2 {
+		defer lockObject("role", roleName)()
+	}
+
+	chefRole, err := role.GetFrom(readDbh(r), roleName)
 	if err != nil {
 		jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 		return
@@ -58,6 +67,9 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 				return
 			}
+			if r.Method == "GET" && notModified(w, r, chefRole) {
+				return
+			}
 			enc := json.NewEncoder(w)
 			if err = enc.Encode(&chefRole); err != nil {
 				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -99,21 +111,25 @@ func roleHandler(w http.ResponseWriter, r *http.Request) {
 			if jsonName == "" {
 				roleData["name"] = roleName
 			}
+			if preconditionFailed(w, r, chefRole) {
+				return
+			}
 			nerr := chefRole.UpdateFromJSON(roleData)
 			if nerr != nil {
 				jsonErrorReport(w, r, nerr.Error(), nerr.Status())
 				return
 			}
 
-			err = chefRole.Save()
+			err = chefRole.SaveIfMatch(r.Header.Get("If-Match"))
 			if err != nil {
-				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+				jsonErrorReport(w, r, err.Error(), saveErrorStatus(err))
 				return
 			}
 			if lerr := loginfo.LogEvent(opUser, chefRole, "modify"); lerr != nil {
 				jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
 				return
 			}
+			setETag(w, chefRole)
 			enc := json.NewEncoder(w)
 			if err = enc.Encode(&chefRole); err != nil {
 				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -198,8 +198,7 @@ func (s *Sandbox) UploadChkList() map[string]map[string]interface{} {
 		if k != nil {
 			chksumStats[chk]["needs_upload"] = false
 		} else {
-			itemURL := fmt.Sprintf("/file_store/%s", chk)
-			chksumStats[chk]["url"] = util.CustomURL(itemURL)
+			chksumStats[chk]["url"] = util.FileStoreURL(chk, "PUT")
 			chksumStats[chk]["needs_upload"] = true
 		}
 
@@ -219,6 +218,14 @@ func (s *Sandbox) IsComplete() error {
 	return nil
 }
 
+// Expired returns true if the sandbox was never committed, and was created
+// longer ago than the sandbox TTL. Expired sandboxes can't be committed, and
+// are purged along with the files uploaded for them.
+func (s *Sandbox) Expired() bool {
+	ttl := config.Config.SandboxTTLDur
+	return ttl > 0 && !s.Completed && time.Since(s.CreationTime) >= ttl
+}
+
 // GetName returns the sandbox's id.
 func (s *Sandbox) GetName() string {
 	return s.ID
@@ -231,9 +238,20 @@ func (s *Sandbox) URLType() string {
 
 // AllSandboxes returns all sandboxes on the server.
 func AllSandboxes() []*Sandbox {
+	sandboxes, err := AllSandboxesTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all sandboxes: %s", err.Error())
+	}
+	return sandboxes
+}
+
+// AllSandboxesTx returns all sandboxes on the server like AllSandboxes, but
+// with an SQL backend reads them through the given db handle. Pass in a
+// transaction to read the sandboxes as part of a consistent snapshot.
+func AllSandboxesTx(tx datastore.Dbhandle) ([]*Sandbox, error) {
 	var sandboxes []*Sandbox
 	if config.UsingDB() {
-		sandboxes = allSandboxesSQL()
+		return allSandboxesSQL(tx)
 	} else {
 		sandboxList := GetList()
 		for _, s := range sandboxList {
@@ -244,5 +262,5 @@ func AllSandboxes() []*Sandbox {
 			sandboxes = append(sandboxes, sb)
 		}
 	}
-	return sandboxes
+	return sandboxes, nil
 }
@@ -110,7 +110,7 @@ func getListSQL() []string {
 	return sandboxList
 }
 
-func allSandboxesSQL() []*Sandbox {
+func allSandboxesSQL(dbhandle datastore.Dbhandle) ([]*Sandbox, error) {
 	var sandboxes []*Sandbox
 	var sqlStmt string
 	if config.Config.UseMySQL {
@@ -118,29 +118,30 @@ func allSandboxesSQL() []*Sandbox {
 	} else if config.Config.UsePostgreSQL {
 		sqlStmt = "SELECT sbox_id, creation_time, checksums, completed FROM goiardi.sandboxes"
 	}
-	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	stmt, err := dbhandle.Prepare(sqlStmt)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return sandboxes
+			return sandboxes, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		sb := new(Sandbox)
 		err = sb.fillSandboxFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		sandboxes = append(sandboxes, sb)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return sandboxes
+	return sandboxes, nil
 }
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Purging sandboxes that were never committed, and the files uploaded for
+// them.
+
+package main
+
+import (
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/sandbox"
+	"sync"
+	"time"
+)
+
+// Only one purge runs at a time.
+var sandboxPurgeLock sync.Mutex
+
+// purgeExpiredSandboxes deletes the sandboxes that expired without being
+// committed, like ones left behind by an interrupted cookbook upload, along
+// with the files uploaded for them that no cookbook or other sandbox uses. It
+// returns how many sandboxes and files were removed.
+func purgeExpiredSandboxes() (int, int, error) {
+	sandboxPurgeLock.Lock()
+	defer sandboxPurgeLock.Unlock()
+
+	var expired []*sandbox.Sandbox
+	// Files in the sandboxes that are staying are kept.
+	keep := make(map[string]bool)
+	for _, s := range sandbox.AllSandboxes() {
+		if s.Expired() {
+			expired = append(expired, s)
+			continue
+		}
+		for _, chksum := range s.Checksums {
+			keep[chksum] = true
+		}
+	}
+	if len(expired) == 0 {
+		return 0, 0, nil
+	}
+	referenced, err := cookbook.ReferencedHashes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var files []string
+	for _, s := range expired {
+		if err := s.Delete(); err != nil {
+			return 0, 0, err
+		}
+		for _, chksum := range s.Checksums {
+			if !referenced[chksum] && !keep[chksum] {
+				keep[chksum] = true
+				files = append(files, chksum)
+			}
+		}
+	}
+	removed := 0
+	for _, chksum := range files {
+		// Not every file in the sandbox was necessarily uploaded.
+		f, err := filestore.Get(chksum)
+		if err != nil {
+			continue
+		}
+		if err := f.Delete(); err != nil {
+			return len(expired), removed, err
+		}
+		removed++
+	}
+	return len(expired), removed, nil
+}
+
+func setSandboxPurgeTicker() {
+	ttl := config.Config.SandboxTTLDur
+	if ttl <= 0 {
+		return
+	}
+	// Check for expired sandboxes hourly, or more often with a shorter TTL.
+	interval := time.Hour
+	if ttl < interval {
+		interval = ttl
+	}
+	// The sandboxes and files a standby has come from the primary, and
+	// it removes them when the primary's purge replicates to it.
+	runUnlessStandby(interval, func() {
+		sboxes, files, err := purgeExpiredSandboxes()
+		if err != nil {
+			logger.Errorf("Error purging expired sandboxes: %s", err.Error())
+			return
+		}
+		if sboxes > 0 {
+			logger.Infof("Purged %d expired sandboxes and %d files uploaded for them", sboxes, files)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/sandbox"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func uploadTestFile(t *testing.T, content string) string {
+	chksum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	f, err := filestore.New(chksum, ioutil.NopCloser(bytes.NewBufferString(content)), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return chksum
+}
+
+func makeTestSandbox(t *testing.T, age time.Duration, completed bool, checksums ...string) *sandbox.Sandbox {
+	chksumHash := make(map[string]interface{}, len(checksums))
+	for _, c := range checksums {
+		chksumHash[c] = nil
+	}
+	s, err := sandbox.New(chksumHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CreationTime = time.Now().Add(-age)
+	s.Completed = completed
+	if err = s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPurgeExpiredSandboxes(t *testing.T) {
+	gobOnce.Do(gobRegister)
+	ttl := time.Hour
+	config.Config.SandboxTTLDur = ttl
+	defer func() { config.Config.SandboxTTLDur = 0 }()
+
+	committedFile := uploadTestFile(t, "committed sandbox file\n")
+	cookbookFile := uploadTestFile(t, "file used by a cookbook\n")
+	orphanFile := uploadTestFile(t, "file only in an expired sandbox\n")
+	sharedFile := uploadTestFile(t, "file also in a fresh sandbox\n")
+
+	cb, gerr := cookbook.New("sbexpiry")
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	if err := cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	cbvData := map[string]interface{}{
+		"cookbook_name": "sbexpiry",
+		"name":          "sbexpiry-1.0.0",
+		"version":       "1.0.0",
+		"json_class":    "Chef::CookbookVersion",
+		"chef_type":     "cookbook_version",
+		"frozen?":       false,
+		"metadata":      map[string]interface{}{"name": "sbexpiry", "version": "1.0.0"},
+		"recipes":       []interface{}{map[string]interface{}{"name": "default.rb", "path": "recipes/default.rb", "checksum": cookbookFile, "specificity": "default"}},
+	}
+	if _, gerr = cb.NewVersion("1.0.0", cbvData); gerr != nil {
+		t.Fatal(gerr)
+	}
+
+	committed := makeTestSandbox(t, 2*ttl, true, committedFile)
+	expired := makeTestSandbox(t, 2*ttl, false, cookbookFile, orphanFile, sharedFile)
+	// Just inside the TTL, so not expired yet.
+	fresh := makeTestSandbox(t, ttl-time.Minute, false, sharedFile)
+	// Just past the TTL.
+	justExpired := makeTestSandbox(t, ttl+time.Second, false)
+
+	sboxes, files, err := purgeExpiredSandboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sboxes != 2 {
+		t.Errorf("expected 2 sandboxes to be purged, got %d", sboxes)
+	}
+	if files != 1 {
+		t.Errorf("expected 1 file to be purged, got %d", files)
+	}
+
+	for _, s := range []*sandbox.Sandbox{committed, fresh} {
+		if _, err := sandbox.Get(s.ID); err != nil {
+			t.Errorf("sandbox %s should have been kept, but was purged", s.ID)
+		}
+	}
+	for _, s := range []*sandbox.Sandbox{expired, justExpired} {
+		if _, err := sandbox.Get(s.ID); err == nil {
+			t.Errorf("sandbox %s should have been purged, but was kept", s.ID)
+		}
+	}
+	for _, c := range []string{committedFile, cookbookFile, sharedFile} {
+		if _, err := filestore.Get(c); err != nil {
+			t.Errorf("file %s should have been kept, but was purged", c)
+		}
+	}
+	if _, err := filestore.Get(orphanFile); err == nil {
+		t.Errorf("file %s, only used by the expired sandbox, should have been purged", orphanFile)
+	}
+
+	// Nothing else has expired, so a second purge does nothing.
+	if sboxes, files, err = purgeExpiredSandboxes(); err != nil || sboxes != 0 || files != 0 {
+		t.Errorf("a second purge should have done nothing, but purged %d sandboxes and %d files (err %v)", sboxes, files, err)
+	}
+}
+
+func TestSandboxExpired(t *testing.T) {
+	config.Config.SandboxTTLDur = time.Hour
+	defer func() { config.Config.SandboxTTLDur = 0 }()
+	now := time.Now()
+	s := &sandbox.Sandbox{CreationTime: now.Add(-59 * time.Minute)}
+	if s.Expired() {
+		t.Errorf("a sandbox created 59 minutes ago should not have expired with a one hour TTL")
+	}
+	s.CreationTime = now.Add(-time.Hour)
+	if !s.Expired() {
+		t.Errorf("a sandbox created an hour ago should have expired with a one hour TTL")
+	}
+	s.Completed = true
+	if s.Expired() {
+		t.Errorf("a committed sandbox should never expire")
+	}
+	config.Config.SandboxTTLDur = 0
+	s.Completed = false
+	if s.Expired() {
+		t.Errorf("sandboxes should never expire without a TTL")
+	}
+}
@@ -20,10 +20,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/ctdk/goiardi/actor"
 	"github.com/ctdk/goiardi/sandbox"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
+	"time"
 )
 
 func sandboxHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,6 +39,36 @@ func sandboxHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch r.Method {
+	case "GET":
+		/* Not in the chef API, but handy for finding uploads that
+		 * never finished. */
+		if len(pathArray) != 1 {
+			jsonErrorReport(w, r, "Bad request.", http.StatusMethodNotAllowed)
+			return
+		}
+		if !opUser.IsAdmin() {
+			jsonErrorReport(w, r, "You are not allowed to take this action.", http.StatusForbidden)
+			return
+		}
+		for _, sbox := range sandbox.AllSandboxes() {
+			if sbox.Completed {
+				continue
+			}
+			missing := 0
+			for _, chk := range sbox.UploadChkList() {
+				if chk["needs_upload"].(bool) {
+					missing++
+				}
+			}
+			sboxResponse[sbox.ID] = map[string]interface{}{
+				"uri":           util.ObjURL(sbox),
+				"create_time":   sbox.CreationTime.UTC().Format("2006-01-02T15:04:05+00:00"),
+				"age":           int64(time.Since(sbox.CreationTime) / time.Second),
+				"total_files":   len(sbox.Checksums),
+				"missing_files": missing,
+				"expired":       sbox.Expired(),
+			}
+		}
 	case "POST":
 		if len(pathArray) != 1 {
 			jsonErrorReport(w, r, "Bad request.", http.StatusMethodNotAllowed)
@@ -110,6 +142,10 @@ func sandboxHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, err.Error(), http.StatusNotFound)
 			return
 		}
+		if sbox.Expired() {
+			jsonErrorReport(w, r, fmt.Sprintf("Sandbox %s has expired", sandboxID), http.StatusNotFound)
+			return
+		}
 
 		if err = sbox.IsComplete(); err == nil {
 			sbox.Completed = sboxCommit
@@ -31,7 +31,6 @@ import (
 	serfclient "github.com/hashicorp/serf/client"
 	"math"
 	"net/http"
-	"os"
 	"reflect"
 	"regexp"
 	"sort"
@@ -248,8 +247,12 @@ func (s *Shovey) GetRun(nodeName string) (*ShoveyRun, util.Gerror) {
 
 // GetNodeRuns gets all of the ShoveyRuns associated with this shovey instance.
 func (s *Shovey) GetNodeRuns() ([]*ShoveyRun, util.Gerror) {
+	return s.getNodeRuns(datastore.Dbh)
+}
+
+func (s *Shovey) getNodeRuns(tx datastore.Dbhandle) ([]*ShoveyRun, util.Gerror) {
 	if config.UsingDB() {
-		return s.getShoveyNodeRunsSQL()
+		return s.getShoveyNodeRunsSQL(tx)
 	}
 	var runs []*ShoveyRun
 	for _, n := range s.NodeNames {
@@ -542,53 +545,79 @@ func GetList() []string {
 }
 
 // AllShoveys returns all shovey objects on the server
-func AllShoveys() ([]*Shovey) {
+func AllShoveys() []*Shovey {
+	shoveys, err := AllShoveysTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all shoveys: %s", err.Error())
+	}
+	return shoveys
+}
+
+// AllShoveysTx returns all shovey objects on the server like AllShoveys, but
+// with an SQL backend reads them through the given db handle. Pass in a
+// transaction to read them as part of a consistent snapshot.
+func AllShoveysTx(tx datastore.Dbhandle) ([]*Shovey, error) {
 	var shoveys []*Shovey
 	if config.UsingDB() {
-		return allShoveysSQL()
+		return allShoveysSQL(tx)
 	} else {
 		shoveList := GetList()
 		for _, s := range shoveList {
 			sh, err := Get(s)
 			if err != nil {
-				logger.Criticalf(err.Error())
-				os.Exit(1)
+				return nil, err
 			}
 			shoveys = append(shoveys, sh)
 		}
 	}
-	return shoveys
+	return shoveys, nil
 }
 
-func AllShoveyRuns() ([]*ShoveyRun) {
+func AllShoveyRuns() ([]*ShoveyRun, error) {
+	return AllShoveyRunsTx(datastore.Dbh)
+}
+
+// AllShoveyRunsTx returns all shovey runs on the server, reading them through
+// the given db handle with an SQL backend.
+func AllShoveyRunsTx(tx datastore.Dbhandle) ([]*ShoveyRun, error) {
 	var shoveyRuns []*ShoveyRun
-	shoveys := AllShoveys()
+	shoveys, err := AllShoveysTx(tx)
+	if err != nil {
+		return nil, err
+	}
 	for _, s := range shoveys {
-		runs, err := s.GetNodeRuns()
+		runs, err := s.getNodeRuns(tx)
 		if err != nil {
-			logger.Criticalf(err.Error())
-			os.Exit(1)
+			return nil, err
 		}
 		shoveyRuns = append(shoveyRuns, runs...)
 	}
-	return shoveyRuns
+	return shoveyRuns, nil
+}
+
+func AllShoveyRunStreams() ([]*ShoveyRunStream, error) {
+	return AllShoveyRunStreamsTx(datastore.Dbh)
 }
 
-func AllShoveyRunStreams() ([]*ShoveyRunStream) {
+// AllShoveyRunStreamsTx returns all shovey run output streams on the server,
+// reading them through the given db handle with an SQL backend.
+func AllShoveyRunStreamsTx(tx datastore.Dbhandle) ([]*ShoveyRunStream, error) {
 	var streams []*ShoveyRunStream
-	shoveyRuns := AllShoveyRuns()
+	shoveyRuns, err := AllShoveyRunsTx(tx)
+	if err != nil {
+		return nil, err
+	}
 	outputTypes := []string{ "stdout", "stderr" }
 	for _, sr := range shoveyRuns {
 		for _, t := range outputTypes {
-			srs, err := sr.GetStreamOutput(t, 0)
+			srs, err := sr.getStreamOutput(tx, t, 0)
 			if err != nil {
-				logger.Criticalf(err.Error())
-				os.Exit(1)
+				return nil, err
 			}
 			streams = append(streams, srs...)
 		}
 	}
-	return streams
+	return streams, nil
 }
 
 // UpdateFromJSON updates a ShoveyRun with the given JSON from the client.
@@ -645,8 +674,12 @@ func (sr *ShoveyRun) AddStreamOutput(output string, outputType string, seq int,
 // GetStreamOutput gets all ShoveyRunStream objects associated with a ShoveyRun
 // of the given output type.
 func (sr *ShoveyRun) GetStreamOutput(outputType string, seq int) ([]*ShoveyRunStream, util.Gerror) {
+	return sr.getStreamOutput(datastore.Dbh, outputType, seq)
+}
+
+func (sr *ShoveyRun) getStreamOutput(tx datastore.Dbhandle, outputType string, seq int) ([]*ShoveyRunStream, util.Gerror) {
 	if config.UsingDB() {
-		return sr.getStreamOutSQL(outputType, seq)
+		return sr.getStreamOutSQL(tx, outputType, seq)
 	}
 	var streams []*ShoveyRunStream
 	ds := datastore.New()
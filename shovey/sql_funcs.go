@@ -177,7 +177,7 @@ func (s *Shovey) getShoveyRunSQL(nodeName string) (*ShoveyRun, util.Gerror) {
 	return sr, nil
 }
 
-func (s *Shovey) getShoveyNodeRunsSQL() ([]*ShoveyRun, util.Gerror) {
+func (s *Shovey) getShoveyNodeRunsSQL(dbhandle datastore.Dbhandle) ([]*ShoveyRun, util.Gerror) {
 	var shoveyRuns []*ShoveyRun
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -188,7 +188,7 @@ func (s *Shovey) getShoveyNodeRunsSQL() ([]*ShoveyRun, util.Gerror) {
 		return nil, util.NoDBConfigured
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
 		gerr := util.CastErr(err)
 		gerr.SetStatus(http.StatusInternalServerError)
@@ -349,7 +349,7 @@ func allShoveyIDsSQL() ([]string, util.Gerror) {
 	return shoveyList, nil
 }
 
-func allShoveysSQL() ([]*Shovey) {
+func allShoveysSQL(dbhandle datastore.Dbhandle) ([]*Shovey, error) {
 	shoveys := make([]*Shovey, 0)
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -358,24 +358,29 @@ func allShoveysSQL() ([]*Shovey) {
 		sqlStatement = "SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = goiardi.shoveys.run_id), command, created_at, updated_at, status, timeout, quorum FROM goiardi.shoveys"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer stmt.Close()
-	rows, err := datastore.Dbh.Query(sqlStatement)
+	rows, err := stmt.Query()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	for rows.Next() {
 		s := new(Shovey)
 		err = s.fillShoveyFromSQL(rows)
 		if err != nil {
-			panic(err)
+			rows.Close()
+			return nil, err
 		}
 		shoveys = append(shoveys, s)
 	}
-	return shoveys
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return shoveys, nil
 }
 
 func (sr *ShoveyRun) addStreamOutSQL(output string, outputType string, seq int, isLast bool) util.Gerror {
@@ -407,7 +412,7 @@ func (sr *ShoveyRun) addStreamOutSQL(output string, outputType string, seq int,
 	return nil
 }
 
-func (sr *ShoveyRun) getStreamOutSQL(outputType string, seq int) ([]*ShoveyRunStream, util.Gerror) {
+func (sr *ShoveyRun) getStreamOutSQL(dbhandle datastore.Dbhandle, outputType string, seq int) ([]*ShoveyRunStream, util.Gerror) {
 	var streams []*ShoveyRunStream
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -418,7 +423,7 @@ func (sr *ShoveyRun) getStreamOutSQL(outputType string, seq int) ([]*ShoveyRunSt
 		return nil, util.NoDBConfigured
 	}
 
-	rows, err := datastore.Dbh.Query(sqlStatement, sr.ID, outputType, seq)
+	rows, err := dbhandle.Query(sqlStatement, sr.ID, outputType, seq)
 	if err != nil {
 		gerr := util.CastErr(err)
 		if err == sql.ErrNoRows {
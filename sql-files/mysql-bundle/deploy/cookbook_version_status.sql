@@ -0,0 +1,7 @@
+-- Deploy cookbook_version_status
+
+BEGIN;
+
+ALTER TABLE cookbook_versions ADD COLUMN deprecated tinyint not null default 0, ADD COLUMN yanked tinyint not null default 0;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Deploy file_checksum_sha256
+
+BEGIN;
+
+ALTER TABLE file_checksums ADD COLUMN sha256 varchar(64);
+
+COMMIT;
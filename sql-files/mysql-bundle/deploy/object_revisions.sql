@@ -0,0 +1,18 @@
+-- Deploy object_revisions
+
+BEGIN;
+
+CREATE TABLE object_revisions (
+	id int not null auto_increment,
+	object_type varchar(32) not null,
+	object_name varchar(220) not null,
+	revision int not null,
+	action enum('save', 'delete') not null,
+	organization_id int not null default '1',
+	created_at datetime not null,
+	data mediumtext,
+	primary key(id),
+	unique key(object_type, object_name, revision)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=COMPRESSED;
+
+COMMIT;
@@ -0,0 +1,39 @@
+-- Deploy policyfiles
+
+BEGIN;
+
+CREATE TABLE policy_revisions (
+	id int not null auto_increment,
+	name varchar(255) not null,
+	revision_id varchar(255) not null,
+	organization_id int not null default '1',
+	created_at datetime not null,
+	data longtext,
+	primary key(id),
+	unique key(organization_id, name, revision_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=COMPRESSED;
+
+CREATE TABLE policy_groups (
+	id int not null auto_increment,
+	name varchar(255) not null,
+	organization_id int not null default '1',
+	policies longtext,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	unique key(organization_id, name(250))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE cookbook_artifacts (
+	id int not null auto_increment,
+	name varchar(255) not null,
+	identifier varchar(255) not null,
+	version varchar(255) not null,
+	organization_id int not null default '1',
+	created_at datetime not null,
+	data longtext,
+	primary key(id),
+	unique key(organization_id, name, identifier)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=COMPRESSED;
+
+COMMIT;
@@ -0,0 +1,17 @@
+-- Deploy trash
+
+BEGIN;
+
+CREATE TABLE trash (
+	id int not null auto_increment,
+	object_type varchar(32) not null,
+	object_name varchar(220) not null,
+	organization_id int not null default '1',
+	deleted_at datetime not null,
+	data longtext,
+	primary key(id),
+	index(object_type, object_name),
+	index(deleted_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=COMPRESSED;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert file_checksum_sha256
+
+BEGIN;
+
+ALTER TABLE file_checksums DROP COLUMN sha256;
+
+COMMIT;
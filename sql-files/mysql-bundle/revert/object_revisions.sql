@@ -0,0 +1,7 @@
+-- Revert object_revisions
+
+BEGIN;
+
+DROP TABLE object_revisions;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Revert policyfiles
+
+BEGIN;
+
+DROP TABLE cookbook_artifacts;
+DROP TABLE policy_groups;
+DROP TABLE policy_revisions;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert trash
+
+BEGIN;
+
+DROP TABLE trash;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Verify file_checksum_sha256
+
+BEGIN;
+
+SELECT sha256 FROM file_checksums WHERE FALSE;
+
+ROLLBACK;
@@ -0,0 +1,7 @@
+-- Verify object_revisions
+
+BEGIN;
+
+SELECT id, object_type, object_name, revision, action, organization_id, created_at, data FROM object_revisions WHERE 0;
+
+ROLLBACK;
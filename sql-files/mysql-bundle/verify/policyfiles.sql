@@ -0,0 +1,9 @@
+-- Verify policyfiles
+
+BEGIN;
+
+SELECT id, name, revision_id, organization_id, created_at, data FROM policy_revisions WHERE 0;
+SELECT id, name, organization_id, policies, created_at, updated_at FROM policy_groups WHERE 0;
+SELECT id, name, identifier, version, organization_id, created_at, data FROM cookbook_artifacts WHERE 0;
+
+ROLLBACK;
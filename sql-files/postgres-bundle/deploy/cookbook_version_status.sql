@@ -0,0 +1,9 @@
+-- Deploy cookbook_version_status
+-- requires: cookbook_versions
+-- requires: goiardi_schema
+
+BEGIN;
+
+ALTER TABLE goiardi.cookbook_versions ADD COLUMN deprecated boolean not null default FALSE, ADD COLUMN yanked boolean not null default FALSE;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Deploy file_checksum_sha256
+-- requires: file_checksums
+-- requires: goiardi_schema
+
+BEGIN;
+
+ALTER TABLE goiardi.file_checksums ADD COLUMN sha256 varchar(64);
+
+COMMIT;
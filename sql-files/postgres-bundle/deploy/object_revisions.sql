@@ -0,0 +1,21 @@
+-- Deploy object_revisions
+-- requires: goiardi_schema
+
+BEGIN;
+
+CREATE TYPE goiardi.revision_action AS ENUM ( 'save', 'delete' );
+CREATE TABLE goiardi.object_revisions (
+	id bigserial,
+	object_type text not null,
+	object_name text not null,
+	revision int not null,
+	action goiardi.revision_action not null,
+	organization_id bigint not null default '1',
+	created_at timestamp with time zone not null,
+	data text,
+	primary key(id),
+	unique(object_type, object_name, revision)
+);
+ALTER TABLE goiardi.object_revisions ALTER data SET STORAGE EXTERNAL;
+
+COMMIT;
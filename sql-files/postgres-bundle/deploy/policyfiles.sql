@@ -0,0 +1,65 @@
+-- Deploy policyfiles
+-- requires: goiardi_schema
+
+BEGIN;
+
+CREATE TABLE goiardi.policy_revisions (
+	id bigserial,
+	name text not null,
+	revision_id text not null,
+	organization_id bigint not null default '1',
+	created_at timestamp with time zone not null,
+	data text,
+	primary key(id),
+	unique(organization_id, name, revision_id)
+);
+ALTER TABLE goiardi.policy_revisions ALTER data SET STORAGE EXTERNAL;
+
+CREATE TABLE goiardi.policy_groups (
+	id bigserial,
+	name text not null,
+	organization_id bigint not null default '1',
+	policies text,
+	created_at timestamp with time zone not null,
+	updated_at timestamp with time zone not null,
+	primary key(id),
+	unique(organization_id, name)
+);
+
+CREATE TABLE goiardi.cookbook_artifacts (
+	id bigserial,
+	name text not null,
+	identifier text not null,
+	version text not null,
+	organization_id bigint not null default '1',
+	created_at timestamp with time zone not null,
+	data text,
+	primary key(id),
+	unique(organization_id, name, identifier)
+);
+ALTER TABLE goiardi.cookbook_artifacts ALTER data SET STORAGE EXTERNAL;
+
+CREATE OR REPLACE FUNCTION goiardi.merge_policy_groups(m_name text, m_policies text) RETURNS VOID AS
+$$
+BEGIN
+    LOOP
+        -- first try to update the key
+	UPDATE goiardi.policy_groups SET policies = m_policies, updated_at = NOW() WHERE name = m_name;
+	IF found THEN
+		RETURN;
+	END IF;
+        -- not there, so try to insert the key
+        -- if someone else inserts the same key concurrently,
+        -- we could get a unique-key failure
+        BEGIN
+	    INSERT INTO goiardi.policy_groups (name, policies, created_at, updated_at) VALUES (m_name, m_policies, NOW(), NOW());
+            RETURN;
+        EXCEPTION WHEN unique_violation THEN
+            -- Do nothing, and loop to try the UPDATE again.
+        END;
+    END LOOP;
+END;
+$$
+LANGUAGE plpgsql;
+
+COMMIT;
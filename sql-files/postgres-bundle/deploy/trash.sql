@@ -0,0 +1,19 @@
+-- Deploy trash
+-- requires: goiardi_schema
+
+BEGIN;
+
+CREATE TABLE goiardi.trash (
+	id bigserial,
+	object_type text not null,
+	object_name text not null,
+	organization_id bigint not null default '1',
+	deleted_at timestamp with time zone not null,
+	data text,
+	primary key(id)
+);
+CREATE INDEX trash_obj ON goiardi.trash(object_type, object_name);
+CREATE INDEX trash_deleted_at ON goiardi.trash(deleted_at);
+ALTER TABLE goiardi.trash ALTER data SET STORAGE EXTERNAL;
+
+COMMIT;
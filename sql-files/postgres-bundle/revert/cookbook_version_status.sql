@@ -0,0 +1,7 @@
+-- Revert cookbook_version_status
+
+BEGIN;
+
+ALTER TABLE goiardi.cookbook_versions DROP COLUMN deprecated, DROP COLUMN yanked;
+
+COMMIT;
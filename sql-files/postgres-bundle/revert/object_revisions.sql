@@ -0,0 +1,8 @@
+-- Revert object_revisions
+
+BEGIN;
+
+DROP TABLE goiardi.object_revisions;
+DROP TYPE goiardi.revision_action;
+
+COMMIT;
@@ -0,0 +1,10 @@
+-- Revert policyfiles
+
+BEGIN;
+
+DROP FUNCTION goiardi.merge_policy_groups(m_name text, m_policies text);
+DROP TABLE goiardi.cookbook_artifacts;
+DROP TABLE goiardi.policy_groups;
+DROP TABLE goiardi.policy_revisions;
+
+COMMIT;
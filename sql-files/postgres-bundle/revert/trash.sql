@@ -0,0 +1,7 @@
+-- Revert trash
+
+BEGIN;
+
+DROP TABLE goiardi.trash;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Verify cookbook_version_status
+
+BEGIN;
+
+SELECT deprecated, yanked FROM goiardi.cookbook_versions WHERE FALSE;
+
+ROLLBACK;
@@ -0,0 +1,11 @@
+-- Verify policyfiles
+
+BEGIN;
+
+SELECT id, name, revision_id, organization_id, created_at, data FROM goiardi.policy_revisions WHERE FALSE;
+SELECT id, name, organization_id, policies, created_at, updated_at FROM goiardi.policy_groups WHERE FALSE;
+SELECT id, name, identifier, version, organization_id, created_at, data FROM goiardi.cookbook_artifacts WHERE FALSE;
+SELECT goiardi.merge_policy_groups('moo', '{}');
+SELECT id FROM goiardi.policy_groups WHERE name = 'moo';
+
+ROLLBACK;
@@ -0,0 +1,7 @@
+-- Verify trash
+
+BEGIN;
+
+SELECT id, object_type, object_name, organization_id, deleted_at, data FROM goiardi.trash WHERE FALSE;
+
+ROLLBACK;
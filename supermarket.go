@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A read-only Supermarket compatible API for the cookbooks on this server, so
+// berks and knife supermarket can use goiardi as a private Supermarket.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const supermarketMaxItems = 100
+
+var supermarketVersionRe = regexp.MustCompile(`^\d+_\d+(_\d+)?$`)
+
+// supermarketRequest checks if this is a request for the Supermarket API,
+// which doesn't use signed requests. Downloads hand out every file in a
+// cookbook version, though, so like the file store they need the signed URL
+// the API gave out for them, unless --unsigned-file-store lets them through
+// without one. Otherwise they have to be signed like any other request.
+func supermarketRequest(r *http.Request) bool {
+	if !config.Config.Supermarket || !strings.HasPrefix(r.URL.Path, "/api/v1/") || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	if !strings.HasSuffix(r.URL.Path, "/download") {
+		return true
+	}
+	query := r.URL.Query()
+	if config.Config.UnsignedFileStore && query.Get("signature") == "" {
+		return true
+	}
+	return util.CheckFileStoreURL(r.Method, r.URL.Path, query) == nil
+}
+
+// supermarketDownloadURL is the signed URL to download a cookbook version from
+// the Supermarket API.
+func supermarketDownloadURL(name string, version string) string {
+	return util.SignedURL(fmt.Sprintf("/api/v1/cookbooks/%s/versions/%s/download", name, version), "GET")
+}
+
+func supermarketHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !config.Config.Supermarket {
+		jsonErrorReport(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pathArray := splitPath(r.URL.Path)
+	pathArrayLen := len(pathArray)
+	if pathArrayLen < 3 || pathArray[pathArrayLen-1] == "" {
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var response interface{}
+	switch {
+	case pathArrayLen == 3 && pathArray[2] == "universe":
+		response = supermarketUniverse()
+	case pathArrayLen == 3 && pathArray[2] == "search":
+		q := r.URL.Query().Get("q")
+		names := make([]string, 0)
+		for _, name := range cookbook.GetList() {
+			if strings.Contains(name, q) {
+				names = append(names, name)
+			}
+		}
+		list, err := supermarketList(r, names)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response = list
+	case pathArrayLen == 3 && pathArray[2] == "cookbooks":
+		list, err := supermarketList(r, cookbook.GetList())
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response = list
+	case pathArrayLen >= 4 && pathArrayLen <= 7 && pathArray[2] == "cookbooks":
+		cb, err := cookbook.Get(pathArray[3])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		if pathArrayLen == 4 {
+			cbInfo, cerr := supermarketCookbook(cb)
+			if cerr != nil {
+				jsonErrorReport(w, r, cerr.Error(), cerr.Status())
+				return
+			}
+			response = cbInfo
+			break
+		}
+		if pathArrayLen == 5 || pathArray[4] != "versions" || (pathArrayLen == 7 && pathArray[6] != "download") {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		cbv, err := cb.GetVersion(supermarketVersion(pathArray[5]))
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		if pathArrayLen == 7 {
+			streamTarball(w, r, cbv)
+			return
+		}
+		response = supermarketCookbookVersion(cb, cbv)
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// supermarketVersion turns a version from a Supermarket URL into a cookbook
+// version. Supermarket writes versions with underscores (1_2_3) in some of its
+// URLs, and knife still asks for them that way.
+func supermarketVersion(ver string) string {
+	if ver == "latest" {
+		return "_latest"
+	}
+	if supermarketVersionRe.MatchString(ver) {
+		return strings.Replace(ver, "_", ".", -1)
+	}
+	return ver
+}
+
+func supermarketURL(path string, args ...interface{}) string {
+	return util.CustomURL(fmt.Sprintf("/api/v1"+path, args...))
+}
+
+func metadataString(cbv *cookbook.CookbookVersion, key string) string {
+	if cbv == nil {
+		return ""
+	}
+	s, _ := cbv.Metadata[key].(string)
+	return s
+}
+
+// supermarketList makes a page of cookbooks in the form the Supermarket
+// cookbook list and search give, using the start and items query parameters.
+func supermarketList(r *http.Request, names []string) (map[string]interface{}, error) {
+	start, items := 0, 10
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil || start < 0 {
+			return nil, fmt.Errorf("Invalid value '%s' for start", s)
+		}
+	}
+	if i := r.URL.Query().Get("items"); i != "" {
+		if items, err = strconv.Atoi(i); err != nil || items < 0 {
+			return nil, fmt.Errorf("Invalid value '%s' for items", i)
+		}
+		if items > supermarketMaxItems {
+			items = supermarketMaxItems
+		}
+	}
+
+	sort.Strings(names)
+	total := len(names)
+	if start > total {
+		start = total
+	}
+	end := start + items
+	if end > total {
+		end = total
+	}
+	cbItems := make([]map[string]interface{}, 0, end-start)
+	for _, name := range names[start:end] {
+		cb, err := cookbook.Get(name)
+		if err != nil {
+			continue
+		}
+		latest := cb.LatestVersion()
+		cbItems = append(cbItems, map[string]interface{}{
+			"cookbook_name":        cb.Name,
+			"cookbook_maintainer":  metadataString(latest, "maintainer"),
+			"cookbook_description": metadataString(latest, "description"),
+			"cookbook":             supermarketURL("/cookbooks/%s", cb.Name),
+		})
+	}
+	return map[string]interface{}{"start": start, "total": total, "items": cbItems}, nil
+}
+
+func supermarketCookbook(cb *cookbook.Cookbook) (map[string]interface{}, util.Gerror) {
+	versions := cb.SortedVersions()
+	verURLs := make([]string, len(versions))
+	for i, cbv := range versions {
+		verURLs[i] = supermarketURL("/cookbooks/%s/versions/%s", cb.Name, cbv.Version)
+	}
+	latest := cb.LatestVersion()
+	if latest == nil {
+		err := util.Errorf("Cookbook %s has no versions that haven't been yanked", cb.Name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return map[string]interface{}{
+		"name":            cb.Name,
+		"maintainer":      metadataString(latest, "maintainer"),
+		"description":     metadataString(latest, "description"),
+		"category":        "Other",
+		"latest_version":  supermarketURL("/cookbooks/%s/versions/%s", cb.Name, latest.Version),
+		"external_url":    metadataString(latest, "source_url"),
+		"source_url":      metadataString(latest, "source_url"),
+		"issues_url":      metadataString(latest, "issues_url"),
+		"average_rating":  nil,
+		"up_for_adoption": nil,
+		"deprecated":      false,
+		"versions":        verURLs,
+	}, nil
+}
+
+func supermarketCookbookVersion(cb *cookbook.Cookbook, cbv *cookbook.CookbookVersion) map[string]interface{} {
+	// Supermarket gives the size of the tarball too, but that's left
+	// out, since finding it out would mean making the whole tarball.
+	return map[string]interface{}{
+		"version":        cbv.Version,
+		"license":        metadataString(cbv, "license"),
+		"average_rating": nil,
+		"cookbook":       supermarketURL("/cookbooks/%s", cb.Name),
+		"file":           supermarketDownloadURL(cb.Name, cbv.Version),
+		"dependencies":   cbv.Metadata["dependencies"],
+		"platforms":      cbv.Metadata["platforms"],
+	}
+}
+
+// supermarketUniverse is the /universe for berks, pointing it at this server's
+// Supermarket API to download cookbooks rather than the chef server API.
+func supermarketUniverse() map[string]map[string]interface{} {
+	universe := cookbook.Universe()
+	for name, vers := range universe {
+		for ver, info := range vers {
+			u, ok := info.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			u["location_type"] = "opscode"
+			u["location_path"] = supermarketURL("")
+			u["download_url"] = supermarketDownloadURL(name, ver)
+		}
+	}
+	return universe
+}
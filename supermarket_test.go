@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupSupermarket(t *testing.T) func() {
+	gobOnce.Do(gobRegister)
+	config.Config.Supermarket = true
+	config.Config.FileStoreURLExpiryDur = time.Hour
+	cb, err := cookbook.New("smkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	makeTestCookbookVersion(t, cb, "1.0.0", uploadTestFile(t, "package 'supermarket-old'\n"))
+	makeTestCookbookVersion(t, cb, "1.1.0", uploadTestFile(t, "package 'supermarket-new'\n"))
+	empty, err := cookbook.New("smktempty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		config.Config.Supermarket = false
+		cb.Delete()
+		empty.Delete()
+	}
+}
+
+func supermarketGet(t *testing.T, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	supermarketHandler(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func supermarketJSON(t *testing.T, target string) map[string]interface{} {
+	w := supermarketGet(t, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s should have given %d, got %d: %s", target, http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestSupermarketList(t *testing.T) {
+	defer setupSupermarket(t)()
+
+	resp := supermarketJSON(t, "/api/v1/cookbooks?items=100")
+	items, _ := resp["items"].([]interface{})
+	found := make(map[string]bool)
+	for _, i := range items {
+		item := i.(map[string]interface{})
+		found[item["cookbook_name"].(string)] = true
+	}
+	// A cookbook without any versions is still listed.
+	if !found["smkt"] || !found["smktempty"] {
+		t.Errorf("expected smkt and smktempty in the cookbook list, got %v", items)
+	}
+
+	resp = supermarketJSON(t, "/api/v1/search?q=smktempty")
+	if total, _ := resp["total"].(float64); total != 1 {
+		t.Errorf("searching for smktempty should have found one cookbook, got %v", resp)
+	}
+
+	if w := supermarketGet(t, "/api/v1/cookbooks?start=-1"); w.Code != http.StatusBadRequest {
+		t.Errorf("a negative start should have given %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestSupermarketCookbook(t *testing.T) {
+	defer setupSupermarket(t)()
+
+	resp := supermarketJSON(t, "/api/v1/cookbooks/smkt")
+	if latest, _ := resp["latest_version"].(string); !strings.HasSuffix(latest, "/api/v1/cookbooks/smkt/versions/1.1.0") {
+		t.Errorf("the latest version should have been 1.1.0, got %s", latest)
+	}
+	if versions, _ := resp["versions"].([]interface{}); len(versions) != 2 {
+		t.Errorf("expected two versions, got %v", resp["versions"])
+	}
+
+	if w := supermarketGet(t, "/api/v1/cookbooks/smktempty"); w.Code != http.StatusNotFound {
+		t.Errorf("a cookbook without versions should have given %d, got %d: %s", http.StatusNotFound, w.Code, w.Body.String())
+	}
+	if w := supermarketGet(t, "/api/v1/cookbooks/nosuchcookbook"); w.Code != http.StatusNotFound {
+		t.Errorf("a missing cookbook should have given %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSupermarketVersion(t *testing.T) {
+	defer setupSupermarket(t)()
+
+	for ver, want := range map[string]string{"1.0.0": "1.0.0", "1_0_0": "1.0.0", "latest": "1.1.0"} {
+		resp := supermarketJSON(t, "/api/v1/cookbooks/smkt/versions/"+ver)
+		if resp["version"] != want {
+			t.Errorf("version %s should have been %s, got %v", ver, want, resp["version"])
+		}
+	}
+	if w := supermarketGet(t, "/api/v1/cookbooks/smkt/versions/2.0.0"); w.Code != http.StatusNotFound {
+		t.Errorf("a missing version should have given %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := supermarketGet(t, "/api/v1/cookbooks/smktempty/versions/latest"); w.Code != http.StatusNotFound {
+		t.Errorf("the latest version of a cookbook without versions should have given %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSupermarketDownload(t *testing.T) {
+	defer setupSupermarket(t)()
+
+	resp := supermarketJSON(t, "/api/v1/cookbooks/smkt/versions/1.0.0")
+	u, err := url.Parse(resp["file"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/v1/cookbooks/smkt/versions/1.0.0/download" || u.Query().Get("signature") == "" {
+		t.Fatalf("expected a signed download URL, got %s", u)
+	}
+
+	w := supermarketGet(t, u.RequestURI())
+	if w.Code != http.StatusOK {
+		t.Fatalf("downloading should have given %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	files := readTestTarball(t, w.Body)
+	if files["smkt/recipes/default.rb"] != "package 'supermarket-old'\n" {
+		t.Errorf("unexpected recipe in the download: %q", files["smkt/recipes/default.rb"])
+	}
+}
+
+func TestSupermarketRequest(t *testing.T) {
+	defer setupSupermarket(t)()
+
+	resp := supermarketJSON(t, "/api/v1/cookbooks/smkt/versions/1.0.0")
+	u, err := url.Parse(resp["file"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := u.Path
+	tampered := strings.Replace(u.RequestURI(), "1.0.0", "1.1.0", 1)
+
+	reqs := []struct {
+		method   string
+		target   string
+		unsigned bool
+		want     bool
+	}{
+		{"GET", "/api/v1/cookbooks/smkt", false, true},
+		{"GET", "/api/v1/universe", false, true},
+		{"POST", "/api/v1/cookbooks", false, false},
+		{"GET", u.RequestURI(), false, true},
+		{"HEAD", u.RequestURI(), false, true},
+		{"GET", unsigned, false, false},
+		{"GET", tampered, false, false},
+		{"GET", unsigned, true, true},
+		{"GET", tampered, true, false},
+	}
+	defer func() { config.Config.UnsignedFileStore = false }()
+	for _, q := range reqs {
+		config.Config.UnsignedFileStore = q.unsigned
+		r := httptest.NewRequest(q.method, q.target, nil)
+		if got := supermarketRequest(r); got != q.want {
+			t.Errorf("supermarketRequest for %s %s (unsigned file store %t) should have been %t, got %t", q.method, q.target, q.unsigned, q.want, got)
+		}
+	}
+
+	config.Config.Supermarket = false
+	if supermarketRequest(httptest.NewRequest("GET", "/api/v1/cookbooks", nil)) {
+		t.Errorf("supermarketRequest should be false with the Supermarket API off")
+	}
+}
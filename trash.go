@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Listing, restoring, and purging deleted objects in the trash.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctdk/goas/v2/logger"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/trash"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
+		return
+	}
+
+	pathArray := splitPath(r.URL.Path)
+	var response interface{}
+
+	switch len(pathArray) {
+	case 1:
+		objType := r.URL.Query().Get("type")
+		items, err := trash.List(objType)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			itemList := make([]map[string]interface{}, len(items))
+			for i, item := range items {
+				itemList[i] = trashSummary(item)
+			}
+			response = itemList
+		case "DELETE":
+			purged := make([]map[string]interface{}, 0, len(items))
+			for _, item := range items {
+				if err := purgeTrashItem(item); err != nil {
+					jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				purged = append(purged, trashSummary(item))
+			}
+			response = map[string]interface{}{"purged": purged}
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	case 2, 3:
+		id, err := strconv.Atoi(pathArray[1])
+		if err != nil {
+			jsonErrorReport(w, r, fmt.Sprintf("Invalid trash id '%s'", pathArray[1]), http.StatusBadRequest)
+			return
+		}
+		item, gerr := trash.Get(id)
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+			return
+		}
+		if len(pathArray) == 3 {
+			if pathArray[2] != "_restore" {
+				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+				return
+			}
+			if r.Method != "POST" {
+				jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+				return
+			}
+			obj, rerr := restoreTrashItem(opUser, item)
+			if rerr != nil {
+				jsonErrorReport(w, r, rerr.Error(), rerr.Status())
+				return
+			}
+			response = obj
+			break
+		}
+		switch r.Method {
+		case "GET":
+			t := trashSummary(item)
+			t["data"] = item.Data
+			response = t
+		case "DELETE":
+			if err := purgeTrashItem(item); err != nil {
+				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response = trashSummary(item)
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&response); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func trashSummary(item *trash.Item) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          item.ID,
+		"object_type": item.ObjectType,
+		"object_name": item.ObjectName,
+		"deleted_at":  item.DeletedAt,
+		"expires_at":  item.Expires(),
+		"uri":         util.CustomURL(fmt.Sprintf("/_trash/%d", item.ID)),
+	}
+}
+
+// purgeTrashItem removes an item from the trash for good. Cookbook versions
+// keep their files until they're purged, so those are cleaned up now too.
+func purgeTrashItem(item *trash.Item) error {
+	if err := item.Remove(); err != nil {
+		return err
+	}
+	if item.ObjectType == "cookbook_version" {
+		return cookbook.PurgeTrashedVersion(item)
+	}
+	return nil
+}
+
+// restoreTrashItem recreates an object from the trash and takes it out of the
+// trash. An object with the same name that's been created since it was deleted
+// is not overwritten.
+func restoreTrashItem(opUser actor.Actor, item *trash.Item) (interface{}, util.Gerror) {
+	objData, err := item.Object()
+	if err != nil {
+		return nil, internalGerror(err)
+	}
+	defer lockObject(item.ObjectType, item.ObjectName)()
+
+	exists := util.Errorf("%s %s already exists", strings.Replace(item.ObjectType, "_", " ", -1), item.ObjectName)
+	exists.SetStatus(http.StatusConflict)
+
+	var obj util.GoiardiObj
+	var response interface{}
+	switch item.ObjectType {
+	case "role":
+		if r, _ := role.Get(item.ObjectName); r != nil {
+			return nil, exists
+		}
+		if objData, err = checkAttrs(objData); err != nil {
+			return nil, util.CastErr(err)
+		}
+		chefRole, gerr := role.NewFromJSON(objData)
+		if gerr != nil {
+			return nil, gerr
+		}
+		if err := chefRole.Save(); err != nil {
+			return nil, internalGerror(err)
+		}
+		obj, response = chefRole, chefRole
+	case "node":
+		if n, _ := node.Get(item.ObjectName); n != nil {
+			return nil, exists
+		}
+		if objData, err = checkAttrs(objData); err != nil {
+			return nil, util.CastErr(err)
+		}
+		chefNode, gerr := node.NewFromJSON(objData)
+		if gerr != nil {
+			return nil, gerr
+		}
+		if err := chefNode.Save(); err != nil {
+			return nil, internalGerror(err)
+		}
+		obj, response = chefNode, chefNode
+	case "data_bag_item":
+		bagItem := strings.SplitN(item.ObjectName, "/", 2)
+		if len(bagItem) != 2 {
+			return nil, util.Errorf("Invalid data bag item name %s", item.ObjectName)
+		}
+		chefDbag, _ := databag.Get(bagItem[0])
+		if chefDbag == nil {
+			var gerr util.Gerror
+			if chefDbag, gerr = databag.New(bagItem[0]); gerr != nil {
+				return nil, gerr
+			}
+			if err := chefDbag.Save(); err != nil {
+				return nil, internalGerror(err)
+			}
+			if lerr := loginfo.LogEvent(opUser, chefDbag, "create"); lerr != nil {
+				return nil, internalGerror(lerr)
+			}
+		} else if dbi, _ := chefDbag.GetDBItem(bagItem[1]); dbi != nil {
+			return nil, exists
+		}
+		dbi, gerr := chefDbag.NewDBItem(objData)
+		if gerr != nil {
+			return nil, gerr
+		}
+		obj, response = dbi, dbi.RawData
+	case "cookbook_version":
+		nameVer := strings.SplitN(item.ObjectName, "/", 2)
+		if len(nameVer) != 2 {
+			return nil, util.Errorf("Invalid cookbook version name %s", item.ObjectName)
+		}
+		cb, _ := cookbook.Get(nameVer[0])
+		if cb == nil {
+			var gerr util.Gerror
+			if cb, gerr = cookbook.New(nameVer[0]); gerr != nil {
+				return nil, gerr
+			}
+			if err := cb.Save(); err != nil {
+				return nil, internalGerror(err)
+			}
+			if lerr := loginfo.LogEvent(opUser, cb, "create"); lerr != nil {
+				return nil, internalGerror(lerr)
+			}
+		} else if cbv, _ := cb.GetVersion(nameVer[1]); cbv != nil {
+			return nil, exists
+		}
+		cbv, gerr := cb.NewVersion(nameVer[1], objData)
+		if gerr != nil {
+			if cb.NumVersions() == 0 {
+				cb.Delete()
+			}
+			return nil, gerr
+		}
+		obj, response = cbv, cbv.ToJSON("GET")
+	default:
+		return nil, util.Errorf("Cannot restore objects of type %s", item.ObjectType)
+	}
+
+	if err := item.Remove(); err != nil {
+		return nil, internalGerror(err)
+	}
+	if lerr := loginfo.LogEvent(opUser, obj, "create"); lerr != nil {
+		return nil, internalGerror(lerr)
+	}
+	return response, nil
+}
+
+// purgeExpiredTrash purges the items that have been in the trash longer than
+// the trash retention period, and returns how many were purged.
+func purgeExpiredTrash() (int, error) {
+	items, err := trash.Expired()
+	if err != nil {
+		return 0, err
+	}
+	p := 0
+	for _, item := range items {
+		if err := purgeTrashItem(item); err != nil {
+			logger.Errorf(err.Error())
+			continue
+		}
+		p++
+	}
+	return p, nil
+}
+
+// setTrashPurgeTicker periodically purges items that have been in the trash
+// longer than the trash retention period.
+func setTrashPurgeTicker() {
+	if !trash.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		for _ = range ticker.C {
+			if isStandby() {
+				continue
+			}
+			p, err := purgeExpiredTrash()
+			if err != nil {
+				logger.Errorf(err.Error())
+				continue
+			}
+			if p > 0 {
+				logger.Debugf("Purged %d expired items from the trash", p)
+			}
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trash
+
+/* MySQL specific functions for the trash */
+
+import (
+	"github.com/ctdk/goiardi/datastore"
+	"time"
+)
+
+func (i *Item) addMySQL() error {
+	res, err := datastore.Dbh.Exec("INSERT INTO trash (object_type, object_name, deleted_at, data) VALUES (?, ?, ?, ?)", i.ObjectType, i.ObjectName, i.DeletedAt, string(i.Data))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	i.ID = int(id)
+	return nil
+}
+
+func (i *Item) fillItemFromMySQL(row datastore.ResRow) error {
+	var tb []byte
+	var data []byte
+	err := row.Scan(&i.ID, &i.ObjectType, &i.ObjectName, &tb, &data)
+	if err != nil {
+		return err
+	}
+	i.DeletedAt, err = time.Parse(datastore.MySQLTimeFormat, string(tb))
+	if err != nil {
+		return err
+	}
+	i.Data = data
+	return nil
+}
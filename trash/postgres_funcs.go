@@ -0,0 +1,37 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trash
+
+/* Postgres specific functions for the trash */
+
+import (
+	"github.com/ctdk/goiardi/datastore"
+)
+
+func (i *Item) addPostgreSQL() error {
+	return datastore.Dbh.QueryRow("INSERT INTO goiardi.trash (object_type, object_name, deleted_at, data) VALUES ($1, $2, $3, $4) RETURNING id", i.ObjectType, i.ObjectName, i.DeletedAt, string(i.Data)).Scan(&i.ID)
+}
+
+func (i *Item) fillItemFromPostgreSQL(row datastore.ResRow) error {
+	var data []byte
+	err := row.Scan(&i.ID, &i.ObjectType, &i.ObjectName, &i.DeletedAt, &data)
+	if err != nil {
+		return err
+	}
+	i.Data = data
+	return nil
+}
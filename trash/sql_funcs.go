@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trash
+
+/* Generic SQL functions for the trash */
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"time"
+)
+
+func (i *Item) addSQL() error {
+	if config.Config.UseMySQL {
+		return i.addMySQL()
+	} else if config.Config.UsePostgreSQL {
+		return i.addPostgreSQL()
+	}
+	return util.NoDBConfigured
+}
+
+func getSQL(id int) (*Item, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM trash WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM goiardi.trash WHERE id = $1"
+	}
+
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	item := new(Item)
+	row := stmt.QueryRow(id)
+	if err = item.fillItemSQL(row); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func listSQL(objType string) ([]*Item, error) {
+	var sqlStmt string
+	var sqlArgs []interface{}
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM trash"
+		if objType != "" {
+			sqlStmt = sqlStmt + " WHERE object_type = ?"
+			sqlArgs = append(sqlArgs, objType)
+		}
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM goiardi.trash"
+		if objType != "" {
+			sqlStmt = sqlStmt + " WHERE object_type = $1"
+			sqlArgs = append(sqlArgs, objType)
+		}
+	}
+	sqlStmt = sqlStmt + " ORDER BY id"
+	return queryItemsSQL(sqlStmt, sqlArgs...)
+}
+
+func expiredSQL(cutoff time.Time) ([]*Item, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM trash WHERE deleted_at <= ? ORDER BY id"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT id, object_type, object_name, deleted_at, data FROM goiardi.trash WHERE deleted_at <= $1 ORDER BY id"
+	}
+	return queryItemsSQL(sqlStmt, cutoff)
+}
+
+func queryItemsSQL(sqlStmt string, sqlArgs ...interface{}) ([]*Item, error) {
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(sqlArgs...)
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	for rows.Next() {
+		item := new(Item)
+		if err = item.fillItemSQL(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (i *Item) removeSQL() error {
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "DELETE FROM trash WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "DELETE FROM goiardi.trash WHERE id = $1"
+	}
+
+	_, err = tx.Exec(sqlStmt, i.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+func (i *Item) fillItemSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return i.fillItemFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return i.fillItemFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
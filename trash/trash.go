@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+Package trash holds deleted nodes, roles, data bag items, and cookbook versions for a while before they're gone for good, so they can be restored if they were deleted by mistake. Trashed objects are really removed from the server, so they don't show up in searches or lists; the trash just keeps a copy of them.
+*/
+package trash
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Item is an object in the trash.
+type Item struct {
+	ID         int             `json:"id"`
+	ObjectType string          `json:"object_type"`
+	ObjectName string          `json:"object_name"`
+	DeletedAt  time.Time       `json:"deleted_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Bin holds the items in the trash in the in-memory data store. Ids are never
+// reused, so a stale id can't restore or purge the wrong thing.
+type Bin struct {
+	NextID int
+	Items  map[int]*Item
+}
+
+// Protects changes to the bin in the in-memory data store.
+var memLock sync.Mutex
+
+func getBin() *Bin {
+	ds := datastore.New()
+	b, _ := ds.Get("trash", "bin")
+	if b == nil {
+		return &Bin{NextID: 1, Items: make(map[int]*Item)}
+	}
+	bin := b.(*Bin)
+	if bin.Items == nil {
+		bin.Items = make(map[int]*Item)
+	}
+	return bin
+}
+
+func setBin(bin *Bin) {
+	ds := datastore.New()
+	ds.Set("trash", "bin", bin)
+}
+
+// Enabled returns true if deleted objects are being put in the trash.
+func Enabled() bool {
+	return config.Config.TrashRetentionDur > 0
+}
+
+// Add a copy of an object that's being deleted to the trash, if the trash is
+// enabled.
+func Add(objType string, name string, obj interface{}) error {
+	if !Enabled() {
+		return nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	item := &Item{ObjectType: objType, ObjectName: name, DeletedAt: time.Now(), Data: data}
+	if config.UsingDB() {
+		return item.addSQL()
+	}
+	memLock.Lock()
+	defer memLock.Unlock()
+	bin := getBin()
+	item.ID = bin.NextID
+	bin.NextID++
+	bin.Items[item.ID] = item
+	setBin(bin)
+	return nil
+}
+
+// Get an item from the trash.
+func Get(id int) (*Item, util.Gerror) {
+	var item *Item
+	if config.UsingDB() {
+		var err error
+		item, err = getSQL(id)
+		if err != nil && err != sql.ErrNoRows {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+	} else {
+		item = getBin().Items[id]
+	}
+	if item == nil {
+		gerr := util.Errorf("Cannot find item %d in the trash", id)
+		gerr.SetStatus(http.StatusNotFound)
+		return nil, gerr
+	}
+	return item, nil
+}
+
+// List the items in the trash, oldest first. If objType isn't empty, only
+// items of that type are listed.
+func List(objType string) ([]*Item, error) {
+	if config.UsingDB() {
+		return listSQL(objType)
+	}
+	var items []*Item
+	for _, item := range getBin().Items {
+		if objType == "" || item.ObjectType == objType {
+			items = append(items, item)
+		}
+	}
+	sort.Sort(byID(items))
+	return items, nil
+}
+
+// Expired lists the items that have been in the trash longer than the trash
+// retention period, oldest first.
+func Expired() ([]*Item, error) {
+	cutoff := time.Now().Add(-config.Config.TrashRetentionDur)
+	if config.UsingDB() {
+		return expiredSQL(cutoff)
+	}
+	var items []*Item
+	for _, item := range getBin().Items {
+		if !item.DeletedAt.After(cutoff) {
+			items = append(items, item)
+		}
+	}
+	sort.Sort(byID(items))
+	return items, nil
+}
+
+// Remove an item from the trash, either because it's been restored or because
+// it's being purged.
+func (i *Item) Remove() error {
+	if config.UsingDB() {
+		return i.removeSQL()
+	}
+	memLock.Lock()
+	defer memLock.Unlock()
+	bin := getBin()
+	delete(bin.Items, i.ID)
+	setBin(bin)
+	return nil
+}
+
+// Expires returns when the item will be purged from the trash automatically.
+func (i *Item) Expires() time.Time {
+	return i.DeletedAt.Add(config.Config.TrashRetentionDur)
+}
+
+// Object returns the trashed object as a map, like it would have been sent to
+// the server in a request.
+func (i *Item) Object() (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(i.Data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+type byID []*Item
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byID) Less(i, j int) bool { return b[i].ID < b[j].ID }
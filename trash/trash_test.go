@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trash
+
+import (
+	"encoding/gob"
+	"github.com/ctdk/goiardi/config"
+	"testing"
+	"time"
+)
+
+func init() {
+	b := new(Bin)
+	gob.Register(b)
+}
+
+func TestTrash(t *testing.T) {
+	if err := Add("role", "disabled", map[string]interface{}{"name": "disabled"}); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := List(""); len(items) != 0 {
+		t.Errorf("an item went in the trash with the trash disabled")
+	}
+
+	config.Config.TrashRetentionDur = time.Hour
+	defer func() { config.Config.TrashRetentionDur = 0 }()
+	names := []string{"foo", "bar", "baz"}
+	for _, n := range names {
+		if err := Add("role", n, map[string]interface{}{"name": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Add("node", "foo", map[string]interface{}{"name": "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := List("role")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(names) {
+		t.Fatalf("expected %d roles in the trash, got %d", len(names), len(items))
+	}
+	for i, item := range items {
+		if item.ObjectName != names[i] || item.ID != i+1 {
+			t.Errorf("expected item %d to be role %s, got %d %s", i+1, names[i], item.ID, item.ObjectName)
+		}
+	}
+	item, gerr := Get(2)
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	obj, err := item.Object()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj["name"] != "bar" {
+		t.Errorf("expected the trashed object to be named bar, got %v", obj["name"])
+	}
+	if e := item.Expires().Sub(item.DeletedAt); e != time.Hour {
+		t.Errorf("expected the item to expire in an hour, got %s", e)
+	}
+	if err = item.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, gerr = Get(2); gerr == nil {
+		t.Errorf("removed item was still in the trash")
+	}
+	if items, _ = List(""); len(items) != 3 {
+		t.Errorf("expected 3 items left in the trash, got %d", len(items))
+	}
+}
+
+func TestExpired(t *testing.T) {
+	config.Config.TrashRetentionDur = time.Hour
+	defer func() { config.Config.TrashRetentionDur = 0 }()
+	// Leave an empty trash behind, since TestTrash counts on the ids.
+	defer setBin(&Bin{NextID: 1, Items: make(map[int]*Item)})
+	if err := Add("role", "expiring", map[string]interface{}{"name": "expiring"}); err != nil {
+		t.Fatal(err)
+	}
+	items, err := Expired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("nothing should have expired yet, but %d items had", len(items))
+	}
+	config.Config.TrashRetentionDur = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	all, _ := List("")
+	if items, err = Expired(); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(all) {
+		t.Errorf("every item should have expired, but only %d of %d had", len(items), len(all))
+	}
+}
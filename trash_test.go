@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/cookbook"
+	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/role"
+	"github.com/ctdk/goiardi/trash"
+	"testing"
+	"time"
+)
+
+func trashedNames(t *testing.T, objType string) map[string]bool {
+	items, err := trash.List(objType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool, len(items))
+	for _, item := range items {
+		names[item.ObjectName] = true
+	}
+	return names
+}
+
+func TestTrashPurge(t *testing.T) {
+	gobOnce.Do(gobRegister)
+	config.Config.TrashRetentionDur = time.Hour
+	defer func() { config.Config.TrashRetentionDur = 0 }()
+
+	r, _ := role.New("trashpurge")
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if !trashedNames(t, "role")["trashpurge"] {
+		t.Errorf("role trashpurge should have been in the trash after being deleted")
+	}
+
+	cb, gerr := cookbook.New("trashpurge")
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	if err := cb.Save(); err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Delete()
+	chksum := uploadTestFile(t, "package 'trash-purge'\n")
+	makeTestCookbookVersion(t, cb, "1.0.0", chksum)
+	if gerr = cb.DeleteVersion("1.0.0"); gerr != nil {
+		t.Fatal(gerr)
+	}
+	if !trashedNames(t, "cookbook_version")["trashpurge/1.0.0"] {
+		t.Errorf("cookbook version trashpurge/1.0.0 should have been in the trash after being deleted")
+	}
+	if _, err := filestore.Get(chksum); err != nil {
+		t.Errorf("the files of a cookbook version in the trash should have been kept")
+	}
+
+	// Nothing has been in the trash long enough to be purged yet.
+	if p, err := purgeExpiredTrash(); err != nil || p != 0 {
+		t.Errorf("nothing should have been purged yet, but %d items were (err %v)", p, err)
+	}
+
+	config.Config.TrashRetentionDur = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	p, err := purgeExpiredTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p < 2 {
+		t.Errorf("expected at least 2 items to be purged, got %d", p)
+	}
+	if trashedNames(t, "")["trashpurge"] {
+		t.Errorf("role trashpurge should have been purged from the trash")
+	}
+	if _, err := filestore.Get(chksum); err == nil {
+		t.Errorf("the files of a purged cookbook version should have been deleted")
+	}
+}
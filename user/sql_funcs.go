@@ -139,7 +139,7 @@ func getListSQL() []string {
 	return userList
 }
 
-func allUsersSQL() []*User {
+func allUsersSQL(dbhandle datastore.Dbhandle) ([]*User, error) {
 	var users []*User
 	var sqlStatement string
 	if config.Config.UseMySQL {
@@ -148,29 +148,30 @@ func allUsersSQL() []*User {
 		sqlStatement = "SELECT name, displayname, admin, public_key, email, passwd, salt FROM goiardi.users"
 	}
 
-	stmt, err := datastore.Dbh.Prepare(sqlStatement)
+	stmt, err := dbhandle.Prepare(sqlStatement)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer stmt.Close()
 	rows, qerr := stmt.Query()
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
-			return users
+			return users, nil
 		}
-		log.Fatal(qerr)
+		return nil, qerr
 	}
 	for rows.Next() {
 		us := new(User)
 		err = us.fillUserFromSQL(rows)
 		if err != nil {
-			log.Fatal(err)
+			rows.Close()
+			return nil, err
 		}
 		users = append(users, us)
 	}
 	rows.Close()
 	if err = rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return users
+	return users, nil
 }
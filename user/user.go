@@ -31,6 +31,7 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"fmt"
+	"github.com/ctdk/goas/v2/logger"
 	"github.com/ctdk/goiardi/chefcrypto"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
@@ -531,9 +532,20 @@ func (u *User) GobDecode(b []byte) error {
 
 // AllUsers returns all the users on this server.
 func AllUsers() []*User {
+	users, err := AllUsersTx(datastore.Dbh)
+	if err != nil {
+		logger.Errorf("Error getting all users: %s", err.Error())
+	}
+	return users
+}
+
+// AllUsersTx returns all the users on this server like AllUsers, but with an
+// SQL backend reads them through the given db handle. Pass in a transaction to
+// read the users as part of a consistent snapshot.
+func AllUsersTx(tx datastore.Dbhandle) ([]*User, error) {
 	var users []*User
 	if config.UsingDB() {
-		users = allUsersSQL()
+		return allUsersSQL(tx)
 	} else {
 		userList := GetList()
 		for _, u := range userList {
@@ -544,17 +556,26 @@ func AllUsers() []*User {
 			users = append(users, us)
 		}
 	}
-	return users
+	return users, nil
 }
 
 // ExportAllUsers return all users, in a fashion suitable for exporting.
-func ExportAllUsers() []interface{} {
-	users := AllUsers()
+func ExportAllUsers() ([]interface{}, error) {
+	return ExportAllUsersTx(datastore.Dbh)
+}
+
+// ExportAllUsersTx returns all users in a fashion suitable for exporting,
+// reading them through the given db handle with an SQL backend.
+func ExportAllUsersTx(tx datastore.Dbhandle) ([]interface{}, error) {
+	users, err := AllUsersTx(tx)
+	if err != nil {
+		return nil, err
+	}
 	export := make([]interface{}, len(users))
 	for i, u := range users {
 		export[i] = u.export()
 	}
-	return export
+	return export, nil
 }
 
 func chkInMemClient(name string) error {
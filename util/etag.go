@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETag returns a strong entity tag for an object, made from a hash of its JSON
+// form. Since it only depends on the object's contents, it comes out the same
+// whether the object came from the in-memory data store or the database.
+func ETag(obj interface{}) (string, error) {
+	j, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\"%x\"", sha1.Sum(j)), nil
+}
+
+// ETagMatches checks if an etag matches any of the entity tags in an If-Match
+// or If-None-Match header. A "*" matches anything, and weak tags are compared
+// as if they were strong, since goiardi's tags are all strong anyway.
+func ETagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagMismatch returns the error for an update whose If-Match header doesn't
+// match the object being updated any more.
+func ETagMismatch() Gerror {
+	err := Errorf("The object has been modified since it was last fetched")
+	err.SetStatus(http.StatusPreconditionFailed)
+	return err
+}
+
+// CheckETag checks an If-Match header against the current state of an object,
+// and returns an error with a 412 status if it doesn't match.
+func CheckETag(ifMatch string, obj interface{}) Gerror {
+	etag, err := ETag(obj)
+	if err != nil {
+		gerr := CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return gerr
+	}
+	if !ETagMatches(ifMatch, etag) {
+		return ETagMismatch()
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// FileStoreURL returns the URL of a file in the file store, signed so that it
+// can be used to download the file (with GET) or upload it (with PUT) until it
+// expires.
+func FileStoreURL(chksum string, method string) string {
+	return SignedURL("/file_store/"+chksum, method)
+}
+
+// SignedURL returns the URL of a path on this server, signed the same way as
+// the file store URLs are.
+func SignedURL(p string, method string) string {
+	expires := time.Now().Add(config.Config.FileStoreURLExpiryDur).Unix()
+	return fmt.Sprintf("%s?expires=%d&signature=%s", CustomURL(p), expires, fileStoreSignature(method, p, expires))
+}
+
+// CheckFileStoreURL checks the signature and expiry of a request for a file in
+// the file store, or another URL made with SignedURL, given its method, path,
+// and query string.
+func CheckFileStoreURL(method string, path string, query url.Values) Gerror {
+	sig := query.Get("signature")
+	if sig == "" {
+		return Errorf("The file store URL is not signed")
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return Errorf("The file store URL has an invalid expiry")
+	}
+	expected := fileStoreSignature(method, path, expires)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return Errorf("The file store URL's signature is invalid")
+	}
+	if time.Now().Unix() > expires {
+		return Errorf("The file store URL has expired")
+	}
+	return nil
+}
+
+// fileStoreSignature signs a file store path for one kind of request, either
+// reading the file or uploading it, until the expiry time.
+func fileStoreSignature(method string, path string, expires int64) string {
+	switch method {
+	case "HEAD":
+		method = "GET"
+	case "POST":
+		method = "PUT"
+	}
+	mac := hmac.New(sha256.New, []byte(config.Config.FileStoreURLKey))
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
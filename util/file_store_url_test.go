@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2013-2014, Jeremy Bingham (<jbingham@gmail.com>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileStoreURL(t *testing.T) {
+	config.Config.FileStoreURLKey = "s3kr1t"
+	config.Config.FileStoreURLExpiryDur = time.Hour
+	defer func() { config.Config.FileStoreURLKey = "" }()
+
+	u, err := url.Parse(FileStoreURL("abc123", "GET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/file_store/abc123" {
+		t.Errorf("unexpected file store path %s", u.Path)
+	}
+	query := u.Query()
+	if err := CheckFileStoreURL("GET", u.Path, query); err != nil {
+		t.Errorf("a freshly signed URL was rejected: %s", err.Error())
+	}
+	if err := CheckFileStoreURL("HEAD", u.Path, query); err != nil {
+		t.Errorf("a URL signed for GET should work for HEAD: %s", err.Error())
+	}
+	if err := CheckFileStoreURL("PUT", u.Path, query); err == nil {
+		t.Errorf("a URL signed for GET was accepted for PUT")
+	}
+	if err := CheckFileStoreURL("GET", "/file_store/def456", query); err == nil {
+		t.Errorf("a signed URL was accepted for another file")
+	}
+	if err := CheckFileStoreURL("GET", u.Path, url.Values{}); err == nil {
+		t.Errorf("an unsigned URL was accepted")
+	}
+
+	// Pushing the expiry out invalidates the signature.
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	query.Set("expires", strconv.FormatInt(expires+3600, 10))
+	if err := CheckFileStoreURL("GET", u.Path, query); err == nil {
+		t.Errorf("a URL with a changed expiry was accepted")
+	}
+
+	config.Config.FileStoreURLExpiryDur = -time.Minute
+	u, _ = url.Parse(FileStoreURL("abc123", "PUT"))
+	if err := CheckFileStoreURL("PUT", u.Path, u.Query()); err == nil {
+		t.Errorf("an expired URL was accepted")
+	}
+}
@@ -211,6 +211,26 @@ func TestValidateEnvName(t *testing.T) {
 	}
 }
 
+func TestValidateCookbookPath(t *testing.T) {
+	for _, p := range []string{"recipes/default.rb", "README.md", "files/default/..foo"} {
+		if !ValidateCookbookPath(p) {
+			t.Errorf("%s should have passed cookbook path validation, but didn't", p)
+		}
+	}
+	for _, p := range []string{"../../etc/cron.d/x", "/etc/x", "files/../../x", "..", "files\\..\\..\\x"} {
+		if ValidateCookbookPath(p) {
+			t.Errorf("%s should not have passed cookbook path validation, but somehow did", p)
+		}
+	}
+}
+
+func TestValidateCookbookDivisionPaths(t *testing.T) {
+	div := []interface{}{map[string]interface{}{"name": "x", "path": "../../etc/cron.d/x", "checksum": "abc", "specificity": "default"}}
+	if _, err := ValidateCookbookDivision("files", div); err == nil {
+		t.Errorf("a file with a path outside the cookbook should not have passed validation")
+	}
+}
+
 // A lot of the validations get taken care of with chef pedant, honestly
 func TestValidateAsVersion(t *testing.T) {
 	goodVersion := "1.0.0"
@@ -238,3 +258,51 @@ func TestValidateAsVersion(t *testing.T) {
 		t.Errorf("Should have come back as 0.0.0, but it came back as %v", v)
 	}
 }
+
+func TestETag(t *testing.T) {
+	obj := &testObj{Name: "foo", TestURLType: "bar"}
+	e1, err := ETag(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, _ := ETag(&testObj{Name: "foo", TestURLType: "bar"})
+	if e1 != e2 {
+		t.Errorf("etags for identical objects differ: %s, %s", e1, e2)
+	}
+	obj.Name = "baz"
+	e3, _ := ETag(obj)
+	if e1 == e3 {
+		t.Errorf("etag did not change when the object did")
+	}
+	if !ETagMatches("\"abc\", "+e1, e1) {
+		t.Errorf("etag %s did not match in a list", e1)
+	}
+	if !ETagMatches("W/"+e1, e1) {
+		t.Errorf("weak etag did not match")
+	}
+	if !ETagMatches("*", e1) {
+		t.Errorf("* did not match")
+	}
+	if ETagMatches(e3, e1) {
+		t.Errorf("etag %s unexpectedly matched %s", e3, e1)
+	}
+}
+
+func TestCheckETag(t *testing.T) {
+	obj := &testObj{Name: "foo", TestURLType: "bar"}
+	etag, _ := ETag(obj)
+	if err := CheckETag(etag, obj); err != nil {
+		t.Errorf("the object's own etag should have matched, got %s", err.Error())
+	}
+	if err := CheckETag("*", obj); err != nil {
+		t.Errorf("* should have matched, got %s", err.Error())
+	}
+	obj.Name = "baz"
+	err := CheckETag(etag, obj)
+	if err == nil {
+		t.Fatalf("the old etag should not have matched the changed object")
+	}
+	if err.Status() != http.StatusPreconditionFailed {
+		t.Errorf("a mismatched etag should have given %d, got %d", http.StatusPreconditionFailed, err.Status())
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/filestore"
 	"net/http"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -136,6 +137,22 @@ func ValidateAttributes(key string, attrs interface{}) (map[string]interface{},
 	}
 }
 
+// ValidateCookbookPath checks that the path of a file in a cookbook stays
+// inside the cookbook when it's put on disk or in a tarball, so it can be
+// neither absolute nor climb out with "..".
+func ValidateCookbookPath(p string) bool {
+	p = strings.Replace(p, "\\", "/", -1)
+	if path.IsAbs(p) {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
 func ValidateCookbookDivision(dname string, div interface{}) ([]map[string]interface{}, Gerror) {
 	switch div := div.(type) {
 	case []interface{}:
@@ -148,6 +165,11 @@ func ValidateCookbookDivision(dname string, div interface{}) ([]map[string]inter
 				if len(v) < 4 {
 					return nil, err
 				}
+				for _, k := range []string{"path", "name"} {
+					if p, ok := v[k].(string); ok && !ValidateCookbookPath(p) {
+						return nil, Errorf("Invalid %s %s in '%s'.", k, p, dname)
+					}
+				}
 				/* validate existence of file
 				 * in sandbox */
 				chksum, cherr := ValidateAsString(v["checksum"])